@@ -0,0 +1,190 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// minAckThreshold is the fixed threshold gcloud uses, and the one used until the round trip time is known.
+	minAckThreshold uint64 = 2 * subprotoMaxFrameSize
+	maxAckThreshold uint64 = 32 * subprotoMaxFrameSize
+
+	minAckDelay = 5 * time.Millisecond
+	maxAckDelay = 50 * time.Millisecond
+
+	rttInterval = 30 * time.Second
+	rttTimeout  = 10 * time.Second
+)
+
+// ErrPingUnsupported is returned by Ping when the transport's channels can't be pinged.
+var ErrPingUnsupported = errors.New("relay channel doesn't support pings")
+
+// ackPacer decides how much received data is acked at once. Acking every couple of frames throttles tunnels with a
+// large bandwidth-delay product with ack chatter, so once the round trip time to the relay is known the threshold
+// grows to a quarter of the product of it and the receive rate, which keeps it well within whatever window the relay
+// allows for the rate it's achieving. Data below the threshold is acked after a delay, so interactive sessions are
+// acked promptly too.
+type ackPacer struct {
+	// rtt is the smoothed round trip time to the relay in nanoseconds, 0 until it's measured
+	rtt atomic.Int64
+
+	// guarded by Conn.ackMu
+	rate      float64
+	lastAck   time.Time
+	lastAckNb uint64
+}
+
+func newAckPacer() *ackPacer {
+	return &ackPacer{lastAck: time.Now()}
+}
+
+func (p *ackPacer) threshold() uint64 {
+	rtt := time.Duration(p.rtt.Load())
+	if rtt == 0 {
+		return minAckThreshold
+	}
+
+	bdp := p.rate * rtt.Seconds()
+	return max(minAckThreshold, min(uint64(bdp/4), maxAckThreshold))
+}
+
+// delay returns how long received data can wait to be acked, or 0 if it waits for the threshold.
+func (p *ackPacer) delay() time.Duration {
+	rtt := time.Duration(p.rtt.Load())
+	if rtt == 0 {
+		return 0
+	}
+	return max(minAckDelay, min(rtt/4, maxAckDelay))
+}
+
+// acked records an ack of nb received bytes, updating the receive rate.
+func (p *ackPacer) acked(nb uint64, now time.Time) {
+	if elapsed := now.Sub(p.lastAck).Seconds(); elapsed > 0 {
+		sample := float64(nb-p.lastAckNb) / elapsed
+		if p.rate == 0 {
+			p.rate = sample
+		} else {
+			p.rate += (sample - p.rate) / 4
+		}
+	}
+	p.lastAck, p.lastAckNb = now, nb
+}
+
+func (p *ackPacer) sampleRTT(rtt time.Duration) {
+	smoothed := time.Duration(p.rtt.Load())
+	if smoothed != 0 {
+		rtt = smoothed + (rtt-smoothed)/8
+	}
+	p.rtt.Store(int64(max(rtt, 1)))
+}
+
+// ack acks everything received if more than the pacer's threshold is unacked, or if anything is when force is set.
+// Acks are held back while recycling so the relay doesn't discard data beyond what the new session resumes from.
+func (c *Conn) ack(force bool) error {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+
+	threshold := c.pacer.threshold()
+	if force {
+		threshold = 0
+	}
+
+	// received is loaded before checking whether the connection is recycling
+	received := c.recvNbUnacked.Load()
+	if received-c.recvNbAcked.Load() <= threshold || c.recycling() {
+		return nil
+	}
+
+	if err := c.writeAck(received); err != nil {
+		return err
+	}
+	c.recvNbAcked.Store(received)
+	c.pacer.acked(received, time.Now())
+
+	return nil
+}
+
+// delayAck makes sure received data below the threshold is acked within the pacer's delay.
+func (c *Conn) delayAck() {
+	delay := c.pacer.delay()
+	if delay == 0 || c.recvNbUnacked.Load() == c.recvNbAcked.Load() {
+		return
+	}
+	if c.ackPending.CompareAndSwap(false, true) {
+		c.ackTimer.Reset(delay)
+	}
+}
+
+func (c *Conn) delayedAck() {
+	c.ackPending.Store(false)
+	// a failed write also fails the read loop, which shuts the connection down
+	c.ack(true)
+}
+
+// measureRTT pings the relay to keep the round trip time up to date, then rearms rttTimer. It runs off a timer rather
+// than a goroutine of its own, and once the round trip time is known it only pings if data moved since the last ping,
+// so an idle connection isn't kept busy. Sessions whose channel can't be pinged leave the pacer on its fixed threshold.
+func (c *Conn) measureRTT() {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	moved := c.recvNbUnacked.Load() + c.sendNbUnacked.Load()
+	if c.RTT() == 0 || c.rttMoved.Swap(moved) != moved {
+		ctx, cancel := context.WithTimeout(context.Background(), rttTimeout)
+		_, err := c.ping(ctx)
+		cancel()
+
+		if errors.Is(err, ErrPingUnsupported) {
+			return
+		}
+	}
+
+	c.rttTimer.Reset(rttInterval)
+}
+
+// Ping pings the relay and returns the round trip time, which also updates the estimate returned by RTT. It performs
+// the handshake first if it hasn't been done, and fails with ErrPingUnsupported if the transport's channels can't be
+// pinged. Errors are returned as a *net.OpError.
+func (c *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	if err := c.Handshake(ctx); err != nil {
+		return 0, c.opError("ping", err)
+	}
+
+	select {
+	case <-c.done:
+		return 0, c.opError("ping", c.err)
+	default:
+	}
+
+	rtt, err := c.ping(ctx)
+	return rtt, c.opError("ping", err)
+}
+
+// RTT returns the smoothed round trip time to the relay, which is measured on connecting, every 30 seconds while data
+// is flowing and by Ping, or 0 if it hasn't been measured yet.
+func (c *Conn) RTT() time.Duration {
+	return time.Duration(c.pacer.rtt.Load())
+}
+
+// ping pings the current session's channel, feeding the round trip time to the pacer.
+func (c *Conn) ping(ctx context.Context) (time.Duration, error) {
+	pinger, ok := c.currentSession().conn.(interface{ Ping(context.Context) error })
+	if !ok {
+		return 0, ErrPingUnsupported
+	}
+
+	start := time.Now()
+	if err := pinger.Ping(ctx); err != nil {
+		return 0, err
+	}
+
+	rtt := time.Since(start)
+	c.pacer.sampleRTT(rtt)
+	return rtt, nil
+}
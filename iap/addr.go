@@ -0,0 +1,80 @@
+package iap
+
+import (
+	"io"
+	"net"
+	"strings"
+)
+
+// Network is the network name reported by the addresses and errors of a Conn.
+const Network = "iap"
+
+// Addr is the address of a tunnel target, returned by Conn.RemoteAddr.
+type Addr struct {
+	// Host is the instance name, or the private IP or FQDN of a host target.
+	Host string
+	Port string
+	// Location is where the target is, like in the path of its URI: the zone of an instance, or the
+	// region/network/group of a host. It's empty if the location isn't known.
+	Location string
+}
+
+// Network returns "iap".
+func (a *Addr) Network() string {
+	return Network
+}
+
+// String returns the target as location/host:port, or host:port if the location isn't known.
+func (a *Addr) String() string {
+	if a.Location == "" {
+		return net.JoinHostPort(a.Host, a.Port)
+	}
+	return a.Location + "/" + net.JoinHostPort(a.Host, a.Port)
+}
+
+func targetAddr(dopts *dialOptions) *Addr {
+	if dopts.Instance != "" {
+		return &Addr{Host: dopts.Instance, Port: dopts.Port, Location: dopts.Zone}
+	}
+
+	var location []string
+	for _, segment := range []string{dopts.Region, dopts.Network, dopts.Group} {
+		if segment != "" {
+			location = append(location, segment)
+		}
+	}
+
+	return &Addr{Host: dopts.Host, Port: dopts.Port, Location: strings.Join(location, "/")}
+}
+
+// RelayAddr is the address of the relay session carrying a Conn, returned by Conn.LocalAddr.
+type RelayAddr struct {
+	// Endpoint is the host of the relay.
+	Endpoint string
+	// SessionID identifies the session, which stays the same when the connection is recycled.
+	SessionID string
+}
+
+// Network returns "iap".
+func (a *RelayAddr) Network() string {
+	return Network
+}
+
+// String returns the address as endpoint/session.
+func (a *RelayAddr) String() string {
+	return a.Endpoint + "/" + a.SessionID
+}
+
+// opError wraps an error from an operation on the connection like the net package does, leaving io.EOF from reads as it
+// is. The source is the relay session, so the error names its session ID.
+func (c *Conn) opError(op string, err error) error {
+	if err == nil || (op == "read" && err == io.EOF) {
+		return err
+	}
+
+	opErr := &net.OpError{Op: op, Net: Network, Addr: c.addr, Err: err}
+	if c.SessionID() != "" {
+		opErr.Source = c.LocalAddr()
+	}
+	return opErr
+}
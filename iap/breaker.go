@@ -0,0 +1,107 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by Dial without dialing while a circuit breaker is open. See WithCircuitBreaker.
+var ErrCircuitOpen = errors.New("not dialing after repeated failures, circuit breaker open")
+
+// CircuitBreaker stops dialing a target which keeps failing, so it doesn't use up the relay's quota or flood logs.
+// After failures dials fail in a row, further dials fail with ErrCircuitOpen for the cooldown period. Then a single
+// dial is let through as a trial, closing the breaker if it succeeds or opening it for another cooldown if it fails.
+// Dials abandoned by their caller don't count. A CircuitBreaker can be shared between goroutines, and should be
+// shared by the dials to a single target.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// BreakerState is a snapshot of a CircuitBreaker.
+type BreakerState struct {
+	// Open is true while dials are being refused.
+	Open bool
+	// Failures is the number of dials that have failed in a row.
+	Failures int
+	// OpenUntil is when a trial dial will be let through, if the breaker is open.
+	OpenUntil time.Time
+}
+
+// NewCircuitBreaker returns a CircuitBreaker which opens for cooldown after failures dials fail in a row.
+func NewCircuitBreaker(failures int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: max(failures, 1),
+		cooldown:  cooldown,
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := BreakerState{Failures: b.failures}
+	if b.tripped() && (time.Now().Before(b.openUntil) || b.trial) {
+		state.Open = true
+		state.OpenUntil = b.openUntil
+	}
+	return state
+}
+
+func (b *CircuitBreaker) tripped() bool {
+	return b.failures >= b.threshold
+}
+
+// allow returns ErrCircuitOpen if the breaker is open, and otherwise whether the dial is a trial.
+func (b *CircuitBreaker) allow() (trial bool, err error) {
+	if b == nil {
+		return false, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.tripped() {
+		return false, nil
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false, ErrCircuitOpen
+	}
+
+	b.trial = true
+	return true, nil
+}
+
+// record updates the breaker with the outcome of a dial it allowed.
+func (b *CircuitBreaker) record(ctx context.Context, trial bool, err error) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if trial {
+		b.trial = false
+	}
+
+	switch {
+	case err == nil:
+		b.failures = 0
+	case ctx.Err() != nil:
+		// the caller gave up, which says nothing about the target
+	default:
+		b.failures++
+		if b.tripped() {
+			b.openUntil = time.Now().Add(b.cooldown)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package iap_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.RejectStatus = http.StatusBadGateway
+
+	breaker := iap.NewCircuitBreaker(2, 100*time.Millisecond)
+	opts := append(server.DialOptions(), iap.WithCircuitBreaker(breaker))
+
+	for range 2 {
+		_, err := iap.Dial(context.Background(), opts...)
+		var handshakeErr *iap.HandshakeError
+		require.ErrorAs(t, err, &handshakeErr)
+	}
+
+	_, err := iap.Dial(context.Background(), opts...)
+	assert.ErrorIs(t, err, iap.ErrCircuitOpen)
+	assert.Len(t, server.Queries(), 2)
+
+	state := breaker.State()
+	assert.True(t, state.Open)
+	assert.Equal(t, 2, state.Failures)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// the trial dial fails, opening the breaker again
+	_, err = iap.Dial(context.Background(), opts...)
+	assert.NotErrorIs(t, err, iap.ErrCircuitOpen)
+	_, err = iap.Dial(context.Background(), opts...)
+	assert.ErrorIs(t, err, iap.ErrCircuitOpen)
+
+	time.Sleep(100 * time.Millisecond)
+	server.Faults.RejectStatus = 0
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	conn.Close()
+
+	assert.Equal(t, iap.BreakerState{}, breaker.State())
+}
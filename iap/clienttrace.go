@@ -0,0 +1,123 @@
+package iap
+
+import (
+	"context"
+	"net"
+	"net/http/httptrace"
+)
+
+// ClientTrace is a set of hooks called as a connection dials the relay and runs, like httptrace.ClientTrace, so
+// embedders can build their own instrumentation. Any of them may be nil. They're called from the connection's own
+// goroutines, so they should return quickly.
+type ClientTrace struct {
+	// DNSStart is called when looking up the relay's host begins, and DNSDone when it's done. They're only called by
+	// the WebSocket transport, and not at all for endpoints given by IP.
+	DNSStart func(host string)
+	DNSDone  func(addrs []net.IPAddr, err error)
+	// DialStart is called before opening a channel to the relay at url, and DialDone once the relay has accepted or
+	// refused it. They're called for every channel, including those which resume a session.
+	DialStart func(url string)
+	DialDone  func(err error)
+	// SuccessFrame is called when the relay confirms the connection, with its session ID.
+	SuccessFrame func(sessionID string)
+	// FirstDataFrame is called when the first data frame is received from the target.
+	FirstDataFrame func()
+	// AckReceived is called with the total bytes the relay has acknowledged each time it sends an ack.
+	AckReceived func(acked uint64)
+	// ReconnectStart is called before the connection moves to a new relay session, and ReconnectDone once it has,
+	// with the error if it failed. See WithMaxLifetime.
+	ReconnectStart func()
+	ReconnectDone  func(err error)
+}
+
+type clientTraceKey struct{}
+
+// ContextWithClientTrace returns a context which makes Dial and NewConn call the hooks of trace, unless WithClientTrace
+// gives another.
+func ContextWithClientTrace(ctx context.Context, trace *ClientTrace) context.Context {
+	return context.WithValue(ctx, clientTraceKey{}, trace)
+}
+
+// ContextClientTrace returns the ClientTrace of ctx, or nil if it doesn't have one.
+func ContextClientTrace(ctx context.Context) *ClientTrace {
+	trace, _ := ctx.Value(clientTraceKey{}).(*ClientTrace)
+	return trace
+}
+
+// WithClientTrace is a functional option that calls the hooks of trace as the connection dials and runs. It takes
+// precedence over a ClientTrace attached to the dial's context.
+func WithClientTrace(trace *ClientTrace) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.ClientTrace = trace
+	}
+}
+
+// traceContext keeps the ClientTrace of ctx for the lifetime of the connection, since later sessions aren't dialed
+// with it.
+func (d *dialOptions) traceContext(ctx context.Context) {
+	if d.ClientTrace == nil {
+		d.ClientTrace = ContextClientTrace(ctx)
+	}
+}
+
+// resolving returns a context which calls the DNS hooks while dialing.
+func (t *ClientTrace) resolving(ctx context.Context) context.Context {
+	if t == nil || (t.DNSStart == nil && t.DNSDone == nil) {
+		return ctx
+	}
+
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			if t.DNSStart != nil {
+				t.DNSStart(info.Host)
+			}
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if t.DNSDone != nil {
+				t.DNSDone(info.Addrs, info.Err)
+			}
+		},
+	})
+}
+
+func (t *ClientTrace) dialStart(url string) {
+	if t != nil && t.DialStart != nil {
+		t.DialStart(url)
+	}
+}
+
+func (t *ClientTrace) dialDone(err error) {
+	if t != nil && t.DialDone != nil {
+		t.DialDone(err)
+	}
+}
+
+func (t *ClientTrace) successFrame(sessionID string) {
+	if t != nil && t.SuccessFrame != nil {
+		t.SuccessFrame(sessionID)
+	}
+}
+
+func (t *ClientTrace) firstDataFrame() {
+	if t != nil && t.FirstDataFrame != nil {
+		t.FirstDataFrame()
+	}
+}
+
+func (t *ClientTrace) ackReceived(acked uint64) {
+	if t != nil && t.AckReceived != nil {
+		t.AckReceived(acked)
+	}
+}
+
+func (t *ClientTrace) reconnectStart() {
+	if t != nil && t.ReconnectStart != nil {
+		t.ReconnectStart()
+	}
+}
+
+func (t *ClientTrace) reconnectDone(err error) {
+	if t != nil && t.ReconnectDone != nil {
+		t.ReconnectDone(err)
+	}
+}
@@ -0,0 +1,74 @@
+package iap_test
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientTrace(t *testing.T) {
+	server := iaptest.NewPlaintextServer()
+	defer server.Close()
+
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	seen := func(event string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Contains(events, event)
+	}
+
+	trace := &iap.ClientTrace{
+		DNSStart:       func(host string) { record("dns " + host) },
+		DNSDone:        func(addrs []net.IPAddr, err error) { record("dns done") },
+		DialStart:      func(url string) { record("dial") },
+		DialDone:       func(err error) { record("dial done") },
+		SuccessFrame:   func(sessionID string) { record("success " + sessionID) },
+		FirstDataFrame: func() { record("data") },
+		AckReceived:    func(acked uint64) { record("ack") },
+		ReconnectStart: func() { record("reconnect") },
+		ReconnectDone: func(err error) {
+			if err == nil {
+				record("reconnect done")
+			}
+		},
+	}
+	ctx := iap.ContextWithClientTrace(context.Background(), trace)
+
+	// a hostname rather than an IP, so there's a lookup to trace
+	endpoint := "ws://" + strings.Replace(strings.TrimPrefix(server.URL, "http://"), "127.0.0.1", "localhost", 1)
+
+	conn, err := iap.Dial(ctx,
+		iap.WithEndpoint(endpoint),
+		iap.WithInstance("prod-1", "europe-west2-a", "nic0"),
+		iap.WithMaxLifetime(20*time.Millisecond),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+
+	require.Eventually(t, func() bool { return seen("reconnect done") }, time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return seen("ack") }, time.Second, 10*time.Millisecond)
+	assert.True(t, seen("data"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"dial", "dns localhost", "dns done", "dial done", "success " + conn.SessionID()}, events[:5])
+}
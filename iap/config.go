@@ -0,0 +1,237 @@
+package iap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// DialConfig is an alternative to functional options which is convenient to build from deserialized configuration.
+// Either Instance and Zone, or Host, Region, Network and Group, must be set.
+type DialConfig struct {
+	Project   string `json:"project"`
+	Instance  string `json:"instance,omitempty"`
+	Zone      string `json:"zone,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Network   string `json:"network,omitempty"`
+	Group     string `json:"group,omitempty"`
+	Port      uint   `json:"port"`
+
+	Compress bool `json:"compress,omitempty"`
+	// CompressThreshold is the size in bytes below which frames aren't compressed when Compress is set, as with
+	// CompressionOptions.
+	CompressThreshold int    `json:"compressThreshold,omitempty"`
+	Endpoint          string `json:"endpoint,omitempty"`
+	// Endpoints are relay endpoints to try in order, as with WithEndpoints, instead of Endpoint.
+	Endpoints []string `json:"endpoints,omitempty"`
+	Strict    bool     `json:"strict,omitempty"`
+
+	// HandshakeTimeout, AckTimeout and MaxLifetime are as with WithHandshakeTimeout, WithAckTimeout and
+	// WithMaxLifetime, and AckThreshold goes with AckTimeout.
+	HandshakeTimeout Duration `json:"handshakeTimeout,omitempty"`
+	AckThreshold     uint64   `json:"ackThreshold,omitempty"`
+	AckTimeout       Duration `json:"ackTimeout,omitempty"`
+	MaxLifetime      Duration `json:"maxLifetime,omitempty"`
+	// DialRetries and RetryBackoff are as with WithDialRetry.
+	DialRetries  int      `json:"dialRetries,omitempty"`
+	RetryBackoff Duration `json:"retryBackoff,omitempty"`
+
+	// DefaultCredentials authorizes the connection with WithDefaultCredentials, and CredentialsFile with
+	// WithCredentialsFile. Scopes apply to either.
+	DefaultCredentials bool     `json:"defaultCredentials,omitempty"`
+	CredentialsFile    string   `json:"credentialsFile,omitempty"`
+	Scopes             []string `json:"scopes,omitempty"`
+}
+
+// Duration is a time.Duration written in JSON as a string like "1m30s", as accepted by time.ParseDuration. A number is
+// read as nanoseconds too.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var ns int64
+		if err := json.Unmarshal(data, &ns); err != nil {
+			return fmt.Errorf("duration %s should be a string like \"30s\"", data)
+		}
+		*d = Duration(ns)
+		return nil
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// Validate returns all problems with the config at once, joined with errors.Join, or nil if it's valid. The error
+// matches ErrInvalidConfig.
+func (c DialConfig) Validate() error {
+	var errs []error
+
+	if c.Project == "" {
+		errs = append(errs, errors.New("project is required"))
+	}
+	if c.Port == 0 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port %v is out of range", c.Port))
+	}
+
+	switch {
+	case c.Instance != "" && c.Host != "":
+		errs = append(errs, errors.New("only one of instance or host can be set"))
+	case c.Instance != "":
+		if c.Zone == "" {
+			errs = append(errs, errors.New("zone is required for instance targets"))
+		}
+	case c.Host != "":
+		if c.Region == "" {
+			errs = append(errs, errors.New("region is required for host targets"))
+		}
+		if c.Network == "" {
+			errs = append(errs, errors.New("network is required for host targets"))
+		}
+		if c.Group == "" {
+			errs = append(errs, errors.New("group is required for host targets"))
+		}
+	default:
+		errs = append(errs, errors.New("one of instance or host is required"))
+	}
+
+	if c.Endpoint != "" && len(c.Endpoints) > 0 {
+		errs = append(errs, errors.New("only one of endpoint or endpoints can be set"))
+	}
+	if c.DefaultCredentials && c.CredentialsFile != "" {
+		errs = append(errs, errors.New("only one of defaultCredentials or credentialsFile can be set"))
+	}
+
+	return mark(errors.Join(errs...), ErrInvalidConfig)
+}
+
+// Target returns the target described by the config.
+func (c DialConfig) Target() Target {
+	if c.Instance != "" {
+		return InstanceTarget{
+			Project:   c.Project,
+			Zone:      c.Zone,
+			Instance:  c.Instance,
+			Interface: c.Interface,
+			Port:      c.Port,
+		}
+	}
+
+	return HostTarget{
+		Project: c.Project,
+		Region:  c.Region,
+		Network: c.Network,
+		Host:    c.Host,
+		Group:   c.Group,
+		Port:    c.Port,
+	}
+}
+
+// DialOptions returns the functional options equivalent to the config.
+func (c DialConfig) DialOptions() []DialOption {
+	opts := []DialOption{WithTarget(c.Target())}
+
+	if c.Compress {
+		opts = append(opts, WithCompressionOptions(CompressionOptions{Threshold: c.CompressThreshold}))
+	}
+	if c.Endpoint != "" {
+		opts = append(opts, WithEndpoint(c.Endpoint))
+	}
+	if len(c.Endpoints) > 0 {
+		opts = append(opts, WithEndpoints(c.Endpoints...))
+	}
+	if c.Strict {
+		opts = append(opts, WithStrictProtocol())
+	}
+	if c.HandshakeTimeout > 0 {
+		opts = append(opts, WithHandshakeTimeout(time.Duration(c.HandshakeTimeout)))
+	}
+	if c.AckTimeout > 0 {
+		opts = append(opts, WithAckTimeout(c.AckThreshold, time.Duration(c.AckTimeout)))
+	}
+	if c.MaxLifetime > 0 {
+		opts = append(opts, WithMaxLifetime(time.Duration(c.MaxLifetime)))
+	}
+	if c.DialRetries > 0 {
+		opts = append(opts, WithDialRetry(c.DialRetries, time.Duration(c.RetryBackoff)))
+	}
+
+	switch {
+	case c.DefaultCredentials:
+		opts = append(opts, WithDefaultCredentials(c.Scopes...))
+	case c.CredentialsFile != "":
+		opts = append(opts, WithCredentialsFile(c.CredentialsFile, c.Scopes...))
+	}
+
+	return opts
+}
+
+// Dial validates the config and dials the target it describes. Further options are applied after the config's.
+func (c DialConfig) Dial(ctx context.Context, opts ...DialOption) (*Conn, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return Dial(ctx, append(c.DialOptions(), opts...)...)
+}
+
+// CollectConfig returns the config that opts amount to, with the target filled in from the environment and gcloud's
+// configuration if they ask for it, without dialing. Options DialConfig can't express, like credentials given as a
+// token source, frame handlers and callbacks, are left out.
+func CollectConfig(opts ...DialOption) (DialConfig, error) {
+	dopts, err := collectDialOptions(opts)
+	if err != nil {
+		return DialConfig{}, err
+	}
+	return dopts.config(), nil
+}
+
+// Config returns the config the connection was dialed with, like CollectConfig, except that Endpoint is the relay
+// endpoint which accepted it. It's empty for Google's relay.
+func (c *Conn) Config() DialConfig {
+	return c.options().config()
+}
+
+func (d *dialOptions) config() DialConfig {
+	port, _ := strconv.ParseUint(d.Port, 10, 16)
+
+	return DialConfig{
+		Project:            d.Project,
+		Instance:           d.Instance,
+		Zone:               d.Zone,
+		Interface:          d.Interface,
+		Host:               d.Host,
+		Region:             d.Region,
+		Network:            d.Network,
+		Group:              d.Group,
+		Port:               uint(port),
+		Compress:           d.Compress,
+		CompressThreshold:  d.Compression.Threshold,
+		Endpoint:           d.Endpoint,
+		Endpoints:          slices.Clone(d.Endpoints),
+		Strict:             d.Strict,
+		HandshakeTimeout:   Duration(d.HandshakeTimeout),
+		AckThreshold:       d.AckThreshold,
+		AckTimeout:         Duration(d.AckTimeout),
+		MaxLifetime:        Duration(d.MaxLifetime),
+		DialRetries:        d.DialRetries,
+		RetryBackoff:       Duration(d.RetryBackoff),
+		DefaultCredentials: d.DefaultCredentials,
+		CredentialsFile:    d.CredentialsFile,
+		Scopes:             slices.Clone(d.Scopes),
+	}
+}
@@ -0,0 +1,129 @@
+package iap_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialConfigValidate(t *testing.T) {
+	var config iap.DialConfig
+	require.NoError(t, json.Unmarshal([]byte(`{"host": "10.0.0.1", "network": "default"}`), &config))
+
+	err := config.Validate()
+	require.Error(t, err)
+
+	// every problem is reported at once
+	for _, problem := range []string{"project is required", "port 0 is out of range", "region is required", "group is required"} {
+		assert.ErrorContains(t, err, problem)
+	}
+	assert.NotContains(t, err.Error(), "network is required")
+}
+
+func TestDialConfigDial(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	config := iap.DialConfig{
+		Project:  "project",
+		Instance: "bastion",
+		Zone:     "europe-west2-a",
+		Port:     22,
+	}
+	require.NoError(t, config.Validate())
+
+	conn, err := config.Dial(context.Background(), server.DialOptions()...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+
+	query := server.Queries()[0]
+	assert.Equal(t, "bastion", query.Get("instance"))
+	assert.Equal(t, "nic0", query.Get("interface"))
+	assert.Equal(t, "22", query.Get("port"))
+}
+
+func TestCollectConfig(t *testing.T) {
+	config := iap.DialConfig{
+		Project:            "project",
+		Instance:           "bastion",
+		Zone:               "europe-west2-a",
+		Interface:          "nic1",
+		Port:               22,
+		Compress:           true,
+		Endpoints:          []string{"relay-a.example.com", "relay-b.example.com"},
+		HandshakeTimeout:   iap.Duration(5 * time.Second),
+		AckThreshold:       1024,
+		AckTimeout:         iap.Duration(time.Minute),
+		MaxLifetime:        iap.Duration(time.Hour),
+		DialRetries:        2,
+		RetryBackoff:       iap.Duration(time.Second),
+		DefaultCredentials: true,
+		Scopes:             []string{"scope"},
+	}
+
+	// the config survives being turned into options and back
+	collected, err := iap.CollectConfig(config.DialOptions()...)
+	require.NoError(t, err)
+	assert.Equal(t, config, collected)
+
+	// and being written as JSON and read back, with durations as strings
+	data, err := json.Marshal(config)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"handshakeTimeout":"5s"`)
+	assert.Contains(t, string(data), `"maxLifetime":"1h0m0s"`)
+
+	var decoded iap.DialConfig
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, config, decoded)
+}
+
+func TestDurationJSON(t *testing.T) {
+	tests := []struct {
+		json     string
+		duration iap.Duration
+		err      bool
+	}{
+		{`"30s"`, iap.Duration(30 * time.Second), false},
+		{`"1m30s"`, iap.Duration(90 * time.Second), false},
+		{`1000000000`, iap.Duration(time.Second), false},
+		{`"30"`, 0, true},
+		{`true`, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.json, func(t *testing.T) {
+			var duration iap.Duration
+			err := json.Unmarshal([]byte(tt.json), &duration)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.duration, duration)
+		})
+	}
+}
+
+func TestConnConfig(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	opts := append(server.DialOptions(), iap.WithInstance("bastion", "europe-west2-a", "nic0"), iap.WithHandshakeTimeout(5*time.Second))
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	config := conn.Config()
+	assert.Equal(t, "bastion", config.Instance)
+	assert.Equal(t, iap.Duration(5*time.Second), config.HandshakeTimeout)
+	assert.Equal(t, strings.TrimPrefix(server.URL, "https://"), config.Endpoint)
+}
@@ -0,0 +1,870 @@
+package iap_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"nhooyr.io/websocket"
+)
+
+func dial(t *testing.T, server *iaptest.Server) *iap.Conn {
+	t.Helper()
+
+	conn, err := iap.Dial(context.Background(), server.DialOptions()...)
+	require.NoError(t, err)
+
+	return conn
+}
+
+func TestDialEcho(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	assert.True(t, conn.Connected())
+	assert.Equal(t, "iaptest-1", conn.SessionID())
+
+	// larger than a frame so writes are split
+	payload := make([]byte, 100_000)
+	rand.Read(payload)
+
+	go func() {
+		conn.Write(payload)
+	}()
+
+	received := make([]byte, len(payload))
+	_, err := io.ReadFull(conn, received)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(payload, received))
+
+	assert.Eventually(t, func() bool {
+		return conn.Sent() == uint64(len(payload))
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	conn := dial(t, server)
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, conn.Close())
+	assert.False(t, conn.Connected())
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	for range 20 {
+		conn := dial(t, server)
+
+		// writes racing Close either succeed or fail with net.ErrClosed, whichever wins
+		writeErr := make(chan error)
+		go func() {
+			payload := make([]byte, 50_000)
+			for {
+				if _, err := conn.Write(payload); err != nil {
+					writeErr <- err
+					return
+				}
+			}
+		}()
+
+		time.Sleep(time.Millisecond)
+		require.NoError(t, conn.Close())
+
+		select {
+		case err := <-writeErr:
+			assert.ErrorIs(t, err, net.ErrClosed)
+		case <-time.After(time.Second):
+			t.Fatal("Write wasn't unblocked by Close")
+		}
+
+		n, err := conn.Write([]byte("hello"))
+		assert.Zero(t, n)
+		assert.ErrorIs(t, err, net.ErrClosed)
+
+		n, err = conn.Write(nil)
+		assert.Zero(t, n)
+		assert.ErrorIs(t, err, net.ErrClosed)
+	}
+}
+
+func TestCloseUnblocksReadWrite(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	// never read, so writes back up until they block
+	block := make(chan struct{})
+	defer close(block)
+	server.Handler = func(r io.Reader, w io.Writer) {
+		<-block
+	}
+
+	conn := dial(t, server)
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 64))
+		readErr <- err
+	}()
+
+	var written atomic.Int64
+	writeErr := make(chan error, 1)
+	go func() {
+		payload := make([]byte, 64*1024)
+		for {
+			n, err := conn.Write(payload)
+			written.Add(int64(n))
+			if err != nil {
+				writeErr <- err
+				return
+			}
+		}
+	}()
+
+	// wait until writes stop making progress
+	var last int64
+	require.Eventually(t, func() bool {
+		now := written.Load()
+		stalled := now > 0 && now == last
+		last = now
+		return stalled
+	}, 5*time.Second, 50*time.Millisecond)
+
+	start := time.Now()
+	require.NoError(t, conn.Close())
+
+	for _, errs := range []chan error{readErr, writeErr} {
+		select {
+		case err := <-errs:
+			assert.ErrorIs(t, err, net.ErrClosed)
+		case <-time.After(time.Second):
+			t.Fatal("I/O wasn't unblocked by Close")
+		}
+	}
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestCloseDuringRecycle(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.ReconnectDelay = 2 * time.Second
+
+	block := make(chan struct{})
+	defer close(block)
+	server.Handler = func(r io.Reader, w io.Writer) {
+		<-block
+	}
+
+	opts := append(server.DialOptions(), iap.WithMaxLifetime(20*time.Millisecond))
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+
+	writeErr := make(chan error, 1)
+	go func() {
+		payload := make([]byte, 64*1024)
+		for {
+			if _, err := conn.Write(payload); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+	}()
+
+	require.Eventually(t, func() bool {
+		return server.Reconnects() > 0
+	}, time.Second, 10*time.Millisecond)
+
+	// Close doesn't wait for the relay to finish resuming the session
+	require.NoError(t, conn.Close())
+
+	select {
+	case err := <-writeErr:
+		assert.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(time.Second):
+		t.Fatal("Write wasn't unblocked by Close")
+	}
+}
+
+func TestParallelReadWriteClose(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	for range 20 {
+		conn := dial(t, server)
+
+		var wg sync.WaitGroup
+
+		for range 4 {
+			wg.Add(2)
+
+			go func() {
+				defer wg.Done()
+
+				for {
+					if _, err := conn.Write([]byte("ping")); err != nil {
+						assert.ErrorIs(t, err, net.ErrClosed)
+						return
+					}
+				}
+			}()
+
+			go func() {
+				defer wg.Done()
+
+				buf := make([]byte, 64)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						assert.ErrorIs(t, err, net.ErrClosed)
+						return
+					}
+				}
+			}()
+		}
+
+		go func() {
+			_ = conn.Sent()
+			_ = conn.Received()
+			_ = conn.Connected()
+		}()
+
+		time.Sleep(5 * time.Millisecond)
+		conn.Close()
+
+		wg.Wait()
+	}
+}
+
+func TestDialStorm(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	var wg sync.WaitGroup
+
+	for range 50 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			conn, err := iap.Dial(context.Background(), server.DialOptions()...)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+
+			_, err = conn.Write([]byte("hello"))
+			assert.NoError(t, err)
+
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(buf))
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestRemoteClose(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Handler = func(r io.Reader, w io.Writer) {
+		w.Write([]byte("bye"))
+	}
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	buf := make([]byte, 3)
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "bye", string(buf))
+
+	_, err = conn.Read(buf)
+	assert.Equal(t, io.EOF, err)
+
+	// the remote closing is reported as the end of the stream even after Close
+	require.NoError(t, conn.Close())
+	_, err = conn.Read(buf)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = conn.Write([]byte("hello"))
+	var opErr *net.OpError
+	assert.ErrorAs(t, err, &opErr)
+}
+
+func TestThroughputCallback(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	var in, out atomic.Uint64
+
+	opts := append(server.DialOptions(), iap.WithThroughputCallback(10*time.Millisecond, func(sessionID string, inNb, outNb uint64) {
+		assert.Equal(t, "iaptest-1", sessionID)
+		in.Add(inNb)
+		out.Add(outNb)
+	}))
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return in.Load() == 5 && out.Load() == 5
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestTee(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	var in, out bytes.Buffer
+
+	opts := append(server.DialOptions(), iap.WithTee(&in, &out, 8))
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for _, msg := range []string{"hello", "world"} {
+		_, err = conn.Write([]byte(msg))
+		require.NoError(t, err)
+
+		_, err = io.ReadFull(conn, make([]byte, len(msg)))
+		require.NoError(t, err)
+	}
+
+	// only the first 8 bytes are copied each way
+	assert.Equal(t, "hellowor", in.String())
+	assert.Equal(t, "hellowor", out.String())
+}
+
+func TestTrace(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	var trace, frames bytes.Buffer
+
+	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "secret"})
+	opts := append(server.DialOptions(),
+		iap.WithTokenSource(&tokenSource),
+		iap.WithTrace(slog.New(slog.NewTextHandler(&trace, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+		iap.WithFrameTrace(slog.New(slog.NewTextHandler(&frames, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+	)
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	require.NoError(t, err)
+
+	conn.Close()
+
+	assert.Contains(t, trace.String(), "Relay handshake complete")
+	assert.Contains(t, trace.String(), "Bearer REDACTED")
+	assert.NotContains(t, trace.String(), "secret")
+	assert.Contains(t, trace.String(), "Connection closed")
+
+	assert.Contains(t, frames.String(), "direction=out tag=4 len=5")
+	assert.Contains(t, frames.String(), "direction=in tag=4 len=5")
+}
+
+func TestPlaintextEndpoint(t *testing.T) {
+	server := iaptest.NewPlaintextServer()
+	defer server.Close()
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+
+	assert.NoError(t, iap.CheckPermissions(context.Background(), append(server.DialOptions(), iap.WithProject("project"), iap.WithInstance("prod-1", "europe-west2-a", "nic0"))...))
+}
+
+func TestNewConn(t *testing.T) {
+	server := iaptest.NewPlaintextServer()
+	defer server.Close()
+
+	ctx := context.Background()
+	url := "ws://" + strings.TrimPrefix(server.URL, "http://") + "/v4/connect?instance=prod-1"
+
+	ws, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{Subprotocols: []string{iap.Subprotocol}})
+	require.NoError(t, err)
+
+	conn, err := iap.NewConn(ctx, ws, iap.WithInstance("prod-1", "europe-west2-a", "nic0"), iap.WithPort("22"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+	assert.Equal(t, "europe-west2-a/prod-1:22", conn.RemoteAddr().String())
+
+	ws, _, err = websocket.Dial(ctx, url, nil)
+	require.NoError(t, err)
+
+	_, err = iap.NewConn(ctx, ws)
+	var protocolErr *iap.ProtocolError
+	assert.ErrorAs(t, err, &protocolErr)
+}
+
+func TestNewConnLimited(t *testing.T) {
+	server := iaptest.NewPlaintextServer()
+	defer server.Close()
+
+	ctx := context.Background()
+	url := "ws://" + strings.TrimPrefix(server.URL, "http://") + "/v4/connect?instance=prod-1"
+
+	ws, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{Subprotocols: []string{iap.Subprotocol}})
+	require.NoError(t, err)
+
+	sessions := iap.NewSessionLimiter(1)
+	projects := iap.NewProjectLimiter(1)
+
+	conn, err := iap.NewConn(ctx, ws, iap.WithProject("project"), iap.WithInstance("prod-1", "europe-west2-a", "nic0"), iap.WithPort("22"), iap.WithSessionLimiter(sessions), iap.WithProjectLimiter(projects))
+	require.NoError(t, err)
+
+	echo(t, conn, "hello")
+	assert.Equal(t, 1, sessions.Active())
+	assert.Equal(t, 1, projects.Limiter("project").Active())
+
+	closed := make(chan error, 1)
+	go func() { closed <- conn.Close() }()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't return")
+	}
+	assert.Equal(t, 0, sessions.Active())
+	assert.Equal(t, 0, projects.Limiter("project").Active())
+}
+
+// lockedBuffer is a bytes.Buffer which can be written to while it's being read.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDelayedAck(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	var frames lockedBuffer
+	opts := append(server.DialOptions(), iap.WithFrameTrace(slog.New(slog.NewTextHandler(&frames, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// wait for the round trip time to be measured, after which data is acked without waiting for the threshold
+	time.Sleep(100 * time.Millisecond)
+
+	echo(t, conn, "hello")
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(frames.String(), "direction=out tag=7 ack=5")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMaxLifetime(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	opts := append(server.DialOptions(), iap.WithMaxLifetime(20*time.Millisecond))
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	payload := make([]byte, 1_000_000)
+	rand.Read(payload)
+
+	go func() {
+		// write slowly so the stream spans several sessions
+		for data := payload; len(data) > 0; {
+			chunk := data[:min(len(data), 10_000)]
+			data = data[len(chunk):]
+
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	received := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, received)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(payload, received))
+
+	assert.Greater(t, server.Reconnects(), 1)
+	assert.Equal(t, "iaptest-1", conn.SessionID())
+	assert.True(t, conn.Connected())
+}
+
+func TestOpError(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	opts := append(server.DialOptions(), iap.WithInstance("prod-1", "europe-west2-a", "nic0"), iap.WithPort("22"))
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+
+	var opErr *net.OpError
+	require.ErrorAs(t, err, &opErr)
+	assert.Equal(t, "write", opErr.Op)
+	assert.Equal(t, "iap", opErr.Net)
+	assert.Equal(t, "europe-west2-a/prod-1:22", opErr.Addr.String())
+	assert.Equal(t, conn.LocalAddr(), opErr.Source)
+	assert.Contains(t, err.Error(), "iaptest-1")
+	assert.ErrorIs(t, err, net.ErrClosed)
+
+	_, err = conn.Read(make([]byte, 5))
+	require.ErrorAs(t, err, &opErr)
+	assert.Equal(t, "read", opErr.Op)
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestAddrs(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	target := iap.HostTarget{Project: "project", Region: "europe-west2", Network: "default", Group: "onprem", Host: "10.0.0.1", Port: 22}
+
+	conn, err := iap.Dial(context.Background(), append(server.DialOptions(), iap.WithTarget(target))...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, "iap", conn.RemoteAddr().Network())
+	assert.Equal(t, "europe-west2/default/onprem/10.0.0.1:22", conn.RemoteAddr().String())
+
+	host, port, err := net.SplitHostPort(conn.RemoteAddr().String())
+	require.NoError(t, err)
+	assert.Equal(t, "europe-west2/default/onprem/10.0.0.1", host)
+	assert.Equal(t, "22", port)
+
+	local, ok := conn.LocalAddr().(*iap.RelayAddr)
+	require.True(t, ok)
+	assert.Equal(t, strings.TrimPrefix(server.URL, "https://"), local.Endpoint)
+	assert.Equal(t, "iaptest-1", local.SessionID)
+}
+
+func TestReadDeadline(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+
+	_, err := conn.Read(make([]byte, 5))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// the connection carries on once the deadline is lifted, even after sitting past it
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, conn.SetReadDeadline(time.Time{}))
+	echo(t, conn, "hello")
+	assert.True(t, conn.Connected())
+}
+
+func TestWriteDeadline(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetWriteDeadline(time.Now().Add(-time.Second)))
+
+	n, err := conn.Write([]byte("hello"))
+	assert.Zero(t, n)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+	echo(t, conn, "hello")
+	assert.True(t, conn.Connected())
+}
+
+func TestWriteDeadlineBlocked(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	block := make(chan struct{})
+	defer close(block)
+	server.Handler = func(r io.Reader, w io.Writer) {
+		<-block
+	}
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	var written atomic.Int64
+	writeErr := make(chan error, 1)
+	go func() {
+		payload := make([]byte, 64*1024)
+		for {
+			n, err := conn.Write(payload)
+			written.Add(int64(n))
+			if err != nil {
+				writeErr <- err
+				return
+			}
+		}
+	}()
+
+	var last int64
+	require.Eventually(t, func() bool {
+		now := written.Load()
+		stalled := now > 0 && now == last
+		last = now
+		return stalled
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// a write stuck past its deadline fails the connection
+	require.NoError(t, conn.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+
+	select {
+	case err := <-writeErr:
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("Write wasn't unblocked by its deadline")
+	}
+	assert.False(t, conn.Connected())
+}
+
+func TestAbort(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	conn := dial(t, server)
+
+	readErr := make(chan error)
+	go func() {
+		_, err := conn.Read(make([]byte, 5))
+		readErr <- err
+	}()
+
+	start := time.Now()
+	conn.Abort()
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	select {
+	case err := <-readErr:
+		assert.ErrorIs(t, err, iap.ErrAborted)
+	case <-time.After(time.Second):
+		t.Fatal("Read wasn't unblocked by Abort")
+	}
+
+	_, err := conn.Write([]byte("hello"))
+	assert.ErrorIs(t, err, iap.ErrAborted)
+
+	assert.NoError(t, conn.Close())
+	conn.Abort()
+}
+
+func TestAckAccountingAcrossReconnects(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	opts := append(server.DialOptions(), iap.WithMaxLifetime(10*time.Millisecond))
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	const chunk = 20_000
+
+	var written, sent, received uint64
+	for i := 0; server.Reconnects() < 3; i++ {
+		require.Less(t, i, 1000, "connection wasn't recycled")
+
+		echo(t, conn, string(make([]byte, chunk)))
+		written += chunk
+
+		// the counters are totals for the connection, which never go backwards when it moves to a new session
+		nowSent, nowReceived := conn.Sent(), conn.Received()
+		assert.GreaterOrEqual(t, nowSent, sent)
+		assert.GreaterOrEqual(t, nowReceived, received)
+		sent, received = nowSent, nowReceived
+
+		time.Sleep(time.Millisecond)
+	}
+
+	// the relay acks everything sent in the end, counting from the start of the connection
+	require.Eventually(t, func() bool {
+		return conn.Sent() == written
+	}, time.Second, time.Millisecond)
+	assert.LessOrEqual(t, conn.Received(), written)
+	assert.True(t, conn.Connected())
+}
+
+func TestFallbackAddress(t *testing.T) {
+	server := iaptest.NewPlaintextServer()
+	defer server.Close()
+
+	// the server only listens on 127.0.0.1, so an IPv6 address of localhost is refused
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	var trace lockedBuffer
+
+	opts := append(server.DialOptions(),
+		iap.WithEndpoint("ws://localhost:"+u.Port()),
+		iap.WithFallbackDelay(10*time.Millisecond),
+		iap.WithTrace(slog.New(slog.NewTextHandler(&trace, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+	)
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+
+	assert.Contains(t, trace.String(), "Relay address connected")
+	assert.Contains(t, trace.String(), "addr=127.0.0.1:"+u.Port())
+}
+
+// countingConn counts the bytes written to a connection.
+type countingConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c countingConn) Write(buf []byte) (int, error) {
+	n, err := c.Conn.Write(buf)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	server := iaptest.NewPlaintextServer()
+	defer server.Close()
+	server.CompressionMode = websocket.CompressionContextTakeover
+
+	// sendZeros writes 200 byte frames of zeros and returns how many bytes went over the wire
+	sendZeros := func(compression iap.CompressionOptions) int64 {
+		var written atomic.Int64
+
+		var dialer net.Dialer
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				return countingConn{Conn: conn, written: &written}, err
+			},
+		}}
+
+		conn, err := iap.Dial(context.Background(), append(server.DialOptions(), iap.WithHTTPClient(client), iap.WithCompressionOptions(compression))...)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		handshake := written.Load()
+		for range 100 {
+			echo(t, conn, string(make([]byte, 200)))
+		}
+		return written.Load() - handshake
+	}
+
+	compressed := sendZeros(iap.CompressionOptions{Threshold: 100})
+	uncompressed := sendZeros(iap.CompressionOptions{Threshold: 1000})
+
+	assert.Greater(t, uncompressed, int64(100*200))
+	assert.Less(t, compressed, uncompressed/2)
+}
+
+func TestPing(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	conn, err := iap.Dial(context.Background(), server.DialOptions()...)
+	require.NoError(t, err)
+
+	rtt, err := conn.Ping(context.Background())
+	require.NoError(t, err)
+	assert.Positive(t, rtt)
+	assert.Positive(t, conn.RTT())
+
+	conn.Close()
+
+	_, err = conn.Ping(context.Background())
+	assert.ErrorIs(t, err, iap.ErrClosed)
+	var opErr *net.OpError
+	require.ErrorAs(t, err, &opErr)
+	assert.Equal(t, "ping", opErr.Op)
+
+	// a failed handshake is wrapped the same way
+	server.Close()
+	conn, err = iap.New(server.DialOptions()...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Ping(context.Background())
+	require.ErrorAs(t, err, &opErr)
+	assert.Equal(t, "ping", opErr.Op)
+	assert.ErrorIs(t, err, iap.ErrRelayUnreachable)
+}
+
+func TestRTTMeasuredOnConnect(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	conn, err := iap.Dial(context.Background(), server.DialOptions()...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Eventually(t, func() bool {
+		return conn.RTT() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,98 @@
+package iap
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// halfCloseIdle is how long Copy waits for more data from the target once the other side has reached EOF.
+const halfCloseIdle = 5 * time.Second
+
+// aLongTimeAgo is a deadline in the past, which unblocks pending reads and writes.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// drainReader reads from a connection, giving up once it's idle for halfCloseIdle after draining is set.
+type drainReader struct {
+	conn     *Conn
+	draining atomic.Bool
+}
+
+func (r *drainReader) Read(buf []byte) (int, error) {
+	if r.draining.Load() {
+		r.conn.SetReadDeadline(time.Now().Add(halfCloseIdle))
+	}
+	return r.conn.Read(buf)
+}
+
+func (r *drainReader) drain() {
+	r.draining.Store(true)
+	// a read already waiting needs the deadline too
+	r.conn.SetReadDeadline(time.Now().Add(halfCloseIdle))
+}
+
+// Copy copies data between conn and other in both directions, as a forwarder bridging a client to a tunnel does. It
+// returns the bytes sent to the target from other, the bytes received from the target, and the first error in either
+// direction, which is nil if the target closed the connection.
+//
+// Tunnels can't be half-closed, so when other reaches EOF Copy keeps delivering data from the target until it closes
+// the connection or sends nothing for 5 seconds, replacing conn's read deadline. Then other's write side is closed if
+// it has a CloseWrite method. A failure in either direction, including a deadline set by the caller passing, stops
+// both by setting the deadlines of both connections in the past. Copy doesn't close either connection.
+func Copy(conn *Conn, other net.Conn) (sent, received int64, err error) {
+	var (
+		mu       sync.Mutex
+		finished bool
+	)
+	// finish records the error which ended the bridge and stops the direction still running
+	finish := func(cause error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if finished {
+			return
+		}
+		finished, err = true, cause
+
+		conn.SetDeadline(aLongTimeAgo)
+		other.SetDeadline(aLongTimeAgo)
+	}
+
+	src := &drainReader{conn: conn}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		var copyErr error
+		received, copyErr = io.Copy(other, src)
+		if src.draining.Load() && errors.Is(copyErr, os.ErrDeadlineExceeded) {
+			// the target went quiet after the other side finished
+			copyErr = nil
+		}
+		if copyErr == nil {
+			if cw, ok := other.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			}
+		}
+		finish(copyErr)
+	}()
+
+	var copyErr error
+	sent, copyErr = io.Copy(conn, other)
+	if copyErr != nil {
+		finish(copyErr)
+	} else {
+		src.drain()
+	}
+
+	wg.Wait()
+
+	return sent, received, err
+}
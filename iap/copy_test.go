@@ -0,0 +1,119 @@
+package iap_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"nhooyr.io/websocket"
+)
+
+// tcpPair returns both ends of a loopback TCP connection, which can be half-closed.
+func tcpPair(t *testing.T) (client, server *net.TCPConn) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	accepted, err := l.Accept()
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		conn.Close()
+		accepted.Close()
+	})
+
+	return conn.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+type copyResult struct {
+	sent, received int64
+	err            error
+}
+
+func startCopy(conn *iap.Conn, other net.Conn) <-chan copyResult {
+	result := make(chan copyResult, 1)
+	go func() {
+		sent, received, err := iap.Copy(conn, other)
+		result <- copyResult{sent, received, err}
+	}()
+	return result
+}
+
+func TestCopyHalfClose(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+	server.Handler = func(r io.Reader, w io.Writer) {
+		buf := make([]byte, 5)
+		io.ReadFull(r, buf)
+		w.Write([]byte("HELLO, WORLD"))
+	}
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	client, other := tcpPair(t)
+	result := startCopy(conn, other)
+
+	_, err := client.Write([]byte("hello"))
+	require.NoError(t, err)
+	// the target still answers after the client is done sending
+	require.NoError(t, client.CloseWrite())
+
+	reply, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "HELLO, WORLD", string(reply))
+
+	res := <-result
+	assert.NoError(t, res.err)
+	assert.Equal(t, int64(5), res.sent)
+	assert.Equal(t, int64(12), res.received)
+}
+
+func TestCopyDeadline(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	_, other := tcpPair(t)
+	other.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	select {
+	case res := <-startCopy(conn, other):
+		assert.ErrorIs(t, res.err, os.ErrDeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadline didn't stop the copy")
+	}
+}
+
+func TestCopyRelayClose(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+	server.Faults.CloseAfter = 1
+	server.Faults.CloseStatus = websocket.StatusCode(4003)
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	client, other := tcpPair(t)
+	result := startCopy(conn, other)
+
+	_, err := client.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	res := <-result
+	var closeErr *iap.CloseError
+	require.ErrorAs(t, res.err, &closeErr)
+	assert.Equal(t, 4003, closeErr.Code)
+}
@@ -0,0 +1,198 @@
+package iap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// noCredentialsError is returned by a step of the credential chain which has no credentials to offer, so the next step
+// is tried. Any other error means credentials were found but couldn't be used, which ends the chain.
+type noCredentialsError struct {
+	reason string
+}
+
+func (e *noCredentialsError) Error() string {
+	return e.reason
+}
+
+func noCredentials(format string, args ...any) error {
+	return &noCredentialsError{fmt.Sprintf(format, args...)}
+}
+
+// CredentialsError is returned when the credential chain didn't yield credentials.
+type CredentialsError struct {
+	// Tried holds the error for each step of the chain, in the order they were tried.
+	Tried []error
+}
+
+func (e *CredentialsError) Error() string {
+	msgs := make([]string, len(e.Tried))
+	for i, err := range e.Tried {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("no usable credentials found, tried: %v", strings.Join(msgs, "; "))
+}
+
+func (e *CredentialsError) Unwrap() []error {
+	return e.Tried
+}
+
+// Is matches ErrUnauthorized.
+func (e *CredentialsError) Is(target error) bool {
+	return target == ErrUnauthorized
+}
+
+type credentialStep struct {
+	name string
+	find func(ctx context.Context, scopes []string) (oauth2.TokenSource, error)
+}
+
+// credentialChain is tried in order by FindCredentials.
+var credentialChain = []credentialStep{
+	{"GOOGLE_APPLICATION_CREDENTIALS", envCredentials},
+	{"application default credentials file", wellKnownFileCredentials},
+	{"gcloud", gcloudCredentials},
+	{"metadata server", metadataCredentials},
+}
+
+// FindCredentials returns a token source for the first credentials found in the chain: the key file named by
+// GOOGLE_APPLICATION_CREDENTIALS, the application default credentials file written by gcloud, the account gcloud is
+// logged in with, and finally the metadata server when running on Google Cloud. Credentials that are found but can't be
+// used, like a malformed key file, end the chain. The returned *CredentialsError lists the outcome of each step tried.
+// Credentials taken from gcloud ignore scopes.
+func FindCredentials(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+	if len(scopes) == 0 {
+		scopes = []string{defaultScope}
+	}
+
+	var tried []error
+
+	for _, step := range credentialChain {
+		source, err := step.find(ctx, scopes)
+		if err == nil {
+			return source, nil
+		}
+
+		tried = append(tried, fmt.Errorf("%v: %w", step.name, err))
+		var noCredsErr *noCredentialsError
+		if !errors.As(err, &noCredsErr) {
+			break
+		}
+	}
+
+	return nil, &CredentialsError{tried}
+}
+
+func credentialsFromFile(ctx context.Context, path string, scopes []string) (oauth2.TokenSource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	source, err := credentialsFromJSON(ctx, data, scopes)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	return source, nil
+}
+
+func credentialsFromJSON(ctx context.Context, data []byte, scopes []string) (oauth2.TokenSource, error) {
+	creds, err := google.CredentialsFromJSON(ctx, data, scopes...)
+	if err != nil {
+		return nil, err
+	}
+
+	return creds.TokenSource, nil
+}
+
+func envCredentials(ctx context.Context, scopes []string) (oauth2.TokenSource, error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		return nil, noCredentials("not set")
+	}
+
+	return credentialsFromFile(ctx, path, scopes)
+}
+
+func wellKnownFileCredentials(ctx context.Context, scopes []string) (oauth2.TokenSource, error) {
+	dir, err := gcloudConfigDir()
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, "application_default_credentials.json")
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil, noCredentials("%v doesn't exist", path)
+	}
+
+	return credentialsFromFile(ctx, path, scopes)
+}
+
+func gcloudCredentials(ctx context.Context, scopes []string) (oauth2.TokenSource, error) {
+	if _, err := exec.LookPath("gcloud"); err != nil {
+		return nil, noCredentials("not installed")
+	}
+
+	source := oauth2.ReuseTokenSource(nil, gcloudTokenSource{})
+
+	// make sure gcloud is logged in before settling on it
+	if _, err := source.Token(); err != nil {
+		return nil, noCredentials("not logged in: %v", err)
+	}
+
+	return source, nil
+}
+
+// gcloudTokenSource fetches tokens for the account gcloud is logged in with.
+type gcloudTokenSource struct{}
+
+func (gcloudTokenSource) Token() (*oauth2.Token, error) {
+	out, err := exec.Command("gcloud", "config", "config-helper", "--format=json").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return nil, fmt.Errorf("%w: %v", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+
+	var helper struct {
+		Credential struct {
+			AccessToken string    `json:"access_token"`
+			TokenExpiry time.Time `json:"token_expiry"`
+		} `json:"credential"`
+	}
+	if err := json.Unmarshal(out, &helper); err != nil {
+		return nil, err
+	}
+	if helper.Credential.AccessToken == "" {
+		return nil, errors.New("gcloud returned no access token")
+	}
+
+	return &oauth2.Token{
+		AccessToken: helper.Credential.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      helper.Credential.TokenExpiry,
+	}, nil
+}
+
+func metadataCredentials(ctx context.Context, scopes []string) (oauth2.TokenSource, error) {
+	if !metadata.OnGCE() {
+		return nil, noCredentials("not running on Google Cloud")
+	}
+
+	return google.ComputeTokenSource("", scopes...), nil
+}
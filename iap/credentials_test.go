@@ -0,0 +1,62 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const authorizedUserJSON = `{
+	"type": "authorized_user",
+	"client_id": "id",
+	"client_secret": "secret",
+	"refresh_token": "token"
+}`
+
+func writeCredentials(t *testing.T, dir, name string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(authorizedUserJSON), 0o600))
+
+	return path
+}
+
+func TestFindCredentialsEnv(t *testing.T) {
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", writeCredentials(t, t.TempDir(), "creds.json"))
+
+	source, err := FindCredentials(context.Background())
+	require.NoError(t, err)
+	assert.NotNil(t, source)
+}
+
+func TestFindCredentialsWellKnownFile(t *testing.T) {
+	dir := t.TempDir()
+	writeCredentials(t, dir, "application_default_credentials.json")
+
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("CLOUDSDK_CONFIG", dir)
+
+	source, err := FindCredentials(context.Background())
+	require.NoError(t, err)
+	assert.NotNil(t, source)
+}
+
+func TestFindCredentialsUnusable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.json")
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", path)
+
+	_, err := FindCredentials(context.Background())
+
+	var credsErr *CredentialsError
+	require.True(t, errors.As(err, &credsErr), err)
+	// the chain stops at credentials that were asked for but can't be used
+	assert.Len(t, credsErr.Tried, 1)
+	assert.Contains(t, err.Error(), "GOOGLE_APPLICATION_CREDENTIALS")
+	assert.Contains(t, err.Error(), path)
+}
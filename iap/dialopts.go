@@ -1,23 +1,101 @@
 package iap
 
 import (
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
 	"golang.org/x/oauth2"
 )
 
 type DialOption func(*dialOptions)
 
+// FrameHandler handles the body of a frame with a tag registered using WithFrameHandler. It's called from the
+// connection's read loop, so it should return quickly. Returning an error fails the connection.
+type FrameHandler func(tag uint16, body []byte) error
+
+// ThroughputFunc is called by WithThroughputCallback with the connection's relay session ID and the number of bytes
+// received and sent during an interval.
+type ThroughputFunc func(sessionID string, in, out uint64)
+
+// ReconnectFunc is called by WithReconnectCallback before the relay is dialed again, with the relay session ID and the
+// error which made the previous attempt fail, or nil if the connection is moving to a new relay session on schedule.
+// The session ID is empty while retrying the first handshake, before the relay has assigned one.
+type ReconnectFunc func(sessionID string, err error)
+
 type dialOptions struct {
-	Zone        string
-	TokenSource *oauth2.TokenSource
-	Region      string
-	Project     string
-	Port        string
-	Network     string
-	Interface   string
-	Instance    string
-	Host        string
-	Group       string
-	Compress    bool
+	Zone          string
+	TokenSource   *oauth2.TokenSource
+	Region        string
+	Project       string
+	Port          string
+	Network       string
+	Interface     string
+	Instance      string
+	Host          string
+	Group         string
+	Compress      bool
+	Compression   CompressionOptions
+	Endpoint      string
+	Endpoints     []string
+	APIEndpoint   string
+	HTTPClient    *http.Client
+	FallbackDelay time.Duration
+	RelayCAs      *x509.CertPool
+	RelayPins     []string
+	Strict        bool
+	Handlers      map[uint16]FrameHandler
+
+	AckThreshold uint64
+	AckTimeout   time.Duration
+
+	HandshakeTimeout time.Duration
+	LazyDial         bool
+
+	DialRetries  int
+	RetryBackoff time.Duration
+
+	MeterProvider metric.MeterProvider
+
+	ThroughputInterval time.Duration
+	ThroughputFunc     ThroughputFunc
+
+	DefaultCredentials bool
+	CredentialsFile    string
+	CredentialsJSON    []byte
+	Scopes             []string
+
+	GcloudDefaults bool
+	Environment    bool
+
+	MaxLifetime   time.Duration
+	ReconnectFunc ReconnectFunc
+
+	SessionLimiter *SessionLimiter
+	ProjectLimiter *ProjectLimiter
+	CircuitBreaker *CircuitBreaker
+	// projectSessions is the ProjectLimiter's limiter for the target's project, once the dial has a session from it
+	projectSessions *SessionLimiter
+
+	TeeIn    io.Writer
+	TeeOut   io.Writer
+	TeeLimit int64
+
+	UploadRate     int
+	DownloadRate   int
+	SharedUpload   *RateLimiter
+	SharedDownload *RateLimiter
+
+	SessionIDAttribute bool
+
+	Trace       *slog.Logger
+	FrameTrace  *slog.Logger
+	ClientTrace *ClientTrace
+
+	Transport Transport
 }
 
 func (d *dialOptions) collectOpts(opts []DialOption) {
@@ -33,6 +111,34 @@ func WithTokenSource(tokenSource *oauth2.TokenSource) func(*dialOptions) {
 	}
 }
 
+// WithDefaultCredentials is a functional option that authorizes the connection with the credentials found by
+// FindCredentials for the given scopes, or the cloud-platform scope if none are given. Tokens are cached and shared
+// between dials with the same scopes, and refreshed in the background before they expire.
+func WithDefaultCredentials(scopes ...string) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.DefaultCredentials = true
+		d.Scopes = scopes
+	}
+}
+
+// WithCredentialsFile is a functional option that authorizes the connection with the service account key or other
+// credentials JSON file at path, for the given scopes or the cloud-platform scope if none are given. The file is read
+// on the first dial and tokens are cached like WithDefaultCredentials.
+func WithCredentialsFile(path string, scopes ...string) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.CredentialsFile = path
+		d.Scopes = scopes
+	}
+}
+
+// WithCredentialsJSON is like WithCredentialsFile but takes the contents of the file.
+func WithCredentialsJSON(json []byte, scopes ...string) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.CredentialsJSON = json
+		d.Scopes = scopes
+	}
+}
+
 // WithCompression is a functional option that enables compression.
 func WithCompression() func(*dialOptions) {
 	return func(d *dialOptions) {
@@ -40,6 +146,25 @@ func WithCompression() func(*dialOptions) {
 	}
 }
 
+// CompressionOptions tunes the compression enabled with WithCompressionOptions. Frames are always deflated at the
+// fastest level, which is all the WebSocket library supports.
+type CompressionOptions struct {
+	// Threshold is the size in bytes below which frames are sent uncompressed, so small frames like keystrokes in an
+	// SSH session don't cost CPU for little gain. It defaults to 128 bytes, or 512 with NoContextTakeover.
+	Threshold int
+	// NoContextTakeover compresses each frame on its own instead of with a 32 KB window carried over from the frames
+	// before, which saves memory for each connection but compresses repetitive protocols less.
+	NoContextTakeover bool
+}
+
+// WithCompressionOptions is a functional option that enables compression tuned by opts.
+func WithCompressionOptions(opts CompressionOptions) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.Compress = true
+		d.Compression = opts
+	}
+}
+
 // WithProject is a functional option that sets the project ID.
 func WithProject(project string) func(*dialOptions) {
 	return func(d *dialOptions) {
@@ -66,9 +191,265 @@ func WithHost(host, region, network, destGroup string) func(*dialOptions) {
 	}
 }
 
+// WithGcloudDefaults is a functional option that fills in the project, and the zone of an instance or region of a host,
+// from the active gcloud configuration when they aren't given by other options.
+func WithGcloudDefaults() func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.GcloudDefaults = true
+	}
+}
+
 // WithPort is a functional option that sets the destination port.
 func WithPort(port string) func(*dialOptions) {
 	return func(d *dialOptions) {
 		d.Port = port
 	}
 }
+
+// WithEndpoint is a functional option that overrides the host (and optionally port) of the relay endpoint. An
+// endpoint written as ws://host connects without TLS, e.g. to a relay emulator on 127.0.0.1, which sends credentials
+// in the clear.
+func WithEndpoint(endpoint string) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.Endpoint, d.Endpoints = endpoint, nil
+	}
+}
+
+// WithEndpoints is a functional option like WithEndpoint which gives relay endpoints to try in order, e.g. a regional
+// endpoint and then the global one, written as an empty string. Dial moves on to the next endpoint when one can't be
+// reached, fails with a server error or is throttled, and if all fail returns an *EndpointError for each. Sessions
+// are resumed on the endpoint they were dialed on.
+func WithEndpoints(endpoints ...string) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.Endpoint, d.Endpoints = "", endpoints
+	}
+}
+
+// WithFallbackDelay is a functional option that sets how long the relay's IPv6 addresses are tried before its IPv4
+// addresses are raced against them, 300ms by default. A negative delay disables racing, trying addresses one after the
+// other. It has no effect with WithHTTPClient, whose client dials the relay instead.
+func WithFallbackDelay(delay time.Duration) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.FallbackDelay = delay
+	}
+}
+
+// WithRelayCAs is a functional option that only trusts relay certificates issued by the CAs in pool, instead of the
+// system's, so a TLS intercepting proxy with its own CA fails the dial rather than reading the traffic.
+func WithRelayCAs(pool *x509.CertPool) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.RelayCAs = pool
+	}
+}
+
+// WithRelayPins is a functional option that fails dials unless a certificate in the relay's chain has one of the public
+// keys pinned, written like PublicKeyPin returns them. Pins are checked during the TLS handshake, before credentials
+// are sent. Pinning an intermediate or root key rather than the relay's own survives certificate rotation. With
+// WithHTTPClient, the client's transport has to be an *http.Transport, and if it skips verification only the relay's
+// own key can be pinned.
+func WithRelayPins(pins ...string) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.RelayPins = pins
+	}
+}
+
+// WithAPIEndpoint is a functional option that overrides the host (and optionally port) of the IAP API, which
+// CheckPermissions calls, e.g. for a Private Service Connect endpoint. An endpoint written as http://host connects
+// without TLS, like an emulator.
+func WithAPIEndpoint(endpoint string) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.APIEndpoint = endpoint
+	}
+}
+
+// WithHTTPClient is a functional option that sets the HTTP client used for the WebSocket handshake and by
+// CheckPermissions.
+func WithHTTPClient(client *http.Client) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.HTTPClient = client
+	}
+}
+
+// WithStrictProtocol is a functional option that fails the connection on any protocol anomaly, such as an unknown tag
+// or a repeated success frame, instead of ignoring it.
+func WithStrictProtocol() func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.Strict = true
+	}
+}
+
+// WithFrameHandler is a functional option that registers a handler for frames with the given tag, such as
+// experimental relay features or private extensions understood by an emulator. The frames must be length-prefixed like
+// data frames. Tags handled by this package can't be registered.
+func WithFrameHandler(tag uint16, handler FrameHandler) func(*dialOptions) {
+	return func(d *dialOptions) {
+		if d.Handlers == nil {
+			d.Handlers = make(map[uint16]FrameHandler)
+		}
+		d.Handlers[tag] = handler
+	}
+}
+
+// WithAckTimeout is a functional option that closes the connection with ErrAckTimeout if more than threshold sent bytes
+// remain unacked for longer than timeout without the relay acking anything, so a half-dead relay can't hang the
+// connection forever.
+func WithAckTimeout(threshold uint64, timeout time.Duration) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.AckThreshold = threshold
+		d.AckTimeout = timeout
+	}
+}
+
+// WithHandshakeTimeout is a functional option that fails the dial with ErrHandshakeTimeout if the relay doesn't
+// confirm the connection within timeout of accepting the WebSocket. The dial context bounds the handshake either way.
+func WithHandshakeTimeout(timeout time.Duration) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.HandshakeTimeout = timeout
+	}
+}
+
+// WithLazyDial is a functional option that makes Dial return without connecting, leaving the handshake to the first
+// Read or Write, so connection pools and http.Transports can hold many idle connections cheaply. The dial context
+// doesn't bound the handshake then, only the read or write deadline and WithHandshakeTimeout do. See New.
+func WithLazyDial() func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.LazyDial = true
+	}
+}
+
+// WithDialRetry is a functional option that retries the dial up to retries times when the relay throttles the
+// handshake with status 429 or 503. Each retry waits as long as the relay asks with Retry-After, up to a minute, or
+// else for backoff, doubling every time.
+func WithDialRetry(retries int, backoff time.Duration) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.DialRetries = retries
+		d.RetryBackoff = backoff
+	}
+}
+
+// WithMeterProvider is a functional option that records OpenTelemetry metrics for the connection, such as bytes
+// transferred, frame counts and dial errors, using the given provider.
+func WithMeterProvider(provider metric.MeterProvider) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.MeterProvider = provider
+	}
+}
+
+// WithSessionIDAttribute is a functional option that adds the relay session ID to the connection's metrics as the
+// session_id attribute, to correlate them with the relay's audit logs. Every connection gets its own series, so it's
+// best left off unless the metrics backend copes with high cardinality.
+func WithSessionIDAttribute() func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.SessionIDAttribute = true
+	}
+}
+
+// WithThroughputCallback is a functional option that calls fn every interval with the bytes received and sent during
+// the interval, e.g. to display a transfer rate. It's called from its own goroutine until the connection is closed.
+func WithThroughputCallback(interval time.Duration, fn ThroughputFunc) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.ThroughputInterval = interval
+		d.ThroughputFunc = fn
+	}
+}
+
+// WithMaxLifetime is a functional option that moves the connection to a new relay session after lifetime, and again
+// every lifetime after that, so it isn't bound by limits on the age of a session or its token. The new session resumes
+// the same connection to the target, so the switch is invisible to the target and to Read and Write. Sent data is kept
+// until it's acked so that it can be replayed to the new session.
+func WithMaxLifetime(lifetime time.Duration) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.MaxLifetime = lifetime
+	}
+}
+
+// WithReconnectCallback is a functional option that calls fn whenever the relay is dialed again, either to retry a
+// throttled handshake with WithDialRetry or to move the connection to a new relay session with WithMaxLifetime, e.g. to
+// report that the tunnel is reconnecting. It's called synchronously, before the dial.
+func WithReconnectCallback(fn ReconnectFunc) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.ReconnectFunc = fn
+	}
+}
+
+// WithSessionLimiter is a functional option that queues the dial until the limiter has room for another session. The
+// session counts against the limit until the connection is closed.
+func WithSessionLimiter(limiter *SessionLimiter) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.SessionLimiter = limiter
+	}
+}
+
+// WithProjectLimiter is a functional option that queues the dial until the limiter has room for another session in
+// the target's project, like WithSessionLimiter. Both can be given, in which case the dial waits for the project first.
+// Queued dials give up when their context is done, so a deadline bounds how long they wait.
+func WithProjectLimiter(limiter *ProjectLimiter) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.ProjectLimiter = limiter
+	}
+}
+
+// WithCircuitBreaker is a functional option that fails the dial with ErrCircuitOpen without dialing while the breaker
+// is open, and records whether the dial succeeded.
+func WithCircuitBreaker(breaker *CircuitBreaker) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.CircuitBreaker = breaker
+	}
+}
+
+// WithTee is a functional option that copies the data read from the connection to in and the data written to it to
+// out, e.g. to debug a protocol or capture a session for compliance. Either writer may be nil. If limit is positive, at
+// most limit bytes are copied in each direction, so long-lived connections only have their start sampled. The writers
+// are called synchronously from Read and Write and must not retain the data. A writer that fails isn't written to
+// again, and its error doesn't affect the connection.
+func WithTee(in, out io.Writer, limit int64) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.TeeIn = in
+		d.TeeOut = out
+		d.TeeLimit = limit
+	}
+}
+
+// WithRateLimit is a functional option that caps the rate the connection sends data at to upload bytes per second, and
+// the rate it receives data at to download bytes per second. Zero leaves a direction unlimited. Every connection dialed
+// with the option gets its own limits.
+func WithRateLimit(upload, download int) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.UploadRate = upload
+		d.DownloadRate = download
+	}
+}
+
+// WithSharedRateLimit is a functional option that caps the rate data is sent and received at, like WithRateLimit, but
+// with limiters shared by every connection dialed with them, e.g. to cap all the clients of a listener together. Nil
+// leaves a direction unlimited. It can be combined with WithRateLimit, in which case data waits for both.
+func WithSharedRateLimit(upload, download *RateLimiter) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.SharedUpload = upload
+		d.SharedDownload = download
+	}
+}
+
+// WithTrace is a functional option that logs the WebSocket handshakes with the relay, with credentials redacted, and the
+// connection's progress through its sessions to logger at debug level, e.g. to attach to a bug report.
+func WithTrace(logger *slog.Logger) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.Trace = logger
+	}
+}
+
+// WithFrameTrace is a functional option that logs every frame sent and received to logger at debug level, with its tag
+// and length or ack. It's verbose, so it's best left off outside of debugging.
+func WithFrameTrace(logger *slog.Logger) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.FrameTrace = logger
+	}
+}
+
+// WithTransport is a functional option that opens channels to the relay with transport instead of WebSockets. The
+// options for the relay's TLS and WebSocket compression only apply to the WebSocket transport.
+func WithTransport(transport Transport) func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.Transport = transport
+	}
+}
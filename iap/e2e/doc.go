@@ -0,0 +1,18 @@
+// Package e2e tests the iap package against the production relay and a real instance. The tests are built with the
+// e2e tag and skip unless IAPC_E2E is set, so they only run when asked for:
+//
+//	IAPC_E2E=1 IAPC_PROJECT=my-project IAPC_INSTANCE=iapc-e2e IAPC_ZONE=europe-west2-a IAPC_PORT=7000 \
+//		go test -tags e2e -v -count=1 ./iap/e2e
+//
+// The instance, interface and port are read with iap.WithEnvironment, and credentials come from IAPC_TOKEN,
+// IAPC_CREDENTIALS_FILE or the application default credentials. IAPC_E2E_IDLE sets how long the idle test holds a
+// connection open, 2 minutes by default.
+//
+// The instance has to run an echo service on the port, reachable from the IAP range 35.235.240.0/20. One can be
+// provisioned with:
+//
+//	gcloud compute instances create iapc-e2e --zone europe-west2-a --machine-type e2-small --no-address \
+//		--image-family debian-12 --image-project debian-cloud \
+//		--metadata startup-script='apt-get install -y socat && socat TCP-LISTEN:7000,fork,reuseaddr EXEC:cat'
+//	gcloud compute firewall-rules create iapc-e2e --network default --source-ranges 35.235.240.0/20 --allow tcp:7000
+package e2e
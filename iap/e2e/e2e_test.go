@@ -0,0 +1,157 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	bulkSize        = 64 << 20
+	defaultIdleTime = 2 * time.Minute
+)
+
+func dial(t *testing.T, opts ...iap.DialOption) *iap.Conn {
+	t.Helper()
+
+	if os.Getenv("IAPC_E2E") == "" {
+		t.Skip("IAPC_E2E not set")
+	}
+
+	opts = append([]iap.DialOption{iap.WithEnvironment()}, opts...)
+	if os.Getenv("IAPC_TOKEN") == "" && os.Getenv("IAPC_CREDENTIALS_FILE") == "" {
+		opts = append(opts, iap.WithDefaultCredentials())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	conn, err := iap.Dial(ctx, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func echo(t *testing.T, conn *iap.Conn, payload string) {
+	t.Helper()
+
+	_, err := conn.Write([]byte(payload))
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(buf))
+}
+
+// transfer sends size random bytes through the echo service while reading them back, and checks they arrive intact.
+func transfer(t *testing.T, conn *iap.Conn, size int64) {
+	t.Helper()
+
+	sent := sha256.New()
+	received := sha256.New()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	var readErr error
+	go func() {
+		defer wg.Done()
+		_, readErr = io.CopyN(received, conn, size)
+	}()
+
+	_, err := io.CopyN(io.MultiWriter(conn, sent), rand.Reader, size)
+	require.NoError(t, err)
+
+	wg.Wait()
+	require.NoError(t, readErr)
+	assert.Equal(t, sent.Sum(nil), received.Sum(nil))
+}
+
+func TestDial(t *testing.T) {
+	conn := dial(t)
+
+	assert.True(t, conn.Connected())
+	assert.NotEmpty(t, conn.SessionID())
+
+	echo(t, conn, "hello")
+}
+
+func TestBulkTransfer(t *testing.T) {
+	conn := dial(t)
+
+	start := time.Now()
+	transfer(t, conn, bulkSize)
+
+	t.Logf("echoed %v MiB in %v", bulkSize>>20, time.Since(start))
+}
+
+func TestIdle(t *testing.T) {
+	idle := defaultIdleTime
+	if value := os.Getenv("IAPC_E2E_IDLE"); value != "" {
+		var err error
+		idle, err = time.ParseDuration(value)
+		require.NoError(t, err)
+	}
+
+	conn := dial(t)
+	echo(t, conn, "before")
+
+	time.Sleep(idle)
+
+	assert.True(t, conn.Connected())
+	echo(t, conn, "after")
+}
+
+func TestReconnect(t *testing.T) {
+	var trace lockedBuffer
+
+	conn := dial(t,
+		iap.WithMaxLifetime(5*time.Second),
+		iap.WithTrace(slog.New(slog.NewTextHandler(&trace, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+	)
+
+	// keep data flowing across several moves to a new session
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		transfer(t, conn, 1<<20)
+	}
+
+	assert.GreaterOrEqual(t, strings.Count(trace.String(), "Resumed session"), 2)
+}
+
+// lockedBuffer is a bytes.Buffer which can be written to while it's being read.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,78 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// EndpointError is a failure to dial one of the relay endpoints given with WithEndpoints. When every endpoint fails,
+// Dial returns an *EndpointError for each joined with errors.Join.
+type EndpointError struct {
+	Endpoint string
+	Err      error
+}
+
+func (e *EndpointError) Error() string {
+	endpoint := e.Endpoint
+	if endpoint == "" {
+		endpoint = proxyHost
+	}
+	return fmt.Sprintf("relay endpoint %v: %v", endpoint, e.Err)
+}
+
+func (e *EndpointError) Unwrap() error {
+	return e.Err
+}
+
+// endpoints returns the relay endpoints to dial, in order.
+func (d *dialOptions) endpoints() []string {
+	if len(d.Endpoints) > 0 {
+		return d.Endpoints
+	}
+	return []string{d.Endpoint}
+}
+
+// fallBack reports whether a dial which failed with err goes on to the next endpoint. Abandoned dials don't, and
+// neither do rejections every endpoint would repeat, like 403 when the caller isn't authorized.
+func fallBack(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var handshakeErr *HandshakeError
+	if errors.As(err, &handshakeErr) {
+		return handshakeErr.Throttled() || handshakeErr.StatusCode >= 500
+	}
+	return true
+}
+
+// dialEndpoints dials a session on each relay endpoint in turn until one succeeds. It returns the options with
+// Endpoint set to the one which did, so the session is resumed there, or dopts if none did.
+func dialEndpoints(ctx context.Context, dopts *dialOptions) (*relaySession, *dialOptions, error) {
+	endpoints := dopts.endpoints()
+	var errs []error
+
+	for i, endpoint := range endpoints {
+		edopts := *dopts
+		edopts.Endpoint, edopts.Endpoints = endpoint, nil
+
+		session, err := dialSessionRetrying(ctx, &edopts, connectURL(&edopts))
+		if err == nil {
+			return session, &edopts, nil
+		}
+		if len(endpoints) == 1 {
+			// without other endpoints to fall back to, the failure is returned as it is
+			return nil, dopts, err
+		}
+
+		errs = append(errs, &EndpointError{Endpoint: endpoint, Err: err})
+		if i == len(endpoints)-1 || !fallBack(ctx, err) {
+			break
+		}
+
+		newTracer(dopts).log("Relay endpoint failed, trying the next", "endpoint", relayHost(&edopts), "err", err)
+	}
+
+	return nil, dopts, errors.Join(errs...)
+}
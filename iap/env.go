@@ -0,0 +1,74 @@
+package iap
+
+import (
+	"os"
+
+	"golang.org/x/oauth2"
+)
+
+// envPrefix is the prefix of the environment variables read by WithEnvironment.
+const envPrefix = "IAPC_"
+
+// WithEnvironment is a functional option that fills in options from IAPC_* environment variables when they aren't
+// given by other options, which is convenient in containers and CI. The variables are IAPC_PROJECT, IAPC_PORT,
+// IAPC_INSTANCE, IAPC_ZONE and IAPC_INTERFACE for instances, IAPC_HOST, IAPC_REGION, IAPC_NETWORK and IAPC_DEST_GROUP
+// for hosts, and IAPC_TOKEN (an access token) or IAPC_CREDENTIALS_FILE for authorization. The environment is read
+// before the gcloud configuration when both are used.
+func WithEnvironment() func(*dialOptions) {
+	return func(d *dialOptions) {
+		d.Environment = true
+	}
+}
+
+func (d *dialOptions) applyEnvironment() {
+	setFromEnv(&d.Project, "PROJECT")
+	setFromEnv(&d.Port, "PORT")
+
+	if d.Instance == "" && d.Host == "" {
+		setFromEnv(&d.Instance, "INSTANCE")
+		if d.Instance == "" {
+			setFromEnv(&d.Host, "HOST")
+		}
+	}
+
+	if d.Instance != "" {
+		setFromEnv(&d.Zone, "ZONE")
+		setFromEnv(&d.Interface, "INTERFACE")
+	}
+	if d.Host != "" {
+		setFromEnv(&d.Region, "REGION")
+		setFromEnv(&d.Network, "NETWORK")
+		setFromEnv(&d.Group, "DEST_GROUP")
+	}
+
+	if d.TokenSource != nil || d.DefaultCredentials || d.CredentialsFile != "" || d.CredentialsJSON != nil {
+		return
+	}
+	d.applyEnvironmentCredentials()
+}
+
+// applyEnvironmentCredentials sets the credentials from IAPC_TOKEN, or failing that IAPC_CREDENTIALS_FILE.
+func (d *dialOptions) applyEnvironmentCredentials() {
+	if token := os.Getenv(envPrefix + "TOKEN"); token != "" {
+		var source oauth2.TokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+		d.TokenSource = &source
+		return
+	}
+	setFromEnv(&d.CredentialsFile, "CREDENTIALS_FILE")
+}
+
+// EnvironmentTokenSource returns a token source for the credentials WithEnvironment reads: the access token in
+// IAPC_TOKEN, or the credentials file named by IAPC_CREDENTIALS_FILE for the given scopes, or the cloud-platform scope
+// if none are given. Tokens from the file are cached like WithCredentialsFile. It returns nil if neither is set.
+func EnvironmentTokenSource(scopes ...string) (oauth2.TokenSource, error) {
+	d := &dialOptions{Scopes: scopes}
+	d.applyEnvironmentCredentials()
+	return d.tokenSource()
+}
+
+// setFromEnv sets an unset option from the IAPC_ environment variable with the given suffix.
+func setFromEnv(opt *string, name string) {
+	if *opt == "" {
+		*opt = os.Getenv(envPrefix + name)
+	}
+}
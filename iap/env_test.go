@@ -0,0 +1,63 @@
+package iap
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyEnvironment(t *testing.T) {
+	t.Setenv("IAPC_PROJECT", "env-project")
+	t.Setenv("IAPC_INSTANCE", "vm")
+	t.Setenv("IAPC_ZONE", "europe-west2-a")
+	t.Setenv("IAPC_PORT", "5432")
+	t.Setenv("IAPC_REGION", "europe-west2")
+	t.Setenv("IAPC_TOKEN", "secret")
+
+	dopts := &dialOptions{}
+	dopts.collectOpts([]DialOption{WithProject("explicit"), WithEnvironment()})
+	dopts.applyEnvironment()
+
+	assert.Equal(t, "explicit", dopts.Project)
+	assert.Equal(t, "vm", dopts.Instance)
+	assert.Equal(t, "europe-west2-a", dopts.Zone)
+	assert.Equal(t, "5432", dopts.Port)
+	assert.Empty(t, dopts.Region)
+
+	require.NotNil(t, dopts.TokenSource)
+	token, err := (*dopts.TokenSource).Token()
+	require.NoError(t, err)
+	assert.Equal(t, "secret", token.AccessToken)
+
+	// explicit credentials aren't overridden by the token
+	dopts = &dialOptions{}
+	dopts.collectOpts([]DialOption{WithHost("10.0.0.1", "", "default", "group"), WithDefaultCredentials()})
+	dopts.applyEnvironment()
+
+	assert.Empty(t, dopts.Instance)
+	assert.Equal(t, "europe-west2", dopts.Region)
+	assert.Nil(t, dopts.TokenSource)
+}
+
+func TestEnvironmentTokenSource(t *testing.T) {
+	t.Setenv("IAPC_TOKEN", "")
+	t.Setenv("IAPC_CREDENTIALS_FILE", "")
+
+	source, err := EnvironmentTokenSource()
+	require.NoError(t, err)
+	assert.Nil(t, source)
+
+	// the file is only used without a token
+	t.Setenv("IAPC_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	_, err = EnvironmentTokenSource()
+	assert.Error(t, err)
+
+	t.Setenv("IAPC_TOKEN", "secret")
+	source, err = EnvironmentTokenSource()
+	require.NoError(t, err)
+	token, err := source.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "secret", token.AccessToken)
+}
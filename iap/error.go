@@ -1,20 +1,220 @@
 package iap
 
-import "fmt"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
 
+const maxReasonLen = 200
+
+// htmlTags matches the tags, scripts and styles of an HTML page, leaving its text.
+var htmlTags = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)>|<[^>]*>`)
+
+// Errors returned by this package match one or more of these with errors.Is, so callers can decide whether to retry
+// without inspecting error types or text. For example, a *HandshakeError with status 403 matches both ErrHandshake and
+// ErrUnauthorized.
+var (
+	// ErrClosed is returned by Read and Write once Close has been called. It's net.ErrClosed.
+	ErrClosed = net.ErrClosed
+	// ErrHandshake is matched by every *HandshakeError.
+	ErrHandshake = errors.New("relay rejected the handshake")
+	// ErrUnauthorized is matched when credentials couldn't be found or used, or the relay refused them.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrTargetNotFound is matched when the relay couldn't find the target instance.
+	ErrTargetNotFound = errors.New("target not found")
+	// ErrTargetUnreachable is matched when the relay couldn't connect to the target port, usually because a firewall
+	// rule doesn't allow IAP's range.
+	ErrTargetUnreachable = errors.New("target unreachable")
+	// ErrThrottled is matched when the relay throttled the dial, which is worth retrying later.
+	ErrThrottled = errors.New("relay throttled the dial")
+	// ErrRelayUnreachable is matched when the relay couldn't be reached at all, such as when DNS or TCP fails.
+	ErrRelayUnreachable = errors.New("relay unreachable")
+	// ErrRelayClosed is matched by every *CloseError.
+	ErrRelayClosed = errors.New("relay closed the connection")
+	// ErrProtocol is matched by every *ProtocolError, and by close codes the relay sends when it sees a protocol
+	// violation.
+	ErrProtocol = errors.New("protocol error")
+	// ErrInvalidConfig is matched when the options or DialConfig can't be used.
+	ErrInvalidConfig = errors.New("invalid config")
+)
+
+// ErrAckTimeout is returned when the relay stops acking sent data. See WithAckTimeout.
+var ErrAckTimeout = errors.New("timed out waiting for ack")
+
+// ErrHandshakeTimeout is returned by Dial when the relay accepts the WebSocket but doesn't confirm the connection
+// before the dial context's deadline or the handshake timeout passes. See WithHandshakeTimeout.
+var ErrHandshakeTimeout = errors.New("timed out waiting for the relay to confirm the connection")
+
+// ErrAborted is returned by Read and Write once a connection has been torn down with Abort.
+var ErrAborted = errors.New("connection aborted")
+
+// closeCodeDescriptions are interpretations of the WebSocket close codes sent by the relay.
+var closeCodeDescriptions = map[int]string{
+	1000: "normal closure",
+	1001: "relay going away",
+	1006: "connection lost without a close frame",
+	1011: "internal relay error",
+	4000: "unknown relay error",
+	4001: "session ID unknown",
+	4002: "session ID already in use",
+	4003: "failed to connect to backend",
+	4004: "reauthentication required",
+	4005: "bad ack",
+	4006: "invalid ack",
+	4007: "invalid WebSocket opcode",
+	4008: "invalid tag",
+	4009: "failed to write to destination",
+	4010: "failed to read from destination",
+	4013: "invalid data",
+	4033: "not authorized",
+	4047: "instance lookup failed",
+	4051: "instance lookup failed on reconnect",
+}
+
+// markedError is an error which also matches a sentinel, without changing its text.
+type markedError struct {
+	err      error
+	sentinel error
+}
+
+// mark returns err so that it also matches sentinel with errors.Is. It returns nil if err is nil.
+func mark(err, sentinel error) error {
+	if err == nil {
+		return nil
+	}
+	return &markedError{err, sentinel}
+}
+
+func (e *markedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *markedError) Unwrap() []error {
+	return []error{e.err, e.sentinel}
+}
+
+// CloseError is returned when the relay closes the connection abnormally. Code and Reason are passed through verbatim
+// from the close frame.
 type CloseError struct {
 	Code   int
 	Reason string
 }
 
+// Description returns an interpretation of Code, or an empty string if the code isn't known.
+func (e *CloseError) Description() string {
+	return closeCodeDescriptions[e.Code]
+}
+
+// Is matches ErrRelayClosed, and ErrUnauthorized, ErrTargetNotFound, ErrTargetUnreachable or ErrProtocol depending
+// on Code.
+func (e *CloseError) Is(target error) bool {
+	switch target {
+	case ErrRelayClosed:
+		return true
+	case ErrUnauthorized:
+		return e.Code == 4004 || e.Code == 4033
+	case ErrTargetNotFound:
+		return e.Code == 4047 || e.Code == 4051
+	case ErrTargetUnreachable:
+		return e.Code == 4003
+	case ErrProtocol:
+		switch e.Code {
+		case 4005, 4006, 4007, 4008, 4013:
+			return true
+		}
+	}
+	return false
+}
+
 func (e *CloseError) Error() string {
-	return fmt.Sprintf("connection closed: code %v (%v)", e.Code, e.Reason)
+	msg := fmt.Sprintf("connection closed: code %v", e.Code)
+
+	if desc := e.Description(); desc != "" {
+		msg += fmt.Sprintf(" (%v)", desc)
+	}
+	if e.Reason != "" {
+		msg += fmt.Sprintf(": %q", e.Reason)
+	}
+
+	return msg
+}
+
+// HandshakeError is returned when the relay rejects the WebSocket handshake with an HTTP status, such as 403 when the
+// caller isn't authorized to tunnel to the target.
+type HandshakeError struct {
+	StatusCode int
+	// Body is the start of the response body, which usually explains the rejection.
+	Body string
+	// RetryAfter is how long the relay asked to wait before dialing again, from the Retry-After header of a throttled
+	// handshake. It's 0 if the relay didn't say.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *HandshakeError) Error() string {
+	if reason := e.Reason(); reason != "" {
+		return fmt.Sprintf("relay rejected connection with status %v: %v", e.StatusCode, reason)
+	}
+	return fmt.Sprintf("relay rejected connection with status %v: %v", e.StatusCode, e.Err)
+}
+
+// Reason returns the explanation in Body as a single line of text, taking the message out of a JSON error or the text
+// out of an HTML page. It's empty if there's no body.
+func (e *HandshakeError) Reason() string {
+	var jsonErr struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(e.Body), &jsonErr) == nil && jsonErr.Error.Message != "" {
+		return jsonErr.Error.Message
+	}
+
+	text := htmlTags.ReplaceAllString(e.Body, " ")
+	text = strings.Join(strings.Fields(html.UnescapeString(text)), " ")
+
+	if runes := []rune(text); len(runes) > maxReasonLen {
+		text = string(runes[:maxReasonLen]) + "..."
+	}
+	return text
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
 }
 
+// Is matches ErrHandshake, and ErrUnauthorized, ErrTargetNotFound or ErrThrottled depending on StatusCode.
+func (e *HandshakeError) Is(target error) bool {
+	switch target {
+	case ErrHandshake:
+		return true
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrTargetNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrThrottled:
+		return e.Throttled()
+	}
+	return false
+}
+
+// ProtocolError is returned when the relay breaks the relay protocol, such as with an unknown tag or a bad ack.
 type ProtocolError struct {
 	Err string
 }
 
+// Is matches ErrProtocol.
+func (e *ProtocolError) Is(target error) bool {
+	return target == ErrProtocol
+}
+
 func (e *ProtocolError) Error() string {
 	return fmt.Sprintf("protocol error: %v", e.Err)
 }
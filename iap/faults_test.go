@@ -0,0 +1,738 @@
+package iap_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+func echo(t *testing.T, conn *iap.Conn, payload string) {
+	t.Helper()
+
+	_, err := conn.Write([]byte(payload))
+	require.NoError(t, err)
+
+	buf := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(buf))
+}
+
+func TestFragmentedFrames(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.FragmentSize = 3
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	echo(t, conn, "fragmented across many messages")
+	assert.Equal(t, "iaptest-1", conn.SessionID())
+}
+
+func TestUnknownTag(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.BogusFrame = []byte{0x0, 0x99, 0x0, 0x0, 0x0, 0x3, 'x', 'y', 'z'}
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+	echo(t, conn, "world")
+}
+
+func TestUnknownTagFragmented(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.BogusFrame = []byte{0x0, 0x99, 0x0, 0x0, 0x0, 0x3, 'x', 'y', 'z'}
+	server.Faults.FragmentSize = 1
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+}
+
+func TestUnknownTagFixedSize(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	// reconnect success ack carries an 8 byte ack with no length
+	server.Faults.BogusFrame = []byte{0x0, 0x2, 0, 0, 0, 0, 0, 0, 0, 0}
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+}
+
+func TestUnknownTagOversized(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.BogusFrame = []byte{0x0, 0x99, 0xff, 0xff, 0xff, 0xff}
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	_, err = conn.Read(make([]byte, 5))
+
+	var protocolErr *iap.ProtocolError
+	assert.True(t, errors.As(err, &protocolErr), err)
+}
+
+func TestDelayedAcks(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.AckDelay = 50 * time.Millisecond
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+
+	assert.Eventually(t, func() bool {
+		return conn.Sent() == 5
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDroppedAcks(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.DropFrame = func(tag uint16, n int) bool {
+		return tag == 0x7
+	}
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+	assert.Zero(t, conn.Sent())
+}
+
+func TestAckAheadOfSent(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Handler = func(r io.Reader, w io.Writer) {
+		w.Write([]byte("hello"))
+		io.Copy(io.Discard, r)
+	}
+	// acks more than the client will ever have sent
+	server.Faults.BogusFrame = []byte{0x0, 0x7, 0, 0, 0, 0, 0, 0, 0x10, 0}
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	_, err := io.ReadAll(conn)
+	var protocolErr *iap.ProtocolError
+	assert.True(t, errors.As(err, &protocolErr), err)
+}
+
+func TestAckTimeout(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.DropFrame = func(tag uint16, n int) bool {
+		return tag == iap.TagAck
+	}
+
+	conn, err := iap.Dial(context.Background(), append(server.DialOptions(), iap.WithAckTimeout(0, 50*time.Millisecond))...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, iap.ErrAckTimeout)
+
+	_, err = conn.Write([]byte("hello"))
+	assert.Error(t, err)
+}
+
+func TestAckTimeoutDelayedAcks(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.AckDelay = 20 * time.Millisecond
+
+	conn, err := iap.Dial(context.Background(), append(server.DialOptions(), iap.WithAckTimeout(0, time.Second))...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+
+	assert.Eventually(t, func() bool {
+		return conn.Sent() == 5
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCloseStatus(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.CloseAfter = 1
+	server.Faults.CloseStatus = 4003
+	server.Faults.CloseReason = "failed to connect to backend"
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+
+	_, err := conn.Read(make([]byte, 1))
+
+	var closeErr *iap.CloseError
+	require.True(t, errors.As(err, &closeErr), err)
+	assert.Equal(t, 4003, closeErr.Code)
+	assert.Equal(t, "failed to connect to backend", closeErr.Reason)
+	assert.Equal(t, "failed to connect to backend", closeErr.Description())
+	assert.Equal(t, `connection closed: code 4003 (failed to connect to backend): "failed to connect to backend"`, closeErr.Error())
+	assert.ErrorIs(t, err, iap.ErrRelayClosed)
+	assert.ErrorIs(t, err, iap.ErrTargetUnreachable)
+	assert.NotErrorIs(t, err, iap.ErrTargetNotFound)
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.RejectStatus = http.StatusForbidden
+
+	_, err := iap.Dial(context.Background(), server.DialOptions()...)
+
+	var handshakeErr *iap.HandshakeError
+	require.True(t, errors.As(err, &handshakeErr), err)
+	assert.Equal(t, http.StatusForbidden, handshakeErr.StatusCode)
+	assert.Equal(t, "Forbidden\n", handshakeErr.Body)
+	assert.Equal(t, "relay rejected connection with status 403: Forbidden", handshakeErr.Error())
+	assert.ErrorIs(t, err, iap.ErrHandshake)
+	assert.ErrorIs(t, err, iap.ErrUnauthorized)
+	assert.NotErrorIs(t, err, iap.ErrThrottled)
+}
+
+func TestErrorSentinels(t *testing.T) {
+	tests := []struct {
+		err      error
+		sentinel error
+		matches  bool
+	}{
+		{&iap.HandshakeError{StatusCode: http.StatusUnauthorized}, iap.ErrUnauthorized, true},
+		{&iap.HandshakeError{StatusCode: http.StatusNotFound}, iap.ErrTargetNotFound, true},
+		{&iap.HandshakeError{StatusCode: http.StatusTooManyRequests}, iap.ErrThrottled, true},
+		{&iap.HandshakeError{StatusCode: http.StatusTooManyRequests}, iap.ErrUnauthorized, false},
+		{&iap.CloseError{Code: 4033}, iap.ErrUnauthorized, true},
+		{&iap.CloseError{Code: 4051}, iap.ErrTargetNotFound, true},
+		{&iap.CloseError{Code: 4008}, iap.ErrProtocol, true},
+		{&iap.CloseError{Code: 1011}, iap.ErrProtocol, false},
+		{&iap.ProtocolError{Err: "bad"}, iap.ErrProtocol, true},
+		{&iap.CredentialsError{}, iap.ErrUnauthorized, true},
+		{iap.DialConfig{}.Validate(), iap.ErrInvalidConfig, true},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.matches, errors.Is(tt.err, tt.sentinel), "%v is %v", tt.err, tt.sentinel)
+	}
+}
+
+func TestRelayUnreachable(t *testing.T) {
+	server := iaptest.NewPlaintextServer()
+	endpoint := server.URL
+	server.Close()
+
+	_, err := iap.Dial(context.Background(), iap.WithEndpoint("ws://"+strings.TrimPrefix(endpoint, "http://")), iap.WithInstance("prod-1", "europe-west2-a", "nic0"))
+	assert.ErrorIs(t, err, iap.ErrRelayUnreachable)
+	assert.NotErrorIs(t, err, iap.ErrHandshake)
+}
+
+func TestHandshakeErrorReason(t *testing.T) {
+	tests := []struct {
+		body   string
+		reason string
+	}{
+		{"", ""},
+		{`{"error": {"code": 403, "message": "Permission denied for tunnel"}}`, "Permission denied for tunnel"},
+		{"<html><head><style>p { color: red; }</style><title>Error 400</title></head>\n<body><p>Bad &amp; <b>wrong</b> request</p></body></html>", "Error 400 Bad & wrong request"},
+		{strings.Repeat("a", 250), strings.Repeat("a", 200) + "..."},
+	}
+
+	for _, tt := range tests {
+		err := &iap.HandshakeError{StatusCode: http.StatusBadRequest, Body: tt.body}
+		assert.Equal(t, tt.reason, err.Reason())
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.RejectStatus = http.StatusTooManyRequests
+	server.Faults.RejectCount = 2
+
+	conn, err := iap.Dial(context.Background(), append(server.DialOptions(), iap.WithDialRetry(2, 10*time.Millisecond))...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+	assert.Len(t, server.Queries(), 3)
+}
+
+func TestDialRetryAfter(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.RejectStatus = http.StatusServiceUnavailable
+	server.Faults.RetryAfter = "1"
+
+	start := time.Now()
+	_, err := iap.Dial(context.Background(), append(server.DialOptions(), iap.WithDialRetry(1, time.Millisecond))...)
+
+	var handshakeErr *iap.HandshakeError
+	require.ErrorAs(t, err, &handshakeErr)
+	assert.Equal(t, time.Second, handshakeErr.RetryAfter)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	assert.Len(t, server.Queries(), 2)
+}
+
+func TestReconnectCallback(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.RejectStatus = http.StatusTooManyRequests
+	server.Faults.RejectCount = 1
+
+	var reasons []error
+	opts := append(server.DialOptions(),
+		iap.WithDialRetry(1, time.Millisecond),
+		iap.WithReconnectCallback(func(sessionID string, err error) {
+			// the first handshake hasn't been given a session
+			assert.Empty(t, sessionID)
+			reasons = append(reasons, err)
+		}),
+	)
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.Len(t, reasons, 1)
+	var handshakeErr *iap.HandshakeError
+	require.ErrorAs(t, reasons[0], &handshakeErr)
+	assert.Equal(t, http.StatusTooManyRequests, handshakeErr.StatusCode)
+}
+
+func TestDialRetryNotThrottled(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.RejectStatus = http.StatusForbidden
+
+	_, err := iap.Dial(context.Background(), append(server.DialOptions(), iap.WithDialRetry(3, time.Millisecond))...)
+	assert.Error(t, err)
+	assert.Len(t, server.Queries(), 1)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.SuccessDelay = 5 * time.Second
+
+	_, err := iap.Dial(context.Background(), append(server.DialOptions(), iap.WithHandshakeTimeout(100*time.Millisecond))...)
+	assert.ErrorIs(t, err, iap.ErrHandshakeTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err = iap.Dial(ctx, server.DialOptions()...)
+	assert.ErrorIs(t, err, iap.ErrHandshakeTimeout)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func dialStrict(t *testing.T, server *iaptest.Server) *iap.Conn {
+	t.Helper()
+
+	conn, err := iap.Dial(context.Background(), append(server.DialOptions(), iap.WithStrictProtocol())...)
+	require.NoError(t, err)
+
+	return conn
+}
+
+func TestStrictUnknownTag(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.BogusFrame = []byte{0x0, 0x99, 0x0, 0x0, 0x0, 0x3, 'x', 'y', 'z'}
+
+	conn := dialStrict(t, server)
+	defer conn.Close()
+
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	_, err = conn.Read(make([]byte, 5))
+
+	var protocolErr *iap.ProtocolError
+	require.True(t, errors.As(err, &protocolErr), err)
+	assert.Contains(t, protocolErr.Error(), "0x99")
+}
+
+func TestRepeatedSuccessFrame(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.BogusFrame = []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x5, 'o', 't', 'h', 'e', 'r'}
+
+	t.Run("lenient", func(t *testing.T) {
+		conn := dial(t, server)
+		defer conn.Close()
+
+		echo(t, conn, "hello")
+		assert.Equal(t, "iaptest-1", conn.SessionID())
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		conn := dialStrict(t, server)
+		defer conn.Close()
+
+		_, err := conn.Write([]byte("hello"))
+		require.NoError(t, err)
+
+		_, err = conn.Read(make([]byte, 5))
+
+		var protocolErr *iap.ProtocolError
+		assert.True(t, errors.As(err, &protocolErr), err)
+	})
+}
+
+func TestFrameHandler(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.BogusFrame = []byte{0x0, 0x99, 0x0, 0x0, 0x0, 0x3, 'x', 'y', 'z'}
+
+	bodies := make(chan string, 10)
+	handler := func(tag uint16, body []byte) error {
+		assert.Equal(t, uint16(0x99), tag)
+		bodies <- string(body)
+		return nil
+	}
+
+	opts := append(server.DialOptions(), iap.WithStrictProtocol(), iap.WithFrameHandler(0x99, handler))
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+	assert.Equal(t, "xyz", <-bodies)
+}
+
+func TestFrameHandlerReservedTag(t *testing.T) {
+	handler := func(tag uint16, body []byte) error {
+		return nil
+	}
+
+	_, err := iap.Dial(context.Background(), iap.WithFrameHandler(0x4, handler))
+	assert.ErrorContains(t, err, "reserved tag")
+}
+
+func wsEndpoint(server *iaptest.Server) string {
+	return "ws://" + strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestEndpointFallback(t *testing.T) {
+	regional := iaptest.NewPlaintextServer()
+	defer regional.Close()
+	regional.Faults.RejectStatus = http.StatusBadGateway
+
+	global := iaptest.NewPlaintextServer()
+	defer global.Close()
+
+	conn, err := iap.Dial(context.Background(), append(global.DialOptions(), iap.WithEndpoints(wsEndpoint(regional), wsEndpoint(global)))...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+
+	assert.Len(t, regional.Queries(), 1)
+	assert.Equal(t, strings.TrimPrefix(global.URL, "http://"), conn.LocalAddr().(*iap.RelayAddr).Endpoint)
+}
+
+func TestSingleEndpoint(t *testing.T) {
+	unused := iaptest.NewPlaintextServer()
+	defer unused.Close()
+
+	server := iaptest.NewPlaintextServer()
+	defer server.Close()
+
+	conn, err := iap.Dial(context.Background(), append(unused.DialOptions(), iap.WithEndpoints(wsEndpoint(server)))...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+
+	assert.Empty(t, unused.Queries())
+	assert.Len(t, server.Queries(), 1)
+}
+
+func TestEndpointFallbackFailures(t *testing.T) {
+	regional := iaptest.NewPlaintextServer()
+	defer regional.Close()
+	regional.Faults.RejectStatus = http.StatusServiceUnavailable
+
+	global := iaptest.NewPlaintextServer()
+	defer global.Close()
+	global.Faults.RejectStatus = http.StatusBadGateway
+
+	_, err := iap.Dial(context.Background(), append(global.DialOptions(), iap.WithEndpoints(wsEndpoint(regional), wsEndpoint(global)))...)
+	require.Error(t, err)
+
+	var errs []*iap.EndpointError
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var endpointErr *iap.EndpointError
+		require.ErrorAs(t, err, &endpointErr)
+		errs = append(errs, endpointErr)
+	}
+	require.Len(t, errs, 2)
+	assert.Equal(t, wsEndpoint(regional), errs[0].Endpoint)
+	assert.Equal(t, wsEndpoint(global), errs[1].Endpoint)
+
+	var handshakeErr *iap.HandshakeError
+	require.ErrorAs(t, errs[1], &handshakeErr)
+	assert.Equal(t, http.StatusBadGateway, handshakeErr.StatusCode)
+}
+
+func TestEndpointFallbackForbidden(t *testing.T) {
+	regional := iaptest.NewPlaintextServer()
+	defer regional.Close()
+	regional.Faults.RejectStatus = http.StatusForbidden
+
+	global := iaptest.NewPlaintextServer()
+	defer global.Close()
+
+	_, err := iap.Dial(context.Background(), append(global.DialOptions(), iap.WithEndpoints(wsEndpoint(regional), wsEndpoint(global)))...)
+
+	var handshakeErr *iap.HandshakeError
+	require.ErrorAs(t, err, &handshakeErr)
+	assert.Equal(t, http.StatusForbidden, handshakeErr.StatusCode)
+	// the global endpoint would reject the caller too
+	assert.Empty(t, global.Queries())
+}
+
+func TestHandshake(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.RejectStatus = http.StatusServiceUnavailable
+	server.Faults.RejectCount = 1
+
+	limiter := iap.NewSessionLimiter(1)
+
+	conn, err := iap.New(append(server.DialOptions(), iap.WithSessionLimiter(limiter))...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// nothing is dialed until the handshake
+	assert.Empty(t, server.Queries())
+
+	err = conn.Handshake(context.Background())
+	assert.ErrorIs(t, err, iap.ErrThrottled)
+	assert.False(t, conn.Connected())
+	assert.Zero(t, limiter.Stats().Active)
+
+	// the caller can retry the handshake themselves
+	require.NoError(t, conn.Handshake(context.Background()))
+	assert.Equal(t, 1, limiter.Stats().Active)
+
+	echo(t, conn, "hello")
+
+	require.NoError(t, conn.Handshake(context.Background()))
+	assert.Len(t, server.Queries(), 2)
+
+	conn.Close()
+	assert.Zero(t, limiter.Stats().Active)
+}
+
+func TestHandshakeOnWrite(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	conn, err := iap.New(server.DialOptions()...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+	assert.Equal(t, "iaptest-1", conn.SessionID())
+}
+
+func TestHandshakeAfterClose(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	conn, err := iap.New(server.DialOptions()...)
+	require.NoError(t, err)
+	conn.Close()
+
+	assert.ErrorIs(t, conn.Handshake(context.Background()), iap.ErrClosed)
+	assert.Empty(t, server.Queries())
+}
+
+func TestHandshakeConcurrentAccess(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	opts := append(server.DialOptions(),
+		iap.WithTrace(logger),
+		iap.WithFrameTrace(logger),
+		iap.WithMeterProvider(sdkmetric.NewMeterProvider()),
+		iap.WithSessionIDAttribute(),
+	)
+
+	conn, err := iap.New(opts...)
+	require.NoError(t, err)
+
+	// the session's details can be asked for while the handshake sets them, which the race detector checks
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				_ = conn.SessionID()
+				_ = conn.LocalAddr().String()
+				_ = conn.Config()
+			}
+		}()
+	}
+
+	require.NoError(t, conn.Handshake(context.Background()))
+	echo(t, conn, "hello")
+	conn.Close()
+
+	close(done)
+	wg.Wait()
+
+	assert.Equal(t, "iaptest-1", conn.SessionID())
+}
+
+func TestCloseDuringLazyHandshake(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	limiter := iap.NewSessionLimiter(1)
+
+	// the connection is closed after the relay confirms it but before the handshake is done with
+	var conn *iap.Conn
+	trace := &iap.ClientTrace{
+		SuccessFrame: func(string) { conn.Close() },
+	}
+
+	conn, err := iap.New(append(server.DialOptions(), iap.WithSessionLimiter(limiter), iap.WithClientTrace(trace))...)
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte("hello"))
+	assert.ErrorIs(t, err, net.ErrClosed)
+	assert.False(t, conn.Connected())
+	assert.Zero(t, limiter.Active())
+}
+
+func TestLazyDial(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.RejectStatus = http.StatusForbidden
+	server.Faults.RejectCount = 1
+
+	conn, err := iap.Dial(context.Background(), append(server.DialOptions(), iap.WithLazyDial())...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Empty(t, server.Queries())
+
+	// the handshake fails with the first write, and is tried again by the next
+	_, err = conn.Write([]byte("hello"))
+	assert.ErrorIs(t, err, iap.ErrUnauthorized)
+
+	echo(t, conn, "hello")
+	assert.Len(t, server.Queries(), 2)
+}
+
+func TestLazyDialBounded(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	// the only session is taken, so lazy handshakes queue until they're given up on
+	limiter := iap.NewSessionLimiter(1)
+	opts := append(server.DialOptions(), iap.WithSessionLimiter(limiter))
+
+	first, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	defer first.Close()
+
+	conn, err := iap.Dial(context.Background(), append(opts, iap.WithLazyDial())...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = conn.Write([]byte("hello"))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// without a deadline, closing the connection gives up on the handshake
+	conn.SetDeadline(time.Time{})
+	read := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		read <- err
+	}()
+
+	assert.Eventually(t, func() bool {
+		return limiter.Waiting() == 1
+	}, time.Second, time.Millisecond)
+	conn.Close()
+
+	select {
+	case err := <-read:
+		assert.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read didn't return after Close")
+	}
+	assert.Equal(t, 1, limiter.Active())
+}
@@ -0,0 +1,108 @@
+package iap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Tags of the frames defined by the relay subprotocol.
+const (
+	TagSuccess             = subprotoTagSuccess
+	TagReconnectSuccessAck = subprotoTagReconnectSuccessAck
+	TagData                = subprotoTagData
+	TagAck                 = subprotoTagAck
+)
+
+// MaxFrameSize is the maximum length of a frame body.
+const MaxFrameSize = subprotoMaxFrameSize
+
+// Frame is a single subprotocol frame.
+type Frame struct {
+	Tag uint16
+	// Data is the body of success, data and other length-prefixed frames.
+	Data []byte
+	// Ack is the value of ack and reconnect success ack frames.
+	Ack uint64
+}
+
+// FrameReader reads subprotocol frames from a stream, such as a WebSocket wrapped with websocket.NetConn.
+// Frames with unknown tags are expected to be length-prefixed like data frames.
+type FrameReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+// NewFrameReader returns a FrameReader reading from r.
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{
+		r:   r,
+		buf: make([]byte, subprotoMaxFrameSize),
+	}
+}
+
+// ReadFrame reads the next frame. The returned Data is only valid until the next call to ReadFrame.
+// A frame longer than MaxFrameSize is returned as a *ProtocolError.
+func (fr *FrameReader) ReadFrame() (Frame, error) {
+	var header [8]byte
+
+	if _, err := io.ReadFull(fr.r, header[:2]); err != nil {
+		return Frame{}, err
+	}
+	frame := Frame{Tag: binary.BigEndian.Uint16(header[:2])}
+
+	if size, ok := subprotoFixedFrameSizes[frame.Tag]; ok {
+		if _, err := io.ReadFull(fr.r, header[:size]); err != nil {
+			return Frame{}, err
+		}
+		frame.Ack = binary.BigEndian.Uint64(header[:size])
+		return frame, nil
+	}
+
+	if _, err := io.ReadFull(fr.r, header[:4]); err != nil {
+		return Frame{}, err
+	}
+	len := binary.BigEndian.Uint32(header[:4])
+
+	if len > subprotoMaxFrameSize {
+		return Frame{}, &ProtocolError{fmt.Sprintf("len of frame with tag %#x exceeds subprotocol max frame size", frame.Tag)}
+	}
+
+	frame.Data = fr.buf[:len]
+	if _, err := io.ReadFull(fr.r, frame.Data); err != nil {
+		return Frame{}, err
+	}
+
+	return frame, nil
+}
+
+// FrameWriter writes subprotocol frames to a stream. Each frame is written with a single call to Write, so every frame
+// is sent in its own message when writing to a WebSocket wrapped with websocket.NetConn.
+type FrameWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewFrameWriter returns a FrameWriter writing to w.
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// WriteFrame writes a frame. Ack frames are written with their Ack value, anything else with its Data.
+func (fw *FrameWriter) WriteFrame(frame Frame) error {
+	fw.buf = binary.BigEndian.AppendUint16(fw.buf[:0], frame.Tag)
+
+	if size, ok := subprotoFixedFrameSizes[frame.Tag]; ok {
+		fw.buf = binary.BigEndian.AppendUint64(fw.buf, frame.Ack)[:2+size]
+	} else {
+		if len(frame.Data) > subprotoMaxFrameSize {
+			return &ProtocolError{"len exceeds subprotocol max frame size"}
+		}
+
+		fw.buf = binary.BigEndian.AppendUint32(fw.buf, uint32(len(frame.Data)))
+		fw.buf = append(fw.buf, frame.Data...)
+	}
+
+	_, err := fw.w.Write(fw.buf)
+	return err
+}
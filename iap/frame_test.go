@@ -0,0 +1,47 @@
+package iap_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []iap.Frame{
+		{Tag: iap.TagSuccess, Data: []byte("session")},
+		{Tag: iap.TagData, Data: []byte("hello")},
+		{Tag: iap.TagAck, Ack: 42},
+		{Tag: iap.TagReconnectSuccessAck, Ack: 7},
+		{Tag: 0x99, Data: []byte{}},
+	}
+
+	var buf bytes.Buffer
+	fw := iap.NewFrameWriter(&buf)
+
+	for _, frame := range frames {
+		require.NoError(t, fw.WriteFrame(frame))
+	}
+
+	fr := iap.NewFrameReader(&buf)
+
+	for _, want := range frames {
+		got, err := fr.ReadFrame()
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := iap.NewFrameWriter(&buf).WriteFrame(iap.Frame{Tag: iap.TagData, Data: make([]byte, iap.MaxFrameSize+1)})
+	var protocolError *iap.ProtocolError
+	assert.ErrorAs(t, err, &protocolError)
+
+	buf.Write([]byte{0x00, 0x04, 0xff, 0xff, 0xff, 0xff})
+	_, err = iap.NewFrameReader(&buf).ReadFrame()
+	assert.ErrorAs(t, err, &protocolError)
+}
@@ -0,0 +1,138 @@
+package iap
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// GcloudConfig holds the properties of the active gcloud configuration that are useful as defaults.
+type GcloudConfig struct {
+	Project string
+	Zone    string
+	Region  string
+}
+
+// gcloudConfigDir returns the directory gcloud keeps its configuration and credentials in.
+func gcloudConfigDir() (string, error) {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return dir, nil
+	}
+
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "gcloud"), nil
+}
+
+// LoadGcloudConfig reads the active gcloud configuration, honouring the CLOUDSDK_ACTIVE_CONFIG_NAME,
+// CLOUDSDK_CORE_PROJECT, CLOUDSDK_COMPUTE_ZONE and CLOUDSDK_COMPUTE_REGION environment variables like gcloud does.
+// A missing configuration isn't an error, the properties are just left empty.
+func LoadGcloudConfig() (GcloudConfig, error) {
+	properties, err := readGcloudProperties()
+	if err != nil {
+		return GcloudConfig{}, err
+	}
+
+	property := func(section, name string) string {
+		if value := os.Getenv("CLOUDSDK_" + strings.ToUpper(section+"_"+name)); value != "" {
+			return value
+		}
+		return properties[section+"/"+name]
+	}
+
+	return GcloudConfig{
+		Project: property("core", "project"),
+		Zone:    property("compute", "zone"),
+		Region:  property("compute", "region"),
+	}, nil
+}
+
+// readGcloudProperties reads the properties of the active configuration, keyed by section/name.
+func readGcloudProperties() (map[string]string, error) {
+	dir, err := gcloudConfigDir()
+	if err != nil {
+		return nil, err
+	}
+
+	name := os.Getenv("CLOUDSDK_ACTIVE_CONFIG_NAME")
+	if name == "" {
+		active, err := os.ReadFile(filepath.Join(dir, "active_config"))
+		switch {
+		case err == nil:
+			name = strings.TrimSpace(string(active))
+		case !errors.Is(err, fs.ErrNotExist):
+			return nil, err
+		}
+	}
+	if name == "" {
+		name = "default"
+	}
+
+	file, err := os.Open(filepath.Join(dir, "configurations", "config_"+name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseGcloudProperties(file)
+}
+
+// parseGcloudProperties parses the INI format gcloud configurations are stored in.
+func parseGcloudProperties(r io.Reader) (map[string]string, error) {
+	properties := make(map[string]string)
+	section := ""
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "", strings.HasPrefix(line, "#"), strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		default:
+			name, value, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			properties[section+"/"+strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+
+	return properties, scanner.Err()
+}
+
+// applyGcloudDefaults fills in the project, and the zone or region of the target, from the gcloud configuration where
+// they weren't given.
+func (d *dialOptions) applyGcloudDefaults() error {
+	config, err := LoadGcloudConfig()
+	if err != nil {
+		return err
+	}
+
+	if d.Project == "" {
+		d.Project = config.Project
+	}
+	if d.Instance != "" && d.Zone == "" {
+		d.Zone = config.Zone
+	}
+	if d.Host != "" && d.Region == "" {
+		d.Region = config.Region
+	}
+
+	return nil
+}
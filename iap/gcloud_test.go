@@ -0,0 +1,76 @@
+package iap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeGcloudConfig(t *testing.T, active, config string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "configurations"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "active_config"), []byte(active+"\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "configurations", "config_"+active), []byte(config), 0o644))
+
+	t.Setenv("CLOUDSDK_CONFIG", dir)
+	t.Setenv("CLOUDSDK_ACTIVE_CONFIG_NAME", "")
+	t.Setenv("CLOUDSDK_CORE_PROJECT", "")
+	t.Setenv("CLOUDSDK_COMPUTE_ZONE", "")
+	t.Setenv("CLOUDSDK_COMPUTE_REGION", "")
+}
+
+const gcloudConfig = `[core]
+account = someone@example.com
+project = my-project
+
+[compute]
+zone = europe-west2-a
+region = europe-west2
+`
+
+func TestLoadGcloudConfig(t *testing.T) {
+	writeGcloudConfig(t, "work", gcloudConfig)
+
+	config, err := LoadGcloudConfig()
+	require.NoError(t, err)
+	assert.Equal(t, GcloudConfig{Project: "my-project", Zone: "europe-west2-a", Region: "europe-west2"}, config)
+
+	t.Setenv("CLOUDSDK_COMPUTE_ZONE", "us-central1-a")
+
+	config, err = LoadGcloudConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "us-central1-a", config.Zone)
+}
+
+func TestLoadGcloudConfigMissing(t *testing.T) {
+	writeGcloudConfig(t, "work", gcloudConfig)
+	t.Setenv("CLOUDSDK_ACTIVE_CONFIG_NAME", "other")
+
+	config, err := LoadGcloudConfig()
+	require.NoError(t, err)
+	assert.Zero(t, config)
+}
+
+func TestApplyGcloudDefaults(t *testing.T) {
+	writeGcloudConfig(t, "work", gcloudConfig)
+
+	dopts := &dialOptions{}
+	dopts.collectOpts([]DialOption{WithInstance("vm", "", "nic0"), WithGcloudDefaults()})
+	require.NoError(t, dopts.applyGcloudDefaults())
+
+	assert.Equal(t, "my-project", dopts.Project)
+	assert.Equal(t, "europe-west2-a", dopts.Zone)
+	assert.Empty(t, dopts.Region)
+
+	dopts = &dialOptions{}
+	dopts.collectOpts([]DialOption{WithProject("explicit"), WithHost("10.0.0.1", "", "default", "group")})
+	require.NoError(t, dopts.applyGcloudDefaults())
+
+	assert.Equal(t, "explicit", dopts.Project)
+	assert.Equal(t, "europe-west2", dopts.Region)
+}
@@ -11,56 +11,138 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/oauth2"
 	"nhooyr.io/websocket"
 )
 
 var _ net.Conn = (*Conn)(nil)
 
+// Subprotocol is the WebSocket subprotocol spoken by the relay.
+const Subprotocol = "relay.tunnel.cloudproxy.app"
+
 const (
-	proxySubproto = "relay.tunnel.cloudproxy.app"
-	proxyHost     = "tunnel.cloudproxy.app"
-	proxyPath     = "/v4/connect"
-	proxyOrigin   = "bot:iap-tunneler"
+	proxyHost          = "tunnel.cloudproxy.app"
+	proxyPath          = "/v4/connect"
+	proxyReconnectPath = "/v4/reconnect"
+	proxyOrigin        = "bot:iap-tunneler"
 )
 
 const (
-	subprotoMaxFrameSize        = 16384
-	subprotoTagSuccess   uint16 = 0x1
-	subprotoTagData      uint16 = 0x4
-	subprotoTagAck       uint16 = 0x7
+	subprotoMaxFrameSize                  = 16384
+	subprotoTagSuccess             uint16 = 0x1
+	subprotoTagReconnectSuccessAck uint16 = 0x2
+	subprotoTagData                uint16 = 0x4
+	subprotoTagAck                 uint16 = 0x7
 )
 
-func min[T int | uint](a, b T) T {
+// subprotoFixedFrameSizes are the body sizes of frames which don't carry a length. Frames with any other tag are
+// length-prefixed like success and data frames, which is how unknown tags are skipped. A frame with an unknown tag and
+// no length can't be told apart from the frames that follow it, so it will desynchronise the stream and usually fail
+// with a ProtocolError.
+var subprotoFixedFrameSizes = map[uint16]int{
+	subprotoTagReconnectSuccessAck: 8,
+	subprotoTagAck:                 8,
+}
+
+func min[T int | int64 | uint | uint64 | time.Duration](a, b T) T {
 	if a < b {
 		return a
 	}
 	return b
 }
 
-// copyNBuffer is like io.CopyN but stages through a given buffer like io.CopyBuffer.
-func copyNBuffer(w io.Writer, r io.Reader, n int64, buf []byte) (int64, error) {
-	return io.CopyBuffer(w, io.LimitReader(r, n), buf)
-}
-
+// Conn is a connection to a target through the IAP. It is safe for concurrent use.
+//
+// The connection is driven by a read loop, while Write frames data and writes it to the relay session directly from the
+// caller's goroutine and delayed acks and round trip time probes run off timers, so an idle connection costs a single
+// goroutine. State only touched by the read loop is left unsynchronised, state observed from outside it is atomic, and
+// teardown always goes through shutdown.
 type Conn struct {
-	conn      net.Conn
-	connected bool
-	sessionID []byte
-
-	recvNbAcked   uint64
-	recvNbUnacked uint64
-	recvBuf       []byte
-	recvReader    *io.PipeReader
-	recvWriter    *io.PipeWriter
-
-	sendNbAcked   uint64
-	sendNbUnacked uint64
-	sendNbCh      chan int
+	strict    bool
+	handlers  map[uint16]FrameHandler
+	metrics   *instruments
+	trace     *tracer
+	connected atomic.Bool
+	addr      *Addr
+
+	// serialises handshakes of a Conn made by New, which can be retried until one succeeds
+	handshakeMu sync.Mutex
+	handshook   atomic.Bool
+
+	// the current relay session, only replaced while holding both sessMu and writeMu
+	sessMu   sync.Mutex
+	session  *relaySession
+	recycled chan struct{}
+	// the options the session was dialed with and the session ID the relay gave it, guarded by sessMu since they're
+	// set by Handshake while other goroutines may be asking for them
+	dopts     *dialOptions
+	sessionID string
+
+	// serialises writes to the relay session
+	writeMu sync.Mutex
+
+	// The byte counters are totals since the connection started, which is what acks carry. Nb*Unacked count bytes
+	// received or sent, and Nb*Acked how many of those were acked. A resumed session restores the acked counts from
+	// the reconnect: recvNbAcked to the ack passed to the relay, and sendNbAcked to the relay's reconnect ack.
+
+	// owned by the read loop
+	readSession   *relaySession
+	recvSkip      uint64
+	receivedData  bool
+	recvNbUnacked atomic.Uint64
+	recvNbAcked   atomic.Uint64
+	recvReader    net.Conn
+	recvWriter    net.Conn
+
+	// serialises acks, which are sent by the read loop and by a timer for data left below the threshold, and guards
+	// ackBuf
+	ackMu      sync.Mutex
+	ackBuf     [10]byte
+	pacer      *ackPacer
+	ackTimer   *time.Timer
+	ackPending atomic.Bool
+
+	// pings the relay to measure the round trip time, and the bytes moved as of the last ping
+	rttTimer *time.Timer
+	rttMoved atomic.Uint64
+
+	// serialises calls to Write so their frames aren't interleaved, and guards sendBuf which frames are encoded into
+	sendMu        sync.Mutex
 	sendBuf       []byte
-	sendReader    *io.PipeReader
-	sendWriter    *io.PipeWriter
+	sendNbUnacked atomic.Uint64
+	sendNbAcked   atomic.Uint64
+
+	// the read deadline in Unix nanoseconds or 0 for none, which bounds a handshake performed by Read
+	readDeadline atomic.Int64
+
+	// the write deadline in Unix nanoseconds or 0 for none, and a timer failing a write still in progress when it passes
+	writeDeadline atomic.Int64
+	writeTimer    *time.Timer
+	writing       atomic.Bool
+
+	// copies of the data read from and written to the connection, nil unless requested with WithTee
+	teeIn  *tee
+	teeOut *tee
+
+	// rate limits for sent and received data, of the connection and shared with other connections, any of which may be nil
+	sendLimits []*RateLimiter
+	recvLimits []*RateLimiter
+
+	// sent data that hasn't been acked, kept to replay to a resumed session when resumable
+	resumable   bool
+	replayMu    sync.Mutex
+	replay      []byte
+	replayStart uint64
+
+	closeOnce sync.Once
+	err       error
+	done      chan struct{}
 }
 
 func connectURL(dopts *dialOptions) string {
@@ -82,297 +164,958 @@ func connectURL(dopts *dialOptions) string {
 		}
 	}
 
+	return relayURL(dopts, proxyPath, query)
+}
+
+// reconnectURL returns the URL to resume the session sid, having received ack bytes from it.
+func reconnectURL(dopts *dialOptions, sid string, ack uint64) string {
+	query := url.Values{
+		"sid": []string{sid},
+		"ack": []string{fmt.Sprint(ack)},
+	}
+
+	if dopts.Zone != "" {
+		query.Set("zone", dopts.Zone)
+	}
+	if dopts.Region != "" {
+		query.Set("region", dopts.Region)
+	}
+
+	return relayURL(dopts, proxyReconnectPath, query)
+}
+
+// relayEndpoint returns the scheme and host of the relay, which is wss unless the endpoint is written as ws://host for
+// a plaintext emulator.
+func relayEndpoint(dopts *dialOptions) (scheme, host string) {
+	if dopts.Endpoint == "" {
+		return "wss", proxyHost
+	}
+	return cutScheme(dopts.Endpoint, "wss", "ws")
+}
+
+func relayHost(dopts *dialOptions) string {
+	_, host := relayEndpoint(dopts)
+	return host
+}
+
+// cutScheme splits an endpoint written as host or scheme://host, where the scheme must be secure or plaintext. The
+// scheme defaults to secure.
+func cutScheme(endpoint, secure, plaintext string) (scheme, host string) {
+	for _, scheme := range []string{secure, plaintext} {
+		if host, ok := strings.CutPrefix(endpoint, scheme+"://"); ok {
+			return scheme, host
+		}
+	}
+	return secure, endpoint
+}
+
+func relayURL(dopts *dialOptions, path string, query url.Values) string {
+	scheme, host := relayEndpoint(dopts)
+
 	url := url.URL{
-		Scheme:   "wss",
-		Host:     proxyHost,
-		Path:     proxyPath,
+		Scheme:   scheme,
+		Host:     host,
+		Path:     path,
 		RawQuery: query.Encode(),
 	}
 
 	return url.String()
 }
 
-// Dial connects to the IAP proxy and returns a Conn or error if the connection fails.
-func Dial(ctx context.Context, opts ...DialOption) (*Conn, error) {
+// collectDialOptions applies opts, filling in the target from the environment and gcloud's configuration if asked to.
+func collectDialOptions(opts []DialOption) (*dialOptions, error) {
 	dopts := &dialOptions{}
 	dopts.collectOpts(opts)
 
+	if dopts.Environment {
+		dopts.applyEnvironment()
+	}
+	if dopts.GcloudDefaults {
+		if err := dopts.applyGcloudDefaults(); err != nil {
+			return nil, err
+		}
+	}
+
+	return dopts, nil
+}
+
+// Dial connects to the IAP proxy and returns a Conn or error if the connection fails. It's New followed by Handshake,
+// unless WithLazyDial defers the handshake to first use.
+func Dial(ctx context.Context, opts ...DialOption) (*Conn, error) {
+	c, err := New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if c.dopts.LazyDial {
+		c.dopts.traceContext(ctx)
+		return c, nil
+	}
+
+	if err := c.Handshake(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// New returns a Conn to the target described by opts without connecting it, so that many can be prepared up front and
+// connected when the caller chooses with Handshake. Read and Write perform the handshake if it hasn't been done, bounded
+// by their deadline and WithHandshakeTimeout, and abandoned if the Conn is closed.
+func New(opts ...DialOption) (*Conn, error) {
+	dopts, err := collectDialOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := dopts.checkHandlers(); err != nil {
+		return nil, err
+	}
+
+	metrics, err := newInstruments(dopts.MeterProvider)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newConn(nil, dopts)
+	c.metrics = metrics
+
+	return c, nil
+}
+
+// Handshake dials the relay and waits for it to confirm the connection. It does nothing if the connection has already
+// been confirmed. A failed handshake leaves the Conn as New returned it, so it can be retried, until Close is called.
+// Concurrent calls wait for the first to finish.
+func (c *Conn) Handshake(ctx context.Context) error {
+	if c.handshook.Load() {
+		return nil
+	}
+
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+
+	if c.handshook.Load() {
+		return nil
+	}
+	select {
+	case <-c.done:
+		return c.err
+	default:
+	}
+
+	c.dopts.traceContext(ctx)
+
+	if err := c.dopts.acquireSessions(ctx, c.metrics); err != nil {
+		c.metrics.dialError(err)
+		return err
+	}
+
+	trial, err := c.dopts.CircuitBreaker.allow()
+	if err != nil {
+		c.dopts.releaseSessions()
+		c.metrics.dialError(err)
+		return err
+	}
+
+	start := time.Now()
+
+	err = c.dial(ctx)
+	c.dopts.CircuitBreaker.record(ctx, trial, err)
+	if err != nil {
+		c.dopts.releaseSessions()
+		c.metrics.dialError(err)
+		return err
+	}
+
+	c.metrics.dialed(time.Since(start))
+
+	return nil
+}
+
+// NewConn runs the relay protocol over a WebSocket the caller dialed themselves, e.g. through a transport Dial doesn't
+// support or to a test fixture, and returns a Conn once the relay confirms the connection. The WebSocket must have
+// negotiated Subprotocol. Options that only concern dialing the relay, like credentials, endpoints and retries, have no
+// effect, and WithMaxLifetime isn't supported because the relay can't be dialed again. Session limiters are waited for
+// before the handshake, and the session is returned when the Conn is closed. The WebSocket is closed when the Conn is,
+// or if NewConn fails.
+func NewConn(ctx context.Context, ws *websocket.Conn, opts ...DialOption) (*Conn, error) {
+	dopts, err := collectDialOptions(opts)
+	if err == nil {
+		dopts.traceContext(ctx)
+		err = dopts.checkHandlers()
+	}
+	if err == nil && dopts.MaxLifetime > 0 {
+		err = mark(errors.New("WithMaxLifetime can't be used with NewConn"), ErrInvalidConfig)
+	}
+	if err == nil && ws.Subprotocol() != Subprotocol {
+		err = &ProtocolError{fmt.Sprintf("expected subprotocol %q but got %q", Subprotocol, ws.Subprotocol())}
+	}
+	if err != nil {
+		ws.CloseNow()
+		return nil, err
+	}
+
+	metrics, err := newInstruments(dopts.MeterProvider)
+	if err != nil {
+		ws.CloseNow()
+		return nil, err
+	}
+
+	if err := dopts.acquireSessions(ctx, metrics); err != nil {
+		ws.CloseNow()
+		return nil, err
+	}
+
+	c := newConn(newRelaySession(newWSChannel(ws)), dopts)
+	c.metrics = metrics
+
+	if err := c.connect(ctx); err != nil {
+		c.shutdown(err)
+		dopts.releaseSessions()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (d *dialOptions) checkHandlers() error {
+	for tag := range d.Handlers {
+		if subprotoReservedTag(tag) {
+			return mark(fmt.Errorf("can't register frame handler for reserved tag %#x", tag), ErrInvalidConfig)
+		}
+	}
+	return nil
+}
+
+// dial dials a relay session and performs the handshake on it. If either fails, the session is closed and the Conn is
+// left ready for another attempt.
+func (c *Conn) dial(ctx context.Context) error {
+	session, dopts, err := dialEndpoints(ctx, c.dopts)
+	if err != nil {
+		return err
+	}
+
+	// nothing else uses the session until the handshake completes, except Close
+	base := c.options()
+	c.sessMu.Lock()
+	c.dopts, c.session, c.readSession = dopts, session, session
+	c.sessMu.Unlock()
+
+	select {
+	case <-c.done:
+		err = c.err
+	default:
+		err = c.connect(ctx)
+	}
+	if err != nil {
+		session.conn.Close()
+
+		c.sessMu.Lock()
+		c.dopts, c.session, c.readSession = base, nil, nil
+		c.sessionID = ""
+		c.sessMu.Unlock()
+
+		c.connected.Store(false)
+		c.trace.session("")
+		return err
+	}
+
+	return nil
+}
+
+// dialSession opens a channel to the relay at url with the transport.
+func dialSession(ctx context.Context, dopts *dialOptions, url string) (*relaySession, error) {
 	header := make(http.Header)
 	header.Set("Origin", proxyOrigin)
 
-	if dopts.TokenSource != nil {
-		token, err := (*dopts.TokenSource).Token()
+	tokenSource, err := dopts.tokenSource()
+	if err != nil {
+		return nil, mark(err, ErrUnauthorized)
+	}
+
+	if tokenSource != nil {
+		token, err := tokenSource.Token()
 		if err != nil {
+			// a token endpoint refusing the credentials isn't worth retrying, unlike failing to reach it
+			var retrieveErr *oauth2.RetrieveError
+			if errors.As(err, &retrieveErr) {
+				err = mark(err, ErrUnauthorized)
+			}
 			return nil, err
 		}
 
 		header.Set("Authorization", fmt.Sprintf("%v %v", token.Type(), token.AccessToken))
 	}
 
-	wsOptions := websocket.DialOptions{
-		HTTPHeader:      header,
-		Subprotocols:    []string{proxySubproto},
-		CompressionMode: websocket.CompressionDisabled,
-	}
-	if dopts.Compress {
-		wsOptions.CompressionMode = websocket.CompressionContextTakeover
-	}
+	trace := newTracer(dopts)
+	trace.dialing(url, header)
 
-	conn, _, err := websocket.Dial(ctx, connectURL(dopts), &wsOptions)
+	dopts.ClientTrace.dialStart(url)
+	conn, err := dopts.transport().Open(ctx, url, header)
+	dopts.ClientTrace.dialDone(err)
 	if err != nil {
+		// the relay answering with a status or an unpinned certificate is a rejection, anything else short of the dial
+		// being cancelled means it couldn't be reached
+		if !errors.Is(err, ErrHandshake) && !errors.Is(err, ErrPinMismatch) && ctx.Err() == nil {
+			err = mark(err, ErrRelayUnreachable)
+		}
 		return nil, err
 	}
 
-	netConn := websocket.NetConn(context.Background(), conn, websocket.MessageBinary)
+	return newRelaySession(conn), nil
+}
 
-	recvReader, recvWriter := io.Pipe()
-	sendReader, sendWriter := io.Pipe()
+func newConn(session *relaySession, dopts *dialOptions) *Conn {
+	// a net.Pipe rather than an io.Pipe for its read deadlines
+	recvReader, recvWriter := net.Pipe()
 
 	c := &Conn{
-		conn: netConn,
+		dopts:    dopts,
+		addr:     targetAddr(dopts),
+		strict:   dopts.Strict,
+		trace:    newTracer(dopts),
+		handlers: dopts.Handlers,
+		session:  session,
+
+		readSession: session,
+		recvReader:  recvReader,
+		recvWriter:  recvWriter,
+
+		sendBuf: make([]byte, 0, 6+subprotoMaxFrameSize),
 
-		recvBuf:    make([]byte, subprotoMaxFrameSize),
-		recvReader: recvReader,
-		recvWriter: recvWriter,
+		pacer: newAckPacer(),
 
-		sendNbCh:   make(chan int),
-		sendBuf:    make([]byte, subprotoMaxFrameSize),
-		sendReader: sendReader,
-		sendWriter: sendWriter,
+		resumable: dopts.MaxLifetime > 0,
+
+		teeIn:  newTee(dopts.TeeIn, dopts.TeeLimit),
+		teeOut: newTee(dopts.TeeOut, dopts.TeeLimit),
+
+		sendLimits: []*RateLimiter{newRateLimiter(dopts.UploadRate), dopts.SharedUpload},
+		recvLimits: []*RateLimiter{newRateLimiter(dopts.DownloadRate), dopts.SharedDownload},
+
+		done: make(chan struct{}),
 	}
 
+	c.writeTimer = time.AfterFunc(time.Hour, c.writeDeadlinePassed)
+	c.writeTimer.Stop()
+	c.ackTimer = time.AfterFunc(time.Hour, c.delayedAck)
+	c.ackTimer.Stop()
+	c.rttTimer = time.AfterFunc(time.Hour, c.measureRTT)
+	c.rttTimer.Stop()
+
+	return c
+}
+
+// connect performs the handshake and starts the read loop. The caller closes the session if it fails.
+func (c *Conn) connect(ctx context.Context) error {
+	if err := c.handshake(ctx); err != nil {
+		return err
+	}
+
+	// teardown only releases the sessions of a handshook connection, so a Close racing the handshake must either see
+	// it marked or leave the caller to release them
+	c.sessMu.Lock()
+	select {
+	case <-c.done:
+		c.sessMu.Unlock()
+		return c.err
+	default:
+	}
+	c.handshook.Store(true)
+	c.sessMu.Unlock()
+
 	go c.read()
-	go c.write()
+	c.rttTimer.Reset(0)
 
-	return c, nil
+	if c.dopts.AckTimeout > 0 {
+		go c.watchdog(c.dopts.AckThreshold, c.dopts.AckTimeout)
+	}
+	if c.dopts.ThroughputFunc != nil && c.dopts.ThroughputInterval > 0 {
+		go c.reportThroughput(c.dopts.ThroughputInterval, c.dopts.ThroughputFunc)
+	}
+	if c.dopts.MaxLifetime > 0 {
+		go c.recycleEvery(c.dopts.MaxLifetime)
+	}
+
+	return nil
+}
+
+// handshake reads frames until the relay confirms the connection with a success frame, giving up when the context is
+// done or the handshake timeout passes. It runs before the read loop is started.
+func (c *Conn) handshake(ctx context.Context) error {
+	if c.dopts.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.dopts.HandshakeTimeout)
+		defer cancel()
+	}
+
+	// the session is closed by connect after a failed handshake anyway, so closing it early just interrupts the read
+	stop := context.AfterFunc(ctx, c.session.abort)
+	defer stop()
+
+	for !c.connected.Load() {
+		if err := c.readFrame(); err != nil {
+			if ctx.Err() != nil {
+				return handshakeContextError(ctx)
+			}
+			return wrapCloseError(err)
+		}
+	}
+
+	if !stop() && ctx.Err() != nil {
+		// the session was aborted just as the success frame arrived
+		return handshakeContextError(ctx)
+	}
+	return nil
 }
 
-// LocalAddr returns the local network address.
+// handshakeContextError returns ErrHandshakeTimeout if the handshake ran out of time, or the context's error if it was
+// cancelled.
+func handshakeContextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrHandshakeTimeout, ctx.Err())
+	}
+	return ctx.Err()
+}
+
+// LocalAddr returns the relay session carrying the connection as a *RelayAddr.
 func (c *Conn) LocalAddr() net.Addr {
-	return c.conn.LocalAddr()
+	c.sessMu.Lock()
+	defer c.sessMu.Unlock()
+
+	return &RelayAddr{Endpoint: relayHost(c.dopts), SessionID: c.sessionID}
 }
 
-// RemoteAddr returns the remote network address.
+// RemoteAddr returns the target of the connection as an *Addr.
 func (c *Conn) RemoteAddr() net.Addr {
-	return c.conn.RemoteAddr()
+	return c.addr
 }
 
 // SetDeadline sets the read and write deadlines associated with the connection.
 func (c *Conn) SetDeadline(t time.Time) error {
-	return c.conn.SetDeadline(t)
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
 }
 
-// SetReadDeadline sets the deadline for future Read calls.
+// SetReadDeadline sets the deadline for pending and future Read calls. Reads past it fail with an error wrapping
+// os.ErrDeadlineExceeded, leaving the connection usable once the deadline is extended.
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	return c.conn.SetReadDeadline(t)
+	if t.IsZero() {
+		c.readDeadline.Store(0)
+	} else {
+		c.readDeadline.Store(t.UnixNano())
+	}
+	return c.recvReader.SetReadDeadline(t)
 }
 
-// SetWriteDeadline sets the deadline for future Write calls.
+// SetWriteDeadline sets the deadline for pending and future Write calls. Writes started past it fail with an error
+// wrapping os.ErrDeadlineExceeded, leaving the connection usable once the deadline is extended. A write still blocked
+// when it passes fails the connection with that error though, since the relay session can't be left partway through a
+// frame.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	return c.conn.SetWriteDeadline(t)
+	if t.IsZero() {
+		c.writeDeadline.Store(0)
+		c.writeTimer.Stop()
+		return nil
+	}
+
+	c.writeDeadline.Store(t.UnixNano())
+	c.writeTimer.Reset(max(time.Until(t), 1))
+	return nil
 }
 
-// Close closes the connection.
+// writeDeadlinePassed fails a write still in progress when the write deadline passes.
+func (c *Conn) writeDeadlinePassed() {
+	if c.writing.Load() {
+		c.shutdown(os.ErrDeadlineExceeded)
+	}
+}
+
+// Close closes the connection, waiting up to 10 seconds for the relay to acknowledge. Pending calls to Read and Write
+// are unblocked straight away, and they and future calls return net.ErrClosed. It is safe to call more than once.
 func (c *Conn) Close() error {
-	close(c.sendNbCh)
-	return c.conn.Close()
+	c.shutdown(net.ErrClosed)
+	return nil
+}
+
+// Abort tears down the connection immediately, without flushing data or a close handshake with the relay. Pending and
+// future calls to Read and Write return ErrAborted. It is safe to call more than once, and after Close.
+func (c *Conn) Abort() {
+	c.teardown(ErrAborted)
+	if session := c.currentSession(); session != nil {
+		session.abort()
+	}
 }
 
-// Read reads data from the connection.
+// Read reads data from the connection. Errors other than io.EOF are returned as a *net.OpError.
+//
+// Once the relay closes the connection, whether with a normal closure or by going away, Read returns io.EOF after the
+// data received before it, and keeps returning io.EOF even after Close. Otherwise, once Close is called, Read returns
+// net.ErrClosed, like other net.Conns.
 func (c *Conn) Read(buf []byte) (n int, err error) {
-	return c.recvReader.Read(buf)
+	if err := c.lazyHandshake(c.readDeadline.Load()); err != nil {
+		return 0, c.opError("read", err)
+	}
+
+	n, err = c.recvReader.Read(buf)
+	c.teeIn.copy(buf[:n])
+	if err == io.EOF {
+		// the pipe is only closed once the connection is torn down
+		err = c.err
+	}
+	return n, c.opError("read", err)
 }
 
-// Write writes data to the connection.
+// Write writes data to the connection. Errors are returned as a *net.OpError. Once Close is called, pending and future
+// writes return net.ErrClosed rather than the error the relay session failed with.
 func (c *Conn) Write(buf []byte) (n int, err error) {
-	c.sendNbCh <- len(buf)
-	return c.sendWriter.Write(buf)
+	if err := c.lazyHandshake(c.writeDeadline.Load()); err != nil {
+		return 0, c.opError("write", err)
+	}
+
+	n, err = c.send(buf)
+	c.teeOut.copy(buf[:n])
+	return n, c.opError("write", err)
+}
+
+// lazyHandshake performs the handshake for Read or Write if it hasn't been done, giving up with os.ErrDeadlineExceeded
+// when the deadline passes, in Unix nanoseconds or 0 for none, or with the connection's error if it's closed.
+func (c *Conn) lazyHandshake(deadline int64) error {
+	if c.handshook.Load() {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if deadline != 0 {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithDeadline(ctx, time.Unix(0, deadline))
+		defer cancelDeadline()
+	}
+
+	// closing the connection abandons the handshake wherever it is, even queued for a session
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := c.Handshake(ctx)
+	if err == nil {
+		return nil
+	}
+
+	select {
+	case <-c.done:
+		return c.err
+	default:
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+// send writes buf to the relay session in frames of at most the maximum frame size. A failed write shuts the
+// connection down.
+func (c *Conn) send(buf []byte) (n int, err error) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	for {
+		select {
+		case <-c.done:
+			return n, c.err
+		default:
+		}
+
+		if c.writeDeadlinePast() {
+			return n, os.ErrDeadlineExceeded
+		}
+
+		if len(buf) == 0 {
+			return n, nil
+		}
+
+		data := buf[:min(len(buf), subprotoMaxFrameSize)]
+		if err := c.waitRate(c.sendLimits, len(data), c.writeDeadline.Load()); err != nil {
+			return n, err
+		}
+		if err := c.sendFrame(data); err != nil {
+			return n, err
+		}
+
+		n += len(data)
+		buf = buf[len(data):]
+	}
+}
+
+// sendFrame writes a frame of data unless the write deadline has passed, marking the write as in progress so that
+// the deadline passing during it fails the connection. A failed write shuts the connection down.
+func (c *Conn) sendFrame(data []byte) error {
+	c.writing.Store(true)
+	defer c.writing.Store(false)
+
+	// checked again now the write is marked, as the deadline timer may have fired while waiting for the rate limits
+	if c.writeDeadlinePast() {
+		return os.ErrDeadlineExceeded
+	}
+
+	if err := c.writeFrame(data); err != nil {
+		c.shutdown(wrapCloseError(err))
+		return c.err
+	}
+	return nil
+}
+
+func (c *Conn) writeDeadlinePast() bool {
+	deadline := c.writeDeadline.Load()
+	return deadline != 0 && time.Now().UnixNano() >= deadline
+}
+
+// waitRate waits until n bytes may pass all of limits, returning the connection's error if it's torn down first.
+func (c *Conn) waitRate(limits []*RateLimiter, n int, deadline int64) error {
+	for _, limit := range limits {
+		if err := limit.wait(n, c.done, deadline); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return c.err
+			}
+			return err
+		}
+	}
+	return nil
 }
 
 // Connected returns whether the connection is established.
 func (c *Conn) Connected() bool {
-	return c.connected
+	return c.connected.Load()
 }
 
 // SessionID returns the session ID of the connection. This is only valid after the connection is established.
 func (c *Conn) SessionID() string {
-	return string(c.sessionID)
+	c.sessMu.Lock()
+	defer c.sessMu.Unlock()
+
+	return c.sessionID
 }
 
-// Sent returns the number of bytes sent and acked.
+// Sent returns the number of bytes sent and acked by the relay. Like the acks themselves, it counts from the start of
+// the connection, carrying on across the relay sessions it moves between.
 func (c *Conn) Sent() uint64 {
-	return c.sendNbAcked
+	return c.sendNbAcked.Load()
 }
 
-// Received returns the number of bytes received and acked.
+// Received returns the number of bytes received and acked to the relay, counting from the start of the connection like
+// Sent.
 func (c *Conn) Received() uint64 {
-	return c.recvNbAcked
+	return c.recvNbAcked.Load()
 }
 
-func (c *Conn) closeWriters(err error) {
-	c.sendWriter.CloseWithError(err)
-	c.recvWriter.CloseWithError(err)
+// shutdown tears down the connection exactly once, unblocking the read loop and any pending Read or Write with err,
+// and closes the relay session gracefully.
+func (c *Conn) shutdown(err error) {
+	if c.teardown(err) {
+		// a Conn made by New has no session until its handshake
+		if session := c.currentSession(); session != nil {
+			session.conn.Close()
+		}
+	}
 }
 
-func (c *Conn) readSuccessFrame(r io.Reader) error {
-	bytes := [4]byte{}
-	if _, err := r.Read(bytes[:]); err != nil {
-		return err
-	}
-	len := binary.BigEndian.Uint32(bytes[:])
+// teardown marks the connection closed and unblocks the read loop and any pending Read with err. It reports whether
+// this call did so, which is only true for the first.
+func (c *Conn) teardown(err error) (first bool) {
+	c.closeOnce.Do(func() {
+		first = true
+
+		c.err = err
+		c.connected.Store(false)
+		close(c.done)
+
+		c.trace.log("Connection closed", "err", err)
+
+		// close the pipe so pending and future reads return err
+		c.recvWriter.Close()
+		c.ackTimer.Stop()
+		c.rttTimer.Stop()
+
+		// a failed handshake releases its own sessions, and connect marks the handshake done under sessMu, so it's
+		// either seen here or connect fails
+		c.sessMu.Lock()
+		handshook, dopts := c.handshook.Load(), c.dopts
+		c.sessMu.Unlock()
+		if handshook {
+			dopts.releaseSessions()
+		}
+	})
+	return first
+}
 
-	if len > subprotoMaxFrameSize {
-		return &ProtocolError{"len exceeds subprotocol max data frame size"}
-	}
+// options returns the options the current session was dialed with.
+func (c *Conn) options() *dialOptions {
+	c.sessMu.Lock()
+	defer c.sessMu.Unlock()
 
-	c.sessionID = make([]byte, len)
-	if _, err := r.Read(c.sessionID); err != nil {
-		return err
-	}
+	return c.dopts
+}
 
-	c.connected = true
-	return nil
+func (c *Conn) currentSession() *relaySession {
+	c.sessMu.Lock()
+	defer c.sessMu.Unlock()
+
+	return c.session
+}
+
+func (c *Conn) readSuccessFrame(frame Frame) {
+	sid := string(frame.Data)
+
+	c.sessMu.Lock()
+	c.sessionID = sid
+	c.sessMu.Unlock()
+
+	c.connected.Store(true)
+	c.trace.session(sid)
+	if c.dopts.SessionIDAttribute {
+		c.metrics.session(sid)
+	}
+	c.trace.log("Connected")
+	c.dopts.ClientTrace.successFrame(sid)
 }
 
 func (c *Conn) writeAck(nb uint64) error {
-	// allocation fine, cold path
-	buf := make([]byte, 10)
+	// only called with ackMu held, which guards ackBuf
+	buf := c.ackBuf[:]
 
 	binary.BigEndian.PutUint16(buf[0:2], subprotoTagAck)
 	binary.BigEndian.PutUint64(buf[2:10], nb)
 
-	_, err := c.conn.Write(buf)
-	return err
-}
-
-func (c *Conn) readAckFrame(r io.Reader) error {
-	bytes := [8]byte{}
-	if _, err := r.Read(bytes[:]); err != nil {
+	if err := c.writeMessage(buf, nil); err != nil {
 		return err
 	}
 
+	c.metrics.frame(directionOut, subprotoTagAck)
+	c.trace.frame("out", subprotoTagAck, 0, nb)
+	return nil
+}
+
+func (c *Conn) readAckFrame(frame Frame) error {
 	// TODO: should we transmit?
 	// since it's over TCP this seems redundant
 
-	c.sendNbAcked = binary.BigEndian.Uint64(bytes[:])
+	if acked := c.sendNbAcked.Load(); frame.Ack < acked {
+		// a session being replaced can still deliver acks behind the reconnect ack its replacement started from
+		if c.currentSession() != c.readSession {
+			return nil
+		}
+		return &ProtocolError{fmt.Sprintf("ack %v is behind previous ack %v", frame.Ack, acked)}
+	}
+	if sent := c.sendNbUnacked.Load(); frame.Ack > sent {
+		return &ProtocolError{fmt.Sprintf("ack %v is ahead of %v bytes sent", frame.Ack, sent)}
+	}
+
+	c.sendNbAcked.Store(frame.Ack)
+	c.trimReplay(frame.Ack)
+	c.dopts.ClientTrace.ackReceived(frame.Ack)
+
 	return nil
 }
 
-func (c *Conn) readDataFrame(r io.Reader) error {
-	bytes := [4]byte{}
-	if _, err := r.Read(bytes[:]); err != nil {
-		return err
+func (c *Conn) readDataFrame(frame Frame) error {
+	data := frame.Data
+
+	if !c.receivedData {
+		c.receivedData = true
+		c.dopts.ClientTrace.firstDataFrame()
+	}
+
+	// drop data resent by a resumed session which was already read from the previous one
+	if c.recvSkip > 0 {
+		nb := min(c.recvSkip, uint64(len(data)))
+		data = data[nb:]
+		c.recvSkip -= nb
 	}
-	len := binary.BigEndian.Uint32(bytes[:])
 
-	if len > subprotoMaxFrameSize {
-		return &ProtocolError{"len exceeds subprotocol max data frame size"}
+	if err := c.waitRate(c.recvLimits, len(data), 0); err != nil {
+		return err
 	}
 
-	if _, err := copyNBuffer(c.recvWriter, r, int64(len), c.recvBuf); err != nil {
+	if _, err := c.recvWriter.Write(data); err != nil {
 		return err
 	}
 
-	c.recvNbUnacked += uint64(len)
+	c.recvNbUnacked.Add(uint64(len(data)))
+	c.metrics.received(len(data))
+
 	return nil
 }
 
 func (c *Conn) readFrame() error {
-	bytes := [2]byte{}
-	if _, err := c.conn.Read(bytes[:]); err != nil {
+	frame, err := c.readSession.frames.ReadFrame()
+	if err != nil {
 		return err
 	}
-	tag := binary.BigEndian.Uint16(bytes[:])
-
-	var err error
+	c.metrics.frame(directionIn, frame.Tag)
+	c.trace.frame("in", frame.Tag, len(frame.Data), frame.Ack)
 
-	switch tag {
+	switch frame.Tag {
 	case subprotoTagSuccess:
-		err = c.readSuccessFrame(c.conn)
+		if !c.connected.Load() {
+			c.readSuccessFrame(frame)
+			break
+		}
+
+		if c.strict {
+			return &ProtocolError{"unexpected success frame after connection was established"}
+		}
+		// the session ID can't change once the connection is established
 	default:
-		if !c.connected {
+		if !c.connected.Load() {
 			return &ProtocolError{"expected success frame but not did receive one"}
 		}
 
-		switch tag {
+		switch frame.Tag {
 		case subprotoTagAck:
-			err = c.readAckFrame(c.conn)
+			if err := c.readAckFrame(frame); err != nil {
+				return err
+			}
 		case subprotoTagData:
-			err = c.readDataFrame(c.conn)
-
-			// can the threshold be increased?
-			if c.recvNbUnacked-c.recvNbAcked > 2*subprotoMaxFrameSize {
-				if err := c.writeAck(c.recvNbUnacked); err != nil {
-					return err
-				}
-				c.recvNbAcked = c.recvNbUnacked
+			if err := c.readDataFrame(frame); err != nil {
+				return err
+			}
+
+			if err := c.ack(false); err != nil {
+				return err
 			}
+			c.delayAck()
 		default:
-			// unknown tags should be ignored
-			return nil
-		}
+			handler, ok := c.handlers[frame.Tag]
 
+			switch {
+			case ok:
+				return handler(frame.Tag, bytes.Clone(frame.Data))
+			case c.strict:
+				return &ProtocolError{fmt.Sprintf("unknown tag %#x", frame.Tag)}
+			}
+			// unknown tags are skipped so that new relay features don't break the connection
+		}
 	}
 
-	return err
+	return nil
 }
 
-func (c *Conn) writeFrame() error {
-	nb, ok := <-c.sendNbCh
-	if !ok {
-		// connection is closing
-		return io.EOF
+func subprotoReservedTag(tag uint16) bool {
+	switch tag {
+	case subprotoTagSuccess, subprotoTagReconnectSuccessAck, subprotoTagData, subprotoTagAck:
+		return true
 	}
+	return false
+}
 
-	for nb > 0 {
-		// clamp each write to max frame size
-		writeNb := min(nb, subprotoMaxFrameSize)
-		nb -= writeNb
+// writeFrame writes data, which must fit in a frame, to the relay session as a data frame. It's called with sendMu
+// held.
+func (c *Conn) writeFrame(data []byte) error {
+	frame := binary.BigEndian.AppendUint16(c.sendBuf[:0], subprotoTagData)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(data)))
+	frame = append(frame, data...)
 
-		var buf bytes.Buffer
+	if err := c.writeMessage(frame, frame[6:]); err != nil {
+		return err
+	}
 
-		binary.Write(&buf, binary.BigEndian, subprotoTagData)
-		binary.Write(&buf, binary.BigEndian, uint32(writeNb))
+	c.metrics.frame(directionOut, subprotoTagData)
+	c.metrics.sent(len(data))
+	c.trace.frame("out", subprotoTagData, len(data), 0)
 
-		if _, err := copyNBuffer(&buf, c.sendReader, int64(writeNb), c.sendBuf); err != nil {
-			return err
+	return nil
+}
+
+// watchdog fails the connection with ErrAckTimeout if more than threshold bytes stay unacked for timeout without any
+// ack progress. Progress is sampled, so the connection may outlive the timeout by a fraction of it.
+func (c *Conn) watchdog(threshold uint64, timeout time.Duration) {
+	ticker := time.NewTicker(max(timeout/4, time.Millisecond))
+	defer ticker.Stop()
+
+	var (
+		acked        = c.sendNbAcked.Load()
+		stalledSince time.Time
+	)
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-c.done:
+			return
 		}
 
-		writtenNb, err := c.conn.Write(buf.Bytes())
-		if err != nil {
-			return err
+		sent, nowAcked := c.sendNbUnacked.Load(), c.sendNbAcked.Load()
+
+		if nowAcked != acked || sent-nowAcked <= threshold {
+			acked = nowAcked
+			stalledSince = time.Time{}
+			continue
 		}
 
-		c.sendNbUnacked += uint64(writtenNb)
+		if stalledSince.IsZero() {
+			stalledSince = now
+		}
+		if now.Sub(stalledSince) >= timeout {
+			c.shutdown(ErrAckTimeout)
+			return
+		}
 	}
-
-	return nil
 }
 
-func (c *Conn) read() {
-	for {
-		if err := c.readFrame(); err != nil {
-			var closeError websocket.CloseError
-			if errors.As(err, &closeError) {
-				err = &CloseError{int(closeError.Code), closeError.Reason}
-			}
+// reportThroughput calls fn every interval with the number of bytes received and sent since the previous call.
+func (c *Conn) reportThroughput(interval time.Duration, fn ThroughputFunc) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-			c.closeWriters(err)
-			break
+	var received, sent uint64
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
 		}
+
+		nowReceived, nowSent := c.recvNbUnacked.Load(), c.sendNbUnacked.Load()
+		fn(c.SessionID(), nowReceived-received, nowSent-sent)
+		received, sent = nowReceived, nowSent
 	}
 }
 
-func (c *Conn) write() {
+func wrapCloseError(err error) error {
+	var closeError websocket.CloseError
+	if errors.As(err, &closeError) {
+		return &CloseError{int(closeError.Code), closeError.Reason}
+	}
+	return err
+}
+
+func (c *Conn) read() {
 	for {
-		if err := c.writeFrame(); err != nil {
-			var closeError websocket.CloseError
-			if errors.As(err, &closeError) {
-				err = &CloseError{int(closeError.Code), closeError.Reason}
+		err := c.readFrame()
+		if err == nil {
+			continue
+		}
+
+		var protocolErr *ProtocolError
+		if !errors.As(err, &protocolErr) {
+			if session := c.replacedSession(c.readSession); session != nil {
+				c.resumeReading(session)
+				continue
 			}
+		}
 
-			c.closeWriters(err)
-			break
+		if errors.Is(err, io.EOF) {
+			// the relay went away, which is the end of the stream to readers
+			err = io.EOF
 		}
+		c.shutdown(wrapCloseError(err))
+		break
 	}
 }
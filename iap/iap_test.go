@@ -1,9 +1,18 @@
 package iap
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestConnectURL(t *testing.T) {
@@ -24,3 +33,206 @@ func TestConnectURL(t *testing.T) {
 	assert.NotContains(t, url, "group=")
 	assert.NotContains(t, url, "port=")
 }
+
+func TestRelayURLScheme(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		prefix   string
+	}{
+		{"", "wss://" + proxyHost + "/"},
+		{"relay.example.com:8443", "wss://relay.example.com:8443/"},
+		{"wss://relay.example.com", "wss://relay.example.com/"},
+		{"ws://127.0.0.1:8080", "ws://127.0.0.1:8080/"},
+	}
+
+	for _, tt := range tests {
+		url := connectURL(&dialOptions{Endpoint: tt.endpoint})
+		assert.True(t, strings.HasPrefix(url, tt.prefix), url)
+	}
+}
+
+func FuzzConnectURL(f *testing.F) {
+	f.Add("zone", "region", "project", "22", "network", "nic0", "instance", "host", "group")
+	f.Add("", "", "", "", "", "", "", "", "")
+	f.Add("europe-west2-a", "", "my-project", "3389", "", "nic0", "bastion-ü", "", "")
+	f.Add("a&b=c", "?#", "%zz", "0", "+ +", "/", "インスタンス", "10.0.0.1", "g;h")
+
+	f.Fuzz(func(t *testing.T, zone, region, project, port, network, ninterface, instance, host, group string) {
+		dopts := &dialOptions{
+			Zone:      zone,
+			Region:    region,
+			Project:   project,
+			Port:      port,
+			Network:   network,
+			Interface: ninterface,
+			Instance:  instance,
+			Host:      host,
+			Group:     group,
+		}
+
+		u, err := url.Parse(connectURL(dopts))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, "wss", u.Scheme)
+		assert.Equal(t, proxyHost, u.Host)
+		assert.Equal(t, proxyPath, u.Path)
+
+		query, err := url.ParseQuery(u.RawQuery)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		expected := map[string]string{
+			"zone":      zone,
+			"region":    region,
+			"project":   project,
+			"port":      port,
+			"network":   network,
+			"interface": ninterface,
+			"instance":  instance,
+			"host":      host,
+			"group":     group,
+		}
+
+		for key, value := range expected {
+			if value == "" {
+				// empty options are omitted rather than sent blank
+				assert.NotContains(t, query, key)
+				continue
+			}
+			assert.Equal(t, []string{value}, query[key], key)
+		}
+
+		for key := range query {
+			assert.Contains(t, expected, key)
+		}
+	})
+}
+
+// discardConn is a net.Conn which discards everything written to it.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+func TestWriteFrameAllocs(t *testing.T) {
+	c := newConn(newRelaySession(discardConn{}), &dialOptions{})
+	data := make([]byte, subprotoMaxFrameSize)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		c.writeFrame(data)
+		c.writeAck(uint64(len(data)))
+	})
+	assert.Zero(t, allocs)
+}
+
+// failingConn is a net.Conn which reads from r and fails every write.
+type failingConn struct {
+	net.Conn
+	r io.Reader
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (c failingConn) Read(buf []byte) (int, error) {
+	return c.r.Read(buf)
+}
+
+func (failingConn) Write(buf []byte) (int, error) {
+	return 0, errWriteFailed
+}
+
+func (failingConn) Close() error {
+	return nil
+}
+
+func TestWriteFrameError(t *testing.T) {
+	c := newConn(newRelaySession(failingConn{}), &dialOptions{})
+	c.connected.Store(true)
+	c.handshook.Store(true)
+
+	_, err := c.Write([]byte("hello"))
+	assert.ErrorIs(t, err, errWriteFailed)
+
+	// the connection is failed, not just the write
+	_, err = c.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, errWriteFailed)
+	assert.False(t, c.Connected())
+}
+
+func TestCloseBeforeHandshakeDone(t *testing.T) {
+	var frames bytes.Buffer
+	require.NoError(t, NewFrameWriter(&frames).WriteFrame(Frame{Tag: subprotoTagSuccess, Data: []byte("sid")}))
+
+	limiter := NewSessionLimiter(1)
+	dopts := &dialOptions{SessionLimiter: limiter}
+	require.NoError(t, dopts.acquireSessions(context.Background(), nil))
+
+	// Close lands after the relay confirmed the connection but before connect marked the handshake done, so teardown
+	// left the sessions to the caller
+	c := newConn(newRelaySession(failingConn{r: io.MultiReader(&frames, blockingReader{})}), dopts)
+	c.Close()
+
+	err := c.connect(context.Background())
+	assert.ErrorIs(t, err, net.ErrClosed)
+	if err != nil {
+		dopts.releaseSessions()
+	}
+	assert.Zero(t, limiter.Active())
+}
+
+func TestWriteAckError(t *testing.T) {
+	// enough data that the read loop acks it
+	var frames bytes.Buffer
+	fw := NewFrameWriter(&frames)
+	for range 3 {
+		require.NoError(t, fw.WriteFrame(Frame{Tag: subprotoTagData, Data: make([]byte, subprotoMaxFrameSize)}))
+	}
+
+	c := newConn(newRelaySession(failingConn{r: io.MultiReader(&frames, blockingReader{})}), &dialOptions{})
+	c.connected.Store(true)
+	c.handshook.Store(true)
+	go c.read()
+
+	_, err := io.Copy(io.Discard, c)
+	assert.ErrorIs(t, err, errWriteFailed)
+	assert.False(t, c.Connected())
+}
+
+// blockingReader blocks forever, like a relay with nothing more to send.
+type blockingReader struct{}
+
+func (blockingReader) Read([]byte) (int, error) {
+	select {}
+}
+
+func TestAckPacer(t *testing.T) {
+	p := newAckPacer()
+
+	// without a round trip time the fixed threshold is used and nothing is acked early
+	assert.Equal(t, minAckThreshold, p.threshold())
+	assert.Zero(t, p.delay())
+
+	start := p.lastAck
+	p.sampleRTT(100 * time.Millisecond)
+	p.acked(10<<20, start.Add(time.Second))
+
+	// a quarter of 10 MiB/s over 100ms
+	assert.Equal(t, uint64(256<<10), p.threshold())
+	assert.Equal(t, 25*time.Millisecond, p.delay())
+
+	p.acked(100<<20, start.Add(2*time.Second))
+	assert.Equal(t, maxAckThreshold, p.threshold())
+
+	p = newAckPacer()
+	p.sampleRTT(time.Millisecond)
+	p.acked(1<<20, p.lastAck.Add(time.Second))
+
+	assert.Equal(t, minAckThreshold, p.threshold())
+	assert.Equal(t, minAckDelay, p.delay())
+}
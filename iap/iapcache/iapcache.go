@@ -0,0 +1,39 @@
+// Package iapcache adapts IAP tunnels to the dial functions of Redis and memcached clients, so caches on private
+// instances can be reached without managing tunnels.
+package iapcache
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+)
+
+// DialFunc dials a connection to addr on network. It's the type of go-redis's Options.Dialer and gomemcache's
+// Client.DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// NewDialFunc returns a DialFunc which dials a tunnel to the target URI with opts, in place of the address the client
+// asks for. The target is parsed up front so a pool replacing connections can dial again quickly. Dials give up after
+// timeout if it's positive, which go-redis doesn't apply to custom dialers itself, so pass its DialTimeout.
+//
+// gomemcache resolves server addresses before dialing them, so give it an IP address like 127.0.0.1:11211.
+func NewDialFunc(target string, timeout time.Duration, opts ...iap.DialOption) (DialFunc, error) {
+	parsed, err := iap.ParseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append(opts[:len(opts):len(opts)], iap.WithTarget(parsed))
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		return iap.Dial(ctx, opts...)
+	}, nil
+}
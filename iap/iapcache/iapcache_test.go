@@ -0,0 +1,59 @@
+package iapcache_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iapcache"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialFunc(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	dial, err := iapcache.NewDialFunc("iap://project/europe-west2-a/cache-1:6379", time.Second, server.DialOptions()...)
+	require.NoError(t, err)
+
+	conn, err := dial(context.Background(), "tcp", "127.0.0.1:6379")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("PING\r\n"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "PING\r\n", string(buf))
+
+	query := server.Queries()[0]
+	assert.Equal(t, "cache-1", query.Get("instance"))
+	assert.Equal(t, "6379", query.Get("port"))
+
+	_, err = iapcache.NewDialFunc("cache-1:6379", time.Second)
+	assert.Error(t, err)
+}
+
+func TestDialFuncTimeout(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	// the only session is taken, so the next dial waits until it times out
+	opts := append(server.DialOptions(), iap.WithSessionLimiter(iap.NewSessionLimiter(1)))
+
+	dial, err := iapcache.NewDialFunc("iap://project/europe-west2-a/cache-1:11211", 50*time.Millisecond, opts...)
+	require.NoError(t, err)
+
+	conn, err := dial(context.Background(), "tcp", "127.0.0.1:11211")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = dial(context.Background(), "tcp", "127.0.0.1:11211")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,26 @@
+module github.com/cedws/iapc/iap/iapgrpc
+
+go 1.23.0
+
+require (
+	github.com/cedws/iapc v0.0.0-20261017055908-4b7aa27bb3fc
+	github.com/stretchr/testify v1.10.0
+	google.golang.org/grpc v1.70.0
+)
+
+require (
+	cloud.google.com/go/compute/metadata v0.5.2 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	go.opentelemetry.io/otel v1.34.0 // indirect
+	go.opentelemetry.io/otel/metric v1.34.0 // indirect
+	golang.org/x/net v0.32.0 // indirect
+	golang.org/x/oauth2 v0.24.0 // indirect
+	golang.org/x/sys v0.32.0 // indirect
+	golang.org/x/text v0.24.0 // indirect
+	golang.org/x/time v0.10.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20241202173237-19429a94021a // indirect
+	google.golang.org/protobuf v1.35.2 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+	nhooyr.io/websocket v1.8.17 // indirect
+)
@@ -0,0 +1,97 @@
+package iapgrpc_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap/iapgrpc"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// streamListener hands the streams of an iaptest handler to a gRPC server as connections.
+type streamListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *streamListener) Close() error   { return nil }
+func (l *streamListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+// healthServer returns a server whose health service reports "backend" as serving and "draining" as not.
+func healthServer(t *testing.T) *iaptest.Server {
+	listener := &streamListener{conns: make(chan net.Conn), done: make(chan struct{})}
+
+	healthService := health.NewServer()
+	healthService.SetServingStatus("backend", healthpb.HealthCheckResponse_SERVING)
+	healthService.SetServingStatus("draining", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	grpcServer := grpc.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthService)
+	go grpcServer.Serve(listener)
+
+	server := iaptest.NewServer()
+	server.Handler = func(r io.Reader, w io.Writer) {
+		local, remote := net.Pipe()
+		defer local.Close()
+
+		listener.conns <- remote
+
+		go io.Copy(local, r)
+		io.Copy(w, local)
+	}
+
+	t.Cleanup(func() {
+		close(listener.done)
+		grpcServer.Stop()
+		server.Close()
+	})
+
+	return server
+}
+
+func TestCheckHealth(t *testing.T) {
+	server := healthServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	status, err := iapgrpc.CheckHealth(ctx, "backend", server.DialOptions()...)
+	require.NoError(t, err)
+	assert.Equal(t, "backend", status.Service)
+	assert.True(t, status.Serving())
+	assert.Positive(t, status.Latency)
+
+	status, err = iapgrpc.CheckHealth(ctx, "draining", server.DialOptions()...)
+	require.NoError(t, err)
+	assert.False(t, status.Serving())
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status.Status)
+}
+
+func TestCheckHealthUnknownService(t *testing.T) {
+	server := healthServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := iapgrpc.CheckHealth(ctx, "missing", server.DialOptions()...)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
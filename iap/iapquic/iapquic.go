@@ -0,0 +1,161 @@
+// Package iapquic is an experimental iap.Transport carrying relay channels over WebTransport on HTTP/3, for networks
+// where WebSockets over TCP suffer from head-of-line blocking or middleboxes resetting long-lived connections.
+//
+// Google's relay only accepts WebSockets today, so the transport is only useful with relays and emulators which accept
+// WebTransport sessions on the same paths. Each channel is a bidirectional stream in a QUIC connection of its own.
+// Since a stream doesn't keep the boundaries between writes that the relay protocol relies on, each message is sent on
+// it prefixed with its length as a 32-bit big-endian integer.
+package iapquic
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/webtransport-go"
+)
+
+// Transport opens relay channels over WebTransport.
+type Transport struct {
+	// TLSConfig configures the QUIC handshake with the relay. The system roots are trusted if it's nil.
+	TLSConfig *tls.Config
+}
+
+var _ iap.Transport = (*Transport)(nil)
+
+// WithTransport is a functional option that dials the relay with WebTransport instead of WebSockets.
+func WithTransport(tlsConfig *tls.Config) iap.DialOption {
+	return iap.WithTransport(&Transport{TLSConfig: tlsConfig})
+}
+
+// Open opens a WebTransport session to the relay and a stream in it, which carries the channel. The wss:// URL given by
+// Dial is requested as https://, and plaintext ws:// URLs are refused since QUIC is always encrypted.
+func (t *Transport) Open(ctx context.Context, url string, header http.Header) (net.Conn, error) {
+	rest, ok := strings.CutPrefix(url, "wss://")
+	if !ok {
+		return nil, fmt.Errorf("WebTransport needs a TLS relay endpoint, not %q", url)
+	}
+
+	// the dialer leaves its QUIC connections open after their sessions close, so the channel closes its own
+	var conn *quic.Conn
+	dialer := &webtransport.Dialer{
+		TLSClientConfig: t.TLSConfig,
+		DialAddr: func(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (*quic.Conn, error) {
+			var err error
+			conn, err = quic.DialAddrEarly(ctx, addr, tlsConfig, config)
+			return conn, err
+		},
+	}
+
+	c, err := open(ctx, dialer, "https://"+rest, header)
+	if err != nil {
+		if conn != nil {
+			conn.CloseWithError(0, "")
+		}
+		dialer.Close()
+		return nil, err
+	}
+
+	c.conn, c.dialer = conn, dialer
+	return c, nil
+}
+
+func open(ctx context.Context, dialer *webtransport.Dialer, url string, header http.Header) (*channel, error) {
+	resp, session, err := dialer.Dial(ctx, url, header)
+	if err != nil {
+		if resp != nil {
+			return nil, &iap.HandshakeError{StatusCode: resp.StatusCode, Err: err}
+		}
+		return nil, err
+	}
+
+	stream, err := session.OpenStreamSync(ctx)
+	if err == nil {
+		// the relay only learns of the stream from its header, which is sent with the first write, and the client
+		// doesn't write until the relay has spoken
+		_, err = stream.Write(nil)
+	}
+	if err != nil {
+		session.CloseWithError(0, "")
+		return nil, err
+	}
+
+	return &channel{Stream: stream, session: session}, nil
+}
+
+// channel is a relay channel over a WebTransport stream, which owns its session and QUIC connection.
+type channel struct {
+	*webtransport.Stream
+	session *webtransport.Session
+	conn    *quic.Conn
+	dialer  *webtransport.Dialer
+
+	// guards writeBuf, which messages are encoded into with their length
+	writeMu  sync.Mutex
+	writeBuf []byte
+
+	// the length of the next message, and how much of the current one hasn't been read
+	header [4]byte
+	unread uint32
+}
+
+// Read reads the messages on the stream, leaving out their lengths.
+func (c *channel) Read(buf []byte) (int, error) {
+	for c.unread == 0 {
+		if _, err := io.ReadFull(c.Stream, c.header[:]); err != nil {
+			return 0, err
+		}
+		c.unread = binary.BigEndian.Uint32(c.header[:])
+	}
+
+	if uint32(len(buf)) > c.unread {
+		buf = buf[:c.unread]
+	}
+	n, err := c.Stream.Read(buf)
+	c.unread -= uint32(n)
+	return n, err
+}
+
+// Write sends buf as one message.
+func (c *channel) Write(buf []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.writeBuf = binary.BigEndian.AppendUint32(c.writeBuf[:0], uint32(len(buf)))
+	c.writeBuf = append(c.writeBuf, buf...)
+
+	if _, err := c.Stream.Write(c.writeBuf); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (c *channel) LocalAddr() net.Addr {
+	return c.session.LocalAddr()
+}
+
+func (c *channel) RemoteAddr() net.Addr {
+	return c.session.RemoteAddr()
+}
+
+// Close finishes the stream and then closes the session and the QUIC connection.
+func (c *channel) Close() error {
+	err := errors.Join(c.Stream.Close(), c.session.CloseWithError(0, ""))
+	c.Abort()
+	return err
+}
+
+// Abort closes the QUIC connection without finishing the stream or the session.
+func (c *channel) Abort() {
+	c.conn.CloseWithError(0, "")
+	c.dialer.Close()
+}
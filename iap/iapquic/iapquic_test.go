@@ -0,0 +1,140 @@
+package iapquic_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iapquic"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"nhooyr.io/websocket"
+)
+
+// newWebTransportRelay serves WebTransport in front of relay, bridging the stream of each session to a WebSocket to
+// relay with the same path. It returns the relay endpoint and the roots to trust it with.
+func newWebTransportRelay(t *testing.T, relay *iaptest.Server) (string, *x509.CertPool) {
+	// borrow a certificate for 127.0.0.1
+	certServer := httptest.NewTLSServer(nil)
+	certServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certServer.Certificate())
+
+	server := &webtransport.Server{
+		H3: http3.Server{
+			TLSConfig: &tls.Config{Certificates: certServer.TLS.Certificates},
+		},
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	server.H3.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := server.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		stream, err := session.AcceptStream(r.Context())
+		if err != nil {
+			return
+		}
+
+		url := "ws://" + strings.TrimPrefix(relay.URL, "http://") + r.URL.RequestURI()
+		ws, _, err := websocket.Dial(context.Background(), url, &websocket.DialOptions{Subprotocols: []string{iap.Subprotocol}})
+		if err != nil {
+			session.CloseWithError(1, err.Error())
+			return
+		}
+
+		// messages on the stream are prefixed with their length, and each is a message on the WebSocket
+		go func() {
+			defer ws.CloseNow()
+
+			var header [4]byte
+			for {
+				if _, err := io.ReadFull(stream, header[:]); err != nil {
+					return
+				}
+				msg := make([]byte, binary.BigEndian.Uint32(header[:]))
+				if _, err := io.ReadFull(stream, msg); err != nil {
+					return
+				}
+				if err := ws.Write(context.Background(), websocket.MessageBinary, msg); err != nil {
+					return
+				}
+			}
+		}()
+
+		defer stream.Close()
+		for {
+			_, msg, err := ws.Read(context.Background())
+			if err != nil {
+				return
+			}
+			if _, err := stream.Write(binary.BigEndian.AppendUint32(nil, uint32(len(msg)))); err != nil {
+				return
+			}
+			if _, err := stream.Write(msg); err != nil {
+				return
+			}
+		}
+	})
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go server.Serve(packetConn)
+	t.Cleanup(func() { server.Close() })
+
+	return packetConn.LocalAddr().String(), roots
+}
+
+func TestTransport(t *testing.T) {
+	relay := iaptest.NewPlaintextServer()
+	defer relay.Close()
+
+	endpoint, roots := newWebTransportRelay(t, relay)
+
+	conn, err := iap.Dial(context.Background(),
+		iapquic.WithTransport(&tls.Config{RootCAs: roots}),
+		iap.WithEndpoint(endpoint),
+		iap.WithInstance("prod-1", "europe-west2-a", "nic0"),
+		iap.WithPort("22"),
+	)
+	require.NoError(t, err)
+
+	// enough data to take many messages each way, and acks
+	payload := strings.Repeat("hello", 20000)
+
+	go conn.Write([]byte(payload))
+
+	buf := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(buf))
+
+	closed := make(chan error, 1)
+	go func() { closed <- conn.Close() }()
+
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't return")
+	}
+}
+
+func TestTransportPlaintext(t *testing.T) {
+	_, err := iap.Dial(context.Background(), iapquic.WithTransport(nil), iap.WithEndpoint("ws://127.0.0.1:1"))
+	assert.ErrorContains(t, err, "TLS relay endpoint")
+}
@@ -0,0 +1,134 @@
+// Package iapsql connects database/sql to Postgres and MySQL servers on private instances through the IAP, so
+// sql.Open works without managing tunnels. Targets are given as URIs like iap://project/zone/db-1:5432, see
+// iap.ParseTarget.
+package iapsql
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// MySQLNetwork is the network name Dialers are registered under with RegisterMySQL.
+const MySQLNetwork = "iap"
+
+// Dialer dials tunnels to target URIs for database connections. Each target is parsed once and its tunnels share a
+// session limiter, so a connection pool growing under load doesn't trip IAP quotas. The zero value is ready to use.
+// A Dialer can be shared between goroutines.
+type Dialer struct {
+	// Options are used for every tunnel, e.g. credentials. The target comes from the URI.
+	Options []iap.DialOption
+	// MaxSessions limits the tunnels open to each target at once, with further dials waiting for one to close. Zero
+	// means no limit.
+	MaxSessions int
+	// BreakerFailures opens a circuit breaker for a target once this many dials to it fail in a row, failing further
+	// dials with iap.ErrCircuitOpen for BreakerCooldown. Zero means no breaker.
+	BreakerFailures int
+	BreakerCooldown time.Duration
+
+	mu      sync.Mutex
+	targets map[string]*dialTarget
+}
+
+type dialTarget struct {
+	opts    []iap.DialOption
+	breaker *iap.CircuitBreaker
+}
+
+// DialContext dials a tunnel to the target URI.
+func (d *Dialer) DialContext(ctx context.Context, target string) (net.Conn, error) {
+	t, err := d.target(target)
+	if err != nil {
+		return nil, err
+	}
+
+	return iap.Dial(ctx, t.opts...)
+}
+
+// BreakerState returns the state of the circuit breaker for the target URI, which is closed if the target hasn't been
+// dialed or there's no breaker.
+func (d *Dialer) BreakerState(target string) iap.BreakerState {
+	d.mu.Lock()
+	t := d.targets[target]
+	d.mu.Unlock()
+
+	if t == nil || t.breaker == nil {
+		return iap.BreakerState{}
+	}
+	return t.breaker.State()
+}
+
+func (d *Dialer) target(uri string) (*dialTarget, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if t, ok := d.targets[uri]; ok {
+		return t, nil
+	}
+
+	target, err := iap.ParseTarget(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := append(d.Options[:len(d.Options):len(d.Options)], iap.WithTarget(target))
+	if d.MaxSessions > 0 {
+		opts = append(opts, iap.WithSessionLimiter(iap.NewSessionLimiter(d.MaxSessions)))
+	}
+
+	t := &dialTarget{}
+	if d.BreakerFailures > 0 {
+		t.breaker = iap.NewCircuitBreaker(d.BreakerFailures, d.BreakerCooldown)
+		opts = append(opts, iap.WithCircuitBreaker(t.breaker))
+	}
+	t.opts = opts
+
+	if d.targets == nil {
+		d.targets = make(map[string]*dialTarget)
+	}
+	d.targets[uri] = t
+
+	return t, nil
+}
+
+// RegisterMySQL registers d with the MySQL driver as MySQLNetwork, so DSNs with the target URI as the address connect
+// through it, like user:password@iap(iap://project/zone/db-1:3306)/dbname.
+func RegisterMySQL(d *Dialer) {
+	mysql.RegisterDialContext(MySQLNetwork, d.DialContext)
+}
+
+// PgxDialFunc returns a pgx DialFunc which dials target through d, in place of the host and port in the connection
+// string.
+func PgxDialFunc(d *Dialer, target string) pgconn.DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return d.DialContext(ctx, target)
+	}
+}
+
+// RegisterPgx registers connString with the pgx driver, connecting to target through d, and returns the name to open
+// it with, like sql.Open("pgx", name). The host and port in connString are ignored.
+func RegisterPgx(d *Dialer, connString, target string) (string, error) {
+	if _, err := iap.ParseTarget(target); err != nil {
+		return "", err
+	}
+
+	config, err := pgx.ParseConfig(connString)
+	if err != nil {
+		return "", err
+	}
+
+	config.DialFunc = PgxDialFunc(d, target)
+	// the host is never dialed, so don't look it up either
+	config.LookupFunc = func(ctx context.Context, host string) ([]string, error) {
+		return []string{host}, nil
+	}
+
+	return stdlib.RegisterConnConfig(config), nil
+}
@@ -0,0 +1,128 @@
+package iapsql_test
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iapsql"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialer(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	d := &iapsql.Dialer{Options: server.DialOptions()}
+
+	conn, err := d.DialContext(context.Background(), "iap://project/europe-west2-a/db-1:5432")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	query := server.Queries()[0]
+	assert.Equal(t, "db-1", query.Get("instance"))
+	assert.Equal(t, "europe-west2-a", query.Get("zone"))
+	assert.Equal(t, "5432", query.Get("port"))
+
+	_, err = d.DialContext(context.Background(), "db-1:5432")
+	assert.Error(t, err)
+}
+
+func TestDialerMaxSessions(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	d := &iapsql.Dialer{Options: server.DialOptions(), MaxSessions: 1}
+
+	conn, err := d.DialContext(context.Background(), "iap://project/europe-west2-a/db-1:5432")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = d.DialContext(ctx, "iap://project/europe-west2-a/db-1:5432")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the limit is per target
+	other, err := d.DialContext(context.Background(), "iap://project/europe-west2-a/db-2:5432")
+	require.NoError(t, err)
+	other.Close()
+}
+
+func TestDialerBreaker(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	server.Faults.RejectStatus = http.StatusBadGateway
+
+	d := &iapsql.Dialer{Options: server.DialOptions(), BreakerFailures: 1, BreakerCooldown: time.Minute}
+
+	_, err := d.DialContext(context.Background(), "iap://project/europe-west2-a/db-1:5432")
+	assert.Error(t, err)
+	_, err = d.DialContext(context.Background(), "iap://project/europe-west2-a/db-1:5432")
+	assert.ErrorIs(t, err, iap.ErrCircuitOpen)
+
+	assert.True(t, d.BreakerState("iap://project/europe-west2-a/db-1:5432").Open)
+	// the breaker is per target
+	assert.False(t, d.BreakerState("iap://project/europe-west2-a/db-2:5432").Open)
+}
+
+// closingServer returns a server which hangs up on every client, for checking which target a driver dialed.
+func closingServer(t *testing.T) *iaptest.Server {
+	server := iaptest.NewServer()
+	server.Handler = func(r io.Reader, w io.Writer) {}
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestRegisterMySQL(t *testing.T) {
+	server := closingServer(t)
+
+	iapsql.RegisterMySQL(&iapsql.Dialer{Options: server.DialOptions()})
+
+	db, err := sql.Open("mysql", "user:password@iap(iap://project/europe-west2-a/db-1:3306)/app")
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.Error(t, db.Ping())
+
+	query := server.Queries()[0]
+	assert.Equal(t, "db-1", query.Get("instance"))
+	assert.Equal(t, "3306", query.Get("port"))
+}
+
+func TestRegisterPgx(t *testing.T) {
+	server := closingServer(t)
+
+	name, err := iapsql.RegisterPgx(&iapsql.Dialer{Options: server.DialOptions()}, "user=app dbname=app sslmode=disable", "iap://project/europe-west2-a/db-1:5432")
+	require.NoError(t, err)
+
+	db, err := sql.Open("pgx", name)
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.Error(t, db.Ping())
+
+	query := server.Queries()[0]
+	assert.Equal(t, "db-1", query.Get("instance"))
+	assert.Equal(t, "5432", query.Get("port"))
+
+	_, err = iapsql.RegisterPgx(&iapsql.Dialer{}, "user=app", "db-1:5432")
+	assert.Error(t, err)
+}
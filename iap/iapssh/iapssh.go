@@ -0,0 +1,196 @@
+// Package iapssh composes IAP tunnels with SSH clients, for workflows like exposing a local server to an instance.
+package iapssh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"golang.org/x/crypto/ssh"
+)
+
+// Dial tunnels to an SSH server through the IAP and establishes an SSH connection over the tunnel. addr is the name of
+// the server used to verify its host key, e.g. instance:22. The context bounds the SSH handshake as well as the
+// tunnel's. Closing the client closes the tunnel.
+func Dial(ctx context.Context, addr string, config *ssh.ClientConfig, opts ...iap.DialOption) (*ssh.Client, error) {
+	tun, err := iap.Dial(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// the SSH handshake doesn't take a context, so the context's deadline is set on the tunnel and the tunnel is closed
+	// if the context is cancelled
+	if deadline, ok := ctx.Deadline(); ok {
+		tun.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { tun.Close() })
+
+	conn, chans, reqs, err := ssh.NewClientConn(tun, addr, config)
+	if !stop() {
+		if err == nil {
+			conn.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		tun.Close()
+		// the tunnel's deadline can pass just before the context's
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, context.DeadlineExceeded
+		}
+		return nil, err
+	}
+	tun.SetDeadline(time.Time{})
+
+	return ssh.NewClient(conn, chans, reqs), nil
+}
+
+// Forward is a remote port forward, forwarding connections to a listener on the SSH server back to a local address.
+type Forward struct {
+	listener  net.Listener
+	localAddr string
+	// client is closed with the forward if it was dialed for it
+	client *ssh.Client
+
+	mu     sync.Mutex
+	closed bool
+	err    error
+	done   chan struct{}
+}
+
+// ForwardRemote asks the SSH server to listen on remoteAddr and forwards every connection to it to localAddr, like
+// ssh -R remoteAddr:localAddr. This exposes a local server to processes on the instance. Use port 0 to let the server
+// pick a port, which is then reported by Addr.
+func ForwardRemote(client *ssh.Client, remoteAddr, localAddr string) (*Forward, error) {
+	return forwardRemote(client, remoteAddr, localAddr, false)
+}
+
+func forwardRemote(client *ssh.Client, remoteAddr, localAddr string, owned bool) (*Forward, error) {
+	listener, err := client.Listen("tcp", remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Forward{
+		listener:  listener,
+		localAddr: localAddr,
+		done:      make(chan struct{}),
+	}
+	if owned {
+		f.client = client
+	}
+	go f.serve()
+
+	return f, nil
+}
+
+// DialForwardRemote dials an SSH server like Dial and starts a remote port forward like ForwardRemote. Closing the
+// forward closes the SSH connection and the tunnel too.
+func DialForwardRemote(ctx context.Context, addr string, config *ssh.ClientConfig, remoteAddr, localAddr string, opts ...iap.DialOption) (*Forward, error) {
+	client, err := Dial(ctx, addr, config, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := forwardRemote(client, remoteAddr, localAddr, true)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Addr returns the address listened on by the SSH server.
+func (f *Forward) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+// Close stops listening on the SSH server. Connections already forwarded carry on until either side closes them.
+func (f *Forward) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+
+	err := f.listener.Close()
+	<-f.done
+
+	if f.client != nil {
+		f.client.Close()
+	}
+
+	return err
+}
+
+// Wait blocks until the forward stops, returning the error which stopped it, or nil if it was closed.
+func (f *Forward) Wait() error {
+	<-f.done
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.err
+}
+
+func (f *Forward) serve() {
+	defer close(f.done)
+
+	for {
+		remote, err := f.listener.Accept()
+		if err != nil {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+
+			if !f.closed {
+				f.err = err
+
+				if f.client != nil {
+					f.client.Close()
+				}
+			}
+			return
+		}
+
+		go f.forward(remote)
+	}
+}
+
+func (f *Forward) forward(remote net.Conn) {
+	defer remote.Close()
+
+	local, err := net.Dial("tcp", f.localAddr)
+	if err != nil {
+		return
+	}
+	defer local.Close()
+
+	pipe(local, remote)
+}
+
+// pipe copies between a and b in both directions until both are done, passing on half-closes where supported.
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		io.Copy(dst, src)
+
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+
+	wg.Wait()
+}
@@ -0,0 +1,277 @@
+package iapssh_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap/iapssh"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// streamConn adapts the stream passed to an iaptest handler to a net.Conn for the SSH server.
+type streamConn struct {
+	io.Reader
+	io.Writer
+	net.Conn
+}
+
+func (c streamConn) Read(p []byte) (int, error)  { return c.Reader.Read(p) }
+func (c streamConn) Write(p []byte) (int, error) { return c.Writer.Write(p) }
+func (c streamConn) Close() error                { return nil }
+
+// sshServer returns a handler serving SSH which supports remote port forwards on loopback, direct-tcpip channels, and
+// the SFTP subsystem.
+func sshServer(t *testing.T) func(r io.Reader, w io.Writer) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	return func(r io.Reader, w io.Writer) {
+		conn, chans, reqs, err := ssh.NewServerConn(streamConn{Reader: r, Writer: w}, config)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		go func() {
+			for newCh := range chans {
+				if newCh.ChannelType() == "direct-tcpip" {
+					go serveDirect(newCh)
+					continue
+				}
+				if newCh.ChannelType() != "session" {
+					newCh.Reject(ssh.UnknownChannelType, "only sessions and direct-tcpip are supported")
+					continue
+				}
+
+				ch, reqs, err := newCh.Accept()
+				if err != nil {
+					continue
+				}
+				go serveSession(ch, reqs)
+			}
+		}()
+
+		for req := range reqs {
+			switch req.Type {
+			case "tcpip-forward":
+			case "cancel-tcpip-forward":
+				req.Reply(true, nil)
+				continue
+			default:
+				req.Reply(false, nil)
+				continue
+			}
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			defer listener.Close()
+
+			port := uint32(listener.Addr().(*net.TCPAddr).Port)
+			req.Reply(true, binary.BigEndian.AppendUint32(nil, port))
+
+			go acceptForwards(conn, listener, port)
+		}
+	}
+}
+
+// serveSession serves the SFTP subsystem on a session channel, rejecting any other requests.
+func serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	for req := range reqs {
+		if req.Type != "subsystem" || string(req.Payload[4:]) != "sftp" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		go ssh.DiscardRequests(reqs)
+
+		server, err := sftp.NewServer(ch)
+		if err != nil {
+			return
+		}
+		server.Serve()
+		return
+	}
+}
+
+// serveDirect connects a direct-tcpip channel to the address it asks for.
+func serveDirect(newCh ssh.NewChannel) {
+	var payload struct {
+		Addr       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newCh.ExtraData(), &payload); err != nil {
+		newCh.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	target, err := net.Dial("tcp", net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		newCh.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(ch, target)
+		ch.CloseWrite()
+	}()
+	go func() {
+		io.Copy(target, ch)
+		target.Close()
+	}()
+}
+
+func acceptForwards(conn ssh.Conn, listener net.Listener, port uint32) {
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		origin := client.RemoteAddr().(*net.TCPAddr)
+		payload := ssh.Marshal(struct {
+			Addr       string
+			Port       uint32
+			OriginAddr string
+			OriginPort uint32
+		}{"127.0.0.1", port, origin.IP.String(), uint32(origin.Port)})
+
+		ch, reqs, err := conn.OpenChannel("forwarded-tcpip", payload)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+
+		go func() {
+			io.Copy(ch, client)
+			ch.CloseWrite()
+		}()
+		go func() {
+			io.Copy(client, ch)
+			client.Close()
+		}()
+	}
+}
+
+var clientConfig = &ssh.ClientConfig{
+	User:            "test",
+	HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	Timeout:         5 * time.Second,
+}
+
+func TestDialHandshakeContext(t *testing.T) {
+	server := iaptest.NewServer()
+	// a server that never answers, so the SSH handshake waits forever
+	server.Handler = func(r io.Reader, w io.Writer) { io.Copy(io.Discard, r) }
+	defer server.Close()
+
+	config := &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := iapssh.Dial(ctx, "instance:22", config, server.DialOptions()...)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	_, err = iapssh.DialJump(ctx, "bastion:22", config, "tcp", "db:5432", server.DialOptions()...)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestDialClearsDeadline(t *testing.T) {
+	server := iaptest.NewServer()
+	server.Handler = sshServer(t)
+	defer server.Close()
+
+	config := &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	client, err := iapssh.Dial(ctx, "instance:22", config, server.DialOptions()...)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// the handshake's deadline doesn't outlive it
+	time.Sleep(300 * time.Millisecond)
+	_, _, err = client.SendRequest("keepalive@openssh.com", true, nil)
+	assert.NoError(t, err)
+}
+
+func TestDialForwardRemote(t *testing.T) {
+	server := iaptest.NewServer()
+	server.Handler = sshServer(t)
+	defer server.Close()
+
+	// the local server being exposed to the instance
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer local.Close()
+
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	forward, err := iapssh.DialForwardRemote(context.Background(), "instance:22", clientConfig, "127.0.0.1:0", local.Addr().String(), server.DialOptions()...)
+	require.NoError(t, err)
+
+	// a process on the instance connecting to the remote listener
+	conn, err := net.Dial("tcp", forward.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	assert.NoError(t, forward.Close())
+	assert.NoError(t, forward.Wait())
+}
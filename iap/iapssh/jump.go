@@ -0,0 +1,49 @@
+package iapssh
+
+import (
+	"context"
+	"net"
+
+	"github.com/cedws/iapc/iap"
+	"golang.org/x/crypto/ssh"
+)
+
+// DialJump tunnels to an SSH server on a bastion through the IAP like Dial, and then connects from the bastion to addr
+// on a further host over a direct-tcpip channel, like ssh -J. bastion is the name of the bastion used to verify its
+// host key, e.g. bastion:22. The returned connection can carry any protocol, including another SSH connection with
+// ssh.NewClientConn. Closing it closes the SSH connection to the bastion and the tunnel too.
+func DialJump(ctx context.Context, bastion string, config *ssh.ClientConfig, network, addr string, opts ...iap.DialOption) (net.Conn, error) {
+	client, err := Dial(ctx, bastion, config, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.DialContext(ctx, network, addr)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &jumpConn{conn, client}, nil
+}
+
+// jumpConn is a connection through a bastion which owns the SSH connection to it.
+type jumpConn struct {
+	net.Conn
+	client *ssh.Client
+}
+
+// CloseWrite closes the connection for writing, so the further host sees EOF.
+func (c *jumpConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// Close closes the connection, the SSH connection to the bastion and the tunnel.
+func (c *jumpConn) Close() error {
+	err := c.Conn.Close()
+	c.client.Close()
+	return err
+}
@@ -0,0 +1,70 @@
+package iapssh_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/cedws/iapc/iap/iapssh"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialJump(t *testing.T) {
+	server := iaptest.NewServer()
+	server.Handler = sshServer(t)
+	defer server.Close()
+
+	// the further host, only reachable from the bastion
+	further, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer further.Close()
+
+	go func() {
+		for {
+			conn, err := further.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	conn, err := iapssh.DialJump(context.Background(), "bastion:22", clientConfig, "tcp", further.Addr().String(), server.DialOptions()...)
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// the further host sees EOF once writes are closed, and closes its end
+	require.NoError(t, conn.(interface{ CloseWrite() error }).CloseWrite())
+	_, err = conn.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+
+	assert.NoError(t, conn.Close())
+}
+
+func TestDialJumpRefused(t *testing.T) {
+	server := iaptest.NewServer()
+	server.Handler = sshServer(t)
+	defer server.Close()
+
+	// a port with nothing listening
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := closed.Addr().String()
+	closed.Close()
+
+	_, err = iapssh.DialJump(context.Background(), "bastion:22", clientConfig, "tcp", addr, server.DialOptions()...)
+	assert.Error(t, err)
+}
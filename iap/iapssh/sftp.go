@@ -0,0 +1,227 @@
+package iapssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPClient is an SFTP client over a tunnel. Closing it closes the SSH connection and the tunnel too.
+type SFTPClient struct {
+	*sftp.Client
+	ssh *ssh.Client
+}
+
+// Close closes the SFTP session, the SSH connection and the tunnel.
+func (c *SFTPClient) Close() error {
+	err := c.Client.Close()
+	c.ssh.Close()
+	return err
+}
+
+// NewSFTPClient starts an SFTP session on an SSH connection, with concurrent reads and writes enabled so large files
+// transfer quickly over the relay.
+func NewSFTPClient(client *ssh.Client) (*sftp.Client, error) {
+	return sftp.NewClient(client,
+		sftp.UseConcurrentReads(true),
+		sftp.UseConcurrentWrites(true),
+	)
+}
+
+// DialSFTP dials an SSH server like Dial and starts an SFTP session on it like NewSFTPClient.
+func DialSFTP(ctx context.Context, addr string, config *ssh.ClientConfig, opts ...iap.DialOption) (*SFTPClient, error) {
+	client, err := Dial(ctx, addr, config, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	sftpClient, err := NewSFTPClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &SFTPClient{Client: sftpClient, ssh: client}, nil
+}
+
+// Transfer is a file to copy from Src to Dst.
+type Transfer struct {
+	Src string
+	Dst string
+}
+
+type TransferOption func(*transferOptions)
+
+type transferOptions struct {
+	Workers int
+	Resume  bool
+}
+
+// WithWorkers is a functional option that sets how many files are transferred at once. Defaults to 1.
+func WithWorkers(workers int) func(*transferOptions) {
+	return func(t *transferOptions) {
+		t.Workers = workers
+	}
+}
+
+// WithResume is a functional option that continues partial transfers. A destination shorter than its source is assumed
+// to hold the start of it, and only the rest is copied. A destination the same size as its source is skipped.
+func WithResume() func(*transferOptions) {
+	return func(t *transferOptions) {
+		t.Resume = true
+	}
+}
+
+// Upload copies local files to the SFTP server. Every transfer is attempted, and the errors of failed ones are returned
+// joined with errors.Join.
+func Upload(ctx context.Context, client *sftp.Client, transfers []Transfer, opts ...TransferOption) error {
+	endpoints := copyEndpoints{
+		open: func(path string) (srcFile, error) {
+			return os.Open(path)
+		},
+		stat: client.Stat,
+		create: func(path string, flag int) (dstFile, error) {
+			return client.OpenFile(path, flag)
+		},
+	}
+
+	return transferAll(ctx, transfers, opts, endpoints)
+}
+
+// Download copies files from the SFTP server to local paths. Every transfer is attempted, and the errors of failed ones
+// are returned joined with errors.Join.
+func Download(ctx context.Context, client *sftp.Client, transfers []Transfer, opts ...TransferOption) error {
+	endpoints := copyEndpoints{
+		open: func(path string) (srcFile, error) {
+			return client.Open(path)
+		},
+		stat: os.Stat,
+		create: func(path string, flag int) (dstFile, error) {
+			return os.OpenFile(path, flag, 0o644)
+		},
+	}
+
+	return transferAll(ctx, transfers, opts, endpoints)
+}
+
+// srcFile and dstFile are the subsets of *os.File and *sftp.File used by copying.
+type srcFile interface {
+	io.ReadSeekCloser
+	Stat() (os.FileInfo, error)
+}
+
+type dstFile interface {
+	io.WriteSeeker
+	io.Closer
+}
+
+// copyEndpoints opens the source of a transfer, and stats and creates its destination.
+type copyEndpoints struct {
+	open   func(string) (srcFile, error)
+	stat   func(string) (os.FileInfo, error)
+	create func(string, int) (dstFile, error)
+}
+
+func transferAll(ctx context.Context, transfers []Transfer, opts []TransferOption, endpoints copyEndpoints) error {
+	topts := &transferOptions{Workers: 1}
+	for _, opt := range opts {
+		opt(topts)
+	}
+
+	queue := make(chan Transfer)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+
+	for range max(topts.Workers, 1) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for t := range queue {
+				if err := endpoints.copy(t, topts.Resume); err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("copying %v to %v: %w", t.Src, t.Dst, err))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+enqueue:
+	for _, t := range transfers {
+		select {
+		case queue <- t:
+		case <-ctx.Done():
+			break enqueue
+		}
+	}
+	close(queue)
+
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (e copyEndpoints) copy(t Transfer, resume bool) error {
+	src, err := e.open(t.Src)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	if resume {
+		if dstInfo, err := e.stat(t.Dst); err == nil && dstInfo.Size() <= info.Size() {
+			if dstInfo.Size() == info.Size() {
+				return nil
+			}
+			offset = dstInfo.Size()
+		}
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+
+	dst, err := e.create(t.Dst, flag)
+	if err != nil {
+		return err
+	}
+
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		dst.Close()
+		return err
+	}
+	if _, err := dst.Seek(offset, io.SeekStart); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
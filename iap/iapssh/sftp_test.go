@@ -0,0 +1,110 @@
+package iapssh_test
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cedws/iapc/iap/iapssh"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dialSFTP(t *testing.T) *iapssh.SFTPClient {
+	t.Helper()
+
+	server := iaptest.NewServer()
+	server.Handler = sshServer(t)
+	t.Cleanup(server.Close)
+
+	client, err := iapssh.DialSFTP(context.Background(), "instance:22", clientConfig, server.DialOptions()...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+	})
+
+	return client
+}
+
+func writeRandom(t *testing.T, path string, size int) []byte {
+	t.Helper()
+
+	data := make([]byte, size)
+	rand.Read(data)
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	return data
+}
+
+func TestUploadDownload(t *testing.T) {
+	client := dialSFTP(t)
+
+	// the fake server shares the local filesystem
+	local, remote := t.TempDir(), t.TempDir()
+
+	var uploads, downloads []iapssh.Transfer
+	files := make(map[string][]byte)
+
+	for _, name := range []string{"a", "b", "c"} {
+		files[name] = writeRandom(t, filepath.Join(local, name), 300_000)
+
+		uploads = append(uploads, iapssh.Transfer{Src: filepath.Join(local, name), Dst: filepath.Join(remote, name)})
+		downloads = append(downloads, iapssh.Transfer{Src: filepath.Join(remote, name), Dst: filepath.Join(local, name+".back")})
+	}
+
+	require.NoError(t, iapssh.Upload(context.Background(), client.Client, uploads, iapssh.WithWorkers(2)))
+	require.NoError(t, iapssh.Download(context.Background(), client.Client, downloads, iapssh.WithWorkers(2)))
+
+	for name, data := range files {
+		back, err := os.ReadFile(filepath.Join(local, name+".back"))
+		require.NoError(t, err)
+		assert.Equal(t, data, back, name)
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	client := dialSFTP(t)
+
+	local, remote := t.TempDir(), t.TempDir()
+
+	data := writeRandom(t, filepath.Join(local, "partial"), 300_000)
+	require.NoError(t, os.WriteFile(filepath.Join(remote, "partial"), data[:100_000], 0o644))
+
+	// a destination the same size as its source is assumed to be complete
+	writeRandom(t, filepath.Join(local, "complete"), 1000)
+	complete := writeRandom(t, filepath.Join(remote, "complete"), 1000)
+
+	transfers := []iapssh.Transfer{
+		{Src: filepath.Join(local, "partial"), Dst: filepath.Join(remote, "partial")},
+		{Src: filepath.Join(local, "complete"), Dst: filepath.Join(remote, "complete")},
+	}
+	require.NoError(t, iapssh.Upload(context.Background(), client.Client, transfers, iapssh.WithResume()))
+
+	uploaded, err := os.ReadFile(filepath.Join(remote, "partial"))
+	require.NoError(t, err)
+	assert.Equal(t, data, uploaded)
+
+	untouched, err := os.ReadFile(filepath.Join(remote, "complete"))
+	require.NoError(t, err)
+	assert.Equal(t, complete, untouched)
+}
+
+func TestUploadErrors(t *testing.T) {
+	client := dialSFTP(t)
+
+	local, remote := t.TempDir(), t.TempDir()
+	writeRandom(t, filepath.Join(local, "exists"), 1000)
+
+	transfers := []iapssh.Transfer{
+		{Src: filepath.Join(local, "missing"), Dst: filepath.Join(remote, "missing")},
+		{Src: filepath.Join(local, "exists"), Dst: filepath.Join(remote, "exists")},
+	}
+
+	err := iapssh.Upload(context.Background(), client.Client, transfers)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing")
+	assert.FileExists(t, filepath.Join(remote, "exists"))
+}
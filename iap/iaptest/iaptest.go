@@ -0,0 +1,510 @@
+// Package iaptest provides a fake IAP relay for testing clients of package iap.
+package iaptest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"nhooyr.io/websocket"
+)
+
+const (
+	subproto      = "relay.tunnel.cloudproxy.app"
+	reconnectPath = "/v4/reconnect"
+)
+
+// Echo is a Handler that writes back everything it reads.
+func Echo(r io.Reader, w io.Writer) {
+	io.Copy(w, r)
+}
+
+// Server is a fake relay listening on a local TLS server. Each connection is acknowledged with a success frame, and
+// the data stream is passed to the Handler. Sessions can be resumed on a new connection, replaying unacknowledged data
+// in both directions like the relay does.
+type Server struct {
+	*httptest.Server
+
+	// SessionID is the prefix of the session IDs sent to clients in the success frame, which are numbered to keep them
+	// unique.
+	SessionID string
+	// Handler is called for each connection with the data sent by the client, and a writer that sends data back.
+	// The connection is closed when it returns. Defaults to Echo.
+	Handler func(r io.Reader, w io.Writer)
+
+	// Faults configures misbehaviour applied to every connection.
+	Faults Faults
+
+	// CompressionMode is agreed to with clients which ask for compression, like the relay does. Compression is
+	// disabled by default.
+	CompressionMode websocket.CompressionMode
+
+	// DeniedPermissions are left out of the permissions granted by the server's testIamPermissions endpoint, which
+	// otherwise grants everything asked about.
+	DeniedPermissions []string
+
+	mu        sync.Mutex
+	queries   []url.Values
+	sessions  map[string]*session
+	nsessions int
+	rejected  int
+}
+
+// Faults configures ways in which the server misbehaves, so client resilience can be tested deterministically.
+// The zero value disables all faults.
+type Faults struct {
+	// DropFrame is called with the tag and sequence number (starting at 1) of every frame sent to the client after
+	// the success frame. The frame is discarded if it returns true.
+	DropFrame func(tag uint16, n int) bool
+	// AckDelay delays every ack sent to the client. Acks are still sent in order.
+	AckDelay time.Duration
+	// FragmentSize splits every frame sent to the client into WebSocket messages of at most this many bytes.
+	FragmentSize int
+	// BogusFrame is sent as-is before every data frame, e.g. a frame with an unknown tag.
+	BogusFrame []byte
+	// CloseAfter closes the connection with CloseStatus and CloseReason once this many data frames have been sent.
+	CloseAfter  int
+	CloseStatus websocket.StatusCode
+	CloseReason string
+	// RejectStatus responds to the WebSocket handshake with this HTTP status instead of upgrading, like the relay does
+	// when the caller isn't authorized. The body is RejectBody, or the status text if it's empty. If RejectCount is
+	// set, only that many handshakes are rejected before the server starts upgrading them.
+	RejectStatus int
+	RejectBody   string
+	RejectCount  int
+	// RetryAfter is sent as the Retry-After header of rejections, like the relay does when throttling.
+	RetryAfter string
+	// ReconnectDelay delays resuming a session on a new connection, like a slow relay.
+	ReconnectDelay time.Duration
+	// SuccessDelay delays the success frame after accepting the WebSocket, like a relay that never confirms the
+	// connection.
+	SuccessDelay time.Duration
+}
+
+// NewServer starts and returns a new Server. The caller should call Close when finished.
+func NewServer() *Server {
+	s := &Server{
+		SessionID: "iaptest",
+		Handler:   Echo,
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+// NewPlaintextServer starts and returns a new Server without TLS, which clients reach with ws:// endpoints.
+func NewPlaintextServer() *Server {
+	s := &Server{
+		SessionID: "iaptest",
+		Handler:   Echo,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+// DialOptions returns options that point iap.Dial at the server.
+func (s *Server) DialOptions() []iap.DialOption {
+	u, _ := url.Parse(s.URL)
+
+	if s.TLS == nil {
+		return []iap.DialOption{
+			iap.WithEndpoint("ws://" + u.Host),
+			iap.WithAPIEndpoint("http://" + u.Host),
+		}
+	}
+
+	return []iap.DialOption{
+		iap.WithEndpoint(u.Host),
+		iap.WithAPIEndpoint(u.Host),
+		iap.WithHTTPClient(s.Client()),
+	}
+}
+
+// Queries returns the query parameters of every connection made to the server so far.
+func (s *Server) Queries() []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]url.Values(nil), s.queries...)
+}
+
+// Reconnects returns the number of times a session has been resumed on a new connection.
+func (s *Server) Reconnects() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, query := range s.queries {
+		if query.Has("sid") {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, ":testIamPermissions") {
+		s.testPermissions(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	s.queries = append(s.queries, r.URL.Query())
+	reject := s.Faults.RejectStatus != 0 && (s.Faults.RejectCount == 0 || s.rejected < s.Faults.RejectCount)
+	if reject {
+		s.rejected++
+	}
+	s.mu.Unlock()
+
+	if reject {
+		if s.Faults.RetryAfter != "" {
+			w.Header().Set("Retry-After", s.Faults.RetryAfter)
+		}
+
+		body := s.Faults.RejectBody
+		if body == "" {
+			body = http.StatusText(s.Faults.RejectStatus)
+		}
+		http.Error(w, body, s.Faults.RejectStatus)
+		return
+	}
+
+	ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols: []string{subproto},
+		// the client sends a non-URL origin which would fail verification
+		InsecureSkipVerify: true,
+		CompressionMode:    s.CompressionMode,
+	})
+	if err != nil {
+		return
+	}
+
+	conn := websocket.NetConn(context.Background(), ws, websocket.MessageBinary)
+
+	var sess *session
+	if r.URL.Path == reconnectPath {
+		sess = s.resume(ws, conn, r.URL.Query())
+	} else {
+		sess = s.start(ws, conn)
+	}
+	if sess == nil {
+		conn.Close()
+		return
+	}
+
+	err = sess.readFrames(conn)
+	if errors.Is(err, errReplaced) {
+		// the session carries on over the connection which replaced this one, and resume closes this one once it's no
+		// longer written to
+		return
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	delete(s.sessions, sess.id)
+	s.mu.Unlock()
+
+	sess.data.CloseWithError(err)
+	close(sess.acks)
+}
+
+// testPermissions grants the permissions asked about, except for DeniedPermissions.
+func (s *Server) testPermissions(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	granted := slices.DeleteFunc(req.Permissions, func(permission string) bool {
+		return slices.Contains(s.DeniedPermissions, permission)
+	})
+	json.NewEncoder(w).Encode(map[string][]string{"permissions": granted})
+}
+
+// start begins a new session on a connection.
+func (s *Server) start(ws *websocket.Conn, conn net.Conn) *session {
+	s.mu.Lock()
+	s.nsessions++
+	sess := &session{
+		id:       fmt.Sprintf("%v-%v", s.SessionID, s.nsessions),
+		faults:   s.Faults,
+		acks:     make(chan pendingAck, 64),
+		readConn: conn,
+		ws:       ws,
+		conn:     conn,
+	}
+	s.mu.Unlock()
+
+	time.Sleep(s.Faults.SuccessDelay)
+
+	if err := sess.writeFrame(iap.Frame{Tag: iap.TagSuccess, Data: []byte(sess.id)}); err != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*session)
+	}
+	s.sessions[sess.id] = sess
+	s.mu.Unlock()
+
+	dataReader, dataWriter := io.Pipe()
+	sess.data = dataWriter
+
+	go func() {
+		s.Handler(dataReader, &frameWriter{sess})
+		dataReader.Close()
+
+		sess.mu.Lock()
+		sess.conn.Close()
+		sess.mu.Unlock()
+	}()
+
+	go func() {
+		for ack := range sess.acks {
+			time.Sleep(time.Until(ack.at))
+			if err := sess.writeFrame(iap.Frame{Tag: iap.TagAck, Ack: ack.nb}); err != nil {
+				return
+			}
+		}
+	}()
+
+	return sess
+}
+
+// resume moves an existing session to a new connection. The client is told how much data was received from it, and
+// data it hasn't received is sent again.
+func (s *Server) resume(ws *websocket.Conn, conn net.Conn, query url.Values) *session {
+	s.mu.Lock()
+	sess := s.sessions[query.Get("sid")]
+	s.mu.Unlock()
+
+	if sess == nil {
+		ws.Close(4001, "session ID unknown")
+		return nil
+	}
+
+	ack, err := strconv.ParseUint(query.Get("ack"), 10, 64)
+	if err != nil {
+		ws.Close(4006, "invalid ack")
+		return nil
+	}
+
+	time.Sleep(s.Faults.ReconnectDelay)
+
+	sess.recvMu.Lock()
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if ack < sess.replayStart || ack > sess.replayStart+uint64(len(sess.replay)) {
+		sess.recvMu.Unlock()
+		ws.Close(4005, "bad ack")
+		return nil
+	}
+
+	// from here on, frames from the old connection are discarded and the client resends them. Both locks are held so
+	// the old connection is still written to until it's replaced below.
+	sess.readConn = conn
+	received := sess.received
+	sess.recvMu.Unlock()
+
+	old := sess.ws
+	sess.ws, sess.conn = ws, conn
+	sess.acked = received
+	old.Close(websocket.StatusNormalClosure, "")
+
+	fw := iap.NewFrameWriter(conn)
+	if err := fw.WriteFrame(iap.Frame{Tag: iap.TagReconnectSuccessAck, Ack: received}); err != nil {
+		return nil
+	}
+
+	sess.trimReplay(ack)
+	for data := sess.replay; len(data) > 0; {
+		chunk := data[:min(len(data), iap.MaxFrameSize)]
+		data = data[len(chunk):]
+
+		if err := fw.WriteFrame(iap.Frame{Tag: iap.TagData, Data: chunk}); err != nil {
+			return nil
+		}
+	}
+
+	return sess
+}
+
+// errReplaced is returned when reading from a connection which a session has moved away from.
+var errReplaced = errors.New("connection replaced")
+
+type session struct {
+	id     string
+	faults Faults
+	data   *io.PipeWriter
+	acks   chan pendingAck
+
+	// recvMu guards the connection data is read from, and the number of bytes read from the client.
+	recvMu   sync.Mutex
+	readConn net.Conn
+	received uint64
+
+	// mu guards the connection data is written to, and the data sent to the client that hasn't been acked.
+	mu          sync.Mutex
+	ws          *websocket.Conn
+	conn        net.Conn
+	buf         bytes.Buffer
+	frames      int
+	dataFrames  int
+	acked       uint64
+	replay      []byte
+	replayStart uint64
+}
+
+type pendingAck struct {
+	nb uint64
+	at time.Time
+}
+
+// writeFrame sends a frame to the client, applying faults.
+func (s *session) writeFrame(frame iap.Frame) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if frame.Tag == iap.TagAck {
+		// the session was resumed with a later ack than this one
+		if frame.Ack < s.acked {
+			return nil
+		}
+		s.acked = frame.Ack
+	}
+
+	if frame.Tag == iap.TagData {
+		s.replay = append(s.replay, frame.Data...)
+	}
+
+	if frame.Tag != iap.TagSuccess {
+		s.frames++
+		if s.faults.DropFrame != nil && s.faults.DropFrame(frame.Tag, s.frames) {
+			return nil
+		}
+	}
+
+	if frame.Tag == iap.TagData && s.faults.BogusFrame != nil {
+		if _, err := s.conn.Write(s.faults.BogusFrame); err != nil {
+			return err
+		}
+	}
+
+	s.buf.Reset()
+	if err := iap.NewFrameWriter(&s.buf).WriteFrame(frame); err != nil {
+		return err
+	}
+
+	for b := s.buf.Bytes(); len(b) > 0; {
+		chunkSize := len(b)
+		if s.faults.FragmentSize > 0 {
+			chunkSize = min(chunkSize, s.faults.FragmentSize)
+		}
+		if _, err := s.conn.Write(b[:chunkSize]); err != nil {
+			return err
+		}
+		b = b[chunkSize:]
+	}
+
+	if frame.Tag == iap.TagData {
+		s.dataFrames++
+		if s.faults.CloseAfter > 0 && s.dataFrames >= s.faults.CloseAfter {
+			return s.ws.Close(s.faults.CloseStatus, s.faults.CloseReason)
+		}
+	}
+
+	return nil
+}
+
+// trimReplay discards data the client has acked. s.mu must be held.
+func (s *session) trimReplay(acked uint64) {
+	if acked > s.replayStart && acked <= s.replayStart+uint64(len(s.replay)) {
+		s.replay = s.replay[acked-s.replayStart:]
+		s.replayStart = acked
+	}
+}
+
+// readFrames reads frames from the client on conn, passing data on and queueing acks, until an error occurs or the
+// session moves to another connection.
+func (s *session) readFrames(conn net.Conn) error {
+	frames := iap.NewFrameReader(conn)
+
+	for {
+		frame, err := frames.ReadFrame()
+
+		s.recvMu.Lock()
+		if s.readConn != conn {
+			s.recvMu.Unlock()
+			return errReplaced
+		}
+		if err == nil {
+			err = s.handleFrame(frame)
+		}
+		s.recvMu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handleFrame handles a frame from the client. s.recvMu must be held.
+func (s *session) handleFrame(frame iap.Frame) error {
+	switch frame.Tag {
+	case iap.TagData:
+		if _, err := s.data.Write(frame.Data); err != nil {
+			return err
+		}
+
+		s.received += uint64(len(frame.Data))
+		s.acks <- pendingAck{s.received, time.Now().Add(s.faults.AckDelay)}
+	case iap.TagAck:
+		s.mu.Lock()
+		s.trimReplay(frame.Ack)
+		s.mu.Unlock()
+	default:
+		return fmt.Errorf("unexpected tag %#x", frame.Tag)
+	}
+
+	return nil
+}
+
+// frameWriter wraps writes in data frames, one WebSocket message per frame.
+type frameWriter struct {
+	sess *session
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	n := 0
+
+	for len(p) > 0 {
+		chunk := p[:min(len(p), iap.MaxFrameSize)]
+		p = p[len(chunk):]
+
+		if err := f.sess.writeFrame(iap.Frame{Tag: iap.TagData, Data: chunk}); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,54 @@
+// Package iapwinrm tunnels WinRM, the protocol behind PowerShell remoting, to Windows instances through the IAP.
+package iapwinrm
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+)
+
+const (
+	// HTTPPort is the port WinRM listens on for HTTP.
+	HTTPPort = 5985
+	// HTTPSPort is the port WinRM listens on for HTTPS.
+	HTTPSPort = 5986
+)
+
+// Endpoint returns the URL of the WinRM service on host, over HTTPS on HTTPSPort if useTLS is set and HTTP on HTTPPort
+// otherwise.
+func Endpoint(host string, useTLS bool) string {
+	u := url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(host, strconv.Itoa(HTTPPort)),
+		Path:   "/wsman",
+	}
+	if useTLS {
+		u.Scheme = "https"
+		u.Host = net.JoinHostPort(host, strconv.Itoa(HTTPSPort))
+	}
+	return u.String()
+}
+
+// NewTransport returns an http.Transport which dials a tunnel with opts for every connection, so WinRM clients can be
+// pointed at an Endpoint on the instance. The port of the URL is tunneled to, but its host is only used for the Host
+// header and to verify the certificate over HTTPS, since the instance comes from opts. Idle connections are kept for
+// reuse, as dialing a tunnel is slower than a TCP handshake.
+func NewTransport(opts ...iap.DialOption) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			return iap.Dial(ctx, append(opts[:len(opts):len(opts)], iap.WithPort(port))...)
+		},
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
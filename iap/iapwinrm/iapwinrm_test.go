@@ -0,0 +1,66 @@
+package iapwinrm_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/cedws/iapc/iap/iapwinrm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// wsmanServer answers every request with the length of its body, keeping the connection open between requests.
+func wsmanServer(r io.Reader, w io.Writer) {
+	br := bufio.NewReader(r)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Body:          io.NopCloser(strings.NewReader(fmt.Sprint(len(body)))),
+			ContentLength: int64(len(fmt.Sprint(len(body)))),
+		}
+		if err := resp.Write(w); err != nil {
+			return
+		}
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	assert.Equal(t, "http://win-1:5985/wsman", iapwinrm.Endpoint("win-1", false))
+	assert.Equal(t, "https://win-1:5986/wsman", iapwinrm.Endpoint("win-1", true))
+}
+
+func TestTransport(t *testing.T) {
+	server := iaptest.NewServer()
+	server.Handler = wsmanServer
+	defer server.Close()
+
+	client := &http.Client{Transport: iapwinrm.NewTransport(server.DialOptions()...)}
+
+	for range 3 {
+		resp, err := client.Post(iapwinrm.Endpoint("win-1", false), "application/soap+xml", strings.NewReader("<Envelope/>"))
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "11", string(body))
+	}
+
+	// the tunnel is reused between requests, and goes to the port in the URL
+	queries := server.Queries()
+	require.Len(t, queries, 1)
+	assert.Equal(t, "5985", queries[0].Get("port"))
+}
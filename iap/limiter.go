@@ -0,0 +1,170 @@
+package iap
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionLimiter limits the number of relay sessions open at once between the connections dialed with it, so bursts
+// of dials don't trip IAP quotas. Dials beyond the limit queue in the order they arrived until a connection closes or
+// their context is done. A SessionLimiter can be shared between goroutines.
+type SessionLimiter struct {
+	slots   chan struct{}
+	waiting atomic.Int64
+	queued  atomic.Uint64
+	// waited is the total time dials have spent queued in nanoseconds
+	waited atomic.Int64
+}
+
+// LimiterStats is a snapshot of a SessionLimiter.
+type LimiterStats struct {
+	Active  int
+	Waiting int
+	// Queued is the number of dials which have had to wait for a session, including those which gave up, and WaitTime
+	// the total time they waited.
+	Queued   uint64
+	WaitTime time.Duration
+}
+
+// NewSessionLimiter returns a SessionLimiter allowing at most max sessions at once.
+func NewSessionLimiter(max int) *SessionLimiter {
+	return &SessionLimiter{
+		slots: make(chan struct{}, max),
+	}
+}
+
+// Active returns the number of sessions currently open.
+func (l *SessionLimiter) Active() int {
+	return len(l.slots)
+}
+
+// Waiting returns the number of dials queued for a session.
+func (l *SessionLimiter) Waiting() int {
+	return int(l.waiting.Load())
+}
+
+// Stats returns the sessions open and the dials queued now, and how long dials have waited so far.
+func (l *SessionLimiter) Stats() LimiterStats {
+	return LimiterStats{
+		Active:   l.Active(),
+		Waiting:  l.Waiting(),
+		Queued:   l.queued.Load(),
+		WaitTime: time.Duration(l.waited.Load()),
+	}
+}
+
+func (l *SessionLimiter) acquire(ctx context.Context, metrics *instruments) error {
+	// fast path so uncontended dials aren't counted as waiting
+	select {
+	case l.slots <- struct{}{}:
+		metrics.limiterWaited(0)
+		return nil
+	default:
+	}
+
+	start := time.Now()
+
+	l.queued.Add(1)
+	l.waiting.Add(1)
+	metrics.limiterWaiting(1)
+	defer func() {
+		l.waited.Add(int64(time.Since(start)))
+		l.waiting.Add(-1)
+		metrics.limiterWaiting(-1)
+	}()
+
+	select {
+	case l.slots <- struct{}{}:
+		metrics.limiterWaited(time.Since(start))
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *SessionLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// ProjectLimiter limits the relay sessions open at once in each project, like a SessionLimiter of its own for every
+// project, so dials queue instead of being rejected by the relay once a project's tunnel quota is reached. A
+// ProjectLimiter can be shared between goroutines.
+type ProjectLimiter struct {
+	max int
+
+	mu       sync.Mutex
+	projects map[string]*SessionLimiter
+}
+
+// NewProjectLimiter returns a ProjectLimiter allowing at most max sessions at once in each project.
+func NewProjectLimiter(max int) *ProjectLimiter {
+	return &ProjectLimiter{
+		max:      max,
+		projects: make(map[string]*SessionLimiter),
+	}
+}
+
+// Limiter returns the SessionLimiter for project, creating it if the project hasn't been dialed yet.
+func (l *ProjectLimiter) Limiter(project string) *SessionLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limiter, ok := l.projects[project]
+	if !ok {
+		limiter = NewSessionLimiter(l.max)
+		l.projects[project] = limiter
+	}
+	return limiter
+}
+
+// Lookup returns the SessionLimiter for project if the project has been dialed, without creating one.
+func (l *ProjectLimiter) Lookup(project string) (*SessionLimiter, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limiter, ok := l.projects[project]
+	return limiter, ok
+}
+
+// Stats returns the stats of each project dialed so far.
+func (l *ProjectLimiter) Stats() map[string]LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := make(map[string]LimiterStats, len(l.projects))
+	for project, limiter := range l.projects {
+		stats[project] = limiter.Stats()
+	}
+	return stats
+}
+
+// acquireSessions queues for a session from the project and session limiters.
+func (d *dialOptions) acquireSessions(ctx context.Context, metrics *instruments) error {
+	if d.ProjectLimiter != nil {
+		limiter := d.ProjectLimiter.Limiter(d.Project)
+		if err := limiter.acquire(ctx, metrics); err != nil {
+			return err
+		}
+		d.projectSessions = limiter
+	}
+
+	if d.SessionLimiter != nil {
+		if err := d.SessionLimiter.acquire(ctx, metrics); err != nil {
+			d.projectSessions.release()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseSessions returns the sessions taken by acquireSessions.
+func (d *dialOptions) releaseSessions() {
+	d.projectSessions.release()
+	d.SessionLimiter.release()
+}
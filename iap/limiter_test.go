@@ -0,0 +1,98 @@
+package iap_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionLimiter(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	limiter := iap.NewSessionLimiter(1)
+	opts := append(server.DialOptions(), iap.WithSessionLimiter(limiter))
+
+	first, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	assert.Equal(t, 1, limiter.Active())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = iap.Dial(ctx, opts...)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, limiter.Waiting())
+
+	dialed := make(chan *iap.Conn)
+	go func() {
+		conn, err := iap.Dial(context.Background(), opts...)
+		assert.NoError(t, err)
+		dialed <- conn
+	}()
+
+	assert.Eventually(t, func() bool {
+		return limiter.Waiting() == 1
+	}, time.Second, time.Millisecond)
+
+	first.Close()
+
+	second := <-dialed
+	require.NotNil(t, second)
+	assert.Equal(t, 1, limiter.Active())
+
+	second.Close()
+	assert.Equal(t, 0, limiter.Active())
+}
+
+func TestSessionLimiterFailedDial(t *testing.T) {
+	server := iaptest.NewServer()
+	server.Close()
+
+	limiter := iap.NewSessionLimiter(1)
+
+	_, err := iap.Dial(context.Background(), append(server.DialOptions(), iap.WithSessionLimiter(limiter))...)
+	require.Error(t, err)
+	assert.Equal(t, 0, limiter.Active())
+}
+
+func TestProjectLimiter(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	limiter := iap.NewProjectLimiter(1)
+	dial := func(ctx context.Context, project string) (*iap.Conn, error) {
+		return iap.Dial(ctx, append(server.DialOptions(), iap.WithProject(project), iap.WithProjectLimiter(limiter))...)
+	}
+
+	a, err := dial(context.Background(), "a")
+	require.NoError(t, err)
+	defer a.Close()
+
+	// other projects have room of their own
+	b, err := dial(context.Background(), "b")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = dial(ctx, "a")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	b.Close()
+
+	stats := limiter.Stats()
+	assert.Equal(t, 1, stats["a"].Active)
+	assert.Equal(t, uint64(1), stats["a"].Queued)
+	assert.GreaterOrEqual(t, stats["a"].WaitTime, 20*time.Millisecond)
+	assert.Equal(t, iap.LimiterStats{}, stats["b"])
+
+	_, ok := limiter.Lookup("c")
+	assert.False(t, ok)
+	assert.NotContains(t, limiter.Stats(), "c")
+}
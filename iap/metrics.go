@@ -0,0 +1,188 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const meterName = "github.com/cedws/iapc/iap"
+
+var (
+	directionIn  = attribute.String("direction", "in")
+	directionOut = attribute.String("direction", "out")
+)
+
+// instruments are the OpenTelemetry instruments recorded by a Conn. A nil *instruments records nothing.
+type instruments struct {
+	sentBytes     metric.Int64Counter
+	receivedBytes metric.Int64Counter
+	frames        metric.Int64Counter
+	dialErrors    metric.Int64Counter
+	dialDuration  metric.Float64Histogram
+	reconnects    metric.Int64Counter
+	limiterWait   metric.Float64Histogram
+	limiterQueue  metric.Int64UpDownCounter
+
+	// attrs are added to the connection's measurements, set by the handshake while other goroutines may be measuring
+	attrs atomic.Pointer[[]attribute.KeyValue]
+}
+
+func newInstruments(provider metric.MeterProvider) (*instruments, error) {
+	if provider == nil {
+		return nil, nil
+	}
+
+	meter := provider.Meter(meterName)
+
+	sentBytes, err := meter.Int64Counter("iap.sent",
+		metric.WithUnit("By"),
+		metric.WithDescription("Bytes of data sent to the target."))
+	if err != nil {
+		return nil, err
+	}
+
+	receivedBytes, err := meter.Int64Counter("iap.received",
+		metric.WithUnit("By"),
+		metric.WithDescription("Bytes of data received from the target."))
+	if err != nil {
+		return nil, err
+	}
+
+	frames, err := meter.Int64Counter("iap.frames",
+		metric.WithUnit("{frame}"),
+		metric.WithDescription("Subprotocol frames sent and received, by direction and tag."))
+	if err != nil {
+		return nil, err
+	}
+
+	dialErrors, err := meter.Int64Counter("iap.dial_errors",
+		metric.WithUnit("{error}"),
+		metric.WithDescription("Failed dials, by WebSocket close code where the relay closed the connection."))
+	if err != nil {
+		return nil, err
+	}
+
+	dialDuration, err := meter.Float64Histogram("iap.dial.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Time taken to dial the relay and complete the handshake, for successful dials."),
+		metric.WithExplicitBucketBoundaries(0.05, 0.1, 0.2, 0.4, 0.8, 1.6, 3.2, 6.4, 12.8, 25.6))
+	if err != nil {
+		return nil, err
+	}
+
+	reconnects, err := meter.Int64Counter("iap.reconnects",
+		metric.WithUnit("{reconnect}"),
+		metric.WithDescription("Connections moved to a new relay session."))
+	if err != nil {
+		return nil, err
+	}
+
+	limiterWait, err := meter.Float64Histogram("iap.session_limiter.wait",
+		metric.WithUnit("s"),
+		metric.WithDescription("Time dials spent queued by a SessionLimiter."),
+		metric.WithExplicitBucketBoundaries(0, 0.05, 0.1, 0.2, 0.4, 0.8, 1.6, 3.2, 6.4, 12.8, 25.6))
+	if err != nil {
+		return nil, err
+	}
+
+	limiterQueue, err := meter.Int64UpDownCounter("iap.session_limiter.waiting",
+		metric.WithUnit("{dial}"),
+		metric.WithDescription("Dials currently queued by a SessionLimiter."))
+	if err != nil {
+		return nil, err
+	}
+
+	return &instruments{
+		sentBytes:     sentBytes,
+		receivedBytes: receivedBytes,
+		frames:        frames,
+		dialErrors:    dialErrors,
+		dialDuration:  dialDuration,
+		reconnects:    reconnects,
+		limiterWait:   limiterWait,
+		limiterQueue:  limiterQueue,
+	}, nil
+}
+
+// session adds the relay session ID to the connection's measurements. See WithSessionIDAttribute.
+func (i *instruments) session(sid string) {
+	if i == nil {
+		return
+	}
+	i.attrs.Store(&[]attribute.KeyValue{attribute.String("session_id", sid)})
+}
+
+func (i *instruments) attributes() []attribute.KeyValue {
+	if attrs := i.attrs.Load(); attrs != nil {
+		return *attrs
+	}
+	return nil
+}
+
+func (i *instruments) frame(direction attribute.KeyValue, tag uint16) {
+	if i == nil {
+		return
+	}
+	attrs := append([]attribute.KeyValue{direction, attribute.Int("tag", int(tag))}, i.attributes()...)
+	i.frames.Add(context.Background(), 1, metric.WithAttributes(attrs...))
+}
+
+func (i *instruments) sent(nb int) {
+	if i == nil {
+		return
+	}
+	i.sentBytes.Add(context.Background(), int64(nb), metric.WithAttributes(i.attributes()...))
+}
+
+func (i *instruments) received(nb int) {
+	if i == nil {
+		return
+	}
+	i.receivedBytes.Add(context.Background(), int64(nb), metric.WithAttributes(i.attributes()...))
+}
+
+func (i *instruments) dialed(d time.Duration) {
+	if i == nil {
+		return
+	}
+	i.dialDuration.Record(context.Background(), d.Seconds())
+}
+
+func (i *instruments) reconnect() {
+	if i == nil {
+		return
+	}
+	i.reconnects.Add(context.Background(), 1, metric.WithAttributes(i.attributes()...))
+}
+
+func (i *instruments) limiterWaited(d time.Duration) {
+	if i == nil {
+		return
+	}
+	i.limiterWait.Record(context.Background(), d.Seconds())
+}
+
+func (i *instruments) limiterWaiting(delta int64) {
+	if i == nil {
+		return
+	}
+	i.limiterQueue.Add(context.Background(), delta)
+}
+
+func (i *instruments) dialError(err error) {
+	if i == nil {
+		return
+	}
+
+	var closeErr *CloseError
+	if errors.As(err, &closeErr) {
+		i.dialErrors.Add(context.Background(), 1, metric.WithAttributes(attribute.Int("code", closeErr.Code)))
+		return
+	}
+	i.dialErrors.Add(context.Background(), 1)
+}
@@ -0,0 +1,102 @@
+package iap_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// collectSums returns the totals of counters and the observation counts of histograms.
+func collectSums(t *testing.T, reader sdkmetric.Reader) map[string]int64 {
+	t.Helper()
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+
+	sums := make(map[string]int64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, dp := range data.DataPoints {
+					sums[m.Name] += dp.Value
+				}
+			case metricdata.Histogram[float64]:
+				for _, dp := range data.DataPoints {
+					sums[m.Name] += int64(dp.Count)
+				}
+			}
+		}
+	}
+
+	return sums
+}
+
+func TestMeterProvider(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	conn, err := iap.Dial(context.Background(), append(server.DialOptions(), iap.WithMeterProvider(provider))...)
+	require.NoError(t, err)
+
+	echo(t, conn, "hello")
+	conn.Close()
+
+	sums := collectSums(t, reader)
+	assert.EqualValues(t, 5, sums["iap.sent"])
+	assert.EqualValues(t, 5, sums["iap.received"])
+	// success and data frames in, data frame out, and possibly an ack in
+	assert.GreaterOrEqual(t, sums["iap.frames"], int64(3))
+	assert.EqualValues(t, 1, sums["iap.dial.duration"])
+
+	server.Close()
+
+	_, err = iap.Dial(context.Background(), append(server.DialOptions(), iap.WithMeterProvider(provider))...)
+	require.Error(t, err)
+
+	assert.EqualValues(t, 1, collectSums(t, reader)["iap.dial_errors"])
+}
+
+func TestSessionIDAttribute(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	opts := append(server.DialOptions(), iap.WithMeterProvider(provider), iap.WithSessionIDAttribute())
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "iap.sent" {
+				continue
+			}
+			dps := m.Data.(metricdata.Sum[int64]).DataPoints
+			require.Len(t, dps, 1)
+
+			sid, ok := dps[0].Attributes.Value("session_id")
+			require.True(t, ok)
+			assert.Equal(t, conn.SessionID(), sid.AsString())
+			return
+		}
+	}
+	t.Fatal("no iap.sent metric")
+}
@@ -0,0 +1,131 @@
+package iap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const apiHost = "iap.googleapis.com"
+
+// The permissions needed to tunnel to instances and to hosts in destination groups, both granted by
+// roles/iap.tunnelResourceAccessor.
+const (
+	PermissionTunnelInstances  = "iap.tunnelInstances.accessViaIAP"
+	PermissionTunnelDestGroups = "iap.tunnelDestGroups.accessViaIAP"
+)
+
+// PermissionError is returned by CheckPermissions when the caller lacks permissions needed to tunnel to the target.
+type PermissionError struct {
+	// Resource is the IAP tunnel resource checked, like projects/PROJECT/iap_tunnel/zones/ZONE/instances/INSTANCE.
+	Resource string
+	Missing  []string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("missing %v on %v, which roles/iap.tunnelResourceAccessor grants", strings.Join(e.Missing, ", "), e.Resource)
+}
+
+// CheckPermissions asks IAP whether the caller may tunnel to the target described by opts, the same options as for
+// Dial, so tools can explain a lack of access before dialing. It returns a *PermissionError listing the missing
+// permissions if the caller isn't allowed, or another error if the check itself failed.
+func CheckPermissions(ctx context.Context, opts ...DialOption) error {
+	dopts, err := collectDialOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	resource, permission := tunnelResource(dopts)
+
+	missing, err := missingPermissions(ctx, dopts, resource, []string{permission})
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return &PermissionError{resource, missing}
+	}
+	return nil
+}
+
+// tunnelResource returns the IAP resource for the target and the permission needed to tunnel to it.
+func tunnelResource(dopts *dialOptions) (resource, permission string) {
+	if dopts.Instance != "" {
+		return fmt.Sprintf("projects/%v/iap_tunnel/zones/%v/instances/%v", dopts.Project, dopts.Zone, dopts.Instance), PermissionTunnelInstances
+	}
+	return fmt.Sprintf("projects/%v/iap_tunnel/locations/%v/destGroups/%v", dopts.Project, dopts.Region, dopts.Group), PermissionTunnelDestGroups
+}
+
+// missingPermissions calls testIamPermissions for the resource, returning the permissions the caller doesn't have.
+func missingPermissions(ctx context.Context, dopts *dialOptions, resource string, permissions []string) ([]string, error) {
+	body, err := json.Marshal(map[string][]string{"permissions": permissions})
+	if err != nil {
+		return nil, err
+	}
+
+	reqURL := url.URL{
+		Scheme: "https",
+		Host:   apiHost,
+		Path:   fmt.Sprintf("/v1/%v:testIamPermissions", resource),
+	}
+	if dopts.APIEndpoint != "" {
+		reqURL.Scheme, reqURL.Host = cutScheme(dopts.APIEndpoint, "https", "http")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client, err := apiClient(ctx, dopts)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("testing IAM permissions on %v: %v", resource, resp.Status)
+	}
+
+	var granted struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&granted); err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, permission := range permissions {
+		if !slices.Contains(granted.Permissions, permission) {
+			missing = append(missing, permission)
+		}
+	}
+	return missing, nil
+}
+
+// apiClient returns an HTTP client authorized with the token source from dopts, based on their HTTP client if set.
+func apiClient(ctx context.Context, dopts *dialOptions) (*http.Client, error) {
+	client := http.DefaultClient
+	if dopts.HTTPClient != nil {
+		client = dopts.HTTPClient
+	}
+
+	tokenSource, err := dopts.tokenSource()
+	if err != nil || tokenSource == nil {
+		return client, err
+	}
+
+	return oauth2.NewClient(context.WithValue(ctx, oauth2.HTTPClient, client), tokenSource), nil
+}
@@ -0,0 +1,33 @@
+package iap_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPermissions(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	instance := append(server.DialOptions(), iap.WithProject("project"), iap.WithInstance("prod-1", "europe-west2-a", "nic0"))
+	host := append(server.DialOptions(), iap.WithProject("project"), iap.WithHost("10.0.0.5", "europe-west2", "prod", "prod"))
+
+	assert.NoError(t, iap.CheckPermissions(context.Background(), instance...))
+	assert.NoError(t, iap.CheckPermissions(context.Background(), host...))
+
+	server.DeniedPermissions = []string{iap.PermissionTunnelInstances}
+
+	var permErr *iap.PermissionError
+	err := iap.CheckPermissions(context.Background(), instance...)
+	require.ErrorAs(t, err, &permErr)
+	assert.Equal(t, "projects/project/iap_tunnel/zones/europe-west2-a/instances/prod-1", permErr.Resource)
+	assert.Equal(t, []string{iap.PermissionTunnelInstances}, permErr.Missing)
+
+	// destination groups need a different permission
+	assert.NoError(t, iap.CheckPermissions(context.Background(), host...))
+}
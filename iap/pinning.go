@@ -0,0 +1,99 @@
+package iap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrPinMismatch is returned by Dial when none of the relay's certificates match a key pinned with WithRelayPins.
+var ErrPinMismatch = errors.New("relay certificate doesn't match a pinned key")
+
+// PublicKeyPin returns the pin of cert's public key for WithRelayPins, written as sha256/ and the base64 SHA-256 hash of
+// its DER-encoded SubjectPublicKeyInfo like HPKP and curl's --pinnedpubkey.
+func PublicKeyPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func parsePin(pin string) ([]byte, error) {
+	encoded := strings.TrimLeft(strings.TrimPrefix(pin, "sha256"), "/")
+
+	hash, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("invalid relay key pin %q, want sha256/ followed by a base64 SHA-256 hash", pin)
+	}
+	return hash, nil
+}
+
+// verifyPins returns a TLS connection check passing if any certificate in the relay's verified chain has a pinned key.
+func verifyPins(pins [][]byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		chains := cs.VerifiedChains
+		if len(chains) == 0 {
+			// Verification was skipped, so nothing ties the certificates sent by the relay together. Anyone can send
+			// a public intermediate after a leaf of their own, so only the leaf, whose key the relay proved it holds,
+			// is trusted.
+			if len(cs.PeerCertificates) == 0 {
+				return ErrPinMismatch
+			}
+			chains = [][]*x509.Certificate{cs.PeerCertificates[:1]}
+		}
+
+		for _, chain := range chains {
+			for _, cert := range chain {
+				hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range pins {
+					if bytes.Equal(hash[:], pin) {
+						return nil
+					}
+				}
+			}
+		}
+		return ErrPinMismatch
+	}
+}
+
+// pinnedClient returns a copy of client which only trusts the relay CAs and keys given with WithRelayCAs and
+// WithRelayPins. The checks are made during the TLS handshake, before any credentials are sent.
+func pinnedClient(client *http.Client, dopts *dialOptions) (*http.Client, error) {
+	pins := make([][]byte, 0, len(dopts.RelayPins))
+	for _, pin := range dopts.RelayPins {
+		hash, err := parsePin(pin)
+		if err != nil {
+			return nil, err
+		}
+		pins = append(pins, hash)
+	}
+
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	transport, ok := base.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("can't pin the relay's certificate with a %T transport, only an *http.Transport", base)
+	}
+
+	transport = transport.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	if dopts.RelayCAs != nil {
+		transport.TLSClientConfig.RootCAs = dopts.RelayCAs
+	}
+	if len(pins) > 0 {
+		transport.TLSClientConfig.VerifyConnection = verifyPins(pins)
+	}
+
+	pinned := *client
+	pinned.Transport = transport
+
+	return &pinned, nil
+}
@@ -0,0 +1,129 @@
+package iap_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// otherPin is the pin of a key that isn't the test server's.
+const otherPin = "sha256/D3ou/r/+k4KQR/VDAcEK7iSvvhhv6Mrz+eKqlOUth2s="
+
+func TestRelayPins(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	pin := iap.PublicKeyPin(server.Certificate())
+
+	conn, err := iap.Dial(context.Background(), append(server.DialOptions(), iap.WithRelayPins(otherPin, pin))...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+}
+
+func TestRelayPinMismatch(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	_, err := iap.Dial(context.Background(), append(server.DialOptions(), iap.WithRelayPins(otherPin))...)
+	assert.ErrorIs(t, err, iap.ErrPinMismatch)
+	// the handshake failed before the request, and its credentials, were sent
+	assert.Empty(t, server.Queries())
+
+	_, err = iap.Dial(context.Background(), append(server.DialOptions(), iap.WithRelayPins("sha256/short"))...)
+	assert.ErrorContains(t, err, "invalid relay key pin")
+}
+
+func TestRelayCAs(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	conn, err := iap.Dial(context.Background(), append(server.DialOptions(), iap.WithRelayCAs(pool))...)
+	require.NoError(t, err)
+	conn.Close()
+
+	_, err = iap.Dial(context.Background(), append(server.DialOptions(), iap.WithRelayCAs(x509.NewCertPool()))...)
+	var verifyErr *tls.CertificateVerificationError
+	assert.ErrorAs(t, err, &verifyErr)
+	assert.Empty(t, server.Queries()[1:])
+}
+
+// newCert returns a certificate for key signed by parent's key, or self-signed if parent is nil.
+func newCert(t *testing.T, name string, key *ecdsa.PrivateKey, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		DNSNames:              []string{name},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestRelayPinForgedLeaf(t *testing.T) {
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	intermediate := newCert(t, "intermediate", intermediateKey, nil, nil)
+
+	// a leaf signed by the attacker's own key, sent ahead of the genuine intermediate which is public
+	forgedKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	forged := newCert(t, "relay", forgedKey, nil, nil)
+
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{forged.Raw, intermediate.Raw},
+		PrivateKey:  forgedKey,
+	}}}
+	server.StartTLS()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	dial := func(pin string) error {
+		_, err := iap.Dial(context.Background(),
+			iap.WithEndpoint(strings.TrimPrefix(server.URL, "https://")),
+			iap.WithHTTPClient(client),
+			iap.WithInstance("prod-1", "europe-west2-a", "nic0"),
+			iap.WithRelayPins(pin),
+		)
+		return err
+	}
+
+	assert.ErrorIs(t, dial(iap.PublicKeyPin(intermediate)), iap.ErrPinMismatch)
+
+	// the leaf itself can still be pinned when verification is skipped
+	err = dial(iap.PublicKeyPin(forged))
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, iap.ErrPinMismatch)
+}
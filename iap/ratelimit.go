@@ -0,0 +1,66 @@
+package iap
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter caps the rate data passes through the connections using it, in bytes per second. Connections sharing a
+// RateLimiter share its rate, e.g. between all the clients of a listener. A RateLimiter can be shared between
+// goroutines.
+type RateLimiter struct {
+	limiter *rate.Limiter
+}
+
+// NewRateLimiter returns a RateLimiter allowing bytesPerSecond bytes per second, with bursts of up to a second's worth.
+func NewRateLimiter(bytesPerSecond int) *RateLimiter {
+	// a burst smaller than a frame could never be waited for
+	return &RateLimiter{rate.NewLimiter(rate.Limit(bytesPerSecond), max(bytesPerSecond, subprotoMaxFrameSize))}
+}
+
+func newRateLimiter(bytesPerSecond int) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return NewRateLimiter(bytesPerSecond)
+}
+
+// wait blocks until n bytes may pass. It returns net.ErrClosed if done is closed first, or os.ErrDeadlineExceeded
+// without waiting if the bytes can't pass before deadline, in Unix nanoseconds or 0 for none. A nil *RateLimiter never
+// waits.
+func (l *RateLimiter) wait(n int, done <-chan struct{}, deadline int64) error {
+	if l == nil {
+		return nil
+	}
+
+	for n > 0 {
+		chunk := min(n, l.limiter.Burst())
+		n -= chunk
+
+		now := time.Now()
+		reservation := l.limiter.ReserveN(now, chunk)
+
+		delay := reservation.DelayFrom(now)
+		if delay == 0 {
+			continue
+		}
+		if deadline != 0 && now.Add(delay).UnixNano() > deadline {
+			reservation.CancelAt(now)
+			return os.ErrDeadlineExceeded
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			reservation.Cancel()
+			return net.ErrClosed
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package iap_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRate = 64 * 1024
+
+// transfer writes size bytes to conn while reading the echo, returning how long it took.
+func transfer(t *testing.T, conn *iap.Conn, size int) time.Duration {
+	t.Helper()
+
+	start := time.Now()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(conn, make([]byte, size))
+		errs <- err
+	}()
+
+	_, err := conn.Write(make([]byte, size))
+	require.NoError(t, err)
+	require.NoError(t, <-errs)
+
+	return time.Since(start)
+}
+
+func TestRateLimit(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		upload   int
+		download int
+	}{
+		{"upload", testRate, 0},
+		{"download", 0, testRate},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := append(server.DialOptions(), iap.WithRateLimit(test.upload, test.download))
+
+			conn, err := iap.Dial(context.Background(), opts...)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			// the first second's worth is a burst, the rest takes half a second
+			assert.GreaterOrEqual(t, transfer(t, conn, testRate+testRate/2), 400*time.Millisecond)
+		})
+	}
+}
+
+func TestSharedRateLimit(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	opts := append(server.DialOptions(), iap.WithSharedRateLimit(iap.NewRateLimiter(testRate), nil))
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for range 2 {
+		conn, err := iap.Dial(context.Background(), opts...)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			transfer(t, conn, testRate*3/4)
+		}()
+	}
+	wg.Wait()
+
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestRateLimitWriteDeadline(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	opts := append(server.DialOptions(), iap.WithRateLimit(testRate, 0))
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	go io.Copy(io.Discard, conn)
+
+	conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+
+	// the burst is written, the rest would only be allowed after the deadline
+	n, err := conn.Write(make([]byte, 2*testRate))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Equal(t, testRate, n)
+
+	conn.SetWriteDeadline(time.Time{})
+
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,49 @@
+package iap
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const relayConnectTimeout = 30 * time.Second
+
+// relayClients are the HTTP clients for WebSocket handshakes by fallback delay, so dials with the same delay share one.
+var relayClients sync.Map
+
+// relayClient returns the HTTP client for the WebSocket handshake. Unless one is given with WithHTTPClient, it resolves
+// every address of the relay and races IPv4 against IPv6 once the fallback delay passes, so a broken IPv6 path doesn't
+// hold up dials. Either is restricted to the CAs and keys pinned for the relay, if any.
+func relayClient(dopts *dialOptions) (*http.Client, error) {
+	client := dopts.HTTPClient
+	if client == nil {
+		client = sharedRelayClient(dopts)
+	}
+
+	if dopts.RelayCAs != nil || len(dopts.RelayPins) > 0 {
+		return pinnedClient(client, dopts)
+	}
+	return client, nil
+}
+
+func sharedRelayClient(dopts *dialOptions) *http.Client {
+	if client, ok := relayClients.Load(dopts.FallbackDelay); ok {
+		return client.(*http.Client)
+	}
+	client, _ := relayClients.LoadOrStore(dopts.FallbackDelay, newRelayClient(dopts.FallbackDelay))
+	return client.(*http.Client)
+}
+
+func newRelayClient(fallbackDelay time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:       relayConnectTimeout,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: fallbackDelay,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{Transport: transport}
+}
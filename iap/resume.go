@@ -0,0 +1,261 @@
+package iap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// recycleTimeout bounds how long moving to a new relay session may take.
+	recycleTimeout = 30 * time.Second
+	// recycleRetry is how long to wait before retrying a failed recycle.
+	recycleRetry = 10 * time.Second
+)
+
+// relaySession is a WebSocket to the relay carrying the connection. A connection moves to a new session when it's
+// recycled, resuming the same backend connection.
+type relaySession struct {
+	conn   net.Conn
+	frames *FrameReader
+	// resumeAt is the number of bytes that had been received when the session was resumed, which the relay resends
+	// data from.
+	resumeAt uint64
+}
+
+func newRelaySession(conn net.Conn) *relaySession {
+	return &relaySession{
+		conn:   conn,
+		frames: NewFrameReader(conn),
+	}
+}
+
+// abort closes the session without a graceful shutdown, if its channel supports that.
+func (s *relaySession) abort() {
+	if aborter, ok := s.conn.(interface{ Abort() }); ok {
+		aborter.Abort()
+		return
+	}
+	s.conn.Close()
+}
+
+// writeMessage writes a frame to the current relay session. payload is the data carried by a data frame, which is
+// counted as sent and kept for replay. If the session is replaced while writing, the error is dropped because the new
+// session carries on from what the relay received.
+func (c *Conn) writeMessage(frame, payload []byte) error {
+	c.writeMu.Lock()
+
+	if payload != nil {
+		c.appendReplay(payload)
+		// count the bytes before writing them so that an ack racing with the write is never ahead of them
+		c.sendNbUnacked.Add(uint64(len(payload)))
+	}
+
+	session := c.session
+	_, err := session.conn.Write(frame)
+
+	c.writeMu.Unlock()
+
+	if err != nil && c.replacedSession(session) != nil {
+		return nil
+	}
+	return err
+}
+
+// replacedSession waits for a recycle in progress to finish and returns the session which replaced s, or nil if s is
+// still the current session.
+func (c *Conn) replacedSession(s *relaySession) *relaySession {
+	c.sessMu.Lock()
+	recycled := c.recycled
+	c.sessMu.Unlock()
+
+	if recycled != nil {
+		<-recycled
+	}
+
+	if session := c.currentSession(); session != s {
+		return session
+	}
+	return nil
+}
+
+// recycling reports whether the connection is moving to a new relay session.
+func (c *Conn) recycling() bool {
+	c.sessMu.Lock()
+	defer c.sessMu.Unlock()
+
+	return c.recycled != nil
+}
+
+// resumeReading moves the read loop to a resumed session.
+func (c *Conn) resumeReading(s *relaySession) {
+	c.readSession = s
+	// the relay resends everything after resumeAt, some of which may have been read from the old session already
+	c.recvSkip = c.recvNbUnacked.Load() - s.resumeAt
+}
+
+func (c *Conn) appendReplay(data []byte) {
+	if !c.resumable {
+		return
+	}
+
+	c.replayMu.Lock()
+	defer c.replayMu.Unlock()
+
+	c.replay = append(c.replay, data...)
+}
+
+func (c *Conn) trimReplay(acked uint64) {
+	if !c.resumable {
+		return
+	}
+
+	c.replayMu.Lock()
+	defer c.replayMu.Unlock()
+
+	if acked > c.replayStart {
+		c.replay = c.replay[acked-c.replayStart:]
+		c.replayStart = acked
+	}
+}
+
+// replayFrom resends the data sent after the first acked bytes to a resumed session.
+func (c *Conn) replayFrom(s *relaySession, acked uint64) error {
+	c.replayMu.Lock()
+	defer c.replayMu.Unlock()
+
+	sent := c.replayStart + uint64(len(c.replay))
+	if acked < c.replayStart || acked > sent {
+		return &ProtocolError{fmt.Sprintf("reconnect ack %v is outside of the unacked bytes %v-%v", acked, c.replayStart, sent)}
+	}
+
+	c.replay = c.replay[acked-c.replayStart:]
+	c.replayStart = acked
+
+	fw := NewFrameWriter(s.conn)
+	for data := c.replay; len(data) > 0; {
+		chunk := data[:min(len(data), subprotoMaxFrameSize)]
+		data = data[len(chunk):]
+
+		if err := fw.WriteFrame(Frame{Tag: subprotoTagData, Data: chunk}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recycle moves the connection to a new relay session which resumes the current one. The current session keeps going
+// if the new one can't be established, but once the relay has accepted it there's no going back, so any later failure
+// shuts the connection down.
+func (c *Conn) recycle(ctx context.Context) error {
+	recycled := make(chan struct{})
+
+	c.sessMu.Lock()
+	c.recycled = recycled
+	old := c.session
+	c.sessMu.Unlock()
+
+	defer func() {
+		c.sessMu.Lock()
+		c.recycled = nil
+		c.sessMu.Unlock()
+
+		close(recycled)
+	}()
+
+	received := c.recvNbUnacked.Load()
+
+	session, err := dialSession(ctx, c.dopts, reconnectURL(c.dopts, c.SessionID(), received))
+	if err != nil {
+		return err
+	}
+	conn := session.conn
+	session.resumeAt = received
+
+	// Close only closes the current session, so the new one is closed if the recycle is abandoned
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	frame, err := session.frames.ReadFrame()
+	if err != nil {
+		conn.Close()
+		return wrapCloseError(err)
+	}
+	if frame.Tag != subprotoTagReconnectSuccessAck {
+		conn.Close()
+		return &ProtocolError{fmt.Sprintf("expected reconnect success ack but got tag %#x", frame.Tag)}
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.replayFrom(session, frame.Ack); err != nil {
+		conn.Close()
+		c.shutdown(wrapCloseError(err))
+		return err
+	}
+
+	c.sessMu.Lock()
+	select {
+	case <-c.done:
+		c.sessMu.Unlock()
+		conn.Close()
+		return net.ErrClosed
+	default:
+	}
+	c.session = session
+	c.sessMu.Unlock()
+
+	c.sendNbAcked.Store(frame.Ack)
+	c.recvNbAcked.Store(received)
+	c.metrics.reconnect()
+	c.trace.log("Resumed session", "sent", frame.Ack, "received", received)
+
+	// unblocks the read loop, which moves to the new session
+	old.conn.Close()
+
+	return nil
+}
+
+// recycleEvery moves the connection to a new relay session every lifetime, retrying failed attempts while the current
+// session lasts.
+func (c *Conn) recycleEvery(lifetime time.Duration) {
+	timer := time.NewTimer(lifetime)
+	defer timer.Stop()
+
+	var err error
+
+	for {
+		select {
+		case <-timer.C:
+		case <-c.done:
+			return
+		}
+
+		if c.dopts.ReconnectFunc != nil {
+			c.dopts.ReconnectFunc(c.SessionID(), err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), recycleTimeout)
+		// a recycle in progress holds up writes, so Close abandons it rather than waiting for it
+		go func() {
+			select {
+			case <-c.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		c.dopts.ClientTrace.reconnectStart()
+		err = c.recycle(ctx)
+		c.dopts.ClientTrace.reconnectDone(err)
+		cancel()
+
+		if err != nil {
+			timer.Reset(recycleRetry)
+			continue
+		}
+		timer.Reset(lifetime)
+	}
+}
@@ -0,0 +1,77 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRetryBackoff = time.Second
+	// maxRetryAfter caps how long a Retry-After header can hold up a dial.
+	maxRetryAfter = time.Minute
+)
+
+// Throttled reports whether the relay rejected the handshake because it's overloaded or the caller is dialing too
+// often, in which case the dial can be retried after RetryAfter.
+func (e *HandshakeError) Throttled() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date, returning 0 if it's missing or
+// invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0)
+	}
+	return 0
+}
+
+// dialSessionRetrying dials a session like dialSession, retrying throttled handshakes as configured by WithDialRetry.
+// It waits as long as the relay asks with Retry-After, or else backs off exponentially.
+func dialSessionRetrying(ctx context.Context, dopts *dialOptions, url string) (*relaySession, error) {
+	backoff := dopts.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		session, err := dialSession(ctx, dopts, url)
+
+		var handshakeErr *HandshakeError
+		if err == nil || attempt >= dopts.DialRetries || !errors.As(err, &handshakeErr) || !handshakeErr.Throttled() {
+			return session, err
+		}
+
+		wait := backoff
+		if handshakeErr.RetryAfter > 0 {
+			wait = handshakeErr.RetryAfter
+		}
+		if wait > maxRetryAfter {
+			wait = maxRetryAfter
+		}
+		backoff *= 2
+
+		newTracer(dopts).log("Relay throttled handshake, retrying", "status", handshakeErr.StatusCode, "wait", wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+
+		if dopts.ReconnectFunc != nil {
+			dopts.ReconnectFunc("", err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// DefaultMaxConns is how many clients a Server bridges at once unless MaxConns says otherwise.
+const DefaultMaxConns = 256
+
+const maxAcceptBackoff = time.Second
+
+// Server accepts clients on a listener and bridges each one to a connection of its own with Copy, for custom
+// forwarders.
+type Server struct {
+	// Dial returns a connection to the target for a client. Its context is cancelled when Serve returns.
+	Dial func(ctx context.Context) (*Conn, error)
+	// MaxConns caps how many clients are bridged at once, DefaultMaxConns if it's 0 or unlimited if it's negative.
+	// Clients beyond it wait to be dialed until another disconnects.
+	MaxConns int
+	// ErrorLog logs failed dials at error level, and clients disconnecting at debug level. Nothing is logged if it's
+	// nil.
+	ErrorLog *slog.Logger
+}
+
+// Serve accepts clients on l until it's closed, bridging each one to a connection from dial. It's shorthand for a
+// Server with the default limits.
+func Serve(l net.Listener, dial func(ctx context.Context) (*Conn, error)) error {
+	s := &Server{Dial: dial}
+	return s.Serve(l)
+}
+
+// Serve accepts clients on l, bridging each one to a connection from s.Dial. It returns nil once l is closed, or the
+// error which stopped it accepting. Clients already bridged stay connected, and those waiting to be dialed are
+// disconnected.
+func (s *Server) Serve(l net.Listener) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var slots chan struct{}
+	switch {
+	case s.MaxConns == 0:
+		slots = make(chan struct{}, DefaultMaxConns)
+	case s.MaxConns > 0:
+		slots = make(chan struct{}, s.MaxConns)
+	}
+
+	var backoff time.Duration
+
+	for {
+		client, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			// like running out of file descriptors, which passes as clients disconnect
+			var temporary interface{ Temporary() bool }
+			if !errors.As(err, &temporary) || !temporary.Temporary() {
+				return err
+			}
+
+			backoff = min(max(2*backoff, 5*time.Millisecond), maxAcceptBackoff)
+			s.logger().Error("Error accepting client, retrying", "err", err, "wait", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		go s.handle(ctx, client, slots)
+	}
+}
+
+func (s *Server) handle(ctx context.Context, client net.Conn, slots chan struct{}) {
+	defer client.Close()
+
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	conn, err := s.Dial(ctx)
+	if err != nil {
+		s.logger().Error("Error dialing IAP", "client", client.RemoteAddr(), "err", err)
+		return
+	}
+	defer conn.Close()
+
+	sent, received, err := Copy(conn, client)
+	s.logger().Debug("Client disconnected", "client", client.RemoteAddr(), "sentbytes", sent, "recvbytes", received, "err", err)
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.ErrorLog == nil {
+		return slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return s.ErrorLog
+}
@@ -0,0 +1,123 @@
+package iap_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServe(t *testing.T, s *iap.Server) (addr string, stop func() error) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- s.Serve(l)
+	}()
+
+	return l.Addr().String(), func() error {
+		l.Close()
+		return <-result
+	}
+}
+
+func TestServe(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	addr, stop := startServe(t, &iap.Server{
+		Dial: func(ctx context.Context) (*iap.Conn, error) {
+			return iap.Dial(ctx, server.DialOptions()...)
+		},
+	})
+
+	for range 3 {
+		client, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+
+		_, err = client.Write([]byte("hello"))
+		require.NoError(t, err)
+
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(client, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+
+		client.Close()
+	}
+
+	assert.NoError(t, stop())
+}
+
+func TestServeMaxConns(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+	// the target echoes a byte, then closes the connection when it gets another, ending the bridge
+	server.Handler = func(r io.Reader, w io.Writer) {
+		buf := make([]byte, 1)
+		io.ReadFull(r, buf)
+		w.Write(buf)
+		io.ReadFull(r, buf)
+	}
+
+	addr, stop := startServe(t, &iap.Server{
+		Dial: func(ctx context.Context) (*iap.Conn, error) {
+			return iap.Dial(ctx, server.DialOptions()...)
+		},
+		MaxConns: 1,
+	})
+	defer stop()
+
+	first, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = first.Write([]byte("a"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(first, make([]byte, 1))
+	require.NoError(t, err)
+
+	second, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer second.Close()
+	_, err = second.Write([]byte("b"))
+	require.NoError(t, err)
+
+	// the second client isn't dialed until the first's bridge ends
+	second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = second.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	_, err = first.Write([]byte("z"))
+	require.NoError(t, err)
+
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(second, make([]byte, 1))
+	require.NoError(t, err)
+}
+
+func TestServeDialError(t *testing.T) {
+	addr, stop := startServe(t, &iap.Server{
+		Dial: func(ctx context.Context) (*iap.Conn, error) {
+			return nil, iap.ErrCircuitOpen
+		},
+	})
+	defer stop()
+
+	client, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// the client is disconnected straight away
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
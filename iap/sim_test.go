@@ -0,0 +1,436 @@
+package iap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The simulation runs a Conn against a scripted relay over a simulated link. Time is virtual and only advances once
+// the Conn is quiescent, i.e. its read loop is waiting for the next message and its writer has nothing left to send
+// or is blocked by a full link. Every message is a rendezvous with the driver, so runs are deterministic regardless of
+// real scheduling.
+
+// simDeadline bounds how long the driver waits in real time for the Conn to act before declaring it stuck.
+const simDeadline = 5 * time.Second
+
+// simConn is the transport seen by the Conn under test.
+type simConn struct {
+	readReq    chan struct{}
+	toClient   chan []byte
+	fromClient chan []byte
+	closeOnce  sync.Once
+	closed     chan struct{}
+	buf        []byte
+}
+
+func newSimConn() *simConn {
+	return &simConn{
+		readReq:    make(chan struct{}),
+		toClient:   make(chan []byte),
+		fromClient: make(chan []byte),
+		closed:     make(chan struct{}),
+	}
+}
+
+func (s *simConn) Read(p []byte) (int, error) {
+	if len(s.buf) == 0 {
+		// the previous message has been fully processed, ask the driver for the next one
+		select {
+		case s.readReq <- struct{}{}:
+		case <-s.closed:
+			return 0, net.ErrClosed
+		}
+		select {
+		case s.buf = <-s.toClient:
+		case <-s.closed:
+			return 0, net.ErrClosed
+		}
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *simConn) Write(p []byte) (int, error) {
+	select {
+	case s.fromClient <- bytes.Clone(p):
+		return len(p), nil
+	case <-s.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (s *simConn) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+func (s *simConn) LocalAddr() net.Addr                { return nil }
+func (s *simConn) RemoteAddr() net.Addr               { return nil }
+func (s *simConn) SetDeadline(t time.Time) error      { return nil }
+func (s *simConn) SetReadDeadline(t time.Time) error  { return nil }
+func (s *simConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// simProfile describes the link and relay behaviour for a simulation.
+type simProfile struct {
+	name      string
+	bandwidth int           // bytes per virtual second in each direction
+	latency   time.Duration // one-way
+	window    int           // max bytes the relay sends before waiting for acks
+	buffer    int           // bytes the uplink queues before applying backpressure
+	total     int           // bytes to transfer
+}
+
+func (p simProfile) transmit(n int) time.Duration {
+	return time.Duration(n) * time.Second / time.Duration(p.bandwidth)
+}
+
+type simEvent struct {
+	at    time.Duration
+	seq   int
+	msg   []byte // message delivered to the client
+	relay uint64 // bytes arriving at the relay, if msg is nil
+	ack   bool   // whether relay is an ack value rather than data
+}
+
+type simResult struct {
+	elapsed     time.Duration
+	acks        []uint64
+	maxInFlight int
+	maxQueued   int
+	deadlocked  bool
+}
+
+type simDriver struct {
+	t       *testing.T
+	profile simProfile
+	conn    *simConn
+
+	now          time.Duration
+	seq          int
+	events       []simEvent
+	readWaiting  bool
+	downlinkFree time.Duration
+	uplinkFree   time.Duration
+}
+
+func (d *simDriver) schedule(ev simEvent) {
+	d.seq++
+	ev.seq = d.seq
+	d.events = append(d.events, ev)
+	sort.Slice(d.events, func(i, j int) bool {
+		if d.events[i].at != d.events[j].at {
+			return d.events[i].at < d.events[j].at
+		}
+		return d.events[i].seq < d.events[j].seq
+	})
+}
+
+// sendToClient queues a message on the downlink.
+func (d *simDriver) sendToClient(msg []byte) {
+	start := max(d.now, d.downlinkFree)
+	d.downlinkFree = start + d.profile.transmit(len(msg))
+	d.schedule(simEvent{at: d.downlinkFree + d.profile.latency, msg: msg})
+}
+
+// deliver passes the next message to the client once it asks for one.
+func (d *simDriver) deliver(msg []byte) {
+	d.conn.toClient <- msg
+	d.readWaiting = false
+}
+
+func simSuccessFrame() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, subprotoTagSuccess)
+	binary.Write(&buf, binary.BigEndian, uint32(3))
+	buf.WriteString("sim")
+	return buf.Bytes()
+}
+
+func simDataFrame(n int) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, subprotoTagData)
+	binary.Write(&buf, binary.BigEndian, uint32(n))
+	buf.Write(make([]byte, n))
+	return buf.Bytes()
+}
+
+func simAckFrame(nb uint64) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, subprotoTagAck)
+	binary.Write(&buf, binary.BigEndian, nb)
+	return buf.Bytes()
+}
+
+// parseClientFrame returns the tag of a frame written by the client and its data length or ack value.
+func parseClientFrame(t *testing.T, msg []byte) (uint16, uint64) {
+	tag := binary.BigEndian.Uint16(msg[0:2])
+
+	switch tag {
+	case subprotoTagData:
+		nb := binary.BigEndian.Uint32(msg[2:6])
+		require.Equal(t, int(nb), len(msg)-6, "data frame length mismatch")
+		require.LessOrEqual(t, int(nb), subprotoMaxFrameSize, "data frame exceeds max frame size")
+		return tag, uint64(nb)
+	case subprotoTagAck:
+		return tag, binary.BigEndian.Uint64(msg[2:10])
+	default:
+		t.Fatalf("unexpected tag %#x from client", tag)
+		return 0, 0
+	}
+}
+
+func startSim(t *testing.T, profile simProfile) (*simDriver, *Conn) {
+	t.Helper()
+
+	sc := newSimConn()
+	c := newConn(newRelaySession(sc), &dialOptions{})
+
+	go func() {
+		<-sc.readReq
+		sc.toClient <- simSuccessFrame()
+	}()
+	require.NoError(t, c.connect(context.Background()))
+
+	t.Cleanup(func() {
+		c.Close()
+	})
+
+	return &simDriver{t: t, profile: profile, conn: sc}, c
+}
+
+// waitClient waits for the client to ask for a message or write one.
+func (d *simDriver) waitClient() ([]byte, bool) {
+	select {
+	case <-d.conn.readReq:
+		d.readWaiting = true
+		return nil, true
+	case msg := <-d.conn.fromClient:
+		return msg, true
+	case <-time.After(simDeadline):
+		return nil, false
+	}
+}
+
+// simulateDownload streams profile.total bytes from the relay to a client that reads as fast as possible.
+func simulateDownload(t *testing.T, profile simProfile) simResult {
+	d, c := startSim(t, profile)
+
+	var consumed atomic.Int64
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := c.Read(buf)
+			consumed.Add(int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var (
+		res       simResult
+		sent      int
+		acked     uint64
+		delivered int
+	)
+
+	for {
+		// the relay sends as much as its window allows
+		for sent < profile.total && sent-int(acked) < profile.window {
+			n := min(subprotoMaxFrameSize, min(profile.total-sent, profile.window-(sent-int(acked))))
+			d.sendToClient(simDataFrame(n))
+			sent += n
+			res.maxInFlight = max(res.maxInFlight, sent-int(acked))
+		}
+
+		if !d.readWaiting {
+			msg, ok := d.waitClient()
+			require.True(t, ok, "client stopped making progress")
+
+			if msg != nil {
+				tag, nb := parseClientFrame(t, msg)
+				require.Equal(t, subprotoTagAck, tag)
+				res.acks = append(res.acks, nb)
+				d.schedule(simEvent{at: d.now + d.profile.latency, relay: nb, ack: true})
+			} else {
+				// the pipe to the reader is unbuffered, so once the client asks for more everything delivered has
+				// been handed to the reader
+				assert.LessOrEqual(t, int64(delivered)-consumed.Load(), int64(subprotoMaxFrameSize))
+			}
+			continue
+		}
+
+		if len(d.events) == 0 {
+			if delivered == profile.total {
+				res.elapsed = d.now
+				return res
+			}
+			res.deadlocked = true
+			return res
+		}
+
+		// the client is quiescent, advance virtual time to the next event
+		ev := d.events[0]
+		d.events = d.events[1:]
+		d.now = ev.at
+
+		if ev.msg != nil {
+			delivered += len(ev.msg) - 6
+			d.deliver(ev.msg)
+		} else if ev.ack {
+			acked = ev.relay
+		}
+	}
+}
+
+// simulateUpload streams profile.total bytes from a client to a relay that acks every frame on arrival.
+func simulateUpload(t *testing.T, profile simProfile) (simResult, *Conn) {
+	d, c := startSim(t, profile)
+
+	writeDone := make(chan error, 1)
+	go func() {
+		_, err := c.Write(make([]byte, profile.total))
+		writeDone <- err
+	}()
+
+	var (
+		res      simResult
+		accepted int // bytes accepted onto the uplink
+		arrived  int // bytes that reached the relay
+	)
+
+	for {
+		queued := accepted - arrived
+		res.maxQueued = max(res.maxQueued, queued)
+
+		// the writer is quiescent once everything is accepted or the uplink is full and we stop reading from it
+		writerIdle := accepted == profile.total || queued >= profile.buffer
+
+		if !writerIdle || !d.readWaiting {
+			var msg []byte
+			var ok bool
+
+			if writerIdle {
+				// only wait for the read loop, leaving writes blocked to apply backpressure
+				select {
+				case <-d.conn.readReq:
+					d.readWaiting = true
+					ok = true
+				case <-time.After(simDeadline):
+				}
+			} else {
+				msg, ok = d.waitClient()
+			}
+			require.True(t, ok, "client stopped making progress")
+
+			if msg != nil {
+				tag, nb := parseClientFrame(t, msg)
+				require.Equal(t, subprotoTagData, tag)
+
+				start := max(d.now, d.uplinkFree)
+				d.uplinkFree = start + profile.transmit(len(msg))
+				d.schedule(simEvent{at: d.uplinkFree + profile.latency, relay: nb})
+				accepted += int(nb)
+			}
+			continue
+		}
+
+		if len(d.events) == 0 {
+			if arrived == profile.total {
+				require.NoError(t, <-writeDone)
+				res.elapsed = d.now
+				return res, c
+			}
+			res.deadlocked = true
+			return res, c
+		}
+
+		ev := d.events[0]
+		d.events = d.events[1:]
+		d.now = ev.at
+
+		if ev.msg != nil {
+			d.deliver(ev.msg)
+		} else {
+			arrived += int(ev.relay)
+			// ack cumulative bytes received as soon as they arrive
+			d.sendToClient(simAckFrame(uint64(arrived)))
+		}
+	}
+}
+
+var simProfiles = []simProfile{
+	{name: "lan", bandwidth: 100 << 20, latency: time.Millisecond, window: 256 << 10, buffer: 64 << 10, total: 4 << 20},
+	{name: "broadband", bandwidth: 10 << 20, latency: 20 * time.Millisecond, window: 128 << 10, buffer: 64 << 10, total: 2 << 20},
+	{name: "long-fat", bandwidth: 50 << 20, latency: 150 * time.Millisecond, window: 1 << 20, buffer: 256 << 10, total: 4 << 20},
+	{name: "slow", bandwidth: 256 << 10, latency: 80 * time.Millisecond, window: 64 << 10, buffer: 32 << 10, total: 512 << 10},
+}
+
+func TestSimDownload(t *testing.T) {
+	for _, profile := range simProfiles {
+		t.Run(profile.name, func(t *testing.T) {
+			res := simulateDownload(t, profile)
+			require.False(t, res.deadlocked, "transfer deadlocked")
+
+			// bounded memory: the relay never has more than a window outstanding
+			assert.LessOrEqual(t, res.maxInFlight, profile.window)
+
+			// acks are cumulative and only sent once the threshold of unacked bytes is exceeded
+			var last uint64
+			for _, ack := range res.acks {
+				assert.Greater(t, ack-last, uint64(2*subprotoMaxFrameSize))
+				last = ack
+			}
+			assert.LessOrEqual(t, uint64(profile.total)-last, uint64(2*subprotoMaxFrameSize+subprotoMaxFrameSize))
+
+			// can't be faster than the link allows
+			assert.GreaterOrEqual(t, res.elapsed, profile.transmit(profile.total)+profile.latency)
+
+			t.Logf("%v bytes in %v (%.1f MiB/s), %v acks", profile.total, res.elapsed,
+				float64(profile.total)/res.elapsed.Seconds()/(1<<20), len(res.acks))
+		})
+	}
+}
+
+func TestSimUpload(t *testing.T) {
+	for _, profile := range simProfiles {
+		t.Run(profile.name, func(t *testing.T) {
+			res, c := simulateUpload(t, profile)
+			require.False(t, res.deadlocked, "transfer deadlocked")
+
+			// bounded memory: a blocked link stops the writer within one frame
+			assert.LessOrEqual(t, res.maxQueued, profile.buffer+subprotoMaxFrameSize)
+
+			assert.Equal(t, uint64(profile.total), c.Sent())
+			assert.GreaterOrEqual(t, res.elapsed, profile.transmit(profile.total)+profile.latency)
+		})
+	}
+}
+
+// A relay window no larger than the client's ack threshold can never be reopened by an ack, which the harness
+// must detect rather than hang on.
+func TestSimDetectsDeadlock(t *testing.T) {
+	res := simulateDownload(t, simProfile{
+		name:      "small-window",
+		bandwidth: 10 << 20,
+		latency:   10 * time.Millisecond,
+		window:    2 * subprotoMaxFrameSize,
+		total:     1 << 20,
+	})
+
+	assert.True(t, res.deadlocked)
+}
+
+var _ net.Conn = (*simConn)(nil)
@@ -0,0 +1,161 @@
+package iap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// TargetScheme is the URI scheme of targets, see ParseTarget.
+const TargetScheme = "iap"
+
+// Target is a destination to tunnel to, either an InstanceTarget or a HostTarget.
+type Target interface {
+	// String returns the target as a URI which can be parsed by ParseTarget.
+	String() string
+
+	applyTarget(d *dialOptions)
+}
+
+// InstanceTarget is a port on a Compute Engine instance.
+type InstanceTarget struct {
+	Project  string
+	Zone     string
+	Instance string
+	// Interface is the network interface to connect to, nic0 if empty.
+	Interface string
+	Port      uint
+}
+
+// String returns the target as a URI which can be parsed by ParseTarget.
+func (t InstanceTarget) String() string {
+	u := url.URL{
+		Scheme: TargetScheme,
+		Host:   t.Project,
+		Path:   "/" + t.Zone + "/" + net.JoinHostPort(t.Instance, fmt.Sprint(t.Port)),
+	}
+	if t.Interface != "" {
+		u.RawQuery = url.Values{"interface": []string{t.Interface}}.Encode()
+	}
+	return u.String()
+}
+
+func (t InstanceTarget) applyTarget(d *dialOptions) {
+	ninterface := t.Interface
+	if ninterface == "" {
+		ninterface = "nic0"
+	}
+
+	d.Project = t.Project
+	d.Instance = t.Instance
+	d.Zone = t.Zone
+	d.Interface = ninterface
+	d.Port = fmt.Sprint(t.Port)
+}
+
+// HostTarget is a port on a private IP or FQDN in a VPC network, reached through a destination group.
+type HostTarget struct {
+	Project string
+	Region  string
+	Network string
+	Host    string
+	Group   string
+	Port    uint
+}
+
+// String returns the target as a URI which can be parsed by ParseTarget.
+func (t HostTarget) String() string {
+	u := url.URL{
+		Scheme: TargetScheme,
+		Host:   t.Project,
+		Path:   "/" + t.Region + "/" + t.Network + "/" + t.Group + "/" + net.JoinHostPort(t.Host, fmt.Sprint(t.Port)),
+	}
+	return u.String()
+}
+
+func (t HostTarget) applyTarget(d *dialOptions) {
+	d.Project = t.Project
+	d.Host = t.Host
+	d.Region = t.Region
+	d.Network = t.Network
+	d.Group = t.Group
+	d.Port = fmt.Sprint(t.Port)
+}
+
+// WithTarget is a functional option that sets the project, destination and port from a typed target, in place of
+// WithProject, WithInstance or WithHost, and WithPort.
+func WithTarget(target Target) func(*dialOptions) {
+	return func(d *dialOptions) {
+		target.applyTarget(d)
+	}
+}
+
+// ParseTarget parses a target URI. Instances are written as iap://project/zone/instance:port, optionally followed by
+// ?interface=nic1, and hosts in a destination group as iap://project/region/network/group/host:port. IPv6 hosts are
+// written in brackets like [fd00::1]:22.
+func ParseTarget(uri string) (Target, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != TargetScheme {
+		return nil, fmt.Errorf("target %q doesn't have scheme %v", uri, TargetScheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("target %q doesn't have a project", uri)
+	}
+
+	segments := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if slices.Contains(segments, "") {
+		return nil, fmt.Errorf("target %q has an empty path segment", uri)
+	}
+
+	host, port, err := parseHostPort(segments[len(segments)-1])
+	if err != nil {
+		return nil, fmt.Errorf("target %q: %w", uri, err)
+	}
+
+	switch len(segments) {
+	case 2:
+		return InstanceTarget{
+			Project:   u.Host,
+			Zone:      segments[0],
+			Instance:  host,
+			Interface: u.Query().Get("interface"),
+			Port:      port,
+		}, nil
+	case 4:
+		return HostTarget{
+			Project: u.Host,
+			Region:  segments[0],
+			Network: segments[1],
+			Group:   segments[2],
+			Host:    host,
+			Port:    port,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("target %q should be iap://project/zone/instance:port or iap://project/region/network/group/host:port", uri)
+}
+
+func parseHostPort(hostport string) (string, uint, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", 0, err
+	}
+	if host == "" {
+		return "", 0, errors.New("missing host")
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	return host, uint(port), nil
+}
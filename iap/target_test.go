@@ -0,0 +1,97 @@
+package iap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithTarget(t *testing.T) {
+	dopts := &dialOptions{}
+	dopts.collectOpts([]DialOption{WithTarget(InstanceTarget{
+		Project:  "project",
+		Zone:     "europe-west2-a",
+		Instance: "bastion",
+		Port:     22,
+	})})
+
+	assert.Equal(t, &dialOptions{
+		Project:   "project",
+		Zone:      "europe-west2-a",
+		Instance:  "bastion",
+		Interface: "nic0",
+		Port:      "22",
+	}, dopts)
+
+	dopts = &dialOptions{}
+	dopts.collectOpts([]DialOption{WithTarget(HostTarget{
+		Project: "project",
+		Region:  "europe-west2",
+		Network: "default",
+		Host:    "10.0.0.1",
+		Group:   "group",
+		Port:    5432,
+	})})
+
+	assert.Equal(t, &dialOptions{
+		Project: "project",
+		Region:  "europe-west2",
+		Network: "default",
+		Host:    "10.0.0.1",
+		Group:   "group",
+		Port:    "5432",
+	}, dopts)
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		uri    string
+		target Target
+	}{
+		{
+			"iap://my-project/europe-west1-b/bastion:22",
+			InstanceTarget{Project: "my-project", Zone: "europe-west1-b", Instance: "bastion", Port: 22},
+		},
+		{
+			"iap://my-project/europe-west1-b/bastion:3389?interface=nic1",
+			InstanceTarget{Project: "my-project", Zone: "europe-west1-b", Instance: "bastion", Interface: "nic1", Port: 3389},
+		},
+		{
+			"iap://my-project/europe-west1/default/databases/10.0.0.5:5432",
+			HostTarget{Project: "my-project", Region: "europe-west1", Network: "default", Group: "databases", Host: "10.0.0.5", Port: 5432},
+		},
+		{
+			"iap://my-project/europe-west1/default/databases/[fd00::5]:5432",
+			HostTarget{Project: "my-project", Region: "europe-west1", Network: "default", Group: "databases", Host: "fd00::5", Port: 5432},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.uri, func(t *testing.T) {
+			target, err := ParseTarget(test.uri)
+			require.NoError(t, err)
+			assert.Equal(t, test.target, target)
+
+			roundTrip, err := ParseTarget(target.String())
+			require.NoError(t, err)
+			assert.Equal(t, target, roundTrip)
+		})
+	}
+}
+
+func TestParseTargetInvalid(t *testing.T) {
+	for _, uri := range []string{
+		"https://my-project/europe-west1-b/bastion:22",
+		"iap:///europe-west1-b/bastion:22",
+		"iap://my-project/bastion:22",
+		"iap://my-project/europe-west1-b/bastion",
+		"iap://my-project/europe-west1-b/bastion:0",
+		"iap://my-project/europe-west1-b/bastion:65536",
+		"iap://my-project//bastion:22",
+		"iap://my-project/europe-west1/default/bastion:22",
+	} {
+		_, err := ParseTarget(uri)
+		assert.Error(t, err, uri)
+	}
+}
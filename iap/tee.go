@@ -0,0 +1,46 @@
+package iap
+
+import (
+	"io"
+	"sync"
+)
+
+// tee copies the data passing through a connection in one direction to a writer, up to a limit. A nil *tee copies
+// nothing.
+type tee struct {
+	mu        sync.Mutex
+	w         io.Writer
+	limited   bool
+	remaining int64
+}
+
+func newTee(w io.Writer, limit int64) *tee {
+	if w == nil {
+		return nil
+	}
+	return &tee{w: w, limited: limit > 0, remaining: limit}
+}
+
+// copy writes as much of p to the writer as the limit allows. The tee stops for good once the limit is reached or the
+// writer fails.
+func (t *tee) copy(p []byte) {
+	if t == nil || len(p) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.w == nil {
+		return
+	}
+
+	if t.limited {
+		p = p[:min(int64(len(p)), t.remaining)]
+		t.remaining -= int64(len(p))
+	}
+
+	if _, err := t.w.Write(p); err != nil || t.limited && t.remaining == 0 {
+		t.w = nil
+	}
+}
@@ -0,0 +1,166 @@
+package iap
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const defaultScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// tokenExpiryDelta is how long before expiry a cached token is considered stale and replaced. It leaves enough room
+// for a token handed to a dial to still be valid when the relay checks it.
+const tokenExpiryDelta = 5 * time.Minute
+
+// tokenRefreshRetry is how long to wait before retrying a failed background refresh.
+const tokenRefreshRetry = 10 * time.Second
+
+// tokenCache holds the token sources minted by this package, keyed by how they were minted, so tokens are reused
+// across dials until they near expiry instead of being fetched for every connection.
+var tokenCache = struct {
+	sync.Mutex
+	sources map[string]oauth2.TokenSource
+}{sources: make(map[string]oauth2.TokenSource)}
+
+// cachedTokenSource returns the cached token source for key, calling mint to create it if there isn't one.
+func cachedTokenSource(key string, mint func() (oauth2.TokenSource, error)) (oauth2.TokenSource, error) {
+	tokenCache.Lock()
+	defer tokenCache.Unlock()
+
+	if source, ok := tokenCache.sources[key]; ok {
+		return source, nil
+	}
+
+	source, err := mint()
+	if err != nil {
+		return nil, err
+	}
+
+	source = &refreshingTokenSource{
+		source: oauth2.ReuseTokenSourceWithExpiry(nil, source, tokenExpiryDelta),
+	}
+	tokenCache.sources[key] = source
+
+	return source, nil
+}
+
+// ReloadCredentials drops the token sources cached by WithDefaultCredentials, WithCredentialsFile and
+// WithCredentialsJSON, so the next dial re-reads key files and searches for default credentials again. This picks up
+// rotated credentials without restarting. Open connections are unaffected, a token is only needed to dial or reconnect.
+func ReloadCredentials() {
+	tokenCache.Lock()
+	defer tokenCache.Unlock()
+
+	clear(tokenCache.sources)
+}
+
+// refreshingTokenSource refreshes a cached token in the background as soon as it goes stale, so a dial or reconnect
+// doesn't have to wait for a token fetch. Refreshing stops once the source goes unused for a whole token lifetime and
+// resumes on the next call to Token.
+type refreshingTokenSource struct {
+	source oauth2.TokenSource
+
+	mu         sync.Mutex
+	used       bool
+	refreshing bool
+}
+
+func (s *refreshingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.used = true
+	if !s.refreshing && !token.Expiry.IsZero() {
+		s.refreshing = true
+		go s.refresh(token.Expiry)
+	}
+
+	return token, nil
+}
+
+func (s *refreshingTokenSource) refresh(expiry time.Time) {
+	for {
+		time.Sleep(time.Until(expiry.Add(-tokenExpiryDelta)))
+
+		s.mu.Lock()
+		if !s.used {
+			s.refreshing = false
+			s.mu.Unlock()
+			return
+		}
+		s.used = false
+		s.mu.Unlock()
+
+		// the token is stale now, so this fetches a new one
+		token, err := s.source.Token()
+		if err != nil {
+			// keep trying while the token is needed
+			s.mu.Lock()
+			s.used = true
+			s.mu.Unlock()
+
+			expiry = time.Now().Add(tokenExpiryDelta + tokenRefreshRetry)
+			continue
+		}
+
+		if token.Expiry.IsZero() {
+			s.mu.Lock()
+			s.refreshing = false
+			s.mu.Unlock()
+			return
+		}
+
+		expiry = token.Expiry
+	}
+}
+
+// scopesKey returns a cache key for a set of scopes which doesn't depend on their order.
+func scopesKey(scopes []string) string {
+	scopes = slices.Clone(scopes)
+	slices.Sort(scopes)
+
+	return strings.Join(slices.Compact(scopes), " ")
+}
+
+func (d *dialOptions) scopes() []string {
+	if len(d.Scopes) == 0 {
+		return []string{defaultScope}
+	}
+	return d.Scopes
+}
+
+// tokenSource returns the token source to authorize the connection with, or nil if it shouldn't be authorized.
+func (d *dialOptions) tokenSource() (oauth2.TokenSource, error) {
+	switch {
+	case d.TokenSource != nil:
+		return *d.TokenSource, nil
+	case d.CredentialsJSON != nil:
+		hash := sha256.Sum256(d.CredentialsJSON)
+
+		return cachedTokenSource(fmt.Sprintf("json:%x:%v", hash, scopesKey(d.scopes())), func() (oauth2.TokenSource, error) {
+			return credentialsFromJSON(context.Background(), d.CredentialsJSON, d.scopes())
+		})
+	case d.CredentialsFile != "":
+		return cachedTokenSource(fmt.Sprintf("file:%v:%v", d.CredentialsFile, scopesKey(d.scopes())), func() (oauth2.TokenSource, error) {
+			return credentialsFromFile(context.Background(), d.CredentialsFile, d.scopes())
+		})
+	case d.DefaultCredentials:
+		return cachedTokenSource("default:"+scopesKey(d.scopes()), func() (oauth2.TokenSource, error) {
+			// the source outlives the dial, so it mustn't be bound to the dial's context
+			return FindCredentials(context.Background(), d.scopes()...)
+		})
+	}
+
+	return nil, nil
+}
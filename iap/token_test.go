@@ -0,0 +1,153 @@
+package iap
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+type countingTokenSource struct {
+	tokens atomic.Int32
+	expiry time.Duration
+}
+
+func (s *countingTokenSource) Token() (*oauth2.Token, error) {
+	s.tokens.Add(1)
+	return &oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(s.expiry)}, nil
+}
+
+// cacheKey returns a token cache key for the test which is evicted when it finishes.
+func cacheKey(t *testing.T) string {
+	t.Cleanup(func() {
+		tokenCache.Lock()
+		delete(tokenCache.sources, t.Name())
+		tokenCache.Unlock()
+	})
+	return t.Name()
+}
+
+func TestCachedTokenSource(t *testing.T) {
+	mints := 0
+	counting := &countingTokenSource{expiry: time.Hour}
+
+	mint := func() (oauth2.TokenSource, error) {
+		mints++
+		return counting, nil
+	}
+
+	for range 3 {
+		source, err := cachedTokenSource(cacheKey(t), mint)
+		require.NoError(t, err)
+
+		_, err = source.Token()
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 1, mints)
+	assert.EqualValues(t, 1, counting.tokens.Load())
+}
+
+func TestCachedTokenSourceNearExpiry(t *testing.T) {
+	counting := &countingTokenSource{expiry: tokenExpiryDelta / 2}
+
+	source, err := cachedTokenSource(cacheKey(t), func() (oauth2.TokenSource, error) {
+		return counting, nil
+	})
+	require.NoError(t, err)
+
+	source.Token()
+	source.Token()
+
+	assert.GreaterOrEqual(t, counting.tokens.Load(), int32(2))
+}
+
+func TestCachedTokenSourceRefresh(t *testing.T) {
+	// goes stale shortly after being fetched
+	counting := &countingTokenSource{expiry: tokenExpiryDelta + 50*time.Millisecond}
+
+	source, err := cachedTokenSource(cacheKey(t), func() (oauth2.TokenSource, error) {
+		return counting, nil
+	})
+	require.NoError(t, err)
+
+	_, err = source.Token()
+	require.NoError(t, err)
+
+	// refreshed in the background without another call to Token
+	assert.Eventually(t, func() bool {
+		return counting.tokens.Load() == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// and then left alone because the source isn't being used
+	time.Sleep(200 * time.Millisecond)
+	assert.EqualValues(t, 2, counting.tokens.Load())
+}
+
+func TestCachedTokenSourceMintError(t *testing.T) {
+	mintErr := errors.New("no credentials")
+
+	_, err := cachedTokenSource(cacheKey(t), func() (oauth2.TokenSource, error) {
+		return nil, mintErr
+	})
+	assert.ErrorIs(t, err, mintErr)
+
+	// failures aren't cached
+	_, err = cachedTokenSource(cacheKey(t), func() (oauth2.TokenSource, error) {
+		return &countingTokenSource{}, nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestReloadCredentials(t *testing.T) {
+	mints := 0
+	mint := func() (oauth2.TokenSource, error) {
+		mints++
+		return &countingTokenSource{expiry: time.Hour}, nil
+	}
+
+	_, err := cachedTokenSource(cacheKey(t), mint)
+	require.NoError(t, err)
+
+	ReloadCredentials()
+
+	_, err = cachedTokenSource(cacheKey(t), mint)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, mints)
+}
+
+func TestScopesKey(t *testing.T) {
+	assert.Equal(t, scopesKey([]string{"b", "a"}), scopesKey([]string{"a", "b", "a"}))
+}
+
+func TestCredentialsOptions(t *testing.T) {
+	path := writeCredentials(t, t.TempDir(), "creds.json")
+
+	for name, opt := range map[string]DialOption{
+		"file": WithCredentialsFile(path),
+		"json": WithCredentialsJSON([]byte(authorizedUserJSON), "scope"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dopts := &dialOptions{}
+			dopts.collectOpts([]DialOption{opt})
+
+			source, err := dopts.tokenSource()
+			require.NoError(t, err)
+
+			again, err := dopts.tokenSource()
+			require.NoError(t, err)
+			assert.Same(t, source, again)
+		})
+	}
+
+	dopts := &dialOptions{}
+	dopts.collectOpts([]DialOption{WithCredentialsJSON([]byte("{}"))})
+
+	_, err := dopts.tokenSource()
+	assert.Error(t, err)
+}
@@ -0,0 +1,127 @@
+package iap
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync/atomic"
+)
+
+// tracer logs what a connection does on the wire, for bug reports. A nil *tracer logs nothing.
+type tracer struct {
+	logger *slog.Logger
+	// frames is nil unless every frame should be logged
+	frames *slog.Logger
+	// sid is the relay session ID logged with every line once the relay has confirmed the connection, set by the
+	// handshake while other goroutines may be logging
+	sid atomic.Pointer[string]
+}
+
+func newTracer(dopts *dialOptions) *tracer {
+	if dopts.Trace == nil && dopts.FrameTrace == nil {
+		return nil
+	}
+	return &tracer{logger: dopts.Trace, frames: dopts.FrameTrace}
+}
+
+func (t *tracer) log(msg string, args ...any) {
+	if t == nil || t.logger == nil {
+		return
+	}
+	if sid := t.sessionID(); sid != "" {
+		args = append([]any{"sid", sid}, args...)
+	}
+	t.logger.Debug(msg, args...)
+}
+
+// session sets the session ID to log.
+func (t *tracer) session(sid string) {
+	if t != nil {
+		t.sid.Store(&sid)
+	}
+}
+
+func (t *tracer) sessionID() string {
+	if sid := t.sid.Load(); sid != nil {
+		return *sid
+	}
+	return ""
+}
+
+// dialing logs the WebSocket handshake request, leaving out the credentials.
+func (t *tracer) dialing(url string, header http.Header) {
+	t.log("Dialing relay", "url", url, "header", redactHeader(header))
+}
+
+// connecting returns a context which logs each address of the relay connected to during the handshake, so a broken
+// IPv6 path shows up.
+func (t *tracer) connecting(ctx context.Context) context.Context {
+	if t == nil || t.logger == nil {
+		return ctx
+	}
+
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			t.log("Connecting to relay address", "network", network, "addr", addr)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				t.log("Relay address failed", "network", network, "addr", addr, "err", err)
+				return
+			}
+			t.log("Relay address connected", "network", network, "addr", addr)
+		},
+	})
+}
+
+// dialed logs the response to the WebSocket handshake, if there was one.
+func (t *tracer) dialed(resp *http.Response, err error) {
+	if t == nil {
+		return
+	}
+
+	args := []any{}
+	if resp != nil {
+		args = append(args, "status", resp.Status, "header", redactHeader(resp.Header))
+	}
+	if err != nil {
+		t.log("Relay handshake failed", append(args, "err", err)...)
+		return
+	}
+	t.log("Relay handshake complete", args...)
+}
+
+// frame logs a frame sent or received. The length is of the frame's body, and ack is only logged for ack frames.
+func (t *tracer) frame(direction string, tag uint16, length int, ack uint64) {
+	if t == nil || t.frames == nil {
+		return
+	}
+
+	args := []any{"direction", direction, "tag", tag}
+	if sid := t.sessionID(); sid != "" {
+		args = append([]any{"sid", sid}, args...)
+	}
+	switch tag {
+	case subprotoTagAck, subprotoTagReconnectSuccessAck:
+		args = append(args, "ack", ack)
+	default:
+		args = append(args, "len", length)
+	}
+	t.frames.Debug("Frame", args...)
+}
+
+func redactHeader(header http.Header) http.Header {
+	header = header.Clone()
+	if auth := header.Get("Authorization"); auth != "" {
+		scheme, _, _ := strings.Cut(auth, " ")
+		header.Set("Authorization", scheme+" REDACTED")
+	}
+	for _, name := range []string{"Cookie", "Set-Cookie"} {
+		if header.Get(name) != "" {
+			header.Set(name, "REDACTED")
+		}
+	}
+	return header
+}
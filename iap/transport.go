@@ -0,0 +1,101 @@
+package iap
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// Transport opens channels to the relay which carry the relay protocol's frames. Dial uses WebSockets unless
+// WithTransport gives another Transport, so other backends such as HTTP/2 streams or QUIC can be plugged in without
+// changing how frames are written and acknowledged.
+//
+// A channel may also implement Ping(ctx context.Context) error, so the connection can measure the round trip time to
+// the relay to pace its acks, and Abort(), to be closed without a graceful shutdown when the connection gives up on it.
+type Transport interface {
+	// Open opens an ordered, reliable channel to the relay at url, a wss:// URL or ws:// for a plaintext endpoint,
+	// sending header with the request. Each Write must be delivered to the relay as a single message. If the relay
+	// refuses the channel, the error should be a *HandshakeError with its status.
+	Open(ctx context.Context, url string, header http.Header) (net.Conn, error)
+}
+
+// transport returns the Transport to open sessions with, which is a WebSocket transport unless WithTransport was
+// given.
+func (d *dialOptions) transport() Transport {
+	if d.Transport != nil {
+		return d.Transport
+	}
+	return &wsTransport{dopts: d}
+}
+
+// wsTransport opens WebSockets to the relay, applying the TLS, compression and tracing options.
+type wsTransport struct {
+	dopts *dialOptions
+}
+
+func (t *wsTransport) Open(ctx context.Context, url string, header http.Header) (net.Conn, error) {
+	client, err := relayClient(t.dopts)
+	if err != nil {
+		return nil, err
+	}
+
+	wsOptions := websocket.DialOptions{
+		HTTPClient:      client,
+		HTTPHeader:      header,
+		Subprotocols:    []string{Subprotocol},
+		CompressionMode: websocket.CompressionDisabled,
+	}
+	if t.dopts.Compress {
+		wsOptions.CompressionMode = websocket.CompressionContextTakeover
+		if t.dopts.Compression.NoContextTakeover {
+			wsOptions.CompressionMode = websocket.CompressionNoContextTakeover
+		}
+		wsOptions.CompressionThreshold = t.dopts.Compression.Threshold
+	}
+
+	trace := newTracer(t.dopts)
+
+	ctx = t.dopts.ClientTrace.resolving(ctx)
+
+	ws, resp, err := websocket.Dial(trace.connecting(ctx), url, &wsOptions)
+	trace.dialed(resp, err)
+	if err != nil {
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			body, _ := io.ReadAll(resp.Body)
+			return nil, &HandshakeError{
+				StatusCode: resp.StatusCode,
+				Body:       string(body),
+				RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+				Err:        err,
+			}
+		}
+		return nil, err
+	}
+
+	return newWSChannel(ws), nil
+}
+
+// wsChannel is a channel to the relay over a WebSocket, sending each Write as a binary message.
+type wsChannel struct {
+	net.Conn
+	ws *websocket.Conn
+}
+
+func newWSChannel(ws *websocket.Conn) *wsChannel {
+	return &wsChannel{
+		Conn: websocket.NetConn(context.Background(), ws, websocket.MessageBinary),
+		ws:   ws,
+	}
+}
+
+func (c *wsChannel) Ping(ctx context.Context) error {
+	return c.ws.Ping(ctx)
+}
+
+func (c *wsChannel) Abort() {
+	c.ws.CloseNow()
+}
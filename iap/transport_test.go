@@ -0,0 +1,77 @@
+package iap_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"nhooyr.io/websocket"
+)
+
+// plaintextTransport opens channels over plaintext WebSockets, rewriting the URL to point at a server, and counts them.
+type plaintextTransport struct {
+	server *iaptest.Server
+	opens  atomic.Int32
+}
+
+func (t *plaintextTransport) Open(ctx context.Context, url string, header http.Header) (net.Conn, error) {
+	t.opens.Add(1)
+
+	_, rest, _ := strings.Cut(url, "://")
+	_, path, _ := strings.Cut(rest, "/")
+	url = "ws://" + strings.TrimPrefix(t.server.URL, "http://") + "/" + path
+
+	ws, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{HTTPHeader: header, Subprotocols: []string{iap.Subprotocol}})
+	if err != nil {
+		return nil, err
+	}
+	return websocket.NetConn(context.Background(), ws, websocket.MessageBinary), nil
+}
+
+func TestTransport(t *testing.T) {
+	server := iaptest.NewPlaintextServer()
+	defer server.Close()
+
+	transport := &plaintextTransport{server: server}
+	opts := []iap.DialOption{
+		iap.WithTransport(transport),
+		iap.WithInstance("prod-1", "europe-west2-a", "nic0"),
+		iap.WithMaxLifetime(20 * time.Millisecond),
+	}
+
+	conn, err := iap.Dial(context.Background(), opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+
+	// sessions are resumed through the transport too
+	require.Eventually(t, func() bool {
+		return server.Reconnects() > 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Greater(t, transport.opens.Load(), int32(1))
+
+	echo(t, conn, "world")
+}
+
+func TestTransportPing(t *testing.T) {
+	server := iaptest.NewPlaintextServer()
+	defer server.Close()
+
+	conn, err := iap.Dial(context.Background(), iap.WithTransport(&plaintextTransport{server: server}), iap.WithInstance("prod-1", "europe-west2-a", "nic0"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the plaintext transport's channels are bare net.Conns
+	_, err = conn.Ping(context.Background())
+	assert.ErrorIs(t, err, iap.ErrPingUnsupported)
+	assert.Zero(t, conn.RTT())
+}
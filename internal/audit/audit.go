@@ -0,0 +1,59 @@
+// Package audit records every connection proxied by the CLI as a line of JSON, for teams that need a trail of who used
+// which tunnel.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record describes a proxied connection once it has closed.
+type Record struct {
+	Time          time.Time `json:"time"`
+	Client        string    `json:"client"`
+	Target        string    `json:"target"`
+	SessionID     string    `json:"session_id,omitempty"`
+	SentBytes     uint64    `json:"sent_bytes"`
+	ReceivedBytes uint64    `json:"received_bytes"`
+	Duration      float64   `json:"duration_seconds"`
+	Reason        string    `json:"reason"`
+}
+
+var (
+	mu   sync.Mutex
+	sink io.Writer
+)
+
+// Open starts appending records to the file at path, or to stderr if path is "-". Records are dropped until Open
+// is called.
+func Open(path string) error {
+	var w io.Writer = os.Stderr
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+
+	mu.Lock()
+	sink = w
+	mu.Unlock()
+
+	return nil
+}
+
+// Log writes a record to the sink.
+func Log(r Record) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if sink == nil {
+		return nil
+	}
+
+	return json.NewEncoder(sink).Encode(r)
+}
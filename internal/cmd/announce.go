@@ -0,0 +1,306 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/internal/proxy"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// serve listens on the local address, announces it and proxies clients through the IAP until the process exits.
+func serve(target string, opts []iap.DialOption) {
+	opts = applyLimits(opts)
+	serveListener(listenClients(opts), target, opts)
+}
+
+// projectLimiter is the limiter for --max-project-sessions added by applyLimits, if any.
+var projectLimiter *iap.ProjectLimiter
+
+// applyLimits adds the session and rate limits given on the command line to opts. The limits of --max-sessions,
+// --max-project-sessions, --upload-limit and --download-limit are shared by every connection dialed with opts.
+func applyLimits(opts []iap.DialOption) []iap.DialOption {
+	if maxSessions > 0 {
+		opts = append(opts, iap.WithSessionLimiter(iap.NewSessionLimiter(maxSessions)))
+	}
+	if maxProjectSessions > 0 {
+		projectLimiter = iap.NewProjectLimiter(maxProjectSessions)
+		opts = append(opts, iap.WithProjectLimiter(projectLimiter))
+	}
+
+	upload := parseRate("upload-limit", uploadLimit)
+	download := parseRate("download-limit", downloadLimit)
+	if upload > 0 || download > 0 {
+		opts = append(opts, iap.WithSharedRateLimit(rateLimiter(upload), rateLimiter(download)))
+	}
+
+	connUpload := parseRate("conn-upload-limit", connUploadLimit)
+	connDownload := parseRate("conn-download-limit", connDownloadLimit)
+	if connUpload > 0 || connDownload > 0 {
+		opts = append(opts, iap.WithRateLimit(connUpload, connDownload))
+	}
+
+	return opts
+}
+
+// rateLimiter returns a limiter for the rate, or nil for no limit if it's 0.
+func rateLimiter(rate int) *iap.RateLimiter {
+	if rate == 0 {
+		return nil
+	}
+	return iap.NewRateLimiter(rate)
+}
+
+// parseRate parses the rate given to flag in bytes per second, like 512K or 10M with binary multiples. An empty rate
+// is 0, for no limit.
+func parseRate(flag, rate string) int {
+	if rate == "" {
+		return 0
+	}
+
+	number, multiple := strings.ToUpper(rate), 1
+	for i, suffix := range []string{"K", "M", "G"} {
+		if trimmed, ok := strings.CutSuffix(number, suffix); ok {
+			number, multiple = trimmed, 1<<(10*(i+1))
+			break
+		}
+	}
+
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid --%v %q, should be bytes per second like 512K or 10M", flag, rate)
+	}
+	return n * multiple
+}
+
+// servePorts listens on the host of the local address at each of the ports given with --ports, and proxies clients
+// through the IAP to the same port on host until the process exits.
+func servePorts(host string, opts []iap.DialOption) {
+	ports, err := proxy.ParsePorts(targetPorts)
+	if err != nil {
+		log.Fatalf("Invalid --ports: %v", err)
+	}
+	if portFile != "" {
+		log.Fatal("--port-file can't be used with --ports")
+	}
+	if strings.HasPrefix(listen, "unix:") {
+		log.Fatal("--ports requires listening on a TCP address")
+	}
+	listenHost, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		log.Fatalf("--ports requires listening on a TCP address: %v", err)
+	}
+
+	opts = applyLimits(opts)
+	listener, err := proxy.ListenPorts(listenHost, ports, opts)
+	if err != nil {
+		fatal(err)
+	}
+
+	runProxy(acceptClients(listener), opts, func(ctx context.Context, listener net.Listener, opts []iap.DialOption) error {
+		return proxy.ServePorts(ctx, listener, host, opts, newBreakers())
+	})
+}
+
+// listenClients listens on the local address, restricted to the clients allowed on the command line, and announces
+// it.
+func listenClients(opts []iap.DialOption) net.Listener {
+	listener, err := proxy.Listen(listen, opts)
+	if err != nil {
+		fatal(err)
+	}
+	return acceptClients(listener)
+}
+
+// addListenerFlags registers the flags restricting the local clients of commands which listen for them, and closing
+// the listener once they've gone idle.
+func addListenerFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&allowFrom, "allow-from", nil, "Only accept clients from loopback and these CIDRs when listening on other interfaces")
+	cmd.Flags().DurationVar(&exitOnIdle, "exit-on-idle", 0, "Close tunnels and exit successfully once no data has been sent or received for this long")
+}
+
+// addSecureListenerFlags registers the flags securing the local clients of commands which listen for them on a Unix
+// socket or serve them TLS. Transparent proxying can do neither, since its clients don't know they're being proxied.
+func addSecureListenerFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&sameUser, "same-user", false, "Only accept clients running as the current user (Unix sockets on Linux and macOS)")
+	cmd.Flags().BoolVar(&tlsEnabled, "tls", false, "Serve TLS to local clients, with a self-signed certificate unless --tls-cert and --tls-key are given")
+	cmd.Flags().StringVar(&tlsCert, "tls-cert", "", "PEM certificate to serve TLS to local clients with")
+	cmd.Flags().StringVar(&tlsKey, "tls-key", "", "PEM private key for --tls-cert")
+}
+
+// addProxyFlags registers the flags of commands which proxy each local client through its own tunnel.
+func addProxyFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&proxyProtocol, "proxy-protocol", false, "Send a PROXY protocol v2 header with the local client's address at the start of each tunnel")
+	addAuditLogFlag(cmd)
+}
+
+// addAuditLogFlag registers --audit-log on commands which proxy clients through tunnels, including the daemon's.
+func addAuditLogFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&auditLog, "audit-log", "", "Append a JSON record of every proxied connection to this file (- for stderr)")
+}
+
+// acceptClients restricts the listener to the clients allowed on the command line and announces its addresses.
+func acceptClients(listener net.Listener) net.Listener {
+	addrs := []net.Addr{listener.Addr()}
+	if ports, ok := listener.(*proxy.PortsListener); ok {
+		addrs = ports.Addrs()
+	}
+
+	if sameUser {
+		if listener.Addr().Network() != "unix" {
+			log.Fatal("--same-user requires listening on a Unix socket, like --listen unix:/path/to/socket")
+		}
+		listener = proxy.RequirePeerUID(listener, os.Getuid())
+	}
+	if len(allowFrom) > 0 {
+		if listener.Addr().Network() != "tcp" {
+			log.Fatal("--allow-from requires listening on a TCP address")
+		}
+		prefixes, err := proxy.ParsePrefixes(allowFrom)
+		if err != nil {
+			log.Fatalf("Invalid --allow-from: %v", err)
+		}
+		listener = proxy.AllowSources(listener, prefixes)
+	}
+	if tlsEnabled || tlsCert != "" || tlsKey != "" {
+		config, err := proxy.TLSConfig(tlsCert, tlsKey)
+		if err != nil {
+			log.Fatalf("Error loading TLS certificate: %v", err)
+		}
+		listener = tls.NewListener(listener, config)
+	}
+	for _, addr := range addrs {
+		announce(addr)
+	}
+	daemonReady()
+
+	return listener
+}
+
+// serveListener proxies clients accepted on the listener through the IAP until the process exits.
+func serveListener(listener net.Listener, target string, opts []iap.DialOption) {
+	if breakerFailures > 0 {
+		opts = append(opts, iap.WithCircuitBreaker(iap.NewCircuitBreaker(breakerFailures, breakerCooldown)))
+	}
+
+	runProxy(listener, opts, func(ctx context.Context, listener net.Listener, opts []iap.DialOption) error {
+		return proxy.Serve(ctx, listener, target, opts)
+	})
+}
+
+// runProxy runs serve with the listener and opts wrapped as asked on the command line until the process exits.
+func runProxy(listener net.Listener, opts []iap.DialOption, serve func(context.Context, net.Listener, []iap.DialOption) error) {
+	if proxyProtocol {
+		listener = proxy.SendProxyHeader(listener)
+	}
+
+	ctx, stop := runContext()
+	defer stop()
+	ctx, listener = exitWhenIdle(ctx, listener)
+	listener = byteEvents(ctx, listener)
+
+	if err := serve(ctx, listener, opts); err != nil {
+		fatal(err)
+	}
+
+	exitStopped(ctx, "tunnel")
+}
+
+// newBreakers returns the circuit breakers asked for on the command line for proxies serving several targets, which
+// give each target its own, or nil if there are none.
+func newBreakers() *proxy.Breakers {
+	if breakerFailures <= 0 {
+		return nil
+	}
+	return proxy.NewBreakers(breakerFailures, breakerCooldown)
+}
+
+// announce reports the listen address in the formats requested on the command line, so scripts can pick up
+// the port chosen by the OS when listening on port 0. The path is reported in place of the port for Unix sockets.
+func announce(addr net.Addr) {
+	if addr.Network() == "unix" {
+		announceSocket(addr)
+		return
+	}
+
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	localPort, err := strconv.Atoi(portStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch announceFormat {
+	case "":
+	case "text":
+		fmt.Fprintln(os.Stdout, localPort)
+	case "events":
+		emitEvent("tunnel-up", map[string]any{"addr": addr.String(), "host": host, "port": localPort})
+	case "json":
+		json.NewEncoder(os.Stdout).Encode(struct {
+			Addr string `json:"addr"`
+			Host string `json:"host"`
+			Port int    `json:"port"`
+		}{addr.String(), host, localPort})
+	default:
+		log.Fatalf("Unknown announce format %q", announceFormat)
+	}
+
+	if portFile != "" {
+		if err := writeFileAtomic(portFile, []byte(fmt.Sprintln(localPort))); err != nil {
+			log.Fatalf("Error writing port file: %v", err)
+		}
+	}
+}
+
+func announceSocket(addr net.Addr) {
+	switch announceFormat {
+	case "":
+	case "text":
+		fmt.Fprintln(os.Stdout, addr)
+	case "events":
+		emitEvent("tunnel-up", map[string]any{"addr": addr.String()})
+	case "json":
+		json.NewEncoder(os.Stdout).Encode(struct {
+			Addr string `json:"addr"`
+		}{addr.String()})
+	default:
+		log.Fatalf("Unknown announce format %q", announceFormat)
+	}
+
+	if portFile != "" {
+		if err := writeFileAtomic(portFile, []byte(fmt.Sprintln(addr))); err != nil {
+			log.Fatalf("Error writing port file: %v", err)
+		}
+	}
+}
+
+// writeFileAtomic writes the file via a rename so readers never observe partial content.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cedws/iapc/internal/compute"
+	"github.com/spf13/cobra"
+)
+
+func discoverInstances(ctx context.Context) ([]compute.Instance, error) {
+	tokenSource, err := defaultTokenSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return compute.CachedInstances(ctx, tokenSource, project)
+}
+
+// completeInstances completes the instance argument from the instances in the project, narrowed by --zone if set.
+func completeInstances(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	applyGcloudDefaults()
+
+	if len(args) > 0 || project == "" {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	// allow completing the host part of user@instance
+	prefix := ""
+	if username, _, ok := strings.Cut(toComplete, "@"); ok {
+		prefix = username + "@"
+	}
+
+	instances, err := discoverInstances(cmd.Context())
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	var completions []string
+	for _, instance := range instances {
+		if zone != "" && instance.Zone != zone {
+			continue
+		}
+		completions = append(completions, prefix+instance.Name+"\t"+instance.Zone)
+	}
+
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeZones completes the --zone flag from the zones containing instances, narrowed by the instance argument if set.
+func completeZones(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	applyGcloudDefaults()
+
+	if project == "" {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	instances, err := discoverInstances(cmd.Context())
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	name := ""
+	if len(args) > 0 {
+		_, name, _ = strings.Cut(args[0], "@")
+		if name == "" {
+			name = args[0]
+		}
+	}
+
+	seen := make(map[string]bool)
+
+	var completions []string
+	for _, instance := range instances {
+		if (name != "" && instance.Name != name) || seen[instance.Zone] {
+			continue
+		}
+		seen[instance.Zone] = true
+		completions = append(completions, instance.Zone)
+	}
+
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
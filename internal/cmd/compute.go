@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	listenOnStdin bool
+	localHostPort string
+	verbosity     string
+)
+
+// verbosityLevels maps gcloud's --verbosity values to log levels.
+var verbosityLevels = map[string]log.Level{
+	"debug":    log.DebugLevel,
+	"info":     log.InfoLevel,
+	"warning":  log.WarnLevel,
+	"error":    log.ErrorLevel,
+	"critical": log.FatalLevel,
+	"none":     log.FatalLevel + 1,
+}
+
+var computeCmd = &cobra.Command{
+	Use:  "compute",
+	Long: "Drop-in replacements for gcloud compute commands, so scripts and ssh_config files can swap gcloud for iapc",
+}
+
+var startIAPTunnelCmd = &cobra.Command{
+	Use:               "start-iap-tunnel INSTANCE_NAME INSTANCE_PORT",
+	Long:              "Create a tunnel like gcloud compute start-iap-tunnel. With --region, --network and --dest-group, INSTANCE_NAME is a private IP or FQDN instead.",
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: completeInstances,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		targetPort, err := strconv.ParseUint(args[1], 10, 16)
+		if err != nil {
+			log.Fatalf("Invalid port %q", args[1])
+		}
+		port = uint(targetPort)
+
+		switch {
+		case verbosity != "":
+			level, ok := verbosityLevels[verbosity]
+			if !ok {
+				log.Fatalf("Invalid verbosity %q", verbosity)
+			}
+			log.SetLevel(level)
+		case listenOnStdin && !debug && verbose == 0:
+			// like gcloud, only speak up on stderr when something goes wrong, since stderr ends up in the ssh session
+			log.SetLevel(log.WarnLevel)
+		}
+
+		if listenOnStdin && (announceFormat != "" || portFile != "") {
+			log.Fatal("--announce and --port-file can't be used with --listen-on-stdin")
+		}
+
+		if destGroup == "" {
+			instance = resolveInstance(cmd, args[:1])
+			return
+		}
+		if region == "" {
+			region = gcloudConfig.Region
+		}
+		if region == "" || network == "" {
+			log.Fatal("--region and --network are required with --dest-group")
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := []iap.DialOption{
+			iap.WithProject(project),
+			iap.WithPort(fmt.Sprint(port)),
+			iap.WithTokenSource(tokenSource()),
+		}
+		if destGroup == "" {
+			opts = append(opts, iap.WithInstance(instance, zone, ninterface))
+		} else {
+			opts = append(opts, iap.WithHost(args[0], region, network, destGroup))
+		}
+		if compress {
+			opts = append(opts, iap.WithCompression())
+		}
+		opts = append(opts, relayOptions()...)
+
+		target := fmt.Sprintf("%v:%v", args[0], port)
+
+		if listenOnStdin {
+			serveStdio(target, opts)
+			return
+		}
+
+		listen = localHostPort
+		log.Info("Starting proxy", "dest", target, "port", port, "project", project)
+		serve(target, opts)
+	},
+}
+
+// serveStdio tunnels stdin and stdout to the target, for use as an ssh ProxyCommand. Nothing but tunnel data is
+// written to stdout.
+func serveStdio(target string, opts []iap.DialOption) {
+	conn, err := iap.Dial(context.Background(), opts...)
+	if err != nil {
+		fatalf("Error dialing %v: %w", target, err)
+	}
+	defer conn.Close()
+
+	go func() {
+		// the client is done once stdin is closed, which ends the tunnel like gcloud does
+		if _, err := io.Copy(conn, os.Stdin); err != nil {
+			log.Debug("Error reading stdin", "err", err)
+		}
+		conn.Close()
+	}()
+
+	if _, err := io.Copy(os.Stdout, conn); err != nil && !errors.Is(err, net.ErrClosed) {
+		fatal(err)
+	}
+}
+
+func init() {
+	startIAPTunnelCmd.Flags().BoolVar(&listenOnStdin, "listen-on-stdin", false, "Tunnel stdin and stdout instead of listening on a local port")
+	startIAPTunnelCmd.Flags().StringVar(&localHostPort, "local-host-port", "localhost:0", "Local address to listen on")
+	startIAPTunnelCmd.Flags().StringVar(&zone, "zone", "", "Target zone name (defaults to gcloud's compute/zone)")
+	startIAPTunnelCmd.Flags().StringVar(&ninterface, "network-interface", "nic0", "Target network interface")
+	startIAPTunnelCmd.Flags().StringVar(&region, "region", "", "Target region name for --dest-group (defaults to gcloud's compute/region)")
+	startIAPTunnelCmd.Flags().StringVar(&network, "network", "", "Target network name for --dest-group")
+	startIAPTunnelCmd.Flags().StringVar(&destGroup, "dest-group", "", "Destination group to reach INSTANCE_NAME as a private IP or FQDN through")
+	startIAPTunnelCmd.Flags().StringVar(&verbosity, "verbosity", "", "Log verbosity: debug, info, warning, error, critical or none")
+	// accepted so gcloud command lines work unchanged, though the connection is still tested before listening and there
+	// are no prompts to skip
+	startIAPTunnelCmd.Flags().Bool("iap-tunnel-disable-connection-check", false, "Accepted for compatibility with gcloud")
+	startIAPTunnelCmd.Flags().BoolP("quiet", "q", false, "Accepted for compatibility with gcloud")
+	startIAPTunnelCmd.RegisterFlagCompletionFunc("zone", completeZones)
+	addListenerFlags(startIAPTunnelCmd)
+	addSecureListenerFlags(startIAPTunnelCmd)
+	addProxyFlags(startIAPTunnelCmd)
+
+	computeCmd.AddCommand(startIAPTunnelCmd)
+	rootCmd.AddCommand(computeCmd)
+}
@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iapssh"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cpWorkers int
+	cpResume  bool
+)
+
+var cpCmd = &cobra.Command{
+	Use:  "cp [[user@]instance:]src... [[user@]instance:]dst",
+	Long: "Copy files to or from a remote Compute Engine instance over SFTP",
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		srcs, dst := args[:len(args)-1], args[len(args)-1]
+
+		dstUser, dstInstance, dstPath, dstRemote := parseRemotePath(dst)
+
+		var (
+			username  = dstUser
+			remote    = dstInstance
+			srcPaths  []string
+			srcRemote bool
+		)
+		for i, src := range srcs {
+			srcUser, srcInstance, srcPath, isRemote := parseRemotePath(src)
+			if i > 0 && isRemote != srcRemote {
+				log.Fatal("Sources must be either all local or all remote")
+			}
+			if isRemote {
+				if remote != "" && srcInstance != remote {
+					log.Fatal("Sources must all be on the same instance")
+				}
+				username, remote = srcUser, srcInstance
+			}
+
+			srcRemote = isRemote
+			srcPaths = append(srcPaths, srcPath)
+		}
+		if srcRemote == dstRemote {
+			log.Fatal("Exactly one of the sources or the destination must be remote, like instance:path")
+		}
+
+		instance = resolveInstance(cmd, []string{remote})
+
+		opts := []iap.DialOption{
+			iap.WithProject(project),
+			iap.WithInstance(instance, zone, ninterface),
+			iap.WithPort(fmt.Sprint(port)),
+			iap.WithTokenSource(tokenSource()),
+		}
+		if compress {
+			opts = append(opts, iap.WithCompression())
+		}
+		opts = append(opts, relayOptions()...)
+
+		runCp(username, srcPaths, dstPath, dstRemote, opts)
+	},
+}
+
+// parseRemotePath splits a path in the form [user@]instance:path. Paths without an instance are local, as are paths
+// with a single letter before the colon so Windows drive letters aren't mistaken for instances.
+func parseRemotePath(arg string) (username, instance, file string, remote bool) {
+	host, file, ok := strings.Cut(arg, ":")
+	if !ok || len(host) < 2 {
+		return "", "", arg, false
+	}
+
+	username, instance = splitUserHost(host)
+	return username, instance, file, true
+}
+
+func runCp(username string, srcs []string, dst string, upload bool, opts []iap.DialOption) {
+	ctx := context.Background()
+
+	client, err := iapssh.DialSFTP(ctx, net.JoinHostPort(instance, fmt.Sprint(port)), sshClientConfig(username), opts...)
+	if err != nil {
+		fatalf("Error establishing SFTP session: %w", err)
+	}
+	defer client.Close()
+
+	// copy into dst rather than to it when there's more than one source or it's a directory
+	isDir := len(srcs) > 1
+	if upload {
+		if info, err := client.Stat(dst); err == nil && info.IsDir() {
+			isDir = true
+		}
+	} else {
+		if info, err := os.Stat(dst); err == nil && info.IsDir() {
+			isDir = true
+		}
+	}
+
+	transfers := make([]iapssh.Transfer, len(srcs))
+	for i, src := range srcs {
+		transfers[i] = iapssh.Transfer{Src: src, Dst: dst}
+
+		switch {
+		case !isDir:
+		case upload:
+			transfers[i].Dst = path.Join(dst, filepath.Base(src))
+		default:
+			transfers[i].Dst = filepath.Join(dst, path.Base(src))
+		}
+	}
+
+	topts := []iapssh.TransferOption{iapssh.WithWorkers(cpWorkers)}
+	if cpResume {
+		topts = append(topts, iapssh.WithResume())
+	}
+
+	if upload {
+		err = iapssh.Upload(ctx, client.Client, transfers, topts...)
+	} else {
+		err = iapssh.Download(ctx, client.Client, transfers, topts...)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func init() {
+	cpCmd.Flags().StringVarP(&zone, "zone", "z", "", "Target zone name (defaults to gcloud's compute/zone)")
+	cpCmd.Flags().StringVarP(&ninterface, "interface", "i", "nic0", "Target network interface")
+	cpCmd.Flags().StringSliceVar(&identityFiles, "identity", defaultIdentityFiles, "Private key files to authenticate with")
+	cpCmd.Flags().StringVar(&knownHostsFile, "known-hosts", "~/.ssh/known_hosts", "Known hosts file")
+	cpCmd.Flags().IntVar(&cpWorkers, "workers", 4, "Number of files to transfer at once")
+	cpCmd.Flags().BoolVar(&cpResume, "resume", false, "Continue partial transfers of files that are shorter at the destination")
+	cpCmd.RegisterFlagCompletionFunc("zone", completeZones)
+
+	rootCmd.AddCommand(cpCmd)
+}
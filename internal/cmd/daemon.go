@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/internal/daemon"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	socketPath   string
+	grpcListen   string
+	httpListen   string
+	apiTokenFile string
+	tunnelsFile  string
+	parallelAdds int
+)
+
+var daemonCmd = &cobra.Command{
+	Use:  "daemon",
+	Long: "Run a long-lived process that manages tunnels requested with the tunnel subcommands",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		// tokens from a credentials file and default credentials are minted by each dial through the iap package's
+		// cache, which reloading clears, so a rotated file is read again. A token given in the environment can't be
+		// reloaded.
+		credentials := iap.WithDefaultCredentials(tokenScopes...)
+		switch {
+		case os.Getenv(envName("token")) != "":
+			source, err := iap.EnvironmentTokenSource(tokenScopes...)
+			if err != nil {
+				fatal(err)
+			}
+			credentials = iap.WithTokenSource(&source)
+		case os.Getenv(envName("credentials-file")) != "":
+			credentials = iap.WithCredentialsFile(os.Getenv(envName("credentials-file")), tokenScopes...)
+		}
+
+		opts := []iap.DialOption{credentials}
+		if compress {
+			opts = append(opts, iap.WithCompression())
+		}
+		opts = append(opts, relayOptions()...)
+		// the limits are shared by every tunnel, so they're a quota for everyone using the daemon
+		opts = applyLimits(opts)
+
+		ctx, stop := runContext()
+		defer stop()
+
+		d := daemon.New(opts...)
+		d.BreakerFailures = breakerFailures
+		d.BreakerCooldown = breakerCooldown
+		d.ProjectLimiter = projectLimiter
+		d.Ready = daemonReady
+
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				d.Reload()
+			}
+		}()
+
+		if apiTokenFile != "" {
+			token, err := daemon.LoadAPIToken(apiTokenFile)
+			if err != nil {
+				log.Fatalf("Error loading API token: %v", err)
+			}
+			d.APIToken = token
+		}
+
+		if grpcListen != "" {
+			go func() {
+				if err := d.ServeGRPC(ctx, grpcListen); err != nil {
+					log.Fatal(err)
+				}
+			}()
+		}
+
+		if httpListen != "" {
+			go func() {
+				if err := d.ServeHTTP(ctx, httpListen); err != nil {
+					log.Fatal(err)
+				}
+			}()
+		}
+
+		if err := d.Serve(ctx, socketPath); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var tunnelCmd = &cobra.Command{
+	Use:  "tunnel",
+	Long: "Manage tunnels in a running daemon",
+}
+
+var tunnelAddCmd = &cobra.Command{
+	Use:               "add instance|host",
+	Long:              "Add a tunnel to an instance (with --zone) or a host (with --region, --network and --dest-group), or every tunnel in a file (with --file)",
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: completeInstances,
+	Run: func(cmd *cobra.Command, args []string) {
+		if tunnelsFile != "" {
+			if len(args) > 0 {
+				log.Fatal("An instance or host can't be given with --file")
+			}
+			addTunnels(tunnelsFile)
+			return
+		}
+		if len(args) == 0 {
+			log.Fatal("An instance or host is required")
+		}
+
+		if project == "" {
+			log.Fatal(`Required flag "project" not set`)
+		}
+
+		spec := daemon.TunnelSpec{
+			Project: project,
+			Port:    port,
+			Listen:  listen,
+		}
+		if destGroup != "" {
+			spec.Host = args[0]
+			spec.Region = region
+			spec.Network = network
+			spec.DestGroup = destGroup
+		} else {
+			spec.Instance = args[0]
+			spec.Zone = zone
+			spec.Interface = ninterface
+		}
+		applySpecDefaults(&spec)
+
+		if targetPorts != "" {
+			spec.Port, spec.Ports = 0, targetPorts
+			addSpecs([]daemon.TunnelSpec{spec})
+			return
+		}
+
+		t, err := daemon.NewClient(socketPath).Add(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println(t.ID, t.Addr)
+	},
+}
+
+// addTunnels adds every tunnel in a JSON file holding an array of tunnel specs, reporting the result of each.
+func addTunnels(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var specs []daemon.TunnelSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		log.Fatalf("Error parsing %v: %v", path, err)
+	}
+	for i := range specs {
+		applySpecDefaults(&specs[i])
+	}
+
+	addSpecs(specs)
+}
+
+// applySpecDefaults fills in the project, and the zone of an instance or region of a host, from --project and gcloud's
+// configuration when the spec leaves them out.
+func applySpecDefaults(spec *daemon.TunnelSpec) {
+	if spec.Project == "" {
+		spec.Project = project
+	}
+	if spec.Host != "" && spec.Region == "" {
+		spec.Region = gcloudConfig.Region
+	}
+	if spec.Instance != "" && spec.Zone == "" {
+		spec.Zone = gcloudConfig.Zone
+	}
+}
+
+// addSpecs adds the tunnels, expanding specs with ports into a tunnel for each, and reports the result of each.
+func addSpecs(specs []daemon.TunnelSpec) {
+	results := daemon.NewClient(socketPath).AddAll(specs, parallelAdds)
+
+	failed := false
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tID\tADDR\tERROR")
+	for _, result := range results {
+		if result.Err != nil {
+			failed = true
+			fmt.Fprintf(w, "%v\t\t\t%v\n", result.Spec.Target(), result.Err)
+			continue
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t\n", result.Spec.Target(), result.Tunnel.ID, result.Tunnel.Addr)
+	}
+	w.Flush()
+
+	if failed {
+		os.Exit(ExitError)
+	}
+}
+
+var tunnelRemoveCmd = &cobra.Command{
+	Use:  "remove id",
+	Long: "Remove a tunnel",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := daemon.NewClient(socketPath).Remove(args[0]); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var tunnelListCmd = &cobra.Command{
+	Use:  "list",
+	Long: "List tunnels",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		tunnels, err := daemon.NewClient(socketPath).List()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTARGET\tPROJECT\tADDR")
+		for _, t := range tunnels {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", t.ID, t.Spec.Target(), t.Spec.Project, t.Addr)
+		}
+		w.Flush()
+	},
+}
+
+var tunnelStatsCmd = &cobra.Command{
+	Use:  "stats",
+	Long: "Show the connections and bytes of each tunnel",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		stats, err := daemon.NewClient(socketPath).Stats()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tACTIVE\tCONNECTIONS\tSENT\tRECEIVED\tBREAKER\tQUEUED\tQUEUE WAIT")
+		for _, s := range stats {
+			breaker := "closed"
+			if s.BreakerOpen {
+				breaker = "open"
+			}
+			wait := time.Duration(s.QueueWaitSeconds * float64(time.Second)).Round(time.Millisecond)
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", s.ID, s.ActiveConnections, s.Connections, s.SentBytes, s.ReceivedBytes, breaker, s.QueuedDials, wait)
+		}
+		w.Flush()
+	},
+}
+
+var tunnelReloadCmd = &cobra.Command{
+	Use:  "reload",
+	Long: "Make the daemon pick up rotated credentials, also done on SIGHUP",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := daemon.NewClient(socketPath).Reload(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	daemonCmd.Flags().StringVar(&socketPath, "socket", daemon.DefaultSocketPath(), "Control socket path")
+	daemonCmd.Flags().StringVar(&httpListen, "http-listen", "", "Also serve the control API on this address, such as 127.0.0.1:7071 with --api-token-file, for tools that can't use the socket")
+	daemonCmd.Flags().StringVar(&grpcListen, "grpc-listen", "", "Also serve the gRPC broker API on unix:path, a socket only the current user can connect to (the default), or on a TCP address with --api-token-file")
+	daemonCmd.Flags().Lookup("grpc-listen").NoOptDefVal = "unix:" + daemon.DefaultBrokerSocketPath()
+	daemonCmd.Flags().StringVar(&apiTokenFile, "api-token-file", "", "File holding the bearer token clients must send to --grpc-listen and --http-listen on TCP addresses, created with a random token if it doesn't exist")
+	addAuditLogFlag(daemonCmd)
+	tunnelCmd.PersistentFlags().StringVar(&socketPath, "socket", daemon.DefaultSocketPath(), "Control socket path")
+
+	tunnelAddCmd.Flags().StringVarP(&zone, "zone", "z", "", "Target zone name (defaults to gcloud's compute/zone)")
+	tunnelAddCmd.Flags().StringVarP(&ninterface, "interface", "i", "nic0", "Target network interface")
+	tunnelAddCmd.Flags().StringVarP(&destGroup, "dest-group", "d", "", "Destination group name")
+	tunnelAddCmd.Flags().StringVarP(&region, "region", "r", "", "Target region name (defaults to gcloud's compute/region)")
+	tunnelAddCmd.Flags().StringVarP(&network, "network", "n", "", "Target network name")
+	tunnelAddCmd.Flags().StringVar(&targetPorts, "ports", "", "Add a tunnel for each of several target ports, like 8080-8090,9000, listening on the same local port on --listen's host")
+	tunnelAddCmd.Flags().StringVarP(&tunnelsFile, "file", "f", "", "Add every tunnel in this JSON file, an array of tunnel specs")
+	tunnelAddCmd.Flags().IntVar(&parallelAdds, "parallel", 8, "Number of tunnels from --file to add at once")
+	tunnelAddCmd.MarkFlagsMutuallyExclusive("zone", "dest-group")
+	tunnelAddCmd.RegisterFlagCompletionFunc("zone", completeZones)
+
+	tunnelCmd.AddCommand(tunnelAddCmd, tunnelRemoveCmd, tunnelListCmd, tunnelStatsCmd, tunnelReloadCmd)
+	rootCmd.AddCommand(daemonCmd, tunnelCmd)
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// daemonizedEnv marks the detached copy of a process started with --daemon. It isn't named after a flag, so
+// applyEnvironment leaves it alone.
+const daemonizedEnv = "_IAPC_DAEMONIZED"
+
+// writePidfile records the process's PID in --pidfile, refusing to start if the file names another process which is
+// still running.
+func writePidfile() {
+	if data, err := os.ReadFile(pidfile); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() && processRunning(pid) {
+			log.Fatalf("Already running with PID %v according to %v", pid, pidfile)
+		}
+	}
+
+	if err := os.WriteFile(pidfile, []byte(fmt.Sprintln(os.Getpid())), 0o644); err != nil {
+		log.Fatalf("Error writing pidfile: %v", err)
+	}
+}
+
+// openLogFile opens --log-file to append logs to.
+func openLogFile() *os.File {
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		log.Fatalf("Error opening log file: %v", err)
+	}
+	return f
+}
+
+// removePidfile removes --pidfile when shutting down cleanly. A pidfile left behind by a crash is overwritten by the
+// next process, since the PID in it isn't running.
+func removePidfile() {
+	if pidfile != "" {
+		os.Remove(pidfile)
+	}
+}
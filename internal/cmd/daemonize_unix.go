@@ -0,0 +1,104 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// readyPipe is written to by the detached process once it's ready, nil in other processes
+	readyPipe *os.File
+	readyOnce sync.Once
+	// daemonLog is --log-file in the detached process, which logs are written to once it's ready
+	daemonLog *os.File
+)
+
+// daemonize starts the command again detached from the terminal in a new session, waits for it to be ready, and
+// exits. Errors before then, like bad credentials, are reported by the detached process on the terminal and its exit
+// code is passed on. In the detached process, daemonize returns.
+func daemonize() {
+	if os.Getenv(daemonizedEnv) != "" {
+		os.Unsetenv(daemonizedEnv)
+		readyPipe = os.NewFile(3, "ready")
+		if logFile != "" {
+			daemonLog = openLogFile()
+		}
+		return
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Error finding executable: %v", err)
+	}
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonizedEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = devNull, os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{readyWriter}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("Error starting in the background: %v", err)
+	}
+	readyWriter.Close()
+
+	// the pipe closes without a byte if the process exits before it's ready
+	if n, _ := ready.Read(make([]byte, 1)); n == 1 {
+		log.Info("Running in the background", "pid", cmd.Process.Pid)
+		os.Exit(0)
+	}
+
+	var exitErr *exec.ExitError
+	if err := cmd.Wait(); errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	os.Exit(ExitError)
+}
+
+// daemonReady tells the process waiting in daemonize that the detached process is ready, and lets go of the terminal
+// so that a script reading its output isn't left waiting for it. Logs are written to --log-file from then on, or
+// discarded without it. It does nothing in other processes.
+func daemonReady() {
+	if readyPipe == nil {
+		return
+	}
+
+	readyOnce.Do(func() {
+		readyPipe.Write([]byte{1})
+		readyPipe.Close()
+
+		output := daemonLog
+		if output == nil {
+			devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+			if err != nil {
+				return
+			}
+			output = devNull
+		}
+		// the descriptors are replaced rather than the logger's output, so a panic is logged too
+		unix.Dup2(int(output.Fd()), int(os.Stdout.Fd()))
+		unix.Dup2(int(output.Fd()), int(os.Stderr.Fd()))
+	})
+}
+
+// processRunning reports whether a process with the PID exists.
+func processRunning(pid int) bool {
+	// EPERM means the process exists but belongs to someone else
+	return !errors.Is(syscall.Kill(pid, 0), syscall.ESRCH)
+}
@@ -0,0 +1,25 @@
+//go:build windows
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/charmbracelet/log"
+)
+
+func daemonize() {
+	log.Fatal("--daemon isn't supported on Windows, run iapc as a service instead")
+}
+
+func daemonReady() {}
+
+// processRunning reports whether a process with the PID exists.
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
@@ -0,0 +1,283 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/internal/compute"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+	"golang.org/x/oauth2"
+)
+
+const (
+	relayURL     = "https://tunnel.cloudproxy.app/"
+	checkTimeout = 15 * time.Second
+)
+
+var doctorCmd = &cobra.Command{
+	Use:               "doctor [instance]",
+	Long:              "Check the usual reasons tunnels to an instance fail: credentials, IAM roles, firewall rules, the instance itself and reaching the relay",
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: completeInstances,
+	Run: func(cmd *cobra.Command, args []string) {
+		name := os.Getenv("IAPC_INSTANCE")
+		if len(args) > 0 {
+			name = args[0]
+		}
+		if name == "" {
+			log.Fatal("An instance name is required")
+		}
+		if zone == "" {
+			zone = gcloudConfig.Zone
+		}
+
+		d := &diagnosis{ctx: context.Background(), name: name}
+		if !d.run() {
+			os.Exit(ExitError)
+		}
+	},
+}
+
+// diagnosis runs the doctor's checks in order, each building on what the ones before it found.
+type diagnosis struct {
+	ctx         context.Context
+	name        string
+	tokenSource oauth2.TokenSource
+	instance    *compute.InstanceDetails
+	failed      bool
+}
+
+type check struct {
+	name string
+	run  func() (detail, fix string, ok bool)
+	// needs reports why the check can't run, if an earlier check it depends on failed
+	needs func() string
+}
+
+func (d *diagnosis) run() bool {
+	checks := []check{
+		{"Credentials", d.checkCredentials, nil},
+		{"Relay", d.checkRelay, nil},
+		{"Instance", d.checkInstance, d.needsCredentials},
+		{"IAM", d.checkIAM, d.needsInstance},
+		{"Firewall", d.checkFirewall, d.needsInstance},
+		{"Tunnel", d.checkTunnel, d.needsInstance},
+	}
+
+	for _, check := range checks {
+		if check.needs != nil {
+			if reason := check.needs(); reason != "" {
+				fmt.Printf("SKIP  %-12v %v\n", check.name, reason)
+				continue
+			}
+		}
+
+		detail, fix, ok := check.run()
+		if ok {
+			fmt.Printf("PASS  %-12v %v\n", check.name, detail)
+			continue
+		}
+
+		d.failed = true
+		fmt.Printf("FAIL  %-12v %v\n", check.name, detail)
+		if fix != "" {
+			fmt.Printf("      %-12v %v\n", "", fix)
+		}
+	}
+
+	return !d.failed
+}
+
+func (d *diagnosis) needsCredentials() string {
+	if d.tokenSource == nil {
+		return "needs credentials"
+	}
+	return ""
+}
+
+func (d *diagnosis) needsInstance() string {
+	if d.instance == nil {
+		return "needs the instance"
+	}
+	return ""
+}
+
+func (d *diagnosis) checkCredentials() (string, string, bool) {
+	const fix = "Run `gcloud auth application-default login`, or set GOOGLE_APPLICATION_CREDENTIALS to a service account key file"
+
+	tokenSource, err := defaultTokenSource(d.ctx)
+	if err != nil {
+		return err.Error(), fix, false
+	}
+	if _, err := tokenSource.Token(); err != nil {
+		return fmt.Sprintf("couldn't get a token: %v", err), fix, false
+	}
+
+	d.tokenSource = tokenSource
+	return "found credentials and got a token", "", true
+}
+
+func (d *diagnosis) checkRelay() (string, string, bool) {
+	client := &http.Client{Timeout: checkTimeout}
+
+	resp, err := client.Get(relayURL)
+	if err != nil {
+		return fmt.Sprintf("couldn't reach the relay: %v", err), "Allow outbound HTTPS to tunnel.cloudproxy.app, or set HTTPS_PROXY if you're behind a proxy", false
+	}
+	resp.Body.Close()
+
+	return "reached tunnel.cloudproxy.app over HTTPS", "", true
+}
+
+func (d *diagnosis) checkInstance() (string, string, bool) {
+	ctx, cancel := context.WithTimeout(d.ctx, checkTimeout)
+	defer cancel()
+
+	if zone != "" {
+		instance, err := compute.GetInstance(ctx, d.tokenSource, project, zone, d.name)
+		switch {
+		case err == nil:
+			return d.foundInstance(instance)
+		case !errors.Is(err, compute.ErrNotFound):
+			return err.Error(), viewerFix(err, "the project", "the instance"), false
+		}
+	}
+
+	// look for the instance in the other zones, to catch the wrong zone being given
+	instances, err := compute.ListInstances(ctx, d.tokenSource, project)
+	if err != nil {
+		return err.Error(), "", false
+	}
+
+	var zones []string
+	for _, instance := range instances {
+		if instance.Name == d.name {
+			zones = append(zones, instance.Zone)
+		}
+	}
+
+	switch {
+	case len(zones) == 0:
+		return fmt.Sprintf("no instance named %v in project %v", d.name, project), "Check the instance name and --project", false
+	case zone != "":
+		return fmt.Sprintf("%v isn't in zone %v but in %v", d.name, zone, zones), fmt.Sprintf("Pass --zone %v", zones[0]), false
+	case len(zones) > 1:
+		return fmt.Sprintf("%v is in more than one zone: %v", d.name, zones), "Pass --zone to choose one", false
+	}
+
+	zone = zones[0]
+
+	instance, err := compute.GetInstance(ctx, d.tokenSource, project, zone, d.name)
+	if err != nil {
+		return err.Error(), "", false
+	}
+	return d.foundInstance(instance)
+}
+
+func (d *diagnosis) foundInstance(instance *compute.InstanceDetails) (string, string, bool) {
+	if instance.Status != "RUNNING" {
+		return fmt.Sprintf("%v is %v", instance.Name, instance.Status), fmt.Sprintf("Start it with `gcloud compute instances start %v --zone %v`", instance.Name, instance.Zone), false
+	}
+
+	d.instance = instance
+	return fmt.Sprintf("%v is running in %v", instance.Name, instance.Zone), "", true
+}
+
+func (d *diagnosis) checkIAM() (string, string, bool) {
+	ctx, cancel := context.WithTimeout(d.ctx, checkTimeout)
+	defer cancel()
+
+	err := iap.CheckPermissions(ctx, d.dialOptions()...)
+
+	var permErr *iap.PermissionError
+	switch {
+	case errors.As(err, &permErr):
+		return fmt.Sprintf("missing %v", permErr.Missing), fmt.Sprintf("Grant roles/iap.tunnelResourceAccessor with `gcloud projects add-iam-policy-binding %v --member MEMBER --role roles/iap.tunnelResourceAccessor`", project), false
+	case err != nil:
+		return err.Error(), "", false
+	}
+
+	return fmt.Sprintf("allowed %v", iap.PermissionTunnelInstances), "", true
+}
+
+func (d *diagnosis) checkFirewall() (string, string, bool) {
+	ctx, cancel := context.WithTimeout(d.ctx, checkTimeout)
+	defer cancel()
+
+	nic := d.instance.Interface(ninterface)
+	if nic == nil {
+		return fmt.Sprintf("%v has no network interface %v", d.instance.Name, ninterface), "Pass --interface with one of the instance's network interfaces", false
+	}
+
+	firewalls, err := compute.ListFirewalls(ctx, d.tokenSource, nic.Network)
+	if err != nil {
+		return err.Error(), viewerFix(err, "the network's project", "its firewall rules"), false
+	}
+
+	rule, allowed := compute.IAPFirewall(firewalls, d.instance, int(port))
+	switch {
+	case rule == nil:
+		return fmt.Sprintf("no rule allows tcp:%v from %v", port, compute.IAPRange), fmt.Sprintf("Create one with `gcloud compute firewall-rules create allow-iap-ingress --network %v --direction INGRESS --allow tcp:%v --source-ranges %v`", nic.Network, port, compute.IAPRange), false
+	case !allowed:
+		return fmt.Sprintf("rule %v denies tcp:%v from %v", rule.Name, port, compute.IAPRange), fmt.Sprintf("Allow it with a rule of higher priority than %v, i.e. a number below %v", rule.Name, rule.Priority), false
+	}
+
+	return fmt.Sprintf("rule %v allows tcp:%v from %v", rule.Name, port, compute.IAPRange), "", true
+}
+
+func (d *diagnosis) checkTunnel() (string, string, bool) {
+	ctx, cancel := context.WithTimeout(d.ctx, checkTimeout)
+	defer cancel()
+
+	conn, err := iap.Dial(ctx, d.dialOptions()...)
+	if err != nil {
+		fix := ""
+		switch exitCode(err) {
+		case ExitAuth:
+			fix = "Check the IAM check above, the relay refused the credentials"
+		case ExitBlocked:
+			fix = fmt.Sprintf("Check the firewall check above and that something is listening on port %v", port)
+		case ExitNotFound:
+			fix = "Check the instance check above"
+		}
+		return err.Error(), fix, false
+	}
+	defer conn.Close()
+
+	detail := fmt.Sprintf("connected to %v:%v through the IAP", d.name, port)
+	if rtt, err := conn.Ping(ctx); err == nil {
+		detail += fmt.Sprintf(", %v round trip to the relay", rtt.Round(time.Millisecond))
+	}
+	return detail, "", true
+}
+
+func (d *diagnosis) dialOptions() []iap.DialOption {
+	return append([]iap.DialOption{
+		iap.WithProject(project),
+		iap.WithInstance(d.name, zone, ninterface),
+		iap.WithPort(fmt.Sprint(port)),
+		iap.WithTokenSource(&d.tokenSource),
+	}, relayOptions()...)
+}
+
+// viewerFix suggests granting read access to the resources if err is a permission error.
+func viewerFix(err error, project, resources string) string {
+	if !errors.Is(err, compute.ErrForbidden) {
+		return ""
+	}
+	return fmt.Sprintf("Grant roles/compute.viewer on %v so %v can be inspected", project, resources)
+}
+
+func init() {
+	doctorCmd.Flags().StringVarP(&zone, "zone", "z", "", "Target zone name (defaults to gcloud's compute/zone, or the zone the instance is found in)")
+	doctorCmd.Flags().StringVarP(&ninterface, "interface", "i", "nic0", "Target network interface")
+	doctorCmd.RegisterFlagCompletionFunc("zone", completeZones)
+
+	rootCmd.AddCommand(doctorCmd)
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/internal/proxy"
+)
+
+var eventsMu sync.Mutex
+
+// eventsEnabled reports whether --announce events was given, which reports the tunnel's state changes on stdout.
+func eventsEnabled() bool {
+	return announceFormat == "events"
+}
+
+// emitEvent writes an event to stdout as a line of JSON with the time and the fields given, if events are enabled.
+func emitEvent(event string, fields map[string]any) {
+	if !eventsEnabled() {
+		return
+	}
+
+	line := map[string]any{"time": time.Now().UTC(), "event": event}
+	for k, v := range fields {
+		line[k] = v
+	}
+
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+
+	json.NewEncoder(os.Stdout).Encode(line)
+}
+
+// reconnectEvents returns an option reporting each time the relay is dialed again as a reconnecting event.
+func reconnectEvents() iap.DialOption {
+	return iap.WithReconnectCallback(func(sessionID string, err error) {
+		fields := map[string]any{}
+		if sessionID != "" {
+			fields["sid"] = sessionID
+		}
+		if err != nil {
+			fields["reason"] = err.Error()
+		}
+		emitEvent("reconnecting", fields)
+	})
+}
+
+// byteEvents reports the bytes exchanged by the clients of listener every --events-interval as a bytes event until ctx
+// is done, returning the listener counting them. It returns listener as it is if events aren't enabled.
+func byteEvents(ctx context.Context, listener net.Listener) net.Listener {
+	if !eventsEnabled() || eventsInterval <= 0 {
+		return listener
+	}
+
+	tracked := proxy.TrackActivity(listener)
+
+	go func() {
+		ticker := time.NewTicker(eventsInterval)
+		defer ticker.Stop()
+
+		var sent, received uint64
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			nowSent, nowReceived := tracked.Bytes()
+			emitEvent("bytes", map[string]any{
+				"interval": eventsInterval.String(),
+				"sent":     nowSent - sent,
+				"received": nowReceived - received,
+			})
+			sent, received = nowSent, nowReceived
+		}
+	}()
+
+	return tracked
+}
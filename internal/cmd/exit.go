@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/charmbracelet/log"
+	"golang.org/x/oauth2"
+)
+
+// Exit codes, so wrapper scripts can react to common failures. Any other failure exits with ExitError.
+const (
+	ExitError = 1
+	// ExitAuth is returned when credentials couldn't be found or the caller isn't authorized to use the tunnel.
+	ExitAuth = 3
+	// ExitNotFound is returned when the target instance doesn't exist.
+	ExitNotFound = 4
+	// ExitBlocked is returned when the relay couldn't connect to the target port, usually because a firewall rule
+	// doesn't allow IAP's range.
+	ExitBlocked = 5
+	// ExitBind is returned when the local listen address couldn't be bound.
+	ExitBind = 6
+	// ExitInterrupted is returned when a tunnel is stopped with SIGINT or SIGTERM.
+	ExitInterrupted = 130
+)
+
+// exitCode returns the exit code describing err.
+func exitCode(err error) int {
+	var (
+		retrieveErr *oauth2.RetrieveError
+		opErr       *net.OpError
+	)
+
+	switch {
+	// API calls outside of the tunnel fail with the token endpoint's error
+	case errors.Is(err, iap.ErrUnauthorized), errors.As(err, &retrieveErr):
+		return ExitAuth
+	case errors.Is(err, iap.ErrTargetNotFound):
+		return ExitNotFound
+	case errors.Is(err, iap.ErrTargetUnreachable):
+		return ExitBlocked
+	case errors.As(err, &opErr) && opErr.Op == "listen":
+		return ExitBind
+	}
+
+	return ExitError
+}
+
+// fatal logs err and exits with the code describing it.
+func fatal(err error) {
+	log.Log(log.FatalLevel, err)
+	code := exitCode(err)
+	emitEvent("tunnel-down", map[string]any{"reason": err.Error(), "code": code})
+	os.Exit(code)
+}
+
+// fatalf is like fatal but formats the message, so the error should be wrapped with %w.
+func fatalf(format string, args ...any) {
+	fatal(fmt.Errorf(format, args...))
+}
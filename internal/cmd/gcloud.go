@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"sync"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/charmbracelet/log"
+)
+
+var (
+	gcloudOnce   sync.Once
+	gcloudConfig iap.GcloudConfig
+)
+
+// applyGcloudDefaults fills in --project from the active gcloud configuration if it wasn't given, and loads the zone
+// and region for commands to fall back to.
+func applyGcloudDefaults() {
+	gcloudOnce.Do(func() {
+		config, err := iap.LoadGcloudConfig()
+		if err != nil {
+			log.Debug("Error reading gcloud configuration", "err", err)
+			return
+		}
+
+		gcloudConfig = config
+		if project == "" {
+			project = config.Project
+		}
+	})
+}
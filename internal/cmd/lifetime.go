@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/cedws/iapc/internal/proxy"
+	"github.com/charmbracelet/log"
+)
+
+var (
+	errDurationElapsed = errors.New("--duration elapsed")
+	errWatchedExited   = errors.New("--watch-pid process exited")
+	errIdle            = errors.New("no traffic for --exit-on-idle")
+)
+
+// runContext returns the context a tunnel runs in, which is cancelled by SIGINT or SIGTERM, or once --duration passes
+// or the --watch-pid process exits.
+func runContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	if duration > 0 {
+		timer := time.AfterFunc(duration, func() { cancel(errDurationElapsed) })
+		context.AfterFunc(ctx, func() { timer.Stop() })
+	}
+
+	if watchPID > 0 {
+		exited, err := watchProcess(watchPID)
+		if err != nil {
+			log.Fatalf("Can't watch --watch-pid %v: %v", watchPID, err)
+		}
+		go func() {
+			select {
+			case <-exited:
+				cancel(errWatchedExited)
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	return ctx, func() {
+		cancel(nil)
+		stop()
+	}
+}
+
+// exitWhenIdle returns a context cancelled once the clients of listener have exchanged no data for --exit-on-idle, and
+// the listener tracking them. It returns ctx and listener as they are without --exit-on-idle.
+func exitWhenIdle(ctx context.Context, listener net.Listener) (context.Context, net.Listener) {
+	if exitOnIdle <= 0 {
+		return ctx, listener
+	}
+
+	tracked := proxy.TrackActivity(listener)
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	go func() {
+		for {
+			idle := time.Since(tracked.LastActive())
+			if idle >= exitOnIdle {
+				cancel(errIdle)
+				return
+			}
+
+			select {
+			case <-time.After(exitOnIdle - idle):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ctx, tracked
+}
+
+// exitStopped exits once a tunnel's context is done, successfully if --duration, --watch-pid or --exit-on-idle stopped
+// it, or with ExitInterrupted for a signal.
+func exitStopped(ctx context.Context, what string) {
+	cause := context.Cause(ctx)
+	if errors.Is(cause, errDurationElapsed) || errors.Is(cause, errWatchedExited) || errors.Is(cause, errIdle) {
+		log.Info("Closing "+what, "reason", cause)
+		emitEvent("tunnel-down", map[string]any{"reason": cause.Error()})
+		removePidfile()
+		os.Exit(0)
+	}
+
+	log.Info("Interrupted, closing " + what)
+	emitEvent("tunnel-down", map[string]any{"reason": "interrupted"})
+	removePidfile()
+	os.Exit(ExitInterrupted)
+}
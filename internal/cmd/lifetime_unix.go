@@ -0,0 +1,31 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// watchProcess returns a channel closed when the process pid exits. The process isn't a child, so it's polled for.
+func watchProcess(pid int) (<-chan struct{}, error) {
+	if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+		return nil, err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+
+		for {
+			time.Sleep(time.Second)
+			// EPERM means the process exists but belongs to someone else
+			if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+				return
+			}
+		}
+	}()
+
+	return exited, nil
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package cmd
+
+import "os"
+
+// watchProcess returns a channel closed when the process pid exits.
+func watchProcess(pid int) (<-chan struct{}, error) {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		process.Wait()
+	}()
+
+	return exited, nil
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/charmbracelet/log"
+)
+
+// servePprof serves net/http/pprof's profiles on addr, which has to be a loopback address since profiles give away the
+// process's memory, credentials included.
+func servePprof(addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Fatalf("Invalid --pprof-addr: %v", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		log.Fatalf("--pprof-addr must be a loopback address like 127.0.0.1:6060, not %v", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		log.Info("Serving pprof", "addr", addr)
+
+		if err := http.ListenAndServe(addr, mux); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Error serving pprof: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"syscall"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/internal/proxy"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+const rdpPort = 3389
+
+var rdpCmd = &cobra.Command{
+	Use:               "rdp [instance]",
+	Long:              "Create a tunnel to a remote Compute Engine instance and launch the platform RDP client",
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: completeInstances,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if !flagGiven(cmd, "port") {
+			port = rdpPort
+		}
+		instance = resolveInstance(cmd, args)
+
+		log.Info("Starting proxy", "dest", fmt.Sprintf("%v:%v", instance, port), "port", port, "project", project)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := []iap.DialOption{
+			iap.WithProject(project),
+			iap.WithInstance(instance, zone, ninterface),
+			iap.WithPort(fmt.Sprint(port)),
+			iap.WithTokenSource(tokenSource()),
+		}
+		if compress {
+			opts = append(opts, iap.WithCompression())
+		}
+		opts = append(opts, relayOptions()...)
+
+		listener, err := proxy.Listen(listen, opts)
+		if err != nil {
+			fatal(err)
+		}
+		announce(listener.Addr())
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		go func() {
+			if err := proxy.Serve(ctx, listener, fmt.Sprintf("%v:%v", instance, port), opts); err != nil {
+				fatal(err)
+			}
+		}()
+
+		client := rdpClient(listener.Addr())
+		client.Stdout = os.Stdout
+		client.Stderr = os.Stderr
+
+		log.Info("Launching RDP client", "cmd", client.String())
+
+		err = client.Run()
+		if ctx.Err() != nil {
+			log.Info("Interrupted, closing tunnel")
+			os.Exit(ExitInterrupted)
+		}
+		if err != nil {
+			log.Fatalf("Error running RDP client: %v", err)
+		}
+
+		log.Info("RDP client exited, closing tunnel")
+	},
+}
+
+// rdpClient returns a command that launches the platform RDP client and blocks until it exits.
+func rdpClient(addr net.Addr) *exec.Cmd {
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("mstsc", fmt.Sprintf("/v:%v", addr))
+	case "darwin":
+		return exec.Command("open", "-W", fmt.Sprintf("rdp://full%%20address=s:%v", addr))
+	default:
+		return exec.Command("xfreerdp", fmt.Sprintf("/v:%v", addr))
+	}
+}
+
+func init() {
+	rdpCmd.Flags().StringVarP(&zone, "zone", "z", "", "Target zone name (defaults to gcloud's compute/zone)")
+	rdpCmd.Flags().StringVarP(&ninterface, "interface", "i", "nic0", "Target network interface")
+	rdpCmd.RegisterFlagCompletionFunc("zone", completeZones)
+	// the tunnel only serves the RDP client launched here and closes when it exits, so there are no other clients to
+	// restrict or wait on going idle, and RDP clients can't connect over a Unix socket or TLS. Nor do RDP servers
+	// understand PROXY protocol headers, so only auditing applies.
+	addAuditLogFlag(rdpCmd)
+
+	rootCmd.AddCommand(rdpCmd)
+}
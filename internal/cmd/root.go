@@ -2,47 +2,223 @@ package cmd
 
 import (
 	"context"
+	"crypto/x509"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/internal/audit"
+	"github.com/cedws/iapc/internal/metrics"
 	"github.com/charmbracelet/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 )
 
 var (
 	debug       bool
+	verbose     int
 	compress    bool
 	listen      string
 	project     string
 	port        uint
 	tokenScopes []string
+
+	announceFormat     string
+	portFile           string
+	metricsAddr        string
+	pprofAddr          string
+	maxSessions        int
+	maxProjectSessions int
+	uploadLimit        string
+	downloadLimit      string
+	connUploadLimit    string
+	connDownloadLimit  string
+	sameUser           bool
+	allowFrom          []string
+	auditLog           string
+	tlsEnabled         bool
+	tlsCert            string
+	tlsKey             string
+	proxyProtocol      bool
+	breakerFailures    int
+	breakerCooldown    time.Duration
+	relayEndpoints     []string
+	compressThreshold  int
+	relayCA            string
+	relayPins          []string
+	duration           time.Duration
+	watchPID           int
+	exitOnIdle         time.Duration
+	daemonMode         bool
+	pidfile            string
+	logFile            string
+	eventsInterval     time.Duration
 )
 
 var rootCmd = &cobra.Command{
 	Use:  "iapc",
 	Long: "Utility for Google Cloud's Identity-Aware Proxy",
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
-		if debug {
+		applyEnvironment(cmd)
+		if debug || verbose > 0 {
 			log.SetLevel(log.DebugLevel)
 		}
+		if daemonMode {
+			daemonize()
+		} else if logFile != "" {
+			log.SetOutput(openLogFile())
+		}
+		if pidfile != "" {
+			writePidfile()
+		}
+		applyGcloudDefaults()
+		if auditLog != "" {
+			if err := audit.Open(auditLog); err != nil {
+				log.Fatalf("Error opening audit log: %v", err)
+			}
+		}
+		if metricsAddr != "" {
+			metrics.Serve(metricsAddr)
+		}
+		if pprofAddr != "" {
+			servePprof(pprofAddr)
+		}
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		removePidfile()
 	},
 }
 
+// defaultTokenSource returns the credentials in the environment, like the library's WithEnvironment, or failing that
+// the credentials found by FindCredentials.
+func defaultTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	source, err := iap.EnvironmentTokenSource(tokenScopes...)
+	if source != nil || err != nil {
+		return source, err
+	}
+	return iap.FindCredentials(ctx, tokenScopes...)
+}
+
+// applyEnvironment makes IAPC_ environment variables, named after flags like IAPC_PROJECT or IAPC_DEST_GROUP, the
+// defaults of the flags that weren't given on the command line. The flags aren't marked as changed, so they don't
+// conflict with mutually exclusive flags given on the command line, but they do satisfy required flags.
+func applyEnvironment(cmd *cobra.Command) {
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if flag.Changed {
+			return
+		}
+
+		value, ok := os.LookupEnv(envName(flag.Name))
+		if !ok {
+			return
+		}
+		if err := flag.Value.Set(value); err != nil {
+			log.Fatalf("Invalid value for %v in environment: %v", flag.Name, err)
+		}
+		flag.DefValue = value
+		delete(flag.Annotations, cobra.BashCompOneRequiredFlag)
+	})
+}
+
+// envName returns the name of the environment variable for a flag.
+func envName(flag string) string {
+	return "IAPC_" + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// flagGiven reports whether a flag was given on the command line or in the environment.
+func flagGiven(cmd *cobra.Command, name string) bool {
+	if cmd.Flags().Changed(name) {
+		return true
+	}
+	_, ok := os.LookupEnv(envName(name))
+	return ok
+}
+
+// relayOptions returns options for the --relay-endpoint list, --relay-ca and --relay-pin, --compress-threshold and
+// reconnecting events, and tracing relay handshakes to stderr with -vv, and every frame too with -vvv.
+func relayOptions() []iap.DialOption {
+	logger := slog.New(log.Default())
+
+	var opts []iap.DialOption
+	if len(relayEndpoints) > 0 {
+		opts = append(opts, iap.WithEndpoints(relayEndpoints...))
+	}
+	if relayCA != "" {
+		opts = append(opts, iap.WithRelayCAs(loadCertPool(relayCA)))
+	}
+	if len(relayPins) > 0 {
+		opts = append(opts, iap.WithRelayPins(relayPins...))
+	}
+	if compress && compressThreshold > 0 {
+		opts = append(opts, iap.WithCompressionOptions(iap.CompressionOptions{Threshold: compressThreshold}))
+	}
+	if eventsEnabled() {
+		opts = append(opts, reconnectEvents())
+	}
+	if verbose >= 2 {
+		opts = append(opts, iap.WithTrace(logger))
+	}
+	if verbose >= 3 {
+		opts = append(opts, iap.WithFrameTrace(logger))
+	}
+	return opts
+}
+
+// loadCertPool reads the PEM certificates in path into a pool.
+func loadCertPool(path string) *x509.CertPool {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Error reading --relay-ca: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		log.Fatalf("No PEM certificates found in %v", path)
+	}
+	return pool
+}
+
 func tokenSource() *oauth2.TokenSource {
-	tokenSource, err := google.DefaultTokenSource(context.Background(), tokenScopes...)
+	tokenSource, err := defaultTokenSource(context.Background())
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	return &tokenSource
 }
 
 func init() {
 	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "Enable debug logging")
+	rootCmd.PersistentFlags().CountVarP(&verbose, "verbose", "v", "Enable debug logging with -v, also trace relay handshakes with -vv, and every frame with -vvv")
 	rootCmd.PersistentFlags().BoolVarP(&compress, "compress", "c", false, "Enable WebSocket compression")
-	rootCmd.PersistentFlags().StringVarP(&listen, "listen", "l", "127.0.0.1:0", "Listen address and port")
-	rootCmd.PersistentFlags().StringVar(&project, "project", "", "Project ID")
+	rootCmd.PersistentFlags().IntVar(&compressThreshold, "compress-threshold", 0, "Send frames smaller than this many bytes uncompressed with --compress (default 128)")
+	rootCmd.PersistentFlags().StringVarP(&listen, "listen", "l", "127.0.0.1:0", "Listen address and port, or unix:path for a Unix socket")
+	rootCmd.PersistentFlags().StringVar(&project, "project", "", "Project ID (defaults to gcloud's core/project)")
 	rootCmd.PersistentFlags().UintVarP(&port, "port", "p", 22, "Target port")
 	rootCmd.PersistentFlags().StringSliceVarP(&tokenScopes, "token-scopes", "s", []string{"https://www.googleapis.com/auth/cloud-platform"}, "Token scopes")
+	rootCmd.PersistentFlags().StringVar(&announceFormat, "announce", "", "Print the local listen port to stdout once listening (text or json), or report the tunnel's state as a JSON event per line (events)")
+	rootCmd.PersistentFlags().DurationVar(&eventsInterval, "events-interval", 10*time.Second, "How often to report bytes transferred with --announce events (0 to not report them)")
+	rootCmd.PersistentFlags().StringVar(&portFile, "port-file", "", "Write the local listen port to this file once listening")
+	rootCmd.PersistentFlags().StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics on this address")
+	rootCmd.PersistentFlags().StringVar(&pprofAddr, "pprof-addr", "", "Serve Go profiles under /debug/pprof/ on this loopback address, like 127.0.0.1:6060")
+	rootCmd.PersistentFlags().IntVar(&maxSessions, "max-sessions", 0, "Maximum number of simultaneous tunnels, further clients wait for one to close (0 for no limit)")
+	rootCmd.PersistentFlags().IntVar(&maxProjectSessions, "max-project-sessions", 0, "Maximum number of simultaneous tunnels in each project, further clients wait for one to close, to stay under IAP quotas (0 for no limit)")
+	rootCmd.PersistentFlags().StringVar(&uploadLimit, "upload-limit", "", "Cap the rate data is sent to the target at across all tunnels, in bytes per second like 512K or 10M")
+	rootCmd.PersistentFlags().StringVar(&downloadLimit, "download-limit", "", "Cap the rate data is received from the target at across all tunnels, in bytes per second like 512K or 10M")
+	rootCmd.PersistentFlags().StringVar(&connUploadLimit, "conn-upload-limit", "", "Cap the rate data is sent to the target at for each tunnel, in bytes per second")
+	rootCmd.PersistentFlags().StringVar(&connDownloadLimit, "conn-download-limit", "", "Cap the rate data is received from the target at for each tunnel, in bytes per second")
+	rootCmd.PersistentFlags().StringSliceVar(&relayEndpoints, "relay-endpoint", nil, "Relay endpoints to try in order, e.g. a regional endpoint before the global tunnel.cloudproxy.app")
+	rootCmd.PersistentFlags().DurationVar(&duration, "duration", 0, "Close tunnels and exit successfully after this long, e.g. in CI jobs")
+	rootCmd.PersistentFlags().IntVar(&watchPID, "watch-pid", 0, "Close tunnels and exit successfully when the process with this PID exits")
+	rootCmd.PersistentFlags().BoolVar(&daemonMode, "daemon", false, "Run in the background once listening, detached from the terminal (not on Windows)")
+	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "Append logs to this file instead of stderr, or with --daemon once running in the background, where they're otherwise discarded")
+	rootCmd.PersistentFlags().StringVar(&pidfile, "pidfile", "", "Write the process's PID to this file, and remove it on a clean exit")
+	rootCmd.PersistentFlags().StringVar(&relayCA, "relay-ca", "", "Only trust relay certificates issued by the CAs in this PEM file")
+	rootCmd.PersistentFlags().StringSliceVar(&relayPins, "relay-pin", nil, "Fail unless the relay's certificate chain has one of these public keys, written sha256/<base64 hash>")
+	rootCmd.PersistentFlags().IntVar(&breakerFailures, "breaker-failures", 0, "Stop dialing a target for --breaker-cooldown once this many dials to it fail in a row (0 to keep dialing)")
+	rootCmd.PersistentFlags().DurationVar(&breakerCooldown, "breaker-cooldown", 30*time.Second, "How long to stop dialing a failing target for")
 	rootCmd.MarkFlagRequired("project")
 }
 
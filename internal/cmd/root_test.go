@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenerFlags(t *testing.T) {
+	listenerFlags := []string{"allow-from", "exit-on-idle"}
+	secureFlags := []string{"same-user", "tls", "tls-cert", "tls-key"}
+	proxyFlags := []string{"proxy-protocol"}
+
+	tests := []struct {
+		cmd      *cobra.Command
+		listener bool
+		secure   bool
+		proxy    bool
+		audit    bool
+	}{
+		{cmd: instanceCmd, listener: true, secure: true, proxy: true},
+		{cmd: hostCmd, listener: true, secure: true, proxy: true},
+		{cmd: startIAPTunnelCmd, listener: true, secure: true, proxy: true},
+		// redirected clients can't connect over a Unix socket or expect TLS
+		{cmd: transparentCmd, listener: true, proxy: true},
+		{cmd: winrmCmd, listener: true, secure: true, proxy: true},
+		{cmd: webCmd, listener: true, secure: true},
+		// the RDP client launched is the tunnel's only client
+		{cmd: rdpCmd, audit: true},
+		// commands without a listener of their own don't take flags they'd ignore
+		{cmd: sshCmd},
+		{cmd: rsyncCmd},
+		{cmd: cpCmd},
+		{cmd: doctorCmd},
+		{cmd: tunnelAddCmd},
+		// the daemon's tunnels are audited, but how they listen is up to each tunnel's spec
+		{cmd: daemonCmd, audit: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd.Name(), func(t *testing.T) {
+			for _, name := range listenerFlags {
+				assert.Equal(t, tt.listener, tt.cmd.Flag(name) != nil, name)
+			}
+			for _, name := range secureFlags {
+				assert.Equal(t, tt.secure, tt.cmd.Flag(name) != nil, name)
+			}
+			for _, name := range proxyFlags {
+				assert.Equal(t, tt.proxy, tt.cmd.Flag(name) != nil, name)
+			}
+			assert.Equal(t, tt.proxy || tt.audit, tt.cmd.Flag("audit-log") != nil, "audit-log")
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+var rsyncPath string
+
+var rsyncCmd = &cobra.Command{
+	Use:  "rsync [flags] -- [rsync options] [[user@]instance:]src... [[user@]instance:]dst",
+	Long: "Run the local rsync binary with ssh through a stdio tunnel as its remote shell, so [user@]instance:path arguments reach the instance through the IAP",
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		remote, err := rsyncRemote(args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if destGroup == "" {
+			instance = resolveInstance(cmd, []string{remote})
+		} else if network == "" {
+			log.Fatal("--network is required with --dest-group")
+		}
+
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatalf("Error finding the iapc binary: %v", err)
+		}
+
+		rsync := exec.Command(rsyncPath, append([]string{"-e", rsyncShell(exe)}, args...)...)
+		rsync.Stdin, rsync.Stdout, rsync.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+		log.Debug("Running rsync", "cmd", rsync.String())
+
+		if err := rsync.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.ExitCode())
+			}
+			log.Fatalf("Error running rsync: %v", err)
+		}
+	},
+}
+
+// rsyncValueOptions are rsync's long options which take a value, which may be given as the next argument.
+var rsyncValueOptions = map[string]bool{
+	"address": true, "backup-dir": true, "block-size": true, "bwlimit": true, "cc": true, "checksum-choice": true,
+	"checksum-seed": true, "chmod": true, "chown": true, "compare-dest": true, "compress-choice": true,
+	"compress-level": true, "contimeout": true, "copy-as": true, "copy-dest": true, "debug": true, "early-input": true,
+	"exclude": true, "exclude-from": true, "files-from": true, "filter": true, "groupmap": true, "iconv": true,
+	"include": true, "include-from": true, "info": true, "link-dest": true, "log-file": true, "log-file-format": true,
+	"max-alloc": true, "max-delete": true, "max-size": true, "min-size": true, "modify-window": true,
+	"only-write-batch": true, "out-format": true, "outbuf": true, "partial-dir": true, "password-file": true,
+	"port": true, "protocol": true, "read-batch": true, "remote-option": true, "rsh": true, "rsync-path": true,
+	"skip-compress": true, "sockopts": true, "stderr": true, "stop-after": true, "stop-at": true, "suffix": true,
+	"temp-dir": true, "time-limit": true, "timeout": true, "usermap": true, "write-batch": true, "zc": true, "zl": true,
+}
+
+// rsyncValueShorts are rsync's short options which take a value, either the rest of their argument or the next one.
+const rsyncValueShorts = "eBfMT@"
+
+// rsyncPaths returns the paths among rsync's args, skipping its options and their values. It fails if the args set
+// the remote shell, which iapc sets itself.
+func rsyncPaths(args []string) ([]string, error) {
+	errShell := errors.New("iapc sets rsync's remote shell itself, don't pass -e or --rsh")
+
+	var paths []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		switch {
+		case arg == "--":
+			return append(paths, args[i+1:]...), nil
+		case strings.HasPrefix(arg, "--"):
+			name, _, hasValue := strings.Cut(arg[2:], "=")
+			if name == "rsh" {
+				return nil, errShell
+			}
+			if rsyncValueOptions[name] && !hasValue {
+				i++
+			}
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			// short options can be bundled like -avz, and the first taking a value takes the rest of the argument
+			for j, opt := range arg[1:] {
+				if !strings.ContainsRune(rsyncValueShorts, opt) {
+					continue
+				}
+				if opt == 'e' {
+					return nil, errShell
+				}
+				if j+2 == len(arg) {
+					i++
+				}
+				break
+			}
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	return paths, nil
+}
+
+// rsyncRemote returns the instance named by the remote paths among args, which must all be on the same one.
+func rsyncRemote(args []string) (string, error) {
+	paths, err := rsyncPaths(args)
+	if err != nil {
+		return "", err
+	}
+
+	var remote string
+	for _, path := range paths {
+		_, host, _, ok := parseRemotePath(path)
+		if !ok {
+			continue
+		}
+		if remote != "" && host != remote {
+			return "", errors.New("remote paths must all be on the same instance")
+		}
+		remote = host
+	}
+
+	if remote == "" {
+		return "", errors.New("one of the paths must be remote, like instance:path")
+	}
+	return remote, nil
+}
+
+// rsyncShell returns rsync's remote shell command: ssh with a ProxyCommand running a stdio tunnel with exe. ssh fills
+// in the instance, or the host behind the destination group, and port for %h and %p. Credentials are found by the
+// tunnel the same way, and IAPC_TOKEN reaches it through ssh's environment.
+func rsyncShell(exe string) string {
+	tunnel := []string{exe, "compute", "start-iap-tunnel", "%h", "%p", "--listen-on-stdin"}
+	if destGroup == "" {
+		tunnel = append(tunnel, "--zone", zone, "--network-interface", ninterface)
+	} else {
+		tunnel = append(tunnel, "--dest-group", destGroup, "--network", network)
+		if region != "" {
+			tunnel = append(tunnel, "--region", region)
+		}
+	}
+	if project != "" {
+		tunnel = append(tunnel, "--project", project)
+	}
+	if len(tokenScopes) > 0 {
+		tunnel = append(tunnel, "--token-scopes", strings.Join(tokenScopes, ","))
+	}
+	if compress {
+		tunnel = append(tunnel, "--compress")
+	}
+	if compressThreshold > 0 {
+		tunnel = append(tunnel, "--compress-threshold", fmt.Sprint(compressThreshold))
+	}
+	for _, endpoint := range relayEndpoints {
+		tunnel = append(tunnel, "--relay-endpoint", endpoint)
+	}
+	if relayCA != "" {
+		tunnel = append(tunnel, "--relay-ca", relayCA)
+	}
+	for _, pin := range relayPins {
+		tunnel = append(tunnel, "--relay-pin", pin)
+	}
+
+	quoted := make([]string, len(tunnel))
+	for i, arg := range tunnel {
+		quoted[i] = shellQuote(arg)
+	}
+
+	// rsync splits the command itself, keeping what's in double quotes together
+	return fmt.Sprintf(`ssh -p %v -o "ProxyCommand=%v"`, port, strings.Join(quoted, " "))
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes s for the shell ssh runs the ProxyCommand with, if it needs quoting.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func init() {
+	rsyncCmd.Flags().StringVarP(&zone, "zone", "z", "", "Target zone name (defaults to gcloud's compute/zone)")
+	rsyncCmd.Flags().StringVarP(&ninterface, "interface", "i", "nic0", "Target network interface")
+	rsyncCmd.Flags().StringVar(&destGroup, "dest-group", "", "Destination group to reach the remote host as a private IP or FQDN through, instead of an instance")
+	rsyncCmd.Flags().StringVar(&region, "region", "", "Target region name for --dest-group (defaults to gcloud's compute/region)")
+	rsyncCmd.Flags().StringVar(&network, "network", "", "Target network name for --dest-group")
+	rsyncCmd.Flags().StringVar(&rsyncPath, "rsync", "rsync", "rsync binary to run")
+	rsyncCmd.MarkFlagsMutuallyExclusive("zone", "dest-group")
+	rsyncCmd.RegisterFlagCompletionFunc("zone", completeZones)
+	// stop parsing flags after the first path so rsync's options are passed through
+	rsyncCmd.Flags().SetInterspersed(false)
+
+	rootCmd.AddCommand(rsyncCmd)
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRsyncPaths(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		paths []string
+		err   bool
+	}{
+		{"plain", []string{"-avz", "src/", "prod-1:/dst"}, []string{"src/", "prod-1:/dst"}, false},
+		{"long value", []string{"--exclude", "a:b", "src/", "prod-1:/dst"}, []string{"src/", "prod-1:/dst"}, false},
+		{"long value inline", []string{"--exclude=a:b", "src/", "prod-1:/dst"}, []string{"src/", "prod-1:/dst"}, false},
+		{"short value", []string{"-f", "- a:b", "src/", "prod-1:/dst"}, []string{"src/", "prod-1:/dst"}, false},
+		{"bundled short value", []string{"-avf", "- a:b", "src/", "prod-1:/dst"}, []string{"src/", "prod-1:/dst"}, false},
+		{"attached short value", []string{"-B1024", "src/", "prod-1:/dst"}, []string{"src/", "prod-1:/dst"}, false},
+		{"end of options", []string{"-a", "--", "-src", "prod-1:/dst"}, []string{"-src", "prod-1:/dst"}, false},
+		{"stdin", []string{"-", "prod-1:/dst"}, []string{"-", "prod-1:/dst"}, false},
+		{"shell", []string{"-e", "ssh", "src/", "prod-1:/dst"}, nil, true},
+		{"bundled shell", []string{"-ae", "ssh", "src/", "prod-1:/dst"}, nil, true},
+		{"attached shell", []string{"-essh", "src/", "prod-1:/dst"}, nil, true},
+		{"long shell", []string{"--rsh", "ssh", "src/", "prod-1:/dst"}, nil, true},
+		{"long shell inline", []string{"--rsh=ssh", "src/", "prod-1:/dst"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths, err := rsyncPaths(tt.args)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.paths, paths)
+		})
+	}
+}
+
+func TestRsyncRemote(t *testing.T) {
+	remote, err := rsyncRemote([]string{"--exclude", "other:x", "src/", "admin@prod-1:/dst"})
+	require.NoError(t, err)
+	assert.Equal(t, "prod-1", remote)
+
+	_, err = rsyncRemote([]string{"prod-1:/a", "prod-2:/b"})
+	assert.Error(t, err)
+
+	_, err = rsyncRemote([]string{"src/", "dst/"})
+	assert.Error(t, err)
+}
+
+func TestRsyncShell(t *testing.T) {
+	t.Cleanup(func() {
+		zone, ninterface, project, destGroup, region, network = "", "", "", "", "", ""
+		tokenScopes, relayEndpoints, relayPins, port = nil, nil, nil, 22
+	})
+
+	zone, ninterface, project, port = "europe-west2-a", "nic0", "my project", 2222
+	tokenScopes = []string{"https://www.googleapis.com/auth/cloud-platform"}
+	relayPins = []string{"sha256/abc+/="}
+
+	assert.Equal(t,
+		`ssh -p 2222 -o "ProxyCommand='/opt/my iapc' compute start-iap-tunnel %h %p --listen-on-stdin --zone europe-west2-a --network-interface nic0 --project 'my project' --token-scopes https://www.googleapis.com/auth/cloud-platform --relay-pin sha256/abc+/="`,
+		rsyncShell("/opt/my iapc"))
+
+	destGroup, region, network = "group", "europe-west2", "default"
+
+	assert.Equal(t,
+		`ssh -p 2222 -o "ProxyCommand=/usr/bin/iapc compute start-iap-tunnel %h %p --listen-on-stdin --dest-group group --network default --region europe-west2 --project 'my project' --token-scopes https://www.googleapis.com/auth/cloud-platform --relay-pin sha256/abc+/="`,
+		rsyncShell("/usr/bin/iapc"))
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"plain", "plain"},
+		{"%h", "%h"},
+		{"with space", "'with space'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+		{"", "''"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.out, shellQuote(tt.in), tt.in)
+	}
+}
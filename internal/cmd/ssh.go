@@ -0,0 +1,350 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iapssh"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+)
+
+var (
+	identityFiles  []string
+	knownHostsFile string
+	remoteForwards []string
+	forwardAgent   bool
+)
+
+// sshAgent connects to the local SSH agent once, returning nil if there isn't one.
+var sshAgent = sync.OnceValue(func() agent.ExtendedAgent {
+	conn, err := dialAgent()
+	if err != nil {
+		log.Debug("Error connecting to SSH agent", "err", err)
+		return nil
+	}
+	if conn == nil {
+		return nil
+	}
+	return agent.NewClient(conn)
+})
+
+var sshCmd = &cobra.Command{
+	Use:               "ssh [[user@]instance] [command...]",
+	Long:              "Open an interactive SSH session to a remote Compute Engine instance",
+	Args:              cobra.ArbitraryArgs,
+	ValidArgsFunction: completeInstances,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			username string
+			command  string
+		)
+		if len(args) > 0 {
+			username, instance = splitUserHost(args[0])
+			instance = resolveInstance(cmd, []string{instance})
+			command = strings.Join(args[1:], " ")
+		} else {
+			username, _ = splitUserHost("")
+			instance = resolveInstance(cmd, nil)
+		}
+
+		opts := []iap.DialOption{
+			iap.WithProject(project),
+			iap.WithInstance(instance, zone, ninterface),
+			iap.WithPort(fmt.Sprint(port)),
+			iap.WithTokenSource(tokenSource()),
+		}
+		if compress {
+			opts = append(opts, iap.WithCompression())
+		}
+		opts = append(opts, relayOptions()...)
+
+		os.Exit(runSSH(username, instance, command, opts))
+	},
+}
+
+func splitUserHost(target string) (string, string) {
+	if username, host, ok := strings.Cut(target, "@"); ok {
+		return username, host
+	}
+
+	username := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+
+	return username, target
+}
+
+// sshClientConfig returns the SSH client config for username, authenticating with the agent and identity files and
+// checking host keys against the known hosts file.
+func sshClientConfig(username string) *ssh.ClientConfig {
+	hostKeyCallback, err := knownHostsCallback(knownHostsFile)
+	if err != nil {
+		log.Fatalf("Error loading known hosts: %v", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            authMethods(identityFiles),
+		HostKeyCallback: hostKeyCallback,
+	}
+}
+
+func runSSH(username, instance, command string, opts []iap.DialOption) int {
+	config := sshClientConfig(username)
+
+	tun, err := iap.Dial(context.Background(), opts...)
+	if err != nil {
+		fatalf("Error dialing IAP: %w", err)
+	}
+	defer tun.Close()
+
+	log.Debug("Dialed IAP", "instance", instance)
+
+	addr := net.JoinHostPort(instance, fmt.Sprint(port))
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(tun, addr, config)
+	if err != nil {
+		log.Fatalf("Error establishing SSH connection: %v", err)
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	if forwardAgent {
+		keyring := sshAgent()
+		if keyring == nil {
+			log.Fatal("Agent forwarding requested but no SSH agent is available")
+		}
+		if err := agent.ForwardToAgent(client, keyring); err != nil {
+			log.Fatalf("Error forwarding SSH agent: %v", err)
+		}
+	}
+
+	for _, spec := range remoteForwards {
+		remoteAddr, localAddr, err := parseRemoteForward(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		forward, err := iapssh.ForwardRemote(client, remoteAddr, localAddr)
+		if err != nil {
+			log.Fatalf("Error requesting remote forward %v: %v", spec, err)
+		}
+		defer forward.Close()
+
+		log.Info("Forwarding remote port", "remote", forward.Addr(), "local", localAddr)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		log.Fatalf("Error opening SSH session: %v", err)
+	}
+	defer session.Close()
+
+	if forwardAgent {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			log.Fatalf("Error requesting agent forwarding: %v", err)
+		}
+	}
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		restore, err := requestPty(session, fd)
+		if err != nil {
+			log.Fatalf("Error requesting pty: %v", err)
+		}
+		defer restore()
+	}
+
+	if command == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(command)
+	}
+	if err != nil {
+		log.Fatalf("Error starting SSH session: %v", err)
+	}
+
+	if err := session.Wait(); err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitStatus()
+		}
+
+		var exitMissingErr *ssh.ExitMissingError
+		if !errors.As(err, &exitMissingErr) {
+			log.Error(err)
+		}
+		return 255
+	}
+
+	return 0
+}
+
+// parseRemoteForward parses a remote forward in the form of OpenSSH's -R, [bind_address:]port:host:hostport, into the
+// address to listen on remotely and the local address to forward to.
+func parseRemoteForward(spec string) (string, string, error) {
+	parts := strings.Split(spec, ":")
+
+	switch len(parts) {
+	case 3:
+		return net.JoinHostPort("localhost", parts[0]), net.JoinHostPort(parts[1], parts[2]), nil
+	case 4:
+		return net.JoinHostPort(parts[0], parts[1]), net.JoinHostPort(parts[2], parts[3]), nil
+	}
+
+	return "", "", fmt.Errorf("remote forward %q should be [bind_address:]port:host:hostport", spec)
+}
+
+// requestPty puts the local terminal into raw mode and requests a matching pty on the remote end.
+// The returned function restores the local terminal.
+func requestPty(session *ssh.Session, fd int) (func(), error) {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+
+	termType := os.Getenv("TERM")
+	if termType == "" {
+		termType = "xterm-256color"
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty(termType, height, width, modes); err != nil {
+		return nil, err
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	stopResize := watchWindowSize(session)
+
+	return func() {
+		stopResize()
+		term.Restore(fd, state)
+	}, nil
+}
+
+func authMethods(identityFiles []string) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+
+	if keyring := sshAgent(); keyring != nil {
+		methods = append(methods, ssh.PublicKeysCallback(keyring.Signers))
+	}
+
+	var signers []ssh.Signer
+	for _, path := range identityFiles {
+		key, err := os.ReadFile(expandHome(path))
+		if err != nil {
+			continue
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			log.Debug("Skipping identity file", "path", path, "err", err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	return methods
+}
+
+// knownHostsCallback verifies host keys against the known hosts file, recording keys for hosts that
+// haven't been seen before (like OpenSSH's StrictHostKeyChecking=accept-new).
+func knownHostsCallback(path string) (ssh.HostKeyCallback, error) {
+	path = expandHome(path)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+		// the remote address of the tunnel isn't meaningful, the hostname is checked instead
+		err := callback(hostname, &net.TCPAddr{}, key)
+
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return err
+		}
+
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+		if _, err := fmt.Fprintln(f, line); err != nil {
+			return err
+		}
+
+		log.Warn("Permanently added host key to known hosts", "host", hostname, "type", key.Type())
+		return nil
+	}, nil
+}
+
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
+
+var defaultIdentityFiles = []string{
+	"~/.ssh/google_compute_engine",
+	"~/.ssh/id_ed25519",
+	"~/.ssh/id_ecdsa",
+	"~/.ssh/id_rsa",
+}
+
+func init() {
+	sshCmd.Flags().StringVarP(&zone, "zone", "z", "", "Target zone name (defaults to gcloud's compute/zone)")
+	sshCmd.Flags().StringVarP(&ninterface, "interface", "i", "nic0", "Target network interface")
+	sshCmd.Flags().StringSliceVar(&identityFiles, "identity", defaultIdentityFiles, "Private key files to authenticate with")
+	sshCmd.Flags().StringVar(&knownHostsFile, "known-hosts", "~/.ssh/known_hosts", "Known hosts file")
+	sshCmd.Flags().BoolVarP(&forwardAgent, "forward-agent", "A", false, "Forward the local SSH agent to the instance")
+	sshCmd.Flags().StringArrayVarP(&remoteForwards, "remote-forward", "R", nil, "Forward a port on the instance back to a local address ([bind_address:]port:host:hostport)")
+	sshCmd.RegisterFlagCompletionFunc("zone", completeZones)
+	// stop parsing flags after the target so remote command flags are passed through
+	sshCmd.Flags().SetInterspersed(false)
+
+	rootCmd.AddCommand(sshCmd)
+}
@@ -0,0 +1,49 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// watchWindowSize forwards local terminal size changes to the remote pty until the returned function is called.
+func watchWindowSize(session *ssh.Session) func() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGWINCH)
+
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-sigCh:
+				if width, height, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+					session.WindowChange(height, width)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigCh)
+		close(done)
+	}
+}
+
+// dialAgent connects to the SSH agent at SSH_AUTH_SOCK, returning nil if it isn't set.
+func dialAgent() (io.ReadWriter, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, nil
+	}
+	return net.Dial("unix", sock)
+}
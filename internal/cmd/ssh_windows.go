@@ -0,0 +1,71 @@
+//go:build windows
+
+package cmd
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// watchWindowSize forwards local terminal size changes to the remote pty until the returned function is called.
+// Windows has no SIGWINCH so the console size is polled instead.
+func watchWindowSize(session *ssh.Session) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+
+		lastWidth, lastHeight, _ := term.GetSize(int(os.Stdout.Fd()))
+
+		for {
+			select {
+			case <-ticker.C:
+				width, height, err := term.GetSize(int(os.Stdout.Fd()))
+				if err != nil || (width == lastWidth && height == lastHeight) {
+					continue
+				}
+				lastWidth, lastHeight = width, height
+				session.WindowChange(height, width)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// windowsAgentPipe is the named pipe of the Windows OpenSSH agent service.
+const windowsAgentPipe = `\\.\pipe\openssh-ssh-agent`
+
+// dialAgent connects to the SSH agent at SSH_AUTH_SOCK, which may be a named pipe or a Unix socket, or to the Windows
+// OpenSSH agent if it isn't set. It returns nil if the Windows agent isn't running.
+func dialAgent() (io.ReadWriter, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	switch {
+	case sock == "":
+		sock = windowsAgentPipe
+	case !strings.HasPrefix(sock, `\\.\pipe\`):
+		return net.Dial("unix", sock)
+	}
+
+	pipe, err := os.OpenFile(sock, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) && sock == windowsAgentPipe {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pipe, nil
+}
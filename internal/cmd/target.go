@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/cedws/iapc/internal/compute"
+	"github.com/cedws/iapc/internal/picker"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// resolveInstance returns the target instance name. A missing --zone defaults to the gcloud configuration's zone, and
+// otherwise the instance and zone are filled in from an interactive picker over the project's instances when a
+// terminal is attached.
+func resolveInstance(cmd *cobra.Command, args []string) string {
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+	if name == "" {
+		name = os.Getenv("IAPC_INSTANCE")
+	}
+
+	if name != "" && zone == "" {
+		zone = gcloudConfig.Zone
+	}
+
+	if name != "" && zone != "" {
+		return name
+	}
+
+	if !picker.Available() {
+		if name == "" {
+			log.Fatal("An instance name is required")
+		}
+		log.Fatal(`Required flag "zone" not set`)
+	}
+
+	instances, err := discoverInstances(context.Background())
+	if err != nil {
+		fatalf("Error discovering instances: %w", err)
+	}
+
+	var candidates []compute.Instance
+	for _, instance := range instances {
+		if name != "" && instance.Name != name {
+			continue
+		}
+		if zone != "" && instance.Zone != zone {
+			continue
+		}
+		candidates = append(candidates, instance)
+	}
+
+	switch len(candidates) {
+	case 0:
+		log.Log(log.FatalLevel, "No matching instances found", "project", project)
+		os.Exit(ExitNotFound)
+	case 1:
+		// no need to ask if there's only one choice, e.g. the instance name is unique across zones
+		if name != "" {
+			zone = candidates[0].Zone
+			return name
+		}
+	}
+
+	items := make([]string, len(candidates))
+	for i, instance := range candidates {
+		items[i] = fmt.Sprintf("%v (%v, %v)", instance.Name, instance.Zone, instance.Status)
+	}
+
+	i, err := picker.Pick("Instance:", items)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	zone = candidates[i].Zone
+	return candidates[i].Name
+}
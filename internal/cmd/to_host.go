@@ -4,7 +4,6 @@ import (
 	"fmt"
 
 	"github.com/cedws/iapc/iap"
-	"github.com/cedws/iapc/internal/proxy"
 	"github.com/charmbracelet/log"
 	"github.com/spf13/cobra"
 )
@@ -13,37 +12,65 @@ var (
 	destGroup string
 	network   string
 	region    string
+	host      string
 )
 
 var hostCmd = &cobra.Command{
-	Use:  "to-host",
+	Use:  "to-host [host]",
 	Long: "Create a tunnel to a remote private IP or FQDN (requires BeyondCorp Enterprise)",
-	Args: cobra.ExactArgs(1),
+	Args: cobra.MaximumNArgs(1),
 	PreRun: func(cmd *cobra.Command, args []string) {
-		log.Info("Starting proxy", "dest", fmt.Sprintf("%v:%v", args[0], port), "port", port, "project", project)
+		if len(args) > 0 {
+			host = args[0]
+		}
+		if host == "" {
+			log.Fatal("A host is required")
+		}
+
+		if region == "" {
+			region = gcloudConfig.Region
+		}
+		if region == "" {
+			log.Fatal(`Required flag "region" not set`)
+		}
+
+		if targetPorts != "" {
+			log.Info("Starting proxy", "dest", host, "ports", targetPorts, "project", project)
+			return
+		}
+		log.Info("Starting proxy", "dest", fmt.Sprintf("%v:%v", host, port), "port", port, "project", project)
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		opts := []iap.DialOption{
 			iap.WithProject(project),
-			iap.WithHost(args[0], region, network, destGroup),
+			iap.WithHost(host, region, network, destGroup),
 			iap.WithPort(fmt.Sprint(port)),
 			iap.WithTokenSource(tokenSource()),
 		}
 		if compress {
 			opts = append(opts, iap.WithCompression())
 		}
+		opts = append(opts, relayOptions()...)
 
-		proxy.Start(listen, opts)
+		if targetPorts != "" {
+			servePorts(host, opts)
+			return
+		}
+		serve(fmt.Sprintf("%v:%v", host, port), opts)
 	},
 }
 
 func init() {
 	hostCmd.Flags().StringVarP(&destGroup, "dest-group", "d", "", "Destination group name")
-	hostCmd.Flags().StringVarP(&region, "region", "r", "", "Target region name")
+	hostCmd.Flags().StringVarP(&region, "region", "r", "", "Target region name (defaults to gcloud's compute/region)")
 	hostCmd.Flags().StringVarP(&network, "network", "n", "", "Target network name")
+	hostCmd.Flags().StringVar(&host, "host", "", "Target private IP or FQDN, in place of the argument")
+	hostCmd.Flags().StringVar(&targetPorts, "ports", "", portsUsage)
 	hostCmd.MarkFlagRequired("dest-group")
-	hostCmd.MarkFlagRequired("region")
 	hostCmd.MarkFlagRequired("network")
+	addListenerFlags(hostCmd)
+	addSecureListenerFlags(hostCmd)
+	addProxyFlags(hostCmd)
 
 	rootCmd.AddCommand(hostCmd)
 }
@@ -4,42 +4,62 @@ import (
 	"fmt"
 
 	"github.com/cedws/iapc/iap"
-	"github.com/cedws/iapc/internal/proxy"
 	"github.com/charmbracelet/log"
 	"github.com/spf13/cobra"
 )
 
 var (
+	instance   string
 	zone       string
 	ninterface string
+	// targetPorts is a list of ports and ranges to forward at once, in place of --port
+	targetPorts string
 )
 
+const portsUsage = "Forward several target ports at once, like 8080-8090,9000, each from the same local port on --listen's host"
+
 var instanceCmd = &cobra.Command{
-	Use:  "to-instance",
-	Long: "Create a tunnel to a remote Compute Engine instance",
-	Args: cobra.ExactArgs(1),
+	Use:               "to-instance [instance]",
+	Long:              "Create a tunnel to a remote Compute Engine instance",
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: completeInstances,
 	PreRun: func(cmd *cobra.Command, args []string) {
-		log.Info("Starting proxy", "dest", fmt.Sprintf("%v:%v", args[0], port), "port", port, "project", project)
+		instance = resolveInstance(cmd, args)
+
+		if targetPorts != "" {
+			log.Info("Starting proxy", "dest", instance, "ports", targetPorts, "project", project)
+			return
+		}
+		log.Info("Starting proxy", "dest", fmt.Sprintf("%v:%v", instance, port), "port", port, "project", project)
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		opts := []iap.DialOption{
 			iap.WithProject(project),
-			iap.WithInstance(args[0], zone, ninterface),
+			iap.WithInstance(instance, zone, ninterface),
 			iap.WithPort(fmt.Sprint(port)),
 			iap.WithTokenSource(tokenSource()),
 		}
 		if compress {
 			opts = append(opts, iap.WithCompression())
 		}
+		opts = append(opts, relayOptions()...)
 
-		proxy.Start(listen, opts)
+		if targetPorts != "" {
+			servePorts(instance, opts)
+			return
+		}
+		serve(fmt.Sprintf("%v:%v", instance, port), opts)
 	},
 }
 
 func init() {
-	instanceCmd.Flags().StringVarP(&zone, "zone", "z", "", "Target zone name")
+	instanceCmd.Flags().StringVarP(&zone, "zone", "z", "", "Target zone name (defaults to gcloud's compute/zone)")
 	instanceCmd.Flags().StringVarP(&ninterface, "interface", "i", "nic0", "Target network interface")
-	instanceCmd.MarkFlagRequired("zone")
+	instanceCmd.Flags().StringVar(&targetPorts, "ports", "", portsUsage)
+	instanceCmd.RegisterFlagCompletionFunc("zone", completeZones)
+	addListenerFlags(instanceCmd)
+	addSecureListenerFlags(instanceCmd)
+	addProxyFlags(instanceCmd)
 
 	rootCmd.AddCommand(instanceCmd)
 }
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"runtime"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/internal/proxy"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+var transparentRoutes []string
+
+var transparentCmd = &cobra.Command{
+	Use:  "transparent",
+	Long: "Proxy connections redirected by iptables through the IAP, choosing the target by the address they were made to, for access to whole subnets (Linux only)",
+	Args: cobra.NoArgs,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if runtime.GOOS != "linux" {
+			log.Fatal("Transparent proxying is only supported on Linux")
+		}
+		if len(transparentRoutes) == 0 {
+			log.Fatal("At least one --route is required")
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		var routes []proxy.TransparentRoute
+		for _, arg := range transparentRoutes {
+			route, err := proxy.ParseTransparentRoute(arg)
+			if err != nil {
+				log.Fatalf("Invalid route: %v", err)
+			}
+
+			routes = append(routes, route)
+			log.Info("Routing", "prefix", route.Prefix, "target", route.Target)
+		}
+
+		opts := []iap.DialOption{
+			iap.WithTokenSource(tokenSource()),
+		}
+		if compress {
+			opts = append(opts, iap.WithCompression())
+		}
+		opts = append(opts, relayOptions()...)
+		opts = applyLimits(opts)
+
+		// there's no single target to test the connection to up front
+		listener := proxy.RecoverDestinations(listenClients(nil))
+
+		runProxy(listener, opts, func(ctx context.Context, listener net.Listener, opts []iap.DialOption) error {
+			return proxy.ServeTransparent(ctx, listener, routes, opts, newBreakers())
+		})
+	},
+}
+
+func init() {
+	transparentCmd.Flags().StringArrayVar(&transparentRoutes, "route", nil, "Route a CIDR to a destination group like 10.0.0.0/24=iap://project/region/network/group, or an address to an instance like 10.0.1.5=iap://project/zone/instance")
+	addListenerFlags(transparentCmd)
+	addProxyFlags(transparentCmd)
+
+	rootCmd.AddCommand(transparentCmd)
+}
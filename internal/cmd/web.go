@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/internal/proxy"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	webRoutes        []string
+	webHTTPSUpstream []string
+)
+
+var webCmd = &cobra.Command{
+	Use:  "web",
+	Long: "Serve a local reverse proxy to web servers through the IAP, choosing the server by the host name requested",
+	Args: cobra.NoArgs,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if len(webRoutes) == 0 {
+			log.Fatal("At least one --route is required")
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		var routes []proxy.Route
+		for _, arg := range webRoutes {
+			route, err := proxy.ParseRoute(arg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			route.HTTPS = slices.ContainsFunc(webHTTPSUpstream, func(host string) bool {
+				return strings.EqualFold(host, route.Host)
+			})
+
+			routes = append(routes, route)
+			log.Info("Routing", "host", route.Host, "target", route.Target, "https", route.HTTPS)
+		}
+
+		opts := []iap.DialOption{
+			iap.WithTokenSource(tokenSource()),
+		}
+		if compress {
+			opts = append(opts, iap.WithCompression())
+		}
+		opts = append(opts, relayOptions()...)
+		opts = applyLimits(opts)
+
+		handler, err := proxy.NewWebProxy(routes, opts)
+		if err != nil {
+			log.Fatalf("Invalid route: %v", err)
+		}
+
+		// there's no single target to test the connection to up front
+		listener := listenClients(nil)
+
+		ctx, stop := runContext()
+		defer stop()
+		ctx, listener = exitWhenIdle(ctx, listener)
+		listener = byteEvents(ctx, listener)
+
+		server := &http.Server{Handler: handler}
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal(err)
+		}
+
+		exitStopped(ctx, "proxy")
+	},
+}
+
+func init() {
+	webCmd.Flags().StringArrayVar(&webRoutes, "route", nil, "Route a host name to a target URI, like grafana.localhost=iap://project/zone/grafana-1:3000")
+	webCmd.Flags().StringSliceVar(&webHTTPSUpstream, "https-upstream", nil, "Host names whose servers serve HTTPS rather than plain HTTP")
+	addListenerFlags(webCmd)
+	addSecureListenerFlags(webCmd)
+
+	rootCmd.AddCommand(webCmd)
+}
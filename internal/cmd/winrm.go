@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iapwinrm"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+var winrmHTTPS bool
+
+var winrmCmd = &cobra.Command{
+	Use:               "winrm [instance]",
+	Long:              "Create a tunnel to WinRM on a Windows instance for PowerShell remoting",
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: completeInstances,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if !flagGiven(cmd, "port") {
+			port = iapwinrm.HTTPPort
+			if winrmHTTPS {
+				port = iapwinrm.HTTPSPort
+			}
+		}
+		instance = resolveInstance(cmd, args)
+
+		log.Info("Starting proxy", "dest", fmt.Sprintf("%v:%v", instance, port), "port", port, "project", project)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := []iap.DialOption{
+			iap.WithProject(project),
+			iap.WithInstance(instance, zone, ninterface),
+			iap.WithPort(fmt.Sprint(port)),
+			iap.WithTokenSource(tokenSource()),
+		}
+		if compress {
+			opts = append(opts, iap.WithCompression())
+		}
+		opts = append(opts, relayOptions()...)
+
+		opts = applyLimits(opts)
+		listener := listenClients(opts)
+
+		log.Info("Connect with PowerShell", "cmd", psSessionCommand(listener.Addr()))
+
+		serveListener(listener, fmt.Sprintf("%v:%v", instance, port), opts)
+	},
+}
+
+// psSessionCommand returns a PowerShell command that opens a remoting session through the tunnel listening on addr.
+// The instance's certificate can't match the local address, so the name check is skipped over HTTPS.
+func psSessionCommand(addr net.Addr) string {
+	scheme := "http"
+	options := ""
+	if winrmHTTPS {
+		scheme = "https"
+		options = " -SessionOption (New-PSSessionOption -SkipCNCheck)"
+	}
+
+	return fmt.Sprintf("Enter-PSSession -ConnectionUri %v://%v/wsman -Credential (Get-Credential)%v", scheme, addr, options)
+}
+
+func init() {
+	winrmCmd.Flags().StringVarP(&zone, "zone", "z", "", "Target zone name (defaults to gcloud's compute/zone)")
+	winrmCmd.Flags().StringVarP(&ninterface, "interface", "i", "nic0", "Target network interface")
+	winrmCmd.Flags().BoolVar(&winrmHTTPS, "https", false, "Tunnel to WinRM over HTTPS on port 5986 instead of HTTP on 5985")
+	winrmCmd.RegisterFlagCompletionFunc("zone", completeZones)
+	addListenerFlags(winrmCmd)
+	addSecureListenerFlags(winrmCmd)
+	addProxyFlags(winrmCmd)
+
+	rootCmd.AddCommand(winrmCmd)
+}
@@ -0,0 +1,138 @@
+// Package compute discovers Compute Engine resources for CLI completion and prompts.
+package compute
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	computeEndpoint = "https://compute.googleapis.com/compute/v1"
+	cacheTTL        = 5 * time.Minute
+)
+
+// Instance is a Compute Engine instance.
+type Instance struct {
+	Name   string `json:"name"`
+	Zone   string `json:"zone"`
+	Status string `json:"status"`
+}
+
+type aggregatedList struct {
+	Items map[string]struct {
+		Instances []Instance `json:"instances"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+type cacheEntry struct {
+	Fetched   time.Time  `json:"fetched"`
+	Instances []Instance `json:"instances"`
+}
+
+// ListInstances lists all instances in the project across every zone.
+func ListInstances(ctx context.Context, tokenSource oauth2.TokenSource, project string) ([]Instance, error) {
+	client := oauth2.NewClient(ctx, tokenSource)
+
+	var instances []Instance
+	pageToken := ""
+
+	for {
+		query := url.Values{}
+		query.Set("fields", "items/*/instances(name,zone,status),nextPageToken")
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		reqURL := fmt.Sprintf("%v/projects/%v/aggregated/instances?%v", computeEndpoint, url.PathEscape(project), query.Encode())
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var list aggregatedList
+		err = func() error {
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("listing instances: %v", resp.Status)
+			}
+			return json.NewDecoder(resp.Body).Decode(&list)
+		}()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range list.Items {
+			for _, instance := range item.Instances {
+				// zone is returned as a full resource URL
+				instance.Zone = path.Base(instance.Zone)
+				instances = append(instances, instance)
+			}
+		}
+
+		if list.NextPageToken == "" {
+			break
+		}
+		pageToken = list.NextPageToken
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Name < instances[j].Name
+	})
+
+	return instances, nil
+}
+
+// CachedInstances is like ListInstances but serves results from an on-disk cache if they're recent enough.
+func CachedInstances(ctx context.Context, tokenSource oauth2.TokenSource, project string) ([]Instance, error) {
+	cachePath := cacheFile(project)
+
+	if cachePath != "" {
+		if data, err := os.ReadFile(cachePath); err == nil {
+			var entry cacheEntry
+			if err := json.Unmarshal(data, &entry); err == nil && time.Since(entry.Fetched) < cacheTTL {
+				return entry.Instances, nil
+			}
+		}
+	}
+
+	instances, err := ListInstances(ctx, tokenSource, project)
+	if err != nil {
+		return nil, err
+	}
+
+	if cachePath != "" {
+		if data, err := json.Marshal(cacheEntry{time.Now(), instances}); err == nil {
+			if err := os.MkdirAll(filepath.Dir(cachePath), 0o700); err == nil {
+				os.WriteFile(cachePath, data, 0o600)
+			}
+		}
+	}
+
+	return instances, nil
+}
+
+func cacheFile(project string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "iapc", fmt.Sprintf("instances-%v.json", url.PathEscape(project)))
+}
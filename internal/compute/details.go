@@ -0,0 +1,94 @@
+package compute
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+
+	"golang.org/x/oauth2"
+)
+
+var (
+	// ErrNotFound is returned when a resource doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrForbidden is returned when the caller isn't allowed to read a resource.
+	ErrForbidden = errors.New("permission denied")
+)
+
+// InstanceDetails is what decides whether an instance is reachable through the IAP.
+type InstanceDetails struct {
+	Name              string             `json:"name"`
+	Zone              string             `json:"zone"`
+	Status            string             `json:"status"`
+	NetworkInterfaces []NetworkInterface `json:"networkInterfaces"`
+	Tags              struct {
+		Items []string `json:"items"`
+	} `json:"tags"`
+	ServiceAccounts []ServiceAccount `json:"serviceAccounts"`
+}
+
+// ServiceAccount is a service account attached to an instance.
+type ServiceAccount struct {
+	Email string `json:"email"`
+}
+
+// NetworkInterface is a network interface of an instance. Network is the full URL of its VPC network.
+type NetworkInterface struct {
+	Name    string `json:"name"`
+	Network string `json:"network"`
+}
+
+// Interface returns the network interface with the given name, or nil if there isn't one.
+func (i *InstanceDetails) Interface(name string) *NetworkInterface {
+	for _, nic := range i.NetworkInterfaces {
+		if nic.Name == name {
+			return &nic
+		}
+	}
+	return nil
+}
+
+// GetInstance returns the details of an instance, or ErrNotFound if it doesn't exist in the zone.
+func GetInstance(ctx context.Context, tokenSource oauth2.TokenSource, project, zone, name string) (*InstanceDetails, error) {
+	query := url.Values{}
+	query.Set("fields", "name,zone,status,networkInterfaces(name,network),tags(items),serviceAccounts(email)")
+
+	reqURL := fmt.Sprintf("%v/projects/%v/zones/%v/instances/%v?%v", computeEndpoint, url.PathEscape(project), url.PathEscape(zone), url.PathEscape(name), query.Encode())
+
+	var instance InstanceDetails
+	if err := getJSON(ctx, tokenSource, reqURL, &instance); err != nil {
+		return nil, fmt.Errorf("getting instance: %w", err)
+	}
+	instance.Zone = path.Base(instance.Zone)
+
+	return &instance, nil
+}
+
+// getJSON decodes the response to a GET request for reqURL into v.
+func getJSON(ctx context.Context, tokenSource oauth2.TokenSource, reqURL string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := oauth2.NewClient(ctx, tokenSource).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(v)
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusForbidden:
+		return ErrForbidden
+	default:
+		return fmt.Errorf("%v", resp.Status)
+	}
+}
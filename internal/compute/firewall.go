@@ -0,0 +1,176 @@
+package compute
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// IAPRange is the range IAP connects to instances from, which firewall rules must allow.
+var IAPRange = netip.MustParsePrefix("35.235.240.0/20")
+
+// Firewall is a VPC firewall rule.
+type Firewall struct {
+	Name                  string   `json:"name"`
+	Network               string   `json:"network"`
+	Direction             string   `json:"direction"`
+	Priority              int      `json:"priority"`
+	Disabled              bool     `json:"disabled"`
+	SourceRanges          []string `json:"sourceRanges"`
+	TargetTags            []string `json:"targetTags"`
+	TargetServiceAccounts []string `json:"targetServiceAccounts"`
+	Allowed               []Ports  `json:"allowed"`
+	Denied                []Ports  `json:"denied"`
+}
+
+// Ports are the ports of a protocol allowed or denied by a firewall rule. No ports means every port.
+type Ports struct {
+	Protocol string   `json:"IPProtocol"`
+	Ports    []string `json:"ports"`
+}
+
+type firewallList struct {
+	Items         []Firewall `json:"items"`
+	NextPageToken string     `json:"nextPageToken"`
+}
+
+// ListFirewalls lists the firewall rules of the VPC network, given as the URL of the network like the Network of a
+// NetworkInterface. The rules are listed from the network's own project, which is the host project for a shared VPC.
+func ListFirewalls(ctx context.Context, tokenSource oauth2.TokenSource, network string) ([]Firewall, error) {
+	project, ok := networkProject(network)
+	if !ok {
+		return nil, fmt.Errorf("unexpected network URL %v", network)
+	}
+
+	var firewalls []Firewall
+	pageToken := ""
+
+	for {
+		query := url.Values{}
+		query.Set("fields", "items(name,network,direction,priority,disabled,sourceRanges,targetTags,targetServiceAccounts,allowed,denied),nextPageToken")
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		reqURL := fmt.Sprintf("%v/projects/%v/global/firewalls?%v", computeEndpoint, url.PathEscape(project), query.Encode())
+
+		var list firewallList
+		if err := getJSON(ctx, tokenSource, reqURL, &list); err != nil {
+			return nil, fmt.Errorf("listing firewall rules: %w", err)
+		}
+
+		for _, firewall := range list.Items {
+			if sameNetwork(firewall.Network, network) {
+				firewalls = append(firewalls, firewall)
+			}
+		}
+
+		if list.NextPageToken == "" {
+			break
+		}
+		pageToken = list.NextPageToken
+	}
+
+	return firewalls, nil
+}
+
+// IAPFirewall returns the firewall rule deciding whether IAP can connect to the TCP port of the instance, and whether
+// it allows it. The rule is nil if there isn't one, in which case the implied rule denies the connection.
+func IAPFirewall(firewalls []Firewall, instance *InstanceDetails, port int) (rule *Firewall, allowed bool) {
+	for i := range firewalls {
+		firewall := &firewalls[i]
+		if !firewall.applies(instance) {
+			continue
+		}
+
+		allows, denies := portsMatch(firewall.Allowed, port), portsMatch(firewall.Denied, port)
+		if !allows && !denies {
+			continue
+		}
+
+		// the lowest priority number wins, with deny rules winning ties
+		if rule == nil || firewall.Priority < rule.Priority || firewall.Priority == rule.Priority && denies {
+			rule, allowed = firewall, allows
+		}
+	}
+
+	return rule, allowed
+}
+
+// applies returns whether the rule is an enabled ingress rule from the IAP range which targets the instance.
+func (f *Firewall) applies(instance *InstanceDetails) bool {
+	if f.Disabled || f.Direction != "INGRESS" {
+		return false
+	}
+
+	fromIAP := slices.ContainsFunc(f.SourceRanges, func(source string) bool {
+		prefix, err := netip.ParsePrefix(source)
+		return err == nil && prefix.Bits() <= IAPRange.Bits() && prefix.Contains(IAPRange.Addr())
+	})
+	if !fromIAP {
+		return false
+	}
+
+	switch {
+	case len(f.TargetTags) > 0:
+		return slices.ContainsFunc(f.TargetTags, func(tag string) bool {
+			return slices.Contains(instance.Tags.Items, tag)
+		})
+	case len(f.TargetServiceAccounts) > 0:
+		return slices.ContainsFunc(instance.ServiceAccounts, func(account ServiceAccount) bool {
+			return slices.Contains(f.TargetServiceAccounts, account.Email)
+		})
+	}
+	return true
+}
+
+// portsMatch returns whether any of the ports cover the TCP port.
+func portsMatch(ports []Ports, port int) bool {
+	for _, p := range ports {
+		if p.Protocol != "tcp" && p.Protocol != "all" {
+			continue
+		}
+		if len(p.Ports) == 0 {
+			return true
+		}
+
+		for _, r := range p.Ports {
+			low, high, _ := strings.Cut(r, "-")
+			if high == "" {
+				high = low
+			}
+
+			lowPort, err1 := strconv.Atoi(low)
+			highPort, err2 := strconv.Atoi(high)
+			if err1 == nil && err2 == nil && lowPort <= port && port <= highPort {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// networkProject returns the project of a network URL like
+// https://www.googleapis.com/compute/v1/projects/PROJECT/global/networks/NETWORK.
+func networkProject(network string) (string, bool) {
+	_, rest, ok := strings.Cut(network, "/projects/")
+	if !ok {
+		return "", false
+	}
+	project, _, ok := strings.Cut(rest, "/")
+	return project, ok
+}
+
+// sameNetwork compares network URLs by their project and name, as they're given with different hosts and API
+// versions.
+func sameNetwork(a, b string) bool {
+	_, a, _ = strings.Cut(a, "/projects/")
+	_, b, _ = strings.Cut(b, "/projects/")
+	return a != "" && a == b
+}
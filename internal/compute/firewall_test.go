@@ -0,0 +1,150 @@
+package compute
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortsMatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports []Ports
+		port  int
+		want  bool
+	}{
+		{"single port", []Ports{{Protocol: "tcp", Ports: []string{"22"}}}, 22, true},
+		{"other port", []Ports{{Protocol: "tcp", Ports: []string{"22"}}}, 23, false},
+		{"range start", []Ports{{Protocol: "tcp", Ports: []string{"8000-8080"}}}, 8000, true},
+		{"range end", []Ports{{Protocol: "tcp", Ports: []string{"8000-8080"}}}, 8080, true},
+		{"past range", []Ports{{Protocol: "tcp", Ports: []string{"8000-8080"}}}, 8081, false},
+		{"one of several", []Ports{{Protocol: "tcp", Ports: []string{"22", "3389", "5985-5986"}}}, 5986, true},
+		{"all tcp ports", []Ports{{Protocol: "tcp"}}, 443, true},
+		{"all protocols", []Ports{{Protocol: "all"}}, 443, true},
+		{"udp only", []Ports{{Protocol: "udp", Ports: []string{"22"}}}, 22, false},
+		{"all udp ports", []Ports{{Protocol: "udp"}}, 22, false},
+		{"tcp after udp", []Ports{{Protocol: "udp"}, {Protocol: "tcp", Ports: []string{"22"}}}, 22, true},
+		{"invalid range", []Ports{{Protocol: "tcp", Ports: []string{"a-b"}}}, 22, false},
+		{"none", nil, 22, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, portsMatch(tt.ports, tt.port))
+		})
+	}
+}
+
+func TestIAPFirewall(t *testing.T) {
+	instance := &InstanceDetails{Name: "prod-1"}
+	instance.Tags.Items = []string{"ssh"}
+	instance.ServiceAccounts = []ServiceAccount{{Email: "app@project.iam.gserviceaccount.com"}}
+
+	rule := func(name string, priority int, allowed, denied []Ports) Firewall {
+		return Firewall{
+			Name:         name,
+			Direction:    "INGRESS",
+			Priority:     priority,
+			SourceRanges: []string{"35.235.240.0/20"},
+			Allowed:      allowed,
+			Denied:       denied,
+		}
+	}
+	allowSSH := []Ports{{Protocol: "tcp", Ports: []string{"22"}}}
+
+	tests := []struct {
+		name      string
+		firewalls []Firewall
+		wantRule  string
+		allowed   bool
+	}{
+		{
+			name:      "allowed",
+			firewalls: []Firewall{rule("allow-iap", 1000, allowSSH, nil)},
+			wantRule:  "allow-iap",
+			allowed:   true,
+		},
+		{
+			name:      "no rule",
+			firewalls: []Firewall{rule("allow-rdp", 1000, []Ports{{Protocol: "tcp", Ports: []string{"3389"}}}, nil)},
+		},
+		{
+			name: "lower priority number wins",
+			firewalls: []Firewall{
+				rule("allow-iap", 1000, allowSSH, nil),
+				rule("deny-all", 900, nil, []Ports{{Protocol: "all"}}),
+			},
+			wantRule: "deny-all",
+		},
+		{
+			name: "deny wins ties",
+			firewalls: []Firewall{
+				rule("allow-iap", 1000, allowSSH, nil),
+				rule("deny-ssh", 1000, nil, allowSSH),
+			},
+			wantRule: "deny-ssh",
+		},
+		{
+			name: "disabled rules are ignored",
+			firewalls: []Firewall{func() Firewall {
+				f := rule("allow-iap", 1000, allowSSH, nil)
+				f.Disabled = true
+				return f
+			}()},
+		},
+		{
+			name: "wider source ranges apply",
+			firewalls: []Firewall{func() Firewall {
+				f := rule("allow-all", 1000, allowSSH, nil)
+				f.SourceRanges = []string{"0.0.0.0/0"}
+				return f
+			}()},
+			wantRule: "allow-all",
+			allowed:  true,
+		},
+		{
+			name: "narrower source ranges don't",
+			firewalls: []Firewall{func() Firewall {
+				f := rule("allow-part", 1000, allowSSH, nil)
+				f.SourceRanges = []string{"35.235.240.0/24"}
+				return f
+			}()},
+		},
+		{
+			name: "target tags",
+			firewalls: []Firewall{func() Firewall {
+				f := rule("allow-web", 1000, allowSSH, nil)
+				f.TargetTags = []string{"web"}
+				return f
+			}(), func() Firewall {
+				f := rule("allow-ssh", 1000, allowSSH, nil)
+				f.TargetTags = []string{"ssh"}
+				return f
+			}()},
+			wantRule: "allow-ssh",
+			allowed:  true,
+		},
+		{
+			name: "target service accounts",
+			firewalls: []Firewall{func() Firewall {
+				f := rule("allow-app", 1000, allowSSH, nil)
+				f.TargetServiceAccounts = []string{"app@project.iam.gserviceaccount.com"}
+				return f
+			}()},
+			wantRule: "allow-app",
+			allowed:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, allowed := IAPFirewall(tt.firewalls, instance, 22)
+			if tt.wantRule == "" {
+				assert.Nil(t, rule)
+			} else if assert.NotNil(t, rule) {
+				assert.Equal(t, tt.wantRule, rule.Name)
+			}
+			assert.Equal(t, tt.allowed, allowed)
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package daemon
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cedws/iapc/internal/daemon/brokerpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestListenAPIRequiresToken(t *testing.T) {
+	_, err := listenAPI("127.0.0.1:0", "")
+	assert.ErrorIs(t, err, ErrTokenRequired)
+
+	listener, err := listenAPI("127.0.0.1:0", "token")
+	require.NoError(t, err)
+	listener.Close()
+
+	listener, err = listenAPI("unix:"+filepath.Join(t.TempDir(), "api.sock"), "")
+	require.NoError(t, err)
+	listener.Close()
+}
+
+func TestLoadAPIToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+
+	token, err := LoadAPIToken(path)
+	require.NoError(t, err)
+	assert.Len(t, token, 64)
+
+	again, err := LoadAPIToken(path)
+	require.NoError(t, err)
+	assert.Equal(t, token, again)
+}
+
+func TestGRPCToken(t *testing.T) {
+	d := New()
+	t.Cleanup(d.Close)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := d.GRPCServer(tokenInterceptors("secret")...)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	client := brokerpb.NewBrokerClient(conn)
+
+	tests := []struct {
+		name          string
+		authorization string
+		code          codes.Code
+	}{
+		{"missing", "", codes.Unauthenticated},
+		{"wrong", "Bearer wrong", codes.Unauthenticated},
+		{"not bearer", "secret", codes.Unauthenticated},
+		{"valid", "Bearer secret", codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.authorization != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "authorization", tt.authorization)
+			}
+
+			_, err := client.ListTunnels(ctx, &brokerpb.ListTunnelsRequest{})
+			assert.Equal(t, tt.code, status.Code(err))
+		})
+	}
+}
+
+func TestHTTPToken(t *testing.T) {
+	d := New()
+	t.Cleanup(d.Close)
+
+	server := httptest.NewServer(requireToken("secret", d.Handler()))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong", "Bearer wrong", http.StatusUnauthorized},
+		{"valid", "Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/tunnels", nil)
+			require.NoError(t, err)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+		})
+	}
+}
+
+func TestListenUnixExisting(t *testing.T) {
+	dir := t.TempDir()
+
+	// a running daemon's socket is left alone
+	path := filepath.Join(dir, "api.sock")
+	listener, err := listenUnix(path)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	_, err = listenUnix(path)
+	assert.ErrorIs(t, err, ErrAlreadyRunning)
+
+	// a socket left behind is replaced
+	stale, err := net.Listen("unix", filepath.Join(dir, "stale.sock"))
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err = listenUnix(filepath.Join(dir, "stale.sock"))
+	require.NoError(t, err)
+	listener.Close()
+
+	// anything else is never removed
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, []byte("hello"), 0o600))
+
+	_, err = listenUnix(file)
+	assert.Error(t, err)
+	assert.FileExists(t, file)
+}
@@ -0,0 +1,170 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cedws/iapc/internal/daemon/brokerpb"
+	"github.com/charmbracelet/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const minStatsInterval = 100 * time.Millisecond
+
+// brokerServer implements the broker API, the gRPC counterpart to the control API.
+type brokerServer struct {
+	brokerpb.UnimplementedBrokerServer
+	d *Daemon
+}
+
+// GRPCServer returns a gRPC server with the broker API registered.
+func (d *Daemon) GRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(opts...)
+	brokerpb.RegisterBrokerServer(server, brokerServer{d: d})
+	return server
+}
+
+// ServeGRPC serves the broker API until the context is cancelled, on a unix socket if listen is written as unix:path
+// or else on a TCP address. Calls over TCP must carry APIToken as a bearer token in their authorization metadata.
+// Unlike Serve it leaves the tunnels running when it returns.
+func (d *Daemon) ServeGRPC(ctx context.Context, listen string) error {
+	listener, err := listenAPI(listen, d.APIToken)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Listening for broker requests", "addr", listener.Addr())
+
+	var opts []grpc.ServerOption
+	if listener.Addr().Network() == "tcp" {
+		opts = tokenInterceptors(d.APIToken)
+	}
+	server := d.GRPCServer(opts...)
+
+	go func() {
+		<-ctx.Done()
+		server.Stop()
+	}()
+
+	return server.Serve(listener)
+}
+
+func (s brokerServer) CreateTunnel(ctx context.Context, req *brokerpb.CreateTunnelRequest) (*brokerpb.Tunnel, error) {
+	spec := specFromProto(req.GetSpec())
+	if err := spec.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	t, err := s.d.Add(spec)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return tunnelToProto(t), nil
+}
+
+func (s brokerServer) ListTunnels(ctx context.Context, req *brokerpb.ListTunnelsRequest) (*brokerpb.ListTunnelsResponse, error) {
+	resp := &brokerpb.ListTunnelsResponse{}
+	for _, t := range s.d.List() {
+		resp.Tunnels = append(resp.Tunnels, tunnelToProto(t))
+	}
+	return resp, nil
+}
+
+func (s brokerServer) CloseTunnel(ctx context.Context, req *brokerpb.CloseTunnelRequest) (*brokerpb.CloseTunnelResponse, error) {
+	if err := s.d.Remove(req.GetId()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return &brokerpb.CloseTunnelResponse{}, nil
+}
+
+// StreamStats sends statistics every interval. A stream for one tunnel ends when the tunnel is closed.
+func (s brokerServer) StreamStats(req *brokerpb.StreamStatsRequest, stream grpc.ServerStreamingServer[brokerpb.TunnelStats]) error {
+	interval := time.Second
+	if req.Interval != nil {
+		if err := req.Interval.CheckValid(); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		interval = req.Interval.AsDuration()
+	}
+	if interval < minStatsInterval {
+		return status.Errorf(codes.InvalidArgument, "interval must be at least %v", minStatsInterval)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for first := true; ; first = false {
+		stats, err := s.d.Stats(req.GetId())
+		if errors.Is(err, ErrNotFound) {
+			if first {
+				return status.Error(codes.NotFound, err.Error())
+			}
+			return nil
+		}
+
+		now := timestamppb.Now()
+		for _, stat := range stats {
+			if err := stream.Send(statsToProto(stat, now)); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func specFromProto(spec *brokerpb.TunnelSpec) TunnelSpec {
+	return TunnelSpec{
+		Project:   spec.GetProject(),
+		Instance:  spec.GetInstance(),
+		Zone:      spec.GetZone(),
+		Interface: spec.GetInterface(),
+		Host:      spec.GetHost(),
+		Region:    spec.GetRegion(),
+		Network:   spec.GetNetwork(),
+		DestGroup: spec.GetDestGroup(),
+		Port:      uint(spec.GetPort()),
+		Listen:    spec.GetListen(),
+	}
+}
+
+func tunnelToProto(t Tunnel) *brokerpb.Tunnel {
+	return &brokerpb.Tunnel{
+		Id: t.ID,
+		Spec: &brokerpb.TunnelSpec{
+			Project:   t.Spec.Project,
+			Instance:  t.Spec.Instance,
+			Zone:      t.Spec.Zone,
+			Interface: t.Spec.Interface,
+			Host:      t.Spec.Host,
+			Region:    t.Spec.Region,
+			Network:   t.Spec.Network,
+			DestGroup: t.Spec.DestGroup,
+			Port:      uint32(t.Spec.Port),
+			Listen:    t.Spec.Listen,
+		},
+		Addr:    t.Addr,
+		Created: timestamppb.New(t.Created),
+	}
+}
+
+func statsToProto(stats TunnelStats, now *timestamppb.Timestamp) *brokerpb.TunnelStats {
+	return &brokerpb.TunnelStats{
+		Id:                stats.ID,
+		Time:              now,
+		ActiveConnections: stats.ActiveConnections,
+		Connections:       stats.Connections,
+		SentBytes:         stats.SentBytes,
+		ReceivedBytes:     stats.ReceivedBytes,
+		BreakerOpen:       stats.BreakerOpen,
+		DialFailures:      uint32(stats.DialFailures),
+	}
+}
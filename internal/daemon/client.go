@@ -0,0 +1,161 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultSocketPath returns the control socket path used when none is configured.
+func DefaultSocketPath() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, fmt.Sprintf("iapc-%v.sock", os.Getuid()))
+}
+
+// clientHost is the host a Client sends requests to. The requests always go over the socket whatever it is, but the
+// API checks it's local.
+const clientHost = "iapc"
+
+// Client talks to a daemon over its control socket.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a Client for the daemon listening on the given unix socket.
+func NewClient(socketPath string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}
+
+	return &Client{&http.Client{Transport: transport}}
+}
+
+// Add asks the daemon to create a tunnel.
+func (c *Client) Add(spec TunnelSpec) (Tunnel, error) {
+	body, err := json.Marshal(spec)
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	var t Tunnel
+	err = c.do(http.MethodPost, "/tunnels", bytes.NewReader(body), &t)
+	return t, err
+}
+
+// AddResult is the outcome of adding one of the tunnels passed to AddAll.
+type AddResult struct {
+	Spec   TunnelSpec
+	Tunnel Tunnel
+	Err    error
+}
+
+// AddAll asks the daemon to create tunnels, with at most parallel requests in flight since each one waits for the
+// daemon to test its connection. Specs with ports are expanded into a tunnel for each first. A result is returned for
+// every tunnel, in the order of the specs.
+func (c *Client) AddAll(specs []TunnelSpec, parallel int) []AddResult {
+	var results []AddResult
+	for _, spec := range specs {
+		expanded, err := spec.Expand()
+		if err != nil {
+			results = append(results, AddResult{Spec: spec, Err: err})
+			continue
+		}
+		for _, spec := range expanded {
+			results = append(results, AddResult{Spec: spec})
+		}
+	}
+
+	slots := make(chan struct{}, max(parallel, 1))
+
+	var wg sync.WaitGroup
+	for i, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			results[i].Tunnel, results[i].Err = c.Add(result.Spec)
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// Remove asks the daemon to stop a tunnel.
+func (c *Client) Remove(id string) error {
+	return c.do(http.MethodDelete, "/tunnels/"+id, nil, nil)
+}
+
+// List returns the tunnels managed by the daemon.
+func (c *Client) List() ([]Tunnel, error) {
+	var tunnels []Tunnel
+	err := c.do(http.MethodGet, "/tunnels", nil, &tunnels)
+	return tunnels, err
+}
+
+// Stats returns the statistics of every tunnel managed by the daemon.
+func (c *Client) Stats() ([]TunnelStats, error) {
+	var stats []TunnelStats
+	err := c.do(http.MethodGet, "/stats", nil, &stats)
+	return stats, err
+}
+
+// Reload asks the daemon to pick up rotated credentials.
+func (c *Client) Reload() error {
+	return c.do(http.MethodPost, "/reload", nil, nil)
+}
+
+func (c *Client) do(method, path string, body *bytes.Reader, v any) error {
+	url := "http://" + clientHost + path
+
+	var req *http.Request
+	var err error
+	if body != nil {
+		req, err = http.NewRequest(method, url, body)
+	} else {
+		req, err = http.NewRequest(method, url, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var errResp errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == "" {
+			return fmt.Errorf("daemon returned %v", resp.Status)
+		}
+		return errors.New(errResp.Error)
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
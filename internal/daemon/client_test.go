@@ -0,0 +1,86 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientAddAll(t *testing.T) {
+	dir, err := os.MkdirTemp("", "iapc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "daemon.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	var inFlight, maxInFlight atomic.Int32
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /tunnels", func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			peak := maxInFlight.Load()
+			if n <= peak || maxInFlight.CompareAndSwap(peak, n) {
+				break
+			}
+		}
+
+		var spec TunnelSpec
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&spec))
+
+		// later specs finish first, so results are only in order if AddAll puts them there
+		time.Sleep(time.Duration(8090-spec.Port) * 5 * time.Millisecond)
+
+		if spec.Port == 8081 {
+			writeError(w, http.StatusBadGateway, errors.New("connection refused"))
+			return
+		}
+		writeJSON(w, http.StatusCreated, Tunnel{ID: fmt.Sprint(spec.Port), Spec: spec, Addr: spec.Listen})
+	})
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+
+	specs := []TunnelSpec{
+		{Project: "project", Instance: "prod-1", Zone: "europe-west2-a", Ports: "8080-8083", Listen: "127.0.0.1:0"},
+		{Project: "project", Instance: "prod-2", Zone: "europe-west2-a", Ports: "nope"},
+		{Project: "project", Instance: "prod-3", Zone: "europe-west2-a", Port: 8084, Listen: "127.0.0.1:2222"},
+	}
+
+	results := NewClient(socketPath).AddAll(specs, 2)
+	require.Len(t, results, 6)
+
+	for i, port := range []uint{8080, 8081, 8082, 8083} {
+		assert.Equal(t, port, results[i].Spec.Port)
+		assert.Equal(t, "prod-1", results[i].Spec.Instance)
+	}
+	assert.Equal(t, "8080", results[0].Tunnel.ID)
+	assert.Equal(t, "127.0.0.1:8080", results[0].Tunnel.Addr)
+	assert.EqualError(t, results[1].Err, "connection refused")
+	assert.NoError(t, results[2].Err)
+	assert.NoError(t, results[3].Err)
+
+	// a spec which can't be expanded fails without being sent
+	assert.Equal(t, "prod-2", results[4].Spec.Instance)
+	assert.Error(t, results[4].Err)
+	assert.Empty(t, results[4].Tunnel.ID)
+
+	assert.Equal(t, "8084", results[5].Tunnel.ID)
+	assert.NoError(t, results[5].Err)
+
+	assert.Equal(t, int32(2), maxInFlight.Load())
+}
@@ -0,0 +1,542 @@
+// Package daemon implements a long-running process that manages tunnels on request from a local control socket.
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/internal/proxy"
+	"github.com/charmbracelet/log"
+)
+
+// ErrNotFound is returned when a tunnel ID doesn't exist.
+var ErrNotFound = errors.New("tunnel not found")
+
+// ErrAlreadyRunning is returned when asked to listen on a unix socket that another daemon is listening on.
+var ErrAlreadyRunning = errors.New("a daemon is already running")
+
+// TunnelSpec describes a tunnel to create. Either Instance and Zone, or Host, Region, Network and DestGroup must be set.
+type TunnelSpec struct {
+	Project   string `json:"project"`
+	Instance  string `json:"instance,omitempty"`
+	Zone      string `json:"zone,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Network   string `json:"network,omitempty"`
+	DestGroup string `json:"destGroup,omitempty"`
+	Port      uint   `json:"port"`
+	// Ports forwards several ports at once in place of Port, written as a list of ports and ranges like
+	// 8080-8090,9000. Expand turns the spec into one for each port, listening on the same port on the host of Listen.
+	Ports  string `json:"ports,omitempty"`
+	Listen string `json:"listen"`
+}
+
+// Validate returns an error if the spec doesn't describe exactly one kind of target.
+func (s TunnelSpec) Validate() error {
+	switch {
+	case s.Project == "":
+		return errors.New("project is required")
+	case s.Port == 0 && s.Ports == "":
+		return errors.New("port is required")
+	case s.Port != 0 && s.Ports != "":
+		return errors.New("only one of port or ports can be set")
+	case s.Instance != "" && s.Host != "":
+		return errors.New("only one of instance or host can be set")
+	case s.Instance != "":
+		if s.Zone == "" {
+			return errors.New("zone is required for instance targets")
+		}
+	case s.Host != "":
+		if s.Region == "" || s.Network == "" || s.DestGroup == "" {
+			return errors.New("region, network and destGroup are required for host targets")
+		}
+	default:
+		return errors.New("one of instance or host is required")
+	}
+
+	return nil
+}
+
+// Expand returns a spec for each of the ports in Ports, or just the spec if Ports isn't set.
+func (s TunnelSpec) Expand() ([]TunnelSpec, error) {
+	if s.Ports == "" {
+		return []TunnelSpec{s}, nil
+	}
+	if s.Port != 0 {
+		return nil, errors.New("only one of port or ports can be set")
+	}
+
+	ports, err := proxy.ParsePorts(s.Ports)
+	if err != nil {
+		return nil, err
+	}
+
+	host := "127.0.0.1"
+	if strings.HasPrefix(s.Listen, "unix:") {
+		return nil, errors.New("ports need a TCP listen address, each is listened on separately")
+	}
+	if s.Listen != "" {
+		if host, _, err = net.SplitHostPort(s.Listen); err != nil {
+			return nil, fmt.Errorf("listen address for ports: %w", err)
+		}
+	}
+
+	specs := make([]TunnelSpec, len(ports))
+	for i, port := range ports {
+		spec := s
+		spec.Ports = ""
+		spec.Port = port
+		spec.Listen = net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+		specs[i] = spec
+	}
+	return specs, nil
+}
+
+// Target returns a human readable description of the tunnel destination.
+func (s TunnelSpec) Target() string {
+	if s.Instance != "" {
+		return fmt.Sprintf("%v:%v", s.Instance, s.Port)
+	}
+	return fmt.Sprintf("%v:%v", s.Host, s.Port)
+}
+
+func (s TunnelSpec) dialOptions() []iap.DialOption {
+	if s.Instance != "" {
+		return []iap.DialOption{iap.WithTarget(iap.InstanceTarget{
+			Project:   s.Project,
+			Zone:      s.Zone,
+			Instance:  s.Instance,
+			Interface: s.Interface,
+			Port:      s.Port,
+		})}
+	}
+
+	return []iap.DialOption{iap.WithTarget(iap.HostTarget{
+		Project: s.Project,
+		Region:  s.Region,
+		Network: s.Network,
+		Host:    s.Host,
+		Group:   s.DestGroup,
+		Port:    s.Port,
+	})}
+}
+
+// Tunnel is a tunnel managed by the daemon.
+type Tunnel struct {
+	ID      string     `json:"id"`
+	Spec    TunnelSpec `json:"spec"`
+	Addr    string     `json:"addr"`
+	Created time.Time  `json:"created"`
+}
+
+type tunnel struct {
+	Tunnel
+	counters *counters
+	breaker  *iap.CircuitBreaker
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// Daemon manages a set of tunnels sharing the same credentials.
+type Daemon struct {
+	opts []iap.DialOption
+
+	// BreakerFailures gives each tunnel a circuit breaker which stops dialing its target for BreakerCooldown once this
+	// many dials fail in a row. Zero means no breaker. They must be set before tunnels are added.
+	BreakerFailures int
+	BreakerCooldown time.Duration
+
+	// ProjectLimiter is the limiter the tunnels' dial options queue for sessions in each project with, if any. Its
+	// stats for a tunnel's project are included in the tunnel's.
+	ProjectLimiter *iap.ProjectLimiter
+
+	// APIToken is the token clients of ServeGRPC and ServeHTTP must present on TCP addresses. They refuse to listen on
+	// TCP without one, since any local user could otherwise create tunnels with the daemon's credentials.
+	APIToken string
+
+	// Ready is called once Serve is listening on the control socket, if it's set.
+	Ready func()
+
+	mu      sync.Mutex
+	nextID  int
+	tunnels map[string]*tunnel
+}
+
+// New returns a Daemon which applies the given dial options (such as the token source) to every tunnel.
+func New(opts ...iap.DialOption) *Daemon {
+	return &Daemon{
+		opts:    opts,
+		tunnels: make(map[string]*tunnel),
+	}
+}
+
+// Add creates a tunnel and starts listening for clients.
+func (d *Daemon) Add(spec TunnelSpec) (Tunnel, error) {
+	if err := spec.Validate(); err != nil {
+		return Tunnel{}, err
+	}
+	if spec.Ports != "" {
+		return Tunnel{}, errors.New("a spec with ports must be expanded into a tunnel for each")
+	}
+	if spec.Listen == "" {
+		spec.Listen = "127.0.0.1:0"
+	}
+
+	opts := append(spec.dialOptions(), d.opts...)
+
+	var breaker *iap.CircuitBreaker
+	if d.BreakerFailures > 0 {
+		breaker = iap.NewCircuitBreaker(d.BreakerFailures, d.BreakerCooldown)
+		opts = append(opts, iap.WithCircuitBreaker(breaker))
+	}
+
+	listener, err := proxy.Listen(spec.Listen, opts)
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	counters := &counters{}
+	listener = countingListener{listener, counters}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d.mu.Lock()
+	d.nextID++
+	t := &tunnel{
+		Tunnel: Tunnel{
+			ID:      strconv.Itoa(d.nextID),
+			Spec:    spec,
+			Addr:    listener.Addr().String(),
+			Created: time.Now(),
+		},
+		counters: counters,
+		breaker:  breaker,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	d.tunnels[t.ID] = t
+	d.mu.Unlock()
+
+	log.Info("Added tunnel", "id", t.ID, "target", spec.Target(), "addr", t.Addr)
+
+	go func() {
+		defer close(t.done)
+		defer cancel()
+
+		if err := proxy.Serve(ctx, listener, spec.Target(), opts); err != nil {
+			log.Error("Tunnel stopped", "id", t.ID, "err", err)
+		}
+
+		d.mu.Lock()
+		delete(d.tunnels, t.ID)
+		d.mu.Unlock()
+	}()
+
+	return t.Tunnel, nil
+}
+
+// Remove stops a tunnel and closes its listener.
+func (d *Daemon) Remove(id string) error {
+	d.mu.Lock()
+	t, ok := d.tunnels[id]
+	delete(d.tunnels, id)
+	d.mu.Unlock()
+
+	if !ok {
+		return ErrNotFound
+	}
+
+	t.cancel()
+	<-t.done
+
+	log.Info("Removed tunnel", "id", id, "target", t.Spec.Target())
+	return nil
+}
+
+// List returns all tunnels ordered by creation.
+func (d *Daemon) List() []Tunnel {
+	tunnels := make([]Tunnel, 0)
+	for _, t := range d.sorted() {
+		tunnels = append(tunnels, t.Tunnel)
+	}
+	return tunnels
+}
+
+// Stats returns the statistics of the tunnel with the given ID, or of all tunnels ordered by creation if the ID is
+// empty.
+func (d *Daemon) Stats(id string) ([]TunnelStats, error) {
+	if id != "" {
+		d.mu.Lock()
+		t, ok := d.tunnels[id]
+		d.mu.Unlock()
+
+		if !ok {
+			return nil, ErrNotFound
+		}
+		return []TunnelStats{t.stats(d.ProjectLimiter)}, nil
+	}
+
+	stats := make([]TunnelStats, 0)
+	for _, t := range d.sorted() {
+		stats = append(stats, t.stats(d.ProjectLimiter))
+	}
+	return stats, nil
+}
+
+func (d *Daemon) sorted() []*tunnel {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tunnels := make([]*tunnel, 0, len(d.tunnels))
+	for _, t := range d.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].Created.Before(tunnels[j].Created)
+	})
+
+	return tunnels
+}
+
+// Reload makes tunnels pick up rotated credentials for the clients that connect from now on.
+func (d *Daemon) Reload() {
+	iap.ReloadCredentials()
+	log.Info("Reloaded credentials")
+}
+
+// Close removes all tunnels.
+func (d *Daemon) Close() {
+	for _, t := range d.List() {
+		d.Remove(t.ID)
+	}
+}
+
+// Handler returns the HTTP handler for the control API.
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /tunnels", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.List())
+	})
+
+	mux.HandleFunc("POST /tunnels", func(w http.ResponseWriter, r *http.Request) {
+		var spec TunnelSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		t, err := d.Add(spec)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, t)
+	})
+
+	mux.HandleFunc("GET /tunnels/{id}/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats, err := d.Stats(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, stats[0])
+	})
+
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		stats, _ := d.Stats("")
+		writeJSON(w, http.StatusOK, stats)
+	})
+
+	mux.HandleFunc("DELETE /tunnels/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := d.Remove(r.PathValue("id")); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		d.Reload()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
+
+// Serve serves the control API on a unix socket until the context is cancelled, then removes all tunnels.
+func (d *Daemon) Serve(ctx context.Context, socketPath string) error {
+	listener, err := listenUnix(socketPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socketPath)
+
+	log.Info("Listening for control requests", "socket", socketPath)
+	if d.Ready != nil {
+		d.Ready()
+	}
+
+	server := &http.Server{Handler: d.Handler()}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	err = server.Serve(listener)
+	d.Close()
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// ServeHTTP serves the control API until the context is cancelled, on a unix socket if listen is written as
+// unix:path or else on a TCP address, for tools that can't use the control socket. Requests over TCP must carry
+// APIToken as a bearer token in their Authorization header. Unlike Serve it leaves the tunnels running when it returns.
+func (d *Daemon) ServeHTTP(ctx context.Context, listen string) error {
+	listener, err := listenAPI(listen, d.APIToken)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Listening for control requests", "addr", listener.Addr())
+
+	handler := d.Handler()
+	if listener.Addr().Network() == "tcp" {
+		handler = requireToken(d.APIToken, handler)
+	}
+	server := &http.Server{Handler: localOnly(handler)}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// localOnly rejects requests made by web pages, which could otherwise reach an API listening on localhost from the
+// user's browser. Browsers send an Origin header with cross-origin requests, and a Host header naming the attacker's
+// domain if it's rebound to a local address.
+func localOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		ip, err := netip.ParseAddr(strings.Trim(host, "[]"))
+		// a Client's host is a single label, which an attacker can't register a domain as to rebind to a local address
+		local := host == "localhost" || host == clientHost || err == nil && ip.IsLoopback()
+
+		if !local || r.Header.Get("Origin") != "" {
+			writeError(w, http.StatusForbidden, errors.New("requests from browsers are not allowed"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// listenAPI listens for API requests on a unix socket only the current user can connect to if listen is written as
+// unix:path, or else on a TCP address, which needs a token since any local user can connect to it.
+func listenAPI(listen, token string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(listen, "unix:"); ok {
+		return listenUnix(path)
+	}
+	if token == "" {
+		return nil, ErrTokenRequired
+	}
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+		log.Warn("Listening for API requests on a non-loopback address, other hosts can create tunnels", "addr", addr)
+	}
+
+	return listener, nil
+}
+
+// listenUnix listens on a unix socket only the current user can connect to.
+func listenUnix(socketPath string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0o700); err != nil {
+		return nil, err
+	}
+	if err := removeStaleSocket(socketPath); err != nil {
+		return nil, err
+	}
+
+	// created without permissions for anyone else, since they could connect before it's chmodded
+	var listener net.Listener
+	var err error
+	withUmask(0o177, func() {
+		listener, err = net.Listen("unix", socketPath)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(socketPath, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// removeStaleSocket cleans up a socket left behind by a daemon that didn't exit cleanly. Anything else at the path is
+// left alone, whether it's a socket a daemon is still listening on or not a socket at all.
+func removeStaleSocket(socketPath string) error {
+	info, err := os.Lstat(socketPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("%v exists and isn't a socket", socketPath)
+	}
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return fmt.Errorf("%w, listening on %v", ErrAlreadyRunning, socketPath)
+	}
+
+	return os.Remove(socketPath)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{err.Error()})
+}
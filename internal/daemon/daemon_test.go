@@ -0,0 +1,48 @@
+package daemon
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelSpecExpand(t *testing.T) {
+	spec := TunnelSpec{Project: "project", Instance: "prod-1", Zone: "europe-west2-a", Port: 22, Listen: "127.0.0.1:2222"}
+
+	specs, err := spec.Expand()
+	require.NoError(t, err)
+	assert.Equal(t, []TunnelSpec{spec}, specs)
+
+	spec.Port, spec.Ports, spec.Listen = 0, "8081,8080", ""
+
+	specs, err = spec.Expand()
+	require.NoError(t, err)
+	require.Len(t, specs, 2)
+	for i, port := range []uint{8080, 8081} {
+		assert.Equal(t, port, specs[i].Port)
+		assert.Empty(t, specs[i].Ports)
+		assert.Equal(t, "prod-1", specs[i].Instance)
+		assert.NoError(t, specs[i].Validate())
+	}
+	assert.Equal(t, "127.0.0.1:8080", specs[0].Listen)
+	assert.Equal(t, "127.0.0.1:8081", specs[1].Listen)
+
+	// the host of Listen is kept and its port replaced
+	spec.Listen = "[::1]:0"
+	specs, err = spec.Expand()
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]:8080", specs[0].Listen)
+
+	spec.Listen = "unix:/tmp/socket"
+	_, err = spec.Expand()
+	assert.Error(t, err)
+
+	spec.Listen, spec.Port = "", 22
+	_, err = spec.Expand()
+	assert.Error(t, err)
+
+	spec.Port, spec.Ports = 0, "1-65535"
+	_, err = spec.Expand()
+	assert.Error(t, err)
+}
@@ -0,0 +1,100 @@
+package daemon
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cedws/iapc/iap"
+)
+
+// TunnelStats are the statistics of a tunnel's clients since it was created.
+type TunnelStats struct {
+	ID                string `json:"id"`
+	ActiveConnections uint64 `json:"activeConnections"`
+	Connections       uint64 `json:"connections"`
+	// SentBytes and ReceivedBytes count data sent to and received from the target.
+	SentBytes     uint64 `json:"sentBytes"`
+	ReceivedBytes uint64 `json:"receivedBytes"`
+	// BreakerOpen is true while the tunnel's circuit breaker refuses to dial, after DialFailures dials failed in a row.
+	BreakerOpen  bool `json:"breakerOpen"`
+	DialFailures int  `json:"dialFailures"`
+	// ProjectSessions is the number of sessions open in the tunnel's project under the daemon's per-project limit, and
+	// QueuedDials and QueueWaitSeconds how many dials in the project have had to wait for one and for how long in total.
+	ProjectSessions  int     `json:"projectSessions,omitempty"`
+	QueuedDials      uint64  `json:"queuedDials,omitempty"`
+	QueueWaitSeconds float64 `json:"queueWaitSeconds,omitempty"`
+}
+
+type counters struct {
+	active, connections, sent, received atomic.Uint64
+}
+
+func (t *tunnel) stats(projects *iap.ProjectLimiter) TunnelStats {
+	stats := TunnelStats{
+		ID:                t.ID,
+		ActiveConnections: t.counters.active.Load(),
+		Connections:       t.counters.connections.Load(),
+		SentBytes:         t.counters.sent.Load(),
+		ReceivedBytes:     t.counters.received.Load(),
+	}
+	if t.breaker != nil {
+		state := t.breaker.State()
+		stats.BreakerOpen, stats.DialFailures = state.Open, state.Failures
+	}
+	if projects == nil {
+		return stats
+	}
+	// looked up rather than created, so tunnels that haven't dialed yet don't add projects to the limiter's stats
+	if limiter, ok := projects.Lookup(t.Spec.Project); ok {
+		project := limiter.Stats()
+		stats.ProjectSessions, stats.QueuedDials = project.Active, project.Queued
+		stats.QueueWaitSeconds = project.WaitTime.Seconds()
+	}
+	return stats
+}
+
+// countingListener counts the clients it accepts and the bytes they exchange with the tunnel.
+type countingListener struct {
+	net.Listener
+	counters *counters
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.counters.connections.Add(1)
+	l.counters.active.Add(1)
+
+	return &countingConn{Conn: conn, counters: l.counters}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	counters  *counters
+	closeOnce sync.Once
+}
+
+// Read counts what the client sends, which is sent on to the target.
+func (c *countingConn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	c.counters.sent.Add(uint64(n))
+	return n, err
+}
+
+// Write counts what is received from the target and written back to the client.
+func (c *countingConn) Write(buf []byte) (int, error) {
+	n, err := c.Conn.Write(buf)
+	c.counters.received.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.counters.active.Add(^uint64(0))
+	})
+	return c.Conn.Close()
+}
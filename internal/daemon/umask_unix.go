@@ -0,0 +1,14 @@
+//go:build !windows
+
+package daemon
+
+import "syscall"
+
+// withUmask calls fn with the process umask set to mask, so files it creates never have more permissions than mask
+// allows, even for a moment.
+func withUmask(mask int, fn func()) {
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+
+	fn()
+}
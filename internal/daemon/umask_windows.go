@@ -0,0 +1,8 @@
+//go:build windows
+
+package daemon
+
+// withUmask calls fn. Windows has no umask, files get their permissions from the ACL of their directory.
+func withUmask(mask int, fn func()) {
+	fn()
+}
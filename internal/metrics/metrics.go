@@ -0,0 +1,80 @@
+// Package metrics exposes Prometheus metrics for the tunnels managed by the CLI.
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/charmbracelet/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "iapc"
+
+var (
+	ConnectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_total",
+		Help:      "Total number of client connections accepted.",
+	}, []string{"target"})
+
+	ConnectionsActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connections_active",
+		Help:      "Number of client connections currently being proxied.",
+	}, []string{"target"})
+
+	DialErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dial_errors_total",
+		Help:      "Total number of failed dials to the IAP.",
+	}, []string{"target"})
+
+	DialDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dial_duration_seconds",
+		Help:      "Time taken to dial the IAP and complete the relay handshake, for successful dials.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"target"})
+
+	SentBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sent_bytes_total",
+		Help:      "Total number of bytes sent through tunnels.",
+	}, []string{"target"})
+
+	ReceivedBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "received_bytes_total",
+		Help:      "Total number of bytes received through tunnels.",
+	}, []string{"target"})
+)
+
+// Serve serves metrics on the given address in the background.
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		log.Info("Serving metrics", "addr", addr)
+
+		if err := http.ListenAndServe(addr, mux); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Error serving metrics: %v", err)
+		}
+	}()
+}
+
+// CountingWriter adds the number of bytes written to a counter.
+type CountingWriter struct {
+	io.Writer
+	Counter prometheus.Counter
+}
+
+func (w CountingWriter) Write(buf []byte) (int, error) {
+	n, err := w.Writer.Write(buf)
+	w.Counter.Add(float64(n))
+	return n, err
+}
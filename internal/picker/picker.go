@@ -0,0 +1,192 @@
+// Package picker implements a minimal interactive fuzzy-search picker for the terminal.
+package picker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/term"
+)
+
+const maxVisible = 10
+
+// ErrCancelled is returned when the user dismisses the picker without choosing an item.
+var ErrCancelled = errors.New("picker cancelled")
+
+// Available returns whether an interactive picker can be shown.
+func Available() bool {
+	return term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stderr.Fd()))
+}
+
+// Pick prompts the user to choose one of the items and returns its index. The picker is drawn on stderr.
+func Pick(prompt string, items []string) (int, error) {
+	if len(items) == 0 {
+		return -1, errors.New("nothing to pick from")
+	}
+
+	fd := int(os.Stdin.Fd())
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return -1, err
+	}
+	defer term.Restore(fd, state)
+
+	p := &picker{
+		out:    os.Stderr,
+		prompt: prompt,
+		items:  items,
+	}
+	p.filter()
+
+	return p.run(os.Stdin)
+}
+
+type picker struct {
+	out      io.Writer
+	prompt   string
+	items    []string
+	query    []rune
+	matches  []int
+	selected int
+	drawn    int
+}
+
+func (p *picker) run(in io.Reader) (int, error) {
+	defer p.clear()
+
+	buf := make([]byte, 16)
+
+	for {
+		p.draw()
+
+		n, err := in.Read(buf)
+		if err != nil {
+			return -1, err
+		}
+		key := buf[:n]
+
+		switch {
+		case key[0] == '\r' || key[0] == '\n':
+			if len(p.matches) == 0 {
+				continue
+			}
+			return p.matches[p.selected], nil
+		case key[0] == 3 || (key[0] == 27 && n == 1):
+			// ctrl-c or a lone escape
+			return -1, ErrCancelled
+		case string(key) == "\x1b[A" || key[0] == 16:
+			// up arrow or ctrl-p
+			if p.selected > 0 {
+				p.selected--
+			}
+		case string(key) == "\x1b[B" || key[0] == 14:
+			// down arrow or ctrl-n
+			if p.selected < len(p.matches)-1 {
+				p.selected++
+			}
+		case key[0] == 127 || key[0] == 8:
+			if len(p.query) > 0 {
+				p.query = p.query[:len(p.query)-1]
+				p.filter()
+			}
+		case key[0] == 21:
+			// ctrl-u
+			p.query = p.query[:0]
+			p.filter()
+		default:
+			for _, r := range string(key) {
+				if unicode.IsPrint(r) {
+					p.query = append(p.query, r)
+				}
+			}
+			p.filter()
+		}
+	}
+}
+
+func (p *picker) filter() {
+	type scored struct {
+		index int
+		score int
+	}
+
+	var results []scored
+	for i, item := range p.items {
+		if score, ok := fuzzyMatch(string(p.query), item); ok {
+			results = append(results, scored{i, score})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].score < results[j].score
+	})
+
+	p.matches = p.matches[:0]
+	for _, result := range results {
+		p.matches = append(p.matches, result.index)
+	}
+	p.selected = 0
+}
+
+func (p *picker) draw() {
+	p.clear()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v %v\r\n", p.prompt, string(p.query))
+
+	// scroll the window so the selection stays visible
+	start := 0
+	if p.selected >= maxVisible {
+		start = p.selected - maxVisible + 1
+	}
+	end := min(start+maxVisible, len(p.matches))
+
+	for i := start; i < end; i++ {
+		cursor := "  "
+		if i == p.selected {
+			cursor = "> "
+		}
+		fmt.Fprintf(&b, "%v%v\r\n", cursor, p.items[p.matches[i]])
+	}
+	fmt.Fprintf(&b, "  %v/%v", len(p.matches), len(p.items))
+
+	p.drawn = end - start + 1
+	io.WriteString(p.out, b.String())
+}
+
+func (p *picker) clear() {
+	if p.drawn > 0 {
+		fmt.Fprintf(p.out, "\x1b[%vA", p.drawn)
+	}
+	io.WriteString(p.out, "\r\x1b[J")
+	p.drawn = 0
+}
+
+// fuzzyMatch reports whether all runes of query appear in order in s, scoring tighter matches lower.
+func fuzzyMatch(query, s string) (int, bool) {
+	q := []rune(strings.ToLower(query))
+	if len(q) == 0 {
+		return 0, true
+	}
+
+	start, qi := -1, 0
+	for i, r := range []rune(strings.ToLower(s)) {
+		if r != q[qi] {
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+		qi++
+		if qi == len(q) {
+			return i - start, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ActivityListener records when a client last connected to it, or sent or received data, and how much data its clients
+// have exchanged.
+type ActivityListener struct {
+	net.Listener
+	// last is the time of the last activity in Unix nanoseconds
+	last           atomic.Int64
+	sent, received atomic.Uint64
+}
+
+// TrackActivity wraps a listener to record the activity of its clients. The listener counts as active from when it's
+// wrapped.
+func TrackActivity(listener net.Listener) *ActivityListener {
+	l := &ActivityListener{Listener: listener}
+	l.touch()
+	return l
+}
+
+// LastActive returns when a client last connected, or sent or received data.
+func (l *ActivityListener) LastActive() time.Time {
+	return time.Unix(0, l.last.Load())
+}
+
+// Bytes returns the bytes sent by clients to the tunnel and received by them from it so far.
+func (l *ActivityListener) Bytes() (sent, received uint64) {
+	return l.sent.Load(), l.received.Load()
+}
+
+func (l *ActivityListener) touch() {
+	l.last.Store(time.Now().UnixNano())
+}
+
+func (l *ActivityListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.touch()
+	return &activityConn{Conn: conn, l: l}, nil
+}
+
+type activityConn struct {
+	net.Conn
+	l *ActivityListener
+}
+
+func (c *activityConn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	if n > 0 {
+		c.l.sent.Add(uint64(n))
+		c.l.touch()
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(buf []byte) (int, error) {
+	n, err := c.Conn.Write(buf)
+	if n > 0 {
+		c.l.received.Add(uint64(n))
+		c.l.touch()
+	}
+	return n, err
+}
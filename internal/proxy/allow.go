@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/charmbracelet/log"
+)
+
+// sourceListener only accepts TCP connections from loopback or the allowed prefixes.
+type sourceListener struct {
+	net.Listener
+	allowed []netip.Prefix
+}
+
+// AllowSources wraps a TCP listener so that only clients on loopback or within one of the prefixes can connect. Other
+// clients are closed as soon as they're accepted, before a tunnel is dialed for them.
+func AllowSources(listener net.Listener, allowed []netip.Prefix) net.Listener {
+	return sourceListener{listener, allowed}
+}
+
+func (l sourceListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if l.allow(conn.RemoteAddr()) {
+			return conn, nil
+		}
+
+		log.Warn("Rejected client outside the allowed sources", "client", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+func (l sourceListener) allow(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, prefix := range l.allowed {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePrefixes parses CIDRs like 10.0.0.0/8, treating bare addresses as single hosts. IPv4-mapped IPv6 prefixes are
+// turned into IPv4 ones, since clients' addresses are unmapped before they're checked.
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, err
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
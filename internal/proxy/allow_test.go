@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		in       string
+		prefixes []netip.Prefix
+		err      bool
+	}{
+		{in: "10.0.0.0/8", prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+		{in: "10.1.2.3/8", prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+		{in: "192.168.1.10", prefixes: []netip.Prefix{netip.MustParsePrefix("192.168.1.10/32")}},
+		{in: "2001:db8::/32", prefixes: []netip.Prefix{netip.MustParsePrefix("2001:db8::/32")}},
+		{in: "2001:db8::1", prefixes: []netip.Prefix{netip.MustParsePrefix("2001:db8::1/128")}},
+		{in: "::ffff:10.0.0.0/104", prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+		{in: "::ffff:192.168.1.10", prefixes: []netip.Prefix{netip.MustParsePrefix("192.168.1.10/32")}},
+		{in: "10.0.0.0/33", err: true},
+		{in: "2001:db8::/129", err: true},
+		{in: "10.0.0/8", err: true},
+		{in: "10.0.0.0/", err: true},
+		{in: "example.com", err: true},
+		{in: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			prefixes, err := ParsePrefixes([]string{tt.in})
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.prefixes, prefixes)
+		})
+	}
+}
+
+func TestAllowSources(t *testing.T) {
+	allowed, err := ParsePrefixes([]string{"10.0.0.0/8", "192.168.1.10", "::ffff:172.17.0.0/112", "2001:db8::/32"})
+	require.NoError(t, err)
+
+	l := sourceListener{allowed: allowed}
+
+	tests := []struct {
+		addr  net.Addr
+		allow bool
+	}{
+		{addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, allow: true},
+		{addr: &net.TCPAddr{IP: net.ParseIP("::1")}, allow: true},
+		{addr: &net.TCPAddr{IP: net.ParseIP("10.20.30.40").To4()}, allow: true},
+		{addr: &net.TCPAddr{IP: net.ParseIP("172.17.0.5").To4()}, allow: true},
+		{addr: &net.TCPAddr{IP: net.ParseIP("192.168.1.10")}, allow: true},
+		{addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::42")}, allow: true},
+		// IPv4 clients of a dual-stack listener show up as IPv4-mapped IPv6 addresses
+		{addr: &net.TCPAddr{IP: net.ParseIP("::ffff:10.1.1.1")}, allow: true},
+		{addr: &net.TCPAddr{IP: net.ParseIP("::ffff:127.0.0.1")}, allow: true},
+		{addr: &net.TCPAddr{IP: net.ParseIP("::ffff:172.16.0.1")}},
+		{addr: &net.TCPAddr{IP: net.ParseIP("192.168.1.11")}},
+		{addr: &net.TCPAddr{IP: net.ParseIP("11.0.0.1")}},
+		{addr: &net.TCPAddr{IP: net.ParseIP("2001:db9::1")}},
+		{addr: &net.TCPAddr{}},
+		{addr: &net.UnixAddr{Name: "/tmp/socket", Net: "unix"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr.String(), func(t *testing.T) {
+			assert.Equal(t, tt.allow, l.allow(tt.addr))
+		})
+	}
+}
+
+func TestAllowSourcesAccept(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// loopback is always allowed, even with no prefixes
+	listener = AllowSources(listener, nil)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	conn.Close()
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+)
+
+// breakerIdle is how long a target's breaker is kept after its last dial, so a transparent proxy seeing many
+// destinations doesn't keep a breaker for every one it has ever dialed.
+const breakerIdle = 10 * time.Minute
+
+// Breakers hands out a circuit breaker for each target, so clients of targets which are up aren't turned away because
+// another target served by the same listener is failing. Breakers of targets that haven't been dialed for a while are
+// dropped, unless they're open. A nil *Breakers hands out none.
+type Breakers struct {
+	failures int
+	cooldown time.Duration
+
+	mu        sync.Mutex
+	breakers  map[string]*targetBreaker
+	lastSweep time.Time
+}
+
+type targetBreaker struct {
+	breaker *iap.CircuitBreaker
+	used    time.Time
+}
+
+// NewBreakers returns Breakers whose breakers open after failures dials in a row fail, for cooldown.
+func NewBreakers(failures int, cooldown time.Duration) *Breakers {
+	return &Breakers{
+		failures:  failures,
+		cooldown:  cooldown,
+		breakers:  make(map[string]*targetBreaker),
+		lastSweep: time.Now(),
+	}
+}
+
+// options returns opts with the breaker for target. The result is clipped, so clients appending their own options to
+// it don't write into the caller's shared slice.
+func (b *Breakers) options(target string, opts []iap.DialOption) []iap.DialOption {
+	opts = opts[:len(opts):len(opts)]
+	if b == nil {
+		return opts
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.sweep(now)
+
+	breaker, ok := b.breakers[target]
+	if !ok {
+		breaker = &targetBreaker{breaker: iap.NewCircuitBreaker(b.failures, b.cooldown)}
+		b.breakers[target] = breaker
+	}
+	breaker.used = now
+
+	return append(opts, iap.WithCircuitBreaker(breaker.breaker))
+}
+
+// sweep drops the breakers which haven't been handed out for breakerIdle and aren't open, at most once every
+// breakerIdle. Failures short of opening a dropped breaker are forgotten, which only gives its target a fresh start.
+func (b *Breakers) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < breakerIdle {
+		return
+	}
+	b.lastSweep = now
+
+	for target, breaker := range b.breakers {
+		if now.Sub(breaker.used) >= breakerIdle && !breaker.breaker.State().Open {
+			delete(b.breakers, target)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreakers(t *testing.T) {
+	opts := []iap.DialOption{iap.WithProject("project")}
+
+	var none *Breakers
+	assert.Len(t, none.options("prod-1:22", opts), 1)
+
+	breakers := NewBreakers(3, time.Minute)
+	assert.Len(t, breakers.options("prod-1:8080", opts), 2)
+	assert.Len(t, breakers.options("prod-1:8081", opts), 2)
+	assert.Len(t, breakers.options("prod-1:8080", opts), 2)
+
+	// each target has its own breaker, kept between clients
+	require.Len(t, breakers.breakers, 2)
+	assert.NotSame(t, breakers.breakers["prod-1:8080"].breaker, breakers.breakers["prod-1:8081"].breaker)
+
+	// the caller's options are left alone
+	assert.Len(t, opts, 1)
+}
+
+func TestBreakersSweep(t *testing.T) {
+	opts := []iap.DialOption{iap.WithProject("project")}
+
+	breakers := NewBreakers(1, time.Hour)
+	breakers.options("10.0.0.1:22", opts)
+	breakers.options("10.0.0.2:22", opts)
+	breakers.options("10.0.0.3:22", opts)
+
+	// the breaker of 10.0.0.2 is open, its only dial having failed
+	server := iaptest.NewServer()
+	defer server.Close()
+	server.Faults.RejectStatus = http.StatusInternalServerError
+
+	open := breakers.breakers["10.0.0.2:22"].breaker
+	dialOpts := append(server.DialOptions(), iap.WithInstance("prod-2", "europe-west2-a", "nic0"), iap.WithCircuitBreaker(open))
+	_, err := iap.Dial(context.Background(), dialOpts...)
+	require.Error(t, err)
+	require.True(t, open.State().Open)
+
+	// 10.0.0.3 was dialed recently, the others a while ago
+	past := time.Now().Add(-breakerIdle)
+	breakers.lastSweep = past
+	breakers.breakers["10.0.0.1:22"].used = past
+	breakers.breakers["10.0.0.2:22"].used = past
+
+	breakers.options("10.0.0.4:22", opts)
+	assert.NotContains(t, breakers.breakers, "10.0.0.1:22")
+	assert.Contains(t, breakers.breakers, "10.0.0.2:22")
+	assert.Contains(t, breakers.breakers, "10.0.0.3:22")
+	assert.Contains(t, breakers.breakers, "10.0.0.4:22")
+}
+
+func TestBreakersOptionsClipped(t *testing.T) {
+	// spare capacity, like the options grown by the commands
+	opts := make([]iap.DialOption, 1, 8)
+	opts[0] = iap.WithProject("project")
+
+	for _, breakers := range []*Breakers{nil, NewBreakers(3, time.Minute)} {
+		var wg sync.WaitGroup
+		for port := range 16 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				target := fmt.Sprintf("prod-1:%v", 8080+port)
+				clientOpts := append(breakers.options(target, opts), iap.WithPort(fmt.Sprint(8080+port)))
+				assert.NotSame(t, &opts[:cap(opts)][len(opts)], &clientOpts[len(opts)])
+			}()
+		}
+		wg.Wait()
+	}
+}
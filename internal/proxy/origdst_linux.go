@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// originalDestination returns the address a TCP connection was made to before netfilter redirected it.
+func originalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("original destinations are only available on TCP connections")
+	}
+
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		dst    netip.AddrPort
+		dstErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		dst, dstErr = getOriginalDst(int(fd), conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errors.Is(dstErr, unix.ENOENT) {
+		// conntrack has no record of a translation
+		return nil, errNotRedirected
+	}
+	if dstErr != nil {
+		return nil, dstErr
+	}
+
+	return net.TCPAddrFromAddrPort(dst), nil
+}
+
+// getOriginalDst reads SO_ORIGINAL_DST, or its IPv6 equivalent which has the same value, into the sockaddr_in or
+// sockaddr_in6 the kernel fills in.
+func getOriginalDst(fd int, ipv6 bool) (netip.AddrPort, error) {
+	if ipv6 {
+		var sa unix.RawSockaddrInet6
+		if err := getsockopt(fd, unix.SOL_IPV6, unix.SO_ORIGINAL_DST, unsafe.Pointer(&sa), unsafe.Sizeof(sa)); err != nil {
+			return netip.AddrPort{}, err
+		}
+		return netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), networkPort(sa.Port)), nil
+	}
+
+	var sa unix.RawSockaddrInet4
+	if err := getsockopt(fd, unix.SOL_IP, unix.SO_ORIGINAL_DST, unsafe.Pointer(&sa), unsafe.Sizeof(sa)); err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), networkPort(sa.Port)), nil
+}
+
+// getsockopt reads a socket option into the size bytes at value, for options without a typed wrapper in x/sys/unix.
+func getsockopt(fd, level, opt int, value unsafe.Pointer, size uintptr) error {
+	length := uint32(size)
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt), uintptr(value), uintptr(unsafe.Pointer(&length)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// networkPort converts a port read from a sockaddr, which is in network byte order, to the host's.
+func networkPort(port uint16) uint16 {
+	return binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, port))
+}
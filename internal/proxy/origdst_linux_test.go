@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestOriginalDestinationNotRedirected(t *testing.T) {
+	for _, network := range []string{"tcp4", "tcp6"} {
+		t.Run(network, func(t *testing.T) {
+			addr := "127.0.0.1:0"
+			if network == "tcp6" {
+				addr = "[::1]:0"
+			}
+			listener, err := net.Listen(network, addr)
+			if err != nil {
+				t.Skipf("can't listen on %v: %v", network, err)
+			}
+			defer listener.Close()
+
+			client, err := net.Dial(network, listener.Addr().String())
+			require.NoError(t, err)
+			defer client.Close()
+
+			conn, err := listener.Accept()
+			require.NoError(t, err)
+			defer conn.Close()
+
+			// without conntrack there's no record at all, with it the destination is the listener itself
+			dst, err := originalDestination(conn)
+			if errors.Is(err, unix.ENOPROTOOPT) {
+				t.Skip("conntrack isn't available")
+			}
+			if errors.Is(err, errNotRedirected) {
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, sameAddr(dst, conn.LocalAddr()), "%v isn't %v", dst, conn.LocalAddr())
+		})
+	}
+}
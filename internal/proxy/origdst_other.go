@@ -0,0 +1,12 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+func originalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.ErrUnsupported
+}
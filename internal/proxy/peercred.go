@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/charmbracelet/log"
+)
+
+// peerUIDListener only accepts connections from processes running as uid.
+type peerUIDListener struct {
+	net.Listener
+	uid int
+}
+
+// RequirePeerUID wraps a Unix socket listener so that only processes running as uid can connect, which stops other
+// users on a shared host from using the tunnel. Peer credentials are only supported on Linux and macOS, elsewhere
+// every connection is rejected.
+func RequirePeerUID(listener net.Listener, uid int) net.Listener {
+	return peerUIDListener{listener, uid}
+}
+
+func (l peerUIDListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		uid, err := peerUID(conn)
+		if err == nil && uid == l.uid {
+			return conn, nil
+		}
+
+		if err != nil {
+			log.Warn("Rejected client, couldn't get its credentials", "err", err)
+		} else {
+			log.Warn("Rejected client running as another user", "uid", uid)
+		}
+		conn.Close()
+	}
+}
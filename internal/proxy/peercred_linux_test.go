@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenUnix listens on a Unix socket in a fresh directory, short enough to stay under the socket path limit.
+func listenUnix(t *testing.T) net.Listener {
+	dir, err := os.MkdirTemp("", "iapc")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "proxy.sock"))
+	require.NoError(t, err)
+	return listener
+}
+
+func TestRequirePeerUID(t *testing.T) {
+	listener := RequirePeerUID(listenUnix(t), os.Getuid())
+	defer listener.Close()
+
+	client, err := net.Dial("unix", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	uid, err := peerUID(conn)
+	require.NoError(t, err)
+	assert.Equal(t, os.Getuid(), uid)
+}
+
+// assertRejected dials the listener and checks the client is disconnected without Accept returning it.
+func assertRejected(t *testing.T, listener net.Listener, network string) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	client, err := net.Dial(network, listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	listener.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+		t.Fatal("rejected client was accepted")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRequirePeerUIDOtherUser(t *testing.T) {
+	assertRejected(t, RequirePeerUID(listenUnix(t), os.Getuid()+1), "unix")
+}
+
+func TestRequirePeerUIDTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// peer credentials can't be had over TCP, so every client is rejected
+	assertRejected(t, RequirePeerUID(listener, os.Getuid()), "tcp")
+}
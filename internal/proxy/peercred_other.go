@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+func peerUID(conn net.Conn) (int, error) {
+	return 0, errors.ErrUnsupported
+}
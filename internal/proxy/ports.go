@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/charmbracelet/log"
+)
+
+// MaxPorts is how many ports ParsePorts accepts at once, since each gets a listener of its own.
+const MaxPorts = 1024
+
+// ParsePorts parses a list of ports and ranges like 8080-8090,9000 into the ports it covers, in ascending order. It
+// fails if they cover more than MaxPorts ports.
+func ParsePorts(s string) ([]uint, error) {
+	var ports []uint
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+
+		first, last, isRange := strings.Cut(item, "-")
+		from, err := parsePort(first)
+		if err != nil {
+			return nil, fmt.Errorf("ports %q: %w", s, err)
+		}
+		to := from
+		if isRange {
+			if to, err = parsePort(last); err != nil {
+				return nil, fmt.Errorf("ports %q: %w", s, err)
+			}
+			if to < from {
+				return nil, fmt.Errorf("ports %q: range %v ends before it starts", s, item)
+			}
+		}
+
+		// counted before duplicates are dropped, so a huge range can't be expanded before it's refused
+		if len(ports)+int(to-from)+1 > MaxPorts {
+			return nil, fmt.Errorf("ports %q: more than %v ports", s, MaxPorts)
+		}
+		for port := from; port <= to; port++ {
+			ports = append(ports, port)
+		}
+	}
+
+	slices.Sort(ports)
+	return slices.Compact(ports), nil
+}
+
+func parsePort(s string) (uint, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint(port), nil
+}
+
+// ListenPorts tests the connection to the IAP with the first of the ports and then listens on each of them on the
+// given address, returning a listener accepting clients from all of them. The test is skipped if opts is nil.
+func ListenPorts(host string, ports []uint, opts []iap.DialOption) (*PortsListener, error) {
+	if len(ports) == 0 {
+		return nil, errors.New("no ports to listen on")
+	}
+	if opts != nil {
+		opts = append(opts[:len(opts):len(opts)], iap.WithPort(fmt.Sprint(ports[0])))
+		if err := testConn(opts); err != nil {
+			return nil, fmt.Errorf("testing connection: %w", err)
+		}
+	}
+
+	l := &PortsListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	for _, port := range ports {
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.listeners = append(l.listeners, listener)
+
+		log.Info("Listening", "addr", listener.Addr())
+	}
+
+	if addr := l.listeners[0].Addr().(*net.TCPAddr); !addr.IP.IsLoopback() {
+		log.Warn("Listening on a non-loopback address, other hosts can use the tunnel", "addr", addr)
+	}
+
+	for _, listener := range l.listeners {
+		go l.accept(listener)
+	}
+	return l, nil
+}
+
+// PortsListener accepts clients on several TCP listeners at once.
+type PortsListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+	mu        sync.Mutex
+	err       error
+}
+
+func (l *PortsListener) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// the first error ends accepting on every port, like it would for a single listener
+			l.mu.Lock()
+			if l.err == nil {
+				l.err = err
+			}
+			l.mu.Unlock()
+			l.Close()
+			return
+		}
+
+		select {
+		case l.conns <- conn:
+		case <-l.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Accept waits for a client to connect to any of the ports.
+func (l *PortsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return nil, l.err
+	}
+}
+
+// Close closes the listeners on every port.
+func (l *PortsListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		l.mu.Lock()
+		if l.err == nil {
+			l.err = net.ErrClosed
+		}
+		l.mu.Unlock()
+
+		close(l.done)
+		for _, listener := range l.listeners {
+			err = errors.Join(err, listener.Close())
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the listener on the first port.
+func (l *PortsListener) Addr() net.Addr {
+	return l.listeners[0].Addr()
+}
+
+// Addrs returns the address of the listener on each port.
+func (l *PortsListener) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(l.listeners))
+	for i, listener := range l.listeners {
+		addrs[i] = listener.Addr()
+	}
+	return addrs
+}
+
+// ServePorts accepts clients on a listener returned by ListenPorts and proxies each through the IAP to the same port
+// on the target that it connected to locally, until the context is cancelled. The host names the target in metrics.
+// Each port gets its own circuit breaker from breakers, which may be nil.
+func ServePorts(ctx context.Context, listener net.Listener, host string, opts []iap.DialOption, breakers *Breakers) error {
+	return serve(ctx, listener, func(conn net.Conn) {
+		addr, ok := conn.LocalAddr().(*net.TCPAddr)
+		if !ok {
+			log.Warn("Rejected client, its local address isn't TCP", "client", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+
+		target := fmt.Sprintf("%v:%v", host, addr.Port)
+		opts := append(opts[:len(opts):len(opts)], iap.WithPort(fmt.Sprint(addr.Port)))
+		handleClient(ctx, target, breakers.options(target, opts), conn)
+	})
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		in    string
+		ports []uint
+		err   bool
+	}{
+		{in: "22", ports: []uint{22}},
+		{in: "8080-8083", ports: []uint{8080, 8081, 8082, 8083}},
+		{in: "9000, 8080-8081", ports: []uint{8080, 8081, 9000}},
+		{in: "8080-8082,8081,8080", ports: []uint{8080, 8081, 8082}},
+		{in: "8080-8080", ports: []uint{8080}},
+		{in: "1-1024", ports: portRange(1, 1024)},
+		{in: "1-1025", err: true},
+		{in: "1-65535", err: true},
+		{in: "1-600,1000-1600", err: true},
+		{in: "8090-8080", err: true},
+		{in: "0", err: true},
+		{in: "0-10", err: true},
+		{in: "65536", err: true},
+		{in: "8080,", err: true},
+		{in: ",8080", err: true},
+		{in: "", err: true},
+		{in: "http", err: true},
+		{in: "8080-", err: true},
+		{in: "-8080", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			ports, err := ParsePorts(tt.in)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.ports, ports)
+		})
+	}
+}
+
+func portRange(from, to uint) []uint {
+	var ports []uint
+	for port := from; port <= to; port++ {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+func TestPortsListener(t *testing.T) {
+	// reserve two free ports, then listen on them together
+	var free []uint
+	for range 2 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		free = append(free, uint(l.Addr().(*net.TCPAddr).Port))
+		l.Close()
+	}
+
+	listener, err := ListenPorts("127.0.0.1", free, nil)
+	require.NoError(t, err)
+	require.Len(t, listener.Addrs(), 2)
+	assert.Equal(t, listener.Addrs()[0], listener.Addr())
+
+	for _, port := range free {
+		client, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", port))
+		require.NoError(t, err)
+		defer client.Close()
+
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		assert.Equal(t, int(port), conn.LocalAddr().(*net.TCPAddr).Port)
+		conn.Close()
+	}
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := listener.Accept()
+		accepted <- err
+	}()
+
+	require.NoError(t, listener.Close())
+
+	select {
+	case err := <-accepted:
+		assert.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept didn't return after Close")
+	}
+
+	// every port is released
+	for _, port := range free {
+		_, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", port))
+		assert.Error(t, err)
+	}
+	assert.NoError(t, listener.Close())
+}
+
+func TestServePorts(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	listener, err := ListenPorts("127.0.0.1", []uint{0, 0}, nil)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// spare capacity, so clients appending their port to a shared slice would overwrite each other's
+	opts := append(make([]iap.DialOption, 0, 16), server.DialOptions()...)
+	opts = append(opts, iap.WithInstance("prod-1", "europe-west2-a", "nic0"))
+
+	served := make(chan error, 1)
+	go func() {
+		served <- ServePorts(ctx, listener, "prod-1", opts, nil)
+	}()
+	// no client is left to write its audit record after the test has finished
+	defer func() {
+		cancel()
+		assert.NoError(t, <-served)
+	}()
+
+	const clients = 8
+
+	var wg sync.WaitGroup
+	want := map[string]int{}
+	for _, addr := range listener.Addrs() {
+		want[fmt.Sprint(addr.(*net.TCPAddr).Port)] = clients
+
+		for range clients {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				client, err := net.Dial("tcp", addr.String())
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer client.Close()
+
+				_, err = client.Write([]byte("hello"))
+				assert.NoError(t, err)
+				buf := make([]byte, 5)
+				_, err = io.ReadFull(client, buf)
+				assert.NoError(t, err)
+			}()
+		}
+	}
+	wg.Wait()
+
+	// each client is tunnelled to the port it connected to
+	got := map[string]int{}
+	for _, query := range server.Queries() {
+		got[query.Get("port")]++
+	}
+	assert.Equal(t, want, got)
+}
@@ -2,33 +2,80 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/internal/audit"
+	"github.com/cedws/iapc/internal/metrics"
 	"github.com/charmbracelet/log"
 )
 
-// Start starts a proxy server that listens on the given address and port.
-func Start(listen string, opts []iap.DialOption) {
-	if err := testConn(opts); err != nil {
-		log.Fatalf("Error testing connection: %v", err)
+// Listen tests the connection to the IAP and then listens on the given address and port, or on a Unix socket if the
+// address is written as unix:path. The test is skipped if opts is nil, for listeners not tied to a single target.
+func Listen(listen string, opts []iap.DialOption) (net.Listener, error) {
+	if opts != nil {
+		if err := testConn(opts); err != nil {
+			return nil, fmt.Errorf("testing connection: %w", err)
+		}
+	}
+
+	network, address := "tcp", listen
+	if path, ok := strings.CutPrefix(listen, "unix:"); ok {
+		network, address = "unix", path
 	}
 
-	listener, err := net.Listen("tcp", listen)
+	listener, err := net.Listen(network, address)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	log.Info("Listening", "addr", listener.Addr())
 
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+		log.Warn("Listening on a non-loopback address, other hosts can use the tunnel", "addr", addr)
+	}
+
+	return listener, nil
+}
+
+// Serve accepts clients on the listener and proxies them through the IAP until the context is cancelled.
+// The target is used to label metrics.
+func Serve(ctx context.Context, listener net.Listener, target string, opts []iap.DialOption) error {
+	return serve(ctx, listener, func(conn net.Conn) {
+		handleClient(ctx, target, opts, conn)
+	})
+}
+
+// serve accepts clients on the listener and handles each in its own goroutine until the context is cancelled, then
+// waits for the clients being handled to be closed, so none of them outlive it.
+func serve(ctx context.Context, listener net.Listener, handle func(net.Conn)) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var handlers sync.WaitGroup
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Fatal(err)
+			if ctx.Err() != nil && errors.Is(err, net.ErrClosed) {
+				handlers.Wait()
+				return nil
+			}
+			return err
 		}
 
-		go handleClient(opts, conn)
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			handle(conn)
+		}()
 	}
 }
 
@@ -40,26 +87,127 @@ func testConn(opts []iap.DialOption) error {
 	return err
 }
 
-func handleClient(opts []iap.DialOption, conn net.Conn) {
+func handleClient(ctx context.Context, target string, opts []iap.DialOption, conn net.Conn) {
+	defer conn.Close()
+
 	log.Debug("Client connected", "client", conn.RemoteAddr())
 
-	tun, err := iap.Dial(context.Background(), opts...)
+	metrics.ConnectionsTotal.WithLabelValues(target).Inc()
+
+	start := time.Now()
+
+	var (
+		tun    *iap.Conn
+		reason closeReason
+
+		// the bytes copied each way, rather than the tunnel's acked counts which leave out data below the ack
+		// threshold, with received set once copying from the tunnel has finished
+		sent, received int64
+		copied         = make(chan struct{})
+	)
+	defer func() {
+		record := audit.Record{
+			Time:     start,
+			Client:   conn.RemoteAddr().String(),
+			Target:   target,
+			Duration: time.Since(start).Seconds(),
+			Reason:   reason.String(),
+		}
+		if tun != nil {
+			// the tunnel is closed by now, which ends the copy from it
+			<-copied
+			record.SessionID = tun.SessionID()
+			record.SentBytes, record.ReceivedBytes = uint64(sent), uint64(received)
+		}
+		if err := audit.Log(record); err != nil {
+			log.Errorf("Error writing audit record: %v", err)
+		}
+	}()
+
+	tun, err := iap.Dial(ctx, opts...)
 	if err != nil {
+		reason.set(fmt.Sprintf("dial failed: %v", err))
+		metrics.DialErrorsTotal.WithLabelValues(target).Inc()
+		if errors.Is(err, iap.ErrCircuitOpen) {
+			// the failures which opened the breaker were logged already
+			log.Debug("Not dialing IAP, circuit breaker open", "client", conn.RemoteAddr())
+			return
+		}
 		log.Errorf("Error dialing IAP: %v", err)
 		return
 	}
 	defer tun.Close()
 
-	log.Debug("Dialed IAP", "client", conn.RemoteAddr())
+	metrics.DialDurationSeconds.WithLabelValues(target).Observe(time.Since(start).Seconds())
+
+	log.Debug("Dialed IAP", "client", conn.RemoteAddr(), "sid", tun.SessionID())
+
+	stop := context.AfterFunc(ctx, func() {
+		reason.set("shutdown")
+		conn.Close()
+	})
+	defer stop()
+
+	active := metrics.ConnectionsActive.WithLabelValues(target)
+	active.Inc()
+	defer active.Dec()
 
 	go func() {
-		if _, err := io.Copy(conn, tun); err != nil {
-			log.Debug(err)
+		defer close(copied)
+
+		w := metrics.CountingWriter{Writer: conn, Counter: metrics.ReceivedBytesTotal.WithLabelValues(target)}
+		var err error
+		received, err = io.Copy(w, tun)
+		reason.set(tunnelCloseReason(err))
+		if err != nil {
+			logTunnelError(err, conn.RemoteAddr(), tun.SessionID())
 		}
 	}()
-	if _, err := io.Copy(tun, conn); err != nil {
+	w := metrics.CountingWriter{Writer: tun, Counter: metrics.SentBytesTotal.WithLabelValues(target)}
+	if sent, err = io.Copy(w, conn); err != nil {
+		reason.set(fmt.Sprintf("client error: %v", err))
 		log.Debug(err)
 	}
+	reason.set("client closed")
+
+	log.Debug("Client disconnected", "client", conn.RemoteAddr(), "sid", tun.SessionID(), "sentbytes", sent)
+}
+
+// closeReason holds the first reason given for a connection ending.
+type closeReason struct {
+	mu     sync.Mutex
+	reason string
+}
+
+func (r *closeReason) set(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.reason == "" {
+		r.reason = reason
+	}
+}
+
+func (r *closeReason) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.reason
+}
 
-	log.Debug("Client disconnected", "client", conn.RemoteAddr(), "sentbytes", tun.Sent(), "recvbytes", tun.Received())
+func tunnelCloseReason(err error) string {
+	if err == nil {
+		return "remote closed"
+	}
+	return fmt.Sprintf("tunnel error: %v", err)
+}
+
+// logTunnelError logs an error from reading the tunnel, surfacing relay close frames which explain why a tunnel died.
+func logTunnelError(err error, client net.Addr, sid string) {
+	var closeErr *iap.CloseError
+	if errors.As(err, &closeErr) {
+		log.Error("Tunnel closed by relay", "client", client, "sid", sid, "code", closeErr.Code, "description", closeErr.Description(), "reason", closeErr.Reason)
+		return
+	}
+	log.Debug(err)
 }
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/cedws/iapc/internal/audit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeAudit(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	require.NoError(t, audit.Open(path))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := append(server.DialOptions(), iap.WithInstance("prod-1", "europe-west2-a", "nic0"))
+	go Serve(ctx, listener, "prod-1:22", opts)
+
+	// far less than the ack threshold, so the relay never acks any of it
+	payload := strings.Repeat("hello", 100)
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	clientAddr := client.LocalAddr().String()
+	_, err = client.Write([]byte(payload))
+	require.NoError(t, err)
+
+	buf := make([]byte, len(payload))
+	_, err = io.ReadFull(client, buf)
+	require.NoError(t, err)
+	client.Close()
+
+	var record audit.Record
+	require.Eventually(t, func() bool {
+		f, err := os.Open(path)
+		if err != nil {
+			return false
+		}
+		defer f.Close()
+
+		// the sink is shared by every test, so pick out the record of this client
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if json.Unmarshal(scanner.Bytes(), &record) == nil && record.Client == clientAddr {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, "prod-1:22", record.Target)
+	assert.Equal(t, "iaptest-1", record.SessionID)
+	assert.Equal(t, uint64(len(payload)), record.SentBytes)
+	assert.Equal(t, uint64(len(payload)), record.ReceivedBytes)
+	assert.Equal(t, "client closed", record.Reason)
+}
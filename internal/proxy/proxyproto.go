@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+)
+
+// proxyProtoSignature starts every PROXY protocol v2 header.
+var proxyProtoSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyProtoLocal = 0x20
+	proxyProtoProxy = 0x21
+
+	proxyProtoTCP4 = 0x11
+	proxyProtoTCP6 = 0x21
+)
+
+// proxyHeaderListener prefixes the data read from its connections with a PROXY protocol v2 header.
+type proxyHeaderListener struct {
+	net.Listener
+}
+
+// SendProxyHeader wraps a listener so that the data read from each connection starts with a PROXY protocol v2 header
+// carrying the client's address, which is then the first thing sent through its tunnel. Servers behind HAProxy or
+// Nginx with the PROXY protocol enabled see the local client rather than the IAP as the source. Clients that aren't
+// connected over TCP, like those on Unix sockets, get a header without addresses. It must wrap any TLS listener, so
+// that the header is added to the decrypted data.
+func SendProxyHeader(listener net.Listener) net.Listener {
+	return proxyHeaderListener{listener}
+}
+
+func (l proxyHeaderListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	header := proxyHeader(conn.RemoteAddr(), conn.LocalAddr())
+	return &proxyHeaderConn{conn, io.MultiReader(bytes.NewReader(header), conn)}, nil
+}
+
+// proxyHeaderConn reads the header before the connection's own data.
+type proxyHeaderConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *proxyHeaderConn) Read(buf []byte) (int, error) {
+	return c.r.Read(buf)
+}
+
+// proxyHeader returns a PROXY protocol v2 header for a connection from src to dst, or a LOCAL header without addresses
+// if either isn't a TCP address.
+func proxyHeader(src, dst net.Addr) []byte {
+	header := append([]byte{}, proxyProtoSignature...)
+
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	if !srcOK || !dstOK {
+		return append(header, proxyProtoLocal, 0, 0, 0)
+	}
+
+	srcAddr, dstAddr := srcTCP.AddrPort(), dstTCP.AddrPort()
+	srcIP, dstIP := srcAddr.Addr().Unmap(), dstAddr.Addr().Unmap()
+
+	family := byte(proxyProtoTCP4)
+	if !srcIP.Is4() || !dstIP.Is4() {
+		// both addresses must be of the same family, so IPv4 is mapped into IPv6 if they're mixed
+		family = proxyProtoTCP6
+		srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+	}
+
+	var addrs []byte
+	addrs = append(addrs, srcIP.AsSlice()...)
+	addrs = append(addrs, dstIP.AsSlice()...)
+	addrs = binary.BigEndian.AppendUint16(addrs, srcAddr.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, dstAddr.Port())
+
+	header = append(header, proxyProtoProxy, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
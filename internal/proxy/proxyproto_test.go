@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyHeader(t *testing.T) {
+	signature := "\r\n\r\n\x00\r\nQUIT\n"
+
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		want     string
+	}{
+		{
+			name: "ipv4",
+			src:  &net.TCPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 51000},
+			dst:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5432},
+			want: signature + "\x21\x11\x00\x0c" +
+				"\xc0\xa8\x01\x0a" + "\x7f\x00\x00\x01" +
+				"\xc7\x38" + "\x15\x38",
+		},
+		{
+			name: "ipv6",
+			src:  &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 51000},
+			dst:  &net.TCPAddr{IP: net.ParseIP("::1"), Port: 22},
+			want: signature + "\x21\x21\x00\x24" +
+				"\xfd\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\xc7\x38" + "\x00\x16",
+		},
+		{
+			name: "mixed families are mapped to ipv6",
+			src:  &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1},
+			dst:  &net.TCPAddr{IP: net.ParseIP("::1"), Port: 2},
+			want: signature + "\x21\x21\x00\x24" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x0a\x00\x00\x01" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x00\x01" + "\x00\x02",
+		},
+		{
+			name: "unix sockets get a local header",
+			src:  &net.UnixAddr{Name: "@", Net: "unix"},
+			dst:  &net.UnixAddr{Name: "/tmp/iapc.sock", Net: "unix"},
+			want: signature + "\x20\x00\x00\x00",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, []byte(tt.want), proxyHeader(tt.src, tt.dst))
+		})
+	}
+}
+
+func TestSendProxyHeader(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener = SendProxyHeader(listener)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.Write([]byte("hello"))
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	header := proxyHeader(client.LocalAddr(), client.RemoteAddr())
+	buf := make([]byte, len(header)+5)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, append(header, "hello"...), buf)
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSConfigSelfSigned(t *testing.T) {
+	config, err := TLSConfig("", "")
+	require.NoError(t, err)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	// the certificate is pinned rather than chained to a root, so it's trusted directly
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	for _, name := range []string{"localhost", "127.0.0.1", "::1"} {
+		t.Run(name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: name})
+			if err == nil {
+				conn.Close()
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	assert.Equal(t, []string{"localhost"}, leaf.DNSNames)
+	require.Len(t, leaf.IPAddresses, 2)
+	assert.True(t, leaf.IPAddresses[0].Equal(net.IPv4(127, 0, 0, 1)))
+	assert.True(t, leaf.IPAddresses[1].Equal(net.IPv6loopback))
+	assert.Equal(t, x509.KeyUsageDigitalSignature, leaf.KeyUsage)
+	assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, leaf.ExtKeyUsage)
+	assert.False(t, leaf.IsCA)
+
+	// other names aren't covered
+	_, err = tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "example.com"})
+	var hostErr x509.HostnameError
+	assert.ErrorAs(t, err, &hostErr)
+}
+
+func TestTLSConfigMissingFiles(t *testing.T) {
+	_, err := TLSConfig("missing.pem", "missing-key.pem")
+	assert.Error(t, err)
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/charmbracelet/log"
+)
+
+// TransparentRoute sends connections to addresses within a prefix through the IAP.
+type TransparentRoute struct {
+	Prefix netip.Prefix
+	// Target is where the connections go, with the port they were made to. It's a destination group written as
+	// iap://project/region/network/group, reaching the address the client connected to, or an instance written as
+	// iap://project/zone/instance, optionally followed by ?interface=nic1.
+	Target string
+
+	// target is Target parsed, without the port or host which are filled in for each connection
+	target iap.Target
+}
+
+// ParseTransparentRoute parses a route written as cidr=target, treating a bare address as a single host.
+func ParseTransparentRoute(s string) (TransparentRoute, error) {
+	cidr, target, ok := strings.Cut(s, "=")
+	if !ok || cidr == "" || target == "" {
+		return TransparentRoute{}, fmt.Errorf("route %q should be cidr=target", s)
+	}
+
+	prefixes, err := ParsePrefixes([]string{cidr})
+	if err != nil {
+		return TransparentRoute{}, fmt.Errorf("route %q: %w", s, err)
+	}
+
+	parsed, err := parseRouteTarget(target)
+	if err != nil {
+		return TransparentRoute{}, err
+	}
+	return TransparentRoute{Prefix: prefixes[0], Target: target, target: parsed}, nil
+}
+
+func parseRouteTarget(target string) (iap.Target, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != iap.TargetScheme || u.Host == "" {
+		return nil, fmt.Errorf("target %q should be iap://project/region/network/group or iap://project/zone/instance", target)
+	}
+
+	segments := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if slices.Contains(segments, "") {
+		return nil, fmt.Errorf("target %q has an empty path segment", target)
+	}
+
+	switch len(segments) {
+	case 2:
+		return iap.InstanceTarget{
+			Project:   u.Host,
+			Zone:      segments[0],
+			Instance:  segments[1],
+			Interface: u.Query().Get("interface"),
+		}, nil
+	case 3:
+		return iap.HostTarget{
+			Project: u.Host,
+			Region:  segments[0],
+			Network: segments[1],
+			Group:   segments[2],
+		}, nil
+	}
+
+	return nil, fmt.Errorf("target %q should be iap://project/region/network/group or iap://project/zone/instance", target)
+}
+
+// targetFor returns the target the route sends a connection made to dst to.
+func (r TransparentRoute) targetFor(dst netip.AddrPort) iap.Target {
+	switch target := r.target.(type) {
+	case iap.InstanceTarget:
+		target.Port = uint(dst.Port())
+		return target
+	case iap.HostTarget:
+		target.Host = dst.Addr().Unmap().String()
+		target.Port = uint(dst.Port())
+		return target
+	}
+	return nil
+}
+
+// ServeTransparent accepts clients on a listener wrapped by RecoverDestinations and proxies each through the IAP to
+// the target routed to by the address it connected to, until the context is cancelled. The most specific prefix
+// containing the address wins, and clients connecting to addresses outside every route are closed. Each target gets
+// its own circuit breaker from breakers, which may be nil.
+func ServeTransparent(ctx context.Context, listener net.Listener, routes []TransparentRoute, opts []iap.DialOption, breakers *Breakers) error {
+	routes = sortRoutes(routes)
+
+	return serve(ctx, listener, func(conn net.Conn) {
+		target, err := routeTransparent(routes, conn.LocalAddr())
+		if err != nil {
+			log.Warn("Rejected client", "client", conn.RemoteAddr(), "dest", conn.LocalAddr(), "err", err)
+			conn.Close()
+			return
+		}
+
+		opts := append(opts[:len(opts):len(opts)], iap.WithTarget(target))
+		handleClient(ctx, target.String(), breakers.options(target.String(), opts), conn)
+	})
+}
+
+// sortRoutes returns a copy of routes with the most specific prefixes first, keeping the order of equally specific ones.
+func sortRoutes(routes []TransparentRoute) []TransparentRoute {
+	routes = slices.Clone(routes)
+	slices.SortStableFunc(routes, func(a, b TransparentRoute) int {
+		return b.Prefix.Bits() - a.Prefix.Bits()
+	})
+	return routes
+}
+
+// routeTransparent returns the target of the first route containing dst, so routes are sorted most specific first.
+func routeTransparent(routes []TransparentRoute, dst net.Addr) (iap.Target, error) {
+	tcpAddr, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("destination %v isn't a TCP address", dst)
+	}
+
+	addrPort := tcpAddr.AddrPort()
+	addr := addrPort.Addr().Unmap()
+	for _, route := range routes {
+		if route.Prefix.Contains(addr) {
+			return route.targetFor(addrPort), nil
+		}
+	}
+	return nil, fmt.Errorf("no route for %v", addr)
+}
+
+var errNotRedirected = errors.New("connection wasn't redirected")
+
+// destinationListener reports the original destination of redirected connections as their local address.
+type destinationListener struct {
+	net.Listener
+}
+
+// RecoverDestinations wraps a TCP listener receiving connections redirected to it by an iptables REDIRECT rule, so
+// that the LocalAddr of each connection is the address the client originally connected to. Connections made to the
+// listener directly are closed, since proxying them would loop back to it. Original destinations are only available on
+// Linux, elsewhere every connection is rejected.
+func RecoverDestinations(listener net.Listener) net.Listener {
+	return destinationListener{listener}
+}
+
+func (l destinationListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		dst, err := originalDestination(conn)
+		if err == nil && sameAddr(dst, conn.LocalAddr()) {
+			err = errNotRedirected
+		}
+		if err == nil {
+			return destinationConn{conn, dst}, nil
+		}
+
+		if errors.Is(err, errNotRedirected) {
+			log.Warn("Rejected client which wasn't redirected", "client", conn.RemoteAddr())
+		} else {
+			log.Warn("Rejected client, couldn't get its original destination", "client", conn.RemoteAddr(), "err", err)
+		}
+		conn.Close()
+	}
+}
+
+type destinationConn struct {
+	net.Conn
+	dst *net.TCPAddr
+}
+
+func (c destinationConn) LocalAddr() net.Addr {
+	return c.dst
+}
+
+func sameAddr(dst *net.TCPAddr, local net.Addr) bool {
+	tcpAddr, ok := local.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	a, b := dst.AddrPort(), tcpAddr.AddrPort()
+	return a.Addr().Unmap() == b.Addr().Unmap() && a.Port() == b.Port()
+}
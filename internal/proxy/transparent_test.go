@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/cedws/iapc/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTransparentRoute(t *testing.T) {
+	tests := []struct {
+		route  string
+		prefix string
+		target iap.Target
+		err    bool
+	}{
+		{
+			route:  "10.0.0.0/8=iap://project/europe-west2/default/group",
+			prefix: "10.0.0.0/8",
+			target: iap.HostTarget{Project: "project", Region: "europe-west2", Network: "default", Group: "group"},
+		},
+		{
+			route:  "10.1.2.3=iap://project/europe-west2-a/prod-1?interface=nic1",
+			prefix: "10.1.2.3/32",
+			target: iap.InstanceTarget{Project: "project", Zone: "europe-west2-a", Instance: "prod-1", Interface: "nic1"},
+		},
+		{
+			route:  "fd00::/8=iap://project/europe-west2-a/prod-1",
+			prefix: "fd00::/8",
+			target: iap.InstanceTarget{Project: "project", Zone: "europe-west2-a", Instance: "prod-1"},
+		},
+		{route: "10.0.0.0/8", err: true},
+		{route: "=iap://project/europe-west2-a/prod-1", err: true},
+		{route: "10.0.0.0/8=", err: true},
+		{route: "nonsense=iap://project/europe-west2-a/prod-1", err: true},
+		{route: "10.0.0.0/8=https://project/europe-west2-a/prod-1", err: true},
+		{route: "10.0.0.0/8=iap:///europe-west2-a/prod-1", err: true},
+		{route: "10.0.0.0/8=iap://project/europe-west2-a", err: true},
+		{route: "10.0.0.0/8=iap://project/europe-west2//group", err: true},
+		{route: "10.0.0.0/8=iap://project/a/b/c/d", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			route, err := ParseTransparentRoute(tt.route)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, netip.MustParsePrefix(tt.prefix), route.Prefix)
+			assert.Equal(t, tt.target, route.target)
+		})
+	}
+}
+
+func TestRouteTransparent(t *testing.T) {
+	var routes []TransparentRoute
+	for _, s := range []string{
+		"10.0.0.0/8=iap://project/europe-west2/default/wide",
+		"10.1.2.3=iap://project/europe-west2-a/prod-1",
+		"10.1.0.0/16=iap://project/europe-west2/default/narrow",
+		"10.1.0.0/16=iap://project/europe-west2/default/shadowed",
+	} {
+		route, err := ParseTransparentRoute(s)
+		require.NoError(t, err)
+		routes = append(routes, route)
+	}
+	routes = sortRoutes(routes)
+
+	tests := []struct {
+		dst    string
+		target iap.Target
+	}{
+		{"10.1.2.3:22", iap.InstanceTarget{Project: "project", Zone: "europe-west2-a", Instance: "prod-1", Port: 22}},
+		{"10.1.9.9:443", iap.HostTarget{Project: "project", Region: "europe-west2", Network: "default", Group: "narrow", Host: "10.1.9.9", Port: 443}},
+		{"10.2.0.1:80", iap.HostTarget{Project: "project", Region: "europe-west2", Network: "default", Group: "wide", Host: "10.2.0.1", Port: 80}},
+		{"[::ffff:10.2.0.1]:80", iap.HostTarget{Project: "project", Region: "europe-west2", Network: "default", Group: "wide", Host: "10.2.0.1", Port: 80}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dst, func(t *testing.T) {
+			target, err := routeTransparent(routes, net.TCPAddrFromAddrPort(netip.MustParseAddrPort(tt.dst)))
+			require.NoError(t, err)
+			assert.Equal(t, tt.target, target)
+		})
+	}
+
+	_, err := routeTransparent(routes, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("192.168.0.1:22")))
+	assert.Error(t, err)
+
+	_, err = routeTransparent(routes, &net.UnixAddr{Name: "socket", Net: "unix"})
+	assert.Error(t, err)
+}
+
+// redirectedListener stands in for a listener wrapped by RecoverDestinations, handing out each of dsts in turn as the
+// destination of accepted clients.
+type redirectedListener struct {
+	net.Listener
+	dsts []netip.AddrPort
+
+	mu sync.Mutex
+	n  int
+}
+
+func (l *redirectedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	dst := l.dsts[l.n%len(l.dsts)]
+	l.n++
+	return &redirectedConn{Conn: conn, dst: net.TCPAddrFromAddrPort(dst)}, nil
+}
+
+type redirectedConn struct {
+	net.Conn
+	dst net.Addr
+}
+
+func (c *redirectedConn) LocalAddr() net.Addr {
+	return c.dst
+}
+
+func TestServeTransparent(t *testing.T) {
+	server := iaptest.NewServer()
+	defer server.Close()
+
+	var routes []TransparentRoute
+	for _, s := range []string{
+		"10.1.2.3=iap://project/europe-west2-a/prod-1",
+		"10.1.2.4=iap://project/europe-west2-a/prod-2",
+	} {
+		route, err := ParseTransparentRoute(s)
+		require.NoError(t, err)
+		routes = append(routes, route)
+	}
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener := &redirectedListener{
+		Listener: inner,
+		dsts:     []netip.AddrPort{netip.MustParseAddrPort("10.1.2.3:22"), netip.MustParseAddrPort("10.1.2.4:22")},
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// spare capacity, so clients appending their target to a shared slice would overwrite each other's
+	opts := append(make([]iap.DialOption, 0, 16), server.DialOptions()...)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeTransparent(ctx, listener, routes, opts, nil)
+	}()
+	// no client is left to write its audit record after the test has finished
+	defer func() {
+		cancel()
+		assert.NoError(t, <-served)
+	}()
+
+	const clients = 16
+
+	var wg sync.WaitGroup
+	for range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			client, err := net.Dial("tcp", inner.Addr().String())
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer client.Close()
+
+			_, err = client.Write([]byte("hello"))
+			assert.NoError(t, err)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(client, buf)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// each client is tunnelled to the target routed to by its destination
+	got := map[string]int{}
+	for _, query := range server.Queries() {
+		got[query.Get("instance")]++
+	}
+	assert.Equal(t, map[string]int{"prod-1": clients / 2, "prod-2": clients / 2}, got)
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cedws/iapc/iap"
+	"github.com/charmbracelet/log"
+)
+
+// Route sends web requests for a host name to a server through the IAP.
+type Route struct {
+	// Host is matched against the host name requests are made to, ignoring the port.
+	Host string
+	// Target is the URI of the server, see iap.ParseTarget.
+	Target string
+	// HTTPS is set if the server serves HTTPS rather than plain HTTP.
+	HTTPS bool
+}
+
+// ParseRoute parses a route written as host=target.
+func ParseRoute(s string) (Route, error) {
+	host, target, ok := strings.Cut(s, "=")
+	if !ok || host == "" || target == "" {
+		return Route{}, fmt.Errorf("route %q should be host=target", s)
+	}
+
+	return Route{Host: host, Target: target}, nil
+}
+
+// NewWebProxy returns a reverse proxy sending each request to the server routed to by its host name, dialing a tunnel
+// with opts for every upstream connection. Idle upstream connections are kept for reuse. Requests for unknown host
+// names get a 404.
+func NewWebProxy(routes []Route, opts []iap.DialOption) (http.Handler, error) {
+	upstreams := make(map[string]*httputil.ReverseProxy, len(routes))
+
+	for _, route := range routes {
+		host := strings.ToLower(route.Host)
+		if _, ok := upstreams[host]; ok {
+			return nil, fmt.Errorf("host %v is routed more than once", route.Host)
+		}
+
+		upstream, err := newUpstream(route, opts)
+		if err != nil {
+			return nil, err
+		}
+		upstreams[host] = upstream
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		upstream, ok := upstreams[strings.ToLower(host)]
+		if !ok {
+			http.Error(w, fmt.Sprintf("No route for host %v", host), http.StatusNotFound)
+			return
+		}
+
+		upstream.ServeHTTP(w, r)
+	}), nil
+}
+
+func newUpstream(route Route, opts []iap.DialOption) (*httputil.ReverseProxy, error) {
+	target, err := iap.ParseTarget(route.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append(opts[:len(opts):len(opts)], iap.WithTarget(target))
+
+	// the server's certificate is verified against the name of the target
+	upstreamURL := &url.URL{Scheme: "http"}
+	switch target := target.(type) {
+	case iap.InstanceTarget:
+		upstreamURL.Host = net.JoinHostPort(target.Instance, fmt.Sprint(target.Port))
+	case iap.HostTarget:
+		upstreamURL.Host = net.JoinHostPort(target.Host, fmt.Sprint(target.Port))
+	}
+	if route.HTTPS {
+		upstreamURL.Scheme = "https"
+	}
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(upstreamURL)
+			r.SetXForwarded()
+			// keep the host the client asked for, so the server's redirects and links come back through the proxy
+			r.Out.Host = r.In.Host
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return iap.Dial(ctx, opts...)
+			},
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Error("Error proxying request", "host", route.Host, "target", route.Target, "err", err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}, nil
+}